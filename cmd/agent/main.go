@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	AgentApp "github.com/katierevinska/calculatorService/internal/applications/agent_app"
 )
@@ -9,9 +13,18 @@ import (
 func main() {
 	SetEnvVariables()
 	app := AgentApp.New()
-	app.RunServer()
+	if err := app.ConfigureTLS(); err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+	if err := app.ConfigureOutbox(); err != nil {
+		log.Fatalf("Failed to configure outbox: %v", err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app.RunServer(ctx)
 }
 
 func SetEnvVariables() {
 	os.Setenv("COMPUTING_POWER", "20")
+	os.Setenv("AGENT_SECRET", "agent-7Hq2-Lk93-shared")
 }
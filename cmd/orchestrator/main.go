@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	orchestratorApp "github.com/katierevinska/calculatorService/internal/applications/orchestrator_app"
 	"github.com/katierevinska/calculatorService/internal/auth"
@@ -15,6 +18,9 @@ func main() {
 	if err := auth.InitJWT(); err != nil {
 		log.Fatalf("Failed to initialize JWT: %v", err)
 	}
+	if err := auth.InitAgentAuth(); err != nil {
+		log.Fatalf("Failed to initialize agent authentication: %v", err)
+	}
 
 	dbPath := os.Getenv("DATABASE_PATH")
 	if dbPath == "" {
@@ -29,7 +35,9 @@ func main() {
 	defer db.Close()
 
 	app := orchestratorApp.New(db)
-	app.RunServer()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	app.RunServer(ctx)
 }
 
 func SetEnvVariables() {
@@ -39,4 +47,5 @@ func SetEnvVariables() {
 	os.Setenv("TIME_DIVISIONS_MS", "200")
 	os.Setenv("DATABASE_PATH", "./data/orchestrator.db")
 	os.Setenv("JWT_SECRET", "124424-231Swsws-TDedDf")
+	os.Setenv("AGENT_SECRET", "agent-7Hq2-Lk93-shared")
 }
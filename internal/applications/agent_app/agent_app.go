@@ -2,112 +2,579 @@ package application
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/tlsconfig"
+	"github.com/katierevinska/calculatorService/pkg/operations"
 )
 
 type AgentApp struct {
-	OrchestratorTaskURL   string
-	OrchestratorResultURL string
+	OrchestratorTaskURL    string
+	OrchestratorResultURL  string
+	OrchestratorLoginURL   string
+	OrchestratorReleaseURL string
+	AgentID                string
+	AgentSecret            string
+	HTTPClient             *http.Client
+	// Operations lists the operation symbols this agent can compute; the
+	// orchestrator only hands out tasks using them.
+	Operations []string
+	Outbox     *Outbox
+	// OutboxRescanInterval is how often results left in the outbox after
+	// running out of attempts are sent again.
+	OutboxRescanInterval time.Duration
+	MaxSendAttempts      int
+	RetryBaseDelay       time.Duration
+	RetryMaxDelay        time.Duration
+	PollInterval         time.Duration
+	ShutdownGracePeriod  time.Duration
+
+	token    string
+	tokenMu  sync.Mutex
+	inFlight sync.Map
+	// delivering holds the IDs of results being sent, so a result is not
+	// sent twice at once.
+	delivering sync.Map
+	// workers is reported with task requests, so the orchestrator knows how
+	// much agents compute at once.
+	workers int
 }
 
+// defaultOrchestratorURL is used without ORCHESTRATOR_URL. ConfigureTLS
+// moves it to https.
+const defaultOrchestratorURL = "http://localhost:8080"
+
 func New() *AgentApp {
+	agentID := os.Getenv("AGENT_ID")
+	if agentID == "" {
+		hostname, _ := os.Hostname()
+		agentID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	orchestratorURL := os.Getenv("ORCHESTRATOR_URL")
+	if orchestratorURL == "" {
+		orchestratorURL = defaultOrchestratorURL
+	}
 	return &AgentApp{
-		OrchestratorTaskURL:   "http://localhost:8080/internal/task/new",
-		OrchestratorResultURL: "http://localhost:8080/internal/task",
+		OrchestratorTaskURL:    orchestratorURL + "/internal/task/new",
+		OrchestratorResultURL:  orchestratorURL + "/internal/task",
+		OrchestratorLoginURL:   orchestratorURL + "/internal/agent/login",
+		OrchestratorReleaseURL: orchestratorURL + "/internal/task/release",
+		AgentID:                agentID,
+		AgentSecret:            os.Getenv("AGENT_SECRET"),
+		HTTPClient:             http.DefaultClient,
+		Operations:             supportedOperations(),
+		OutboxRescanInterval:   time.Minute,
+		MaxSendAttempts:        8,
+		RetryBaseDelay:         500 * time.Millisecond,
+		RetryMaxDelay:          30 * time.Second,
+		PollInterval:           20 * time.Second,
+		ShutdownGracePeriod:    internal.DurationEnv("SHUTDOWN_GRACE_PERIOD", 10*time.Second),
+	}
+}
+
+// supportedOperations reads AGENT_OPERATIONS (e.g. "+,-,*"), limited to
+// operations this build knows how to compute, all of them by default.
+func supportedOperations() []string {
+	configured := os.Getenv("AGENT_OPERATIONS")
+	if configured == "" {
+		return operations.Default.Symbols()
+	}
+	var supported []string
+	for _, symbol := range strings.Split(configured, ",") {
+		symbol = strings.TrimSpace(symbol)
+		if _, exists := operations.Default.Lookup(symbol); exists {
+			supported = append(supported, symbol)
+		} else if symbol != "" {
+			log.Printf("AGENT_OPERATIONS: unknown operation %q ignored", symbol)
+		}
+	}
+	return supported
+}
+
+// ConfigureOutbox enables the on-disk outbox in AGENT_OUTBOX_DIR.
+func (a *AgentApp) ConfigureOutbox() error {
+	dir := os.Getenv("AGENT_OUTBOX_DIR")
+	if dir == "" {
+		return nil
+	}
+	outbox, err := NewOutbox(dir)
+	if err != nil {
+		return err
+	}
+	a.Outbox = outbox
+	return nil
+}
+
+// ConfigureTLS switches the agent to HTTPS using AGENT_TLS_CERT_FILE and
+// AGENT_TLS_KEY_FILE as the client certificate and AGENT_TLS_CA_FILE to
+// verify the orchestrator. Nothing changes when none of them is set. The
+// default orchestrator URL becomes https, an explicit http one is an error
+// since the certificates would never be used.
+func (a *AgentApp) ConfigureTLS() error {
+	certFile := os.Getenv("AGENT_TLS_CERT_FILE")
+	keyFile := os.Getenv("AGENT_TLS_KEY_FILE")
+	caFile := os.Getenv("AGENT_TLS_CA_FILE")
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil
 	}
+	for _, u := range []*string{&a.OrchestratorTaskURL, &a.OrchestratorResultURL, &a.OrchestratorLoginURL, &a.OrchestratorReleaseURL} {
+		if strings.HasPrefix(*u, defaultOrchestratorURL+"/") {
+			*u = "https" + strings.TrimPrefix(*u, "http")
+		} else if !strings.HasPrefix(*u, "https://") {
+			return fmt.Errorf("TLS is configured, but the orchestrator URL %s is not https", *u)
+		}
+	}
+	config, err := tlsconfig.ClientConfig(certFile, keyFile, caFile)
+	if err != nil {
+		return err
+	}
+	a.HTTPClient = &http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	return nil
 }
 
-func worker(id int, tasks <-chan internal.Task, results chan<- internal.TaskResult) {
+func (a *AgentApp) worker(ctx context.Context, id int, tasks <-chan internal.Task, results chan<- internal.TaskResult) {
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(id)))
 	for t := range tasks {
+		if ctx.Err() != nil {
+			a.releaseTask(t)
+			continue
+		}
 		fmt.Println(id)
-		opTime, _ := strconv.ParseInt(t.Operation_time, 10, 64)
-		time.Sleep(time.Duration(opTime))
+		a.inFlight.Store(t.Id, t)
+		delay, err := TaskDelay(t, rnd)
+		if err != nil {
+			log.Printf("Task %s: %v, computing without delay", t.Id, err)
+		}
+		time.Sleep(delay)
 		resultValue := Calculate(t)
 		log.Println("calculate a value of task and result is " + resultValue)
-		results <- internal.TaskResult{Id: t.Id, Result: resultValue}
+		if _, stillHeld := a.inFlight.LoadAndDelete(t.Id); stillHeld {
+			results <- internal.TaskResult{Id: t.Id, Result: resultValue}
+		}
 	}
 }
 
-func Calculate(t internal.Task) string {
-	var result float64
-	a, errA := strconv.ParseFloat(t.Arg1, 64)
-	b, errB := strconv.ParseFloat(t.Arg2, 64)
-
-	if errA != nil || errB != nil {
-		return "Error: Invalid number"
+// TaskDelay is the simulated duration of the task: sampled from its latency
+// model when the orchestrator sent one, otherwise operation_time in ms.
+func TaskDelay(t internal.Task, rnd *rand.Rand) (time.Duration, error) {
+	if t.Latency != nil {
+		if err := t.Latency.Validate(); err != nil {
+			return 0, err
+		}
+		return t.Latency.Sample(rnd), nil
+	}
+	if t.Operation_time == "" {
+		return 0, nil
 	}
+	ms, err := strconv.ParseFloat(t.Operation_time, 64)
+	if err != nil || ms < 0 {
+		return 0, fmt.Errorf("invalid operation_time %q", t.Operation_time)
+	}
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
 
-	switch t.Operation {
-	case "+":
-		result = a + b
-	case "-":
-		result = a - b
-	case "*":
-		result = a * b
-	case "/":
-		result = a / b
+func Calculate(t internal.Task) string {
+	op, exists := operations.Default.Lookup(t.Operation)
+	if !exists {
+		return "Error: Unknown operation"
 	}
-	return strconv.FormatFloat(result, 'f', 10, 64)
+	args := []string{t.Arg1, t.Arg2}[:op.Arity]
+	if t.Integer {
+		result, err := operations.Default.EvaluateInteger(t.Operation, args)
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		return result.String()
+	}
+	if t.Complex {
+		result, err := operations.Default.EvaluateComplex(t.Operation, args)
+		if err != nil {
+			return "Error: " + err.Error()
+		}
+		return operations.FormatComplex(result)
+	}
+	result, err := operations.Default.Evaluate(t.Operation, args)
+	if err != nil {
+		return "Error: " + err.Error()
+	}
+	return operations.FormatResult(result)
 }
 
-func (a *AgentApp) RunServer() {
+// RunServer fetches and computes tasks until ctx is cancelled. Then it stops
+// fetching, releases tasks that were fetched but not started, lets running
+// tasks finish and delivers their results. Whatever is still running when
+// ShutdownGracePeriod runs out is released back to the orchestrator.
+func (a *AgentApp) RunServer(ctx context.Context) {
 	tasks := make(chan internal.Task, 100)
 	results := make(chan internal.TaskResult, 100)
 	num, _ := strconv.Atoi(os.Getenv("COMPUTING_POWER"))
+	a.workers = num
+
+	var workers sync.WaitGroup
 	for w := 1; w <= num; w++ {
-		go worker(w, tasks, results)
+		workers.Add(1)
+		go func(id int) {
+			defer workers.Done()
+			a.worker(ctx, id, tasks, results)
+		}(w)
+	}
+
+	// results are delivered concurrently, so a failing one does not hold up
+	// the others; retries stop once the grace period is over
+	deliverCtx, stopDelivering := context.WithCancel(context.Background())
+	defer stopDelivering()
+	var deliveries sync.WaitGroup
+	deliver := func(result internal.TaskResult) {
+		if _, busy := a.delivering.LoadOrStore(result.Id, struct{}{}); busy {
+			return
+		}
+		deliveries.Add(1)
+		go func() {
+			defer deliveries.Done()
+			defer a.delivering.Delete(result.Id)
+			a.deliverResult(deliverCtx, result)
+		}()
 	}
+
+	stopSending := make(chan struct{})
+	senderDone := make(chan struct{})
 	go func() {
-		for result := range results {
-			log.Println("try to send to orchestrator " + result.Result)
-			a.sendResult(result)
+		defer close(senderDone)
+		a.resendOutbox(deliver)
+		rescan := time.NewTicker(a.OutboxRescanInterval)
+		defer rescan.Stop()
+		for {
+			select {
+			case result := <-results:
+				log.Println("try to send to orchestrator " + result.Result)
+				deliver(result)
+			case <-rescan.C:
+				a.resendOutbox(deliver)
+			case <-stopSending:
+				for {
+					select {
+					case result := <-results:
+						deliver(result)
+					default:
+						return
+					}
+				}
+			}
 		}
 	}()
-	for {
+
+	a.fetchLoop(ctx, tasks)
+	close(tasks)
+	log.Println("Agent is shutting down, waiting for running tasks")
+
+	graceCtx, cancel := context.WithTimeout(context.Background(), a.ShutdownGracePeriod)
+	defer cancel()
+	workersDone := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+	case <-graceCtx.Done():
+		log.Println("Grace period is over, releasing tasks that are still running")
+		a.inFlight.Range(func(key, value any) bool {
+			if _, held := a.inFlight.LoadAndDelete(key); held {
+				a.releaseTask(value.(internal.Task))
+			}
+			return true
+		})
+	}
+
+	close(stopSending)
+	<-senderDone
+	delivered := make(chan struct{})
+	go func() {
+		deliveries.Wait()
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+	case <-graceCtx.Done():
+		log.Println("Grace period is over before all results were sent")
+		stopDelivering()
+		<-delivered
+	}
+	log.Println("Agent stopped")
+}
+
+func (a *AgentApp) fetchLoop(ctx context.Context, tasks chan<- internal.Task) {
+	for ctx.Err() == nil {
 		task := a.fetchTask()
-		if task != nil {
-			tasks <- *task
-		} else {
-			time.Sleep(time.Second * 20)
+		if task == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(a.PollInterval):
+			}
+			continue
+		}
+		select {
+		case tasks <- *task:
+		case <-ctx.Done():
+			a.releaseTask(*task)
 		}
 	}
 }
 
-func (a *AgentApp) sendResult(result internal.TaskResult) {
-	log.Println("want to send to orchestrator " + result.Id + " " + result.Result)
-	jsonData, err := json.Marshal(result)
+// resendOutbox passes the results left in the outbox to deliver.
+func (a *AgentApp) resendOutbox(deliver func(internal.TaskResult)) {
+	if a.Outbox == nil {
+		return
+	}
+	pending, err := a.Outbox.Pending()
+	if err != nil {
+		log.Printf("Не удалось прочитать outbox: %v", err)
+	}
+	if len(pending) > 0 {
+		log.Printf("Resending %d results left in outbox", len(pending))
+	}
+	for _, result := range pending {
+		deliver(result)
+	}
+}
+
+// releaseTask hands a task the agent will not compute back to the
+// orchestrator so another agent can take it.
+func (a *AgentApp) releaseTask(task internal.Task) {
+	jsonData, err := json.Marshal(internal.TaskResult{Id: task.Id})
 	if err != nil {
-		log.Printf("Ошибка при маршализации результата: %v", err)
 		return
 	}
-	resp, err := http.Post(a.OrchestratorResultURL, "application/json", bytes.NewBuffer(jsonData))
+	resp, err := a.doAuthorized(func() (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodPost, a.OrchestratorReleaseURL, bytes.NewBuffer(jsonData))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
 	if err != nil {
-		log.Printf("Ошибка при отправке результата: %v", err)
+		log.Printf("Не удалось вернуть задачу %s: %v", task.Id, err)
 		return
 	}
 	resp.Body.Close()
+	log.Printf("Task %s released (%s)", task.Id, resp.Status)
+}
+
+// permanentError is a delivery failure that retrying cannot fix, e.g. the
+// orchestrator no longer considers this agent the task holder.
+type permanentError struct {
+	status string
+}
+
+func (e *permanentError) Error() string {
+	return "orchestrator rejected result: " + e.status
+}
+
+// deliverResult sends the result, retrying transient failures with
+// exponential backoff until ctx is cancelled. With an outbox the result
+// stays on disk until it is acknowledged, so results that ran out of
+// attempts are sent again by the next outbox rescan or on restart.
+func (a *AgentApp) deliverResult(ctx context.Context, result internal.TaskResult) {
+	if a.Outbox != nil {
+		if err := a.Outbox.Put(result); err != nil {
+			log.Printf("Не удалось сохранить результат %s в outbox: %v", result.Id, err)
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := a.sendResult(ctx, result)
+		if err == nil {
+			a.forgetResult(result.Id)
+			return
+		}
+		var permanent *permanentError
+		if errors.As(err, &permanent) {
+			log.Printf("Результат %s отброшен: %v", result.Id, err)
+			a.forgetResult(result.Id)
+			return
+		}
+		if attempt >= a.MaxSendAttempts || ctx.Err() != nil {
+			if a.Outbox != nil {
+				log.Printf("Результат %s не доставлен после %d попыток, оставлен в outbox: %v", result.Id, attempt, err)
+			} else {
+				log.Printf("Результат %s потерян после %d попыток: %v", result.Id, attempt, err)
+			}
+			return
+		}
+		delay := a.retryDelay(attempt)
+		log.Printf("Ошибка при отправке результата %s (попытка %d), повтор через %s: %v", result.Id, attempt, delay, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+		}
+	}
+}
+
+func (a *AgentApp) forgetResult(taskID string) {
+	if a.Outbox == nil {
+		return
+	}
+	if err := a.Outbox.Remove(taskID); err != nil {
+		log.Printf("Не удалось удалить результат %s из outbox: %v", taskID, err)
+	}
+}
+
+// retryDelay doubles the base delay per attempt up to RetryMaxDelay and
+// picks a random point in the upper half, so agents do not retry in lockstep.
+func (a *AgentApp) retryDelay(attempt int) time.Duration {
+	delay := a.RetryBaseDelay
+	for i := 1; i < attempt && delay < a.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > a.RetryMaxDelay {
+		delay = a.RetryMaxDelay
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+func (a *AgentApp) sendResult(ctx context.Context, result internal.TaskResult) error {
+	log.Println("want to send to orchestrator " + result.Id + " " + result.Result)
+	jsonData, err := json.Marshal(result)
+	if err != nil {
+		return &permanentError{status: err.Error()}
+	}
+	resp, err := a.doAuthorized(func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.OrchestratorResultURL, bytes.NewBuffer(jsonData))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		return req, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode == http.StatusRequestTimeout, resp.StatusCode == http.StatusUnauthorized:
+		return fmt.Errorf("orchestrator answered %s", resp.Status)
+	default:
+		return &permanentError{status: resp.Status}
+	}
+}
+
+// login exchanges the shared agent secret for an agent-scoped JWT.
+func (a *AgentApp) login() (string, error) {
+	jsonData, err := json.Marshal(map[string]string{"agent_id": a.AgentID, "secret": a.AgentSecret})
+	if err != nil {
+		return "", err
+	}
+	resp, err := a.HTTPClient.Post(a.OrchestratorLoginURL, "application/json", bytes.NewBuffer(jsonData))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("agent login failed: %s", resp.Status)
+	}
+	var tokenResp struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+	return tokenResp.Token, nil
+}
+
+// doAuthorized sends a request with the agent token, logging in first if
+// needed and once more if the orchestrator rejects an expired token.
+func (a *AgentApp) doAuthorized(newRequest func() (*http.Request, error)) (*http.Response, error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		token, err := a.currentToken()
+		if err != nil {
+			return nil, err
+		}
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := a.HTTPClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusUnauthorized || attempt == 1 {
+			return resp, nil
+		}
+		resp.Body.Close()
+		a.dropToken(token)
+	}
+	return nil, fmt.Errorf("agent is not authorized")
+}
+
+func (a *AgentApp) currentToken() (string, error) {
+	a.tokenMu.Lock()
+	defer a.tokenMu.Unlock()
+	if a.token == "" {
+		token, err := a.login()
+		if err != nil {
+			return "", err
+		}
+		a.token = token
+	}
+	return a.token, nil
+}
+
+func (a *AgentApp) dropToken(token string) {
+	a.tokenMu.Lock()
+	defer a.tokenMu.Unlock()
+	if a.token == token {
+		a.token = ""
+	}
 }
 
 func (a *AgentApp) fetchTask() *internal.Task {
-	resp, err := http.Get(a.OrchestratorTaskURL)
+	resp, err := a.doAuthorized(func() (*http.Request, error) {
+		query := url.Values{}
+		if len(a.Operations) > 0 {
+			query.Set("operations", strings.Join(a.Operations, ","))
+		}
+		if a.workers > 0 {
+			query.Set("workers", strconv.Itoa(a.workers))
+		}
+		taskURL := a.OrchestratorTaskURL
+		if len(query) > 0 {
+			taskURL += "?" + query.Encode()
+		}
+		return http.NewRequest(http.MethodGet, taskURL, nil)
+	})
 	if err != nil {
 		log.Printf("Ошибка при получении задачи: %v", err)
-		time.Sleep(5 * time.Second)
 		return nil
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		log.Printf("Ошибка: статус ответа %s", resp.Status)
-		time.Sleep(20 * time.Second)
 		return nil
 	}
 
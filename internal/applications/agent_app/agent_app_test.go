@@ -1,16 +1,21 @@
 package application_test
 
 import (
+	"context"
 	"encoding/json"
+	"encoding/pem"
+	"math/rand"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
 
 	"github.com/katierevinska/calculatorService/internal"
 	agentapp "github.com/katierevinska/calculatorService/internal/applications/agent_app"
+	"github.com/katierevinska/calculatorService/internal/latency"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -22,7 +27,23 @@ func TestAgentApp_RunServer_FetchesAndSendsResult(t *testing.T) {
 	wg.Add(1)
 
 	mockOrchestrator := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/internal/agent/login" && r.Method == http.MethodPost {
+			var creds map[string]string
+			json.NewDecoder(r.Body).Decode(&creds)
+			if creds["secret"] != "agentsecret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "agent-token"})
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer agent-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 		if r.URL.Path == "/internal/task/new" && r.Method == http.MethodGet {
+			assert.Contains(t, r.URL.Query().Get("operations"), "+", "Agent should advertise its operations")
+			assert.Equal(t, "1", r.URL.Query().Get("workers"), "Agent should report its workers")
 			if !taskSent {
 				task := internal.Task{
 					Id:             "task1",
@@ -54,10 +75,14 @@ func TestAgentApp_RunServer_FetchesAndSendsResult(t *testing.T) {
 	agent := agentapp.New()
 	agent.OrchestratorTaskURL = mockOrchestrator.URL + "/internal/task/new"
 	agent.OrchestratorResultURL = mockOrchestrator.URL + "/internal/task"
+	agent.OrchestratorLoginURL = mockOrchestrator.URL + "/internal/agent/login"
+	agent.AgentSecret = "agentsecret"
 
 	os.Setenv("COMPUTING_POWER", "1")
 
-	go agent.RunServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agent.RunServer(ctx)
 
 	waitChan := make(chan struct{})
 	go func() {
@@ -85,8 +110,17 @@ func TestCalculate(t *testing.T) {
 		{name: "Multiplication", task: internal.Task{Arg1: "6", Arg2: "7", Operation: "*"}, expected: "42.0000000000"},
 		{name: "Division", task: internal.Task{Arg1: "8", Arg2: "4", Operation: "/"}, expected: "2.0000000000"},
 		{name: "Division with float result", task: internal.Task{Arg1: "1", Arg2: "3", Operation: "/"}, expected: "0.3333333333"},
-		{name: "Invalid number arg1", task: internal.Task{Arg1: "abc", Arg2: "4", Operation: "+"}, expected: "Error: Invalid number"},
-		{name: "Invalid number arg2", task: internal.Task{Arg1: "3", Arg2: "xyz", Operation: "+"}, expected: "Error: Invalid number"},
+		{name: "Invalid number arg1", task: internal.Task{Arg1: "abc", Arg2: "4", Operation: "+"}, expected: "Error: invalid number"},
+		{name: "Invalid number arg2", task: internal.Task{Arg1: "3", Arg2: "xyz", Operation: "+"}, expected: "Error: invalid number"},
+		{name: "Power", task: internal.Task{Arg1: "2", Arg2: "10", Operation: "^"}, expected: "1024.0000000000"},
+		{name: "Square root ignores second argument", task: internal.Task{Arg1: "16", Operation: "sqrt"}, expected: "4.0000000000"},
+		{name: "Square root of negative", task: internal.Task{Arg1: "-4", Operation: "sqrt"}, expected: "Error: square root of a negative number"},
+		{name: "Unknown operation", task: internal.Task{Arg1: "1", Arg2: "2", Operation: "?"}, expected: "Error: Unknown operation"},
+		{name: "Complex square root of negative", task: internal.Task{Arg1: "-4", Operation: "sqrt", Complex: true}, expected: "0.0000000000+2.0000000000i"},
+		{name: "Complex multiplication", task: internal.Task{Arg1: "1+2i", Arg2: "3-1i", Operation: "*", Complex: true}, expected: "5.0000000000+5.0000000000i"},
+		{name: "Complex comparison", task: internal.Task{Arg1: "1i", Arg2: "2", Operation: "<", Complex: true}, expected: "Error: less is not defined for complex numbers"},
+		{name: "Integer factorial", task: internal.Task{Arg1: "25", Operation: "factorial", Integer: true}, expected: "15511210043330985984000000"},
+		{name: "Inexact integer division", task: internal.Task{Arg1: "7", Arg2: "2", Operation: "/", Integer: true}, expected: "Error: 7/2 is not an integer, use // and %"},
 	}
 
 	for _, tt := range tests {
@@ -96,3 +130,363 @@ func TestCalculate(t *testing.T) {
 		})
 	}
 }
+
+// newMockOrchestrator serves agent login and hands out the given tasks once,
+// passing result deliveries to onResult.
+func newMockOrchestrator(t *testing.T, tasks []internal.Task, onResult func(w http.ResponseWriter, res internal.TaskResult)) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path == "/internal/agent/login":
+			json.NewEncoder(w).Encode(map[string]string{"token": "agent-token"})
+		case r.URL.Path == "/internal/task/new":
+			mu.Lock()
+			defer mu.Unlock()
+			if len(tasks) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			json.NewEncoder(w).Encode(tasks[0])
+			tasks = tasks[1:]
+		case r.URL.Path == "/internal/task":
+			var res internal.TaskResult
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&res))
+			onResult(w, res)
+		case r.URL.Path == "/internal/task/release":
+			var res internal.TaskResult
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&res))
+			res.Result = "released"
+			onResult(w, res)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func newTestAgent(serverURL string) *agentapp.AgentApp {
+	agent := agentapp.New()
+	agent.OrchestratorTaskURL = serverURL + "/internal/task/new"
+	agent.OrchestratorResultURL = serverURL + "/internal/task"
+	agent.OrchestratorLoginURL = serverURL + "/internal/agent/login"
+	agent.OrchestratorReleaseURL = serverURL + "/internal/task/release"
+	agent.PollInterval = 10 * time.Millisecond
+	agent.RetryBaseDelay = 5 * time.Millisecond
+	agent.RetryMaxDelay = 20 * time.Millisecond
+	return agent
+}
+
+func TestAgentApp_RetriesTransientResultFailures(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	delivered := make(chan internal.TaskResult, 1)
+
+	mockOrchestrator := newMockOrchestrator(t,
+		[]internal.Task{{Id: "task-retry", Arg1: "2", Arg2: "3", Operation: "*", Operation_time: "1"}},
+		func(w http.ResponseWriter, res internal.TaskResult) {
+			mu.Lock()
+			defer mu.Unlock()
+			attempts++
+			if attempts < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			delivered <- res
+		})
+	defer mockOrchestrator.Close()
+
+	os.Setenv("COMPUTING_POWER", "1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go newTestAgent(mockOrchestrator.URL).RunServer(ctx)
+
+	select {
+	case res := <-delivered:
+		assert.Equal(t, "task-retry", res.Id)
+		assert.Equal(t, "6.0000000000", res.Result)
+		mu.Lock()
+		assert.Equal(t, 3, attempts, "Result should be accepted on the third attempt")
+		mu.Unlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Agent did not retry the result delivery")
+	}
+}
+
+func TestAgentApp_FailingResultDoesNotBlockOthers(t *testing.T) {
+	delivered := make(chan internal.TaskResult, 10)
+	mockOrchestrator := newMockOrchestrator(t,
+		[]internal.Task{
+			{Id: "stuck", Arg1: "1", Arg2: "1", Operation: "+", Operation_time: "1"},
+			{Id: "ok", Arg1: "2", Arg2: "2", Operation: "+", Operation_time: "50"},
+		},
+		func(w http.ResponseWriter, res internal.TaskResult) {
+			if res.Id == "stuck" {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			delivered <- res
+		})
+	defer mockOrchestrator.Close()
+
+	agent := newTestAgent(mockOrchestrator.URL)
+	agent.RetryBaseDelay = time.Second
+	agent.RetryMaxDelay = time.Second
+	os.Setenv("COMPUTING_POWER", "2")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agent.RunServer(ctx)
+
+	select {
+	case res := <-delivered:
+		assert.Equal(t, "ok", res.Id)
+	case <-time.After(900 * time.Millisecond):
+		t.Fatal("A result waiting for a retry held up the next one")
+	}
+}
+
+func TestAgentApp_RescansOutbox(t *testing.T) {
+	outbox, err := agentapp.NewOutbox(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, outbox.Put(internal.TaskResult{Id: "flaky", Result: "1.0000000000"}))
+
+	var mu sync.Mutex
+	attempts := 0
+	delivered := make(chan internal.TaskResult, 1)
+	mockOrchestrator := newMockOrchestrator(t, nil, func(w http.ResponseWriter, res internal.TaskResult) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		delivered <- res
+	})
+	defer mockOrchestrator.Close()
+
+	agent := newTestAgent(mockOrchestrator.URL)
+	agent.Outbox = outbox
+	agent.MaxSendAttempts = 1
+	agent.OutboxRescanInterval = 20 * time.Millisecond
+	os.Setenv("COMPUTING_POWER", "1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agent.RunServer(ctx)
+
+	select {
+	case res := <-delivered:
+		assert.Equal(t, "flaky", res.Id)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Result that ran out of attempts was not sent again from the outbox")
+	}
+}
+
+func TestAgentApp_ShutdownStopsRetries(t *testing.T) {
+	mockOrchestrator := newMockOrchestrator(t,
+		[]internal.Task{{Id: "unreachable", Arg1: "1", Arg2: "1", Operation: "+", Operation_time: "1"}},
+		func(w http.ResponseWriter, res internal.TaskResult) {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		})
+	defer mockOrchestrator.Close()
+
+	agent := newTestAgent(mockOrchestrator.URL)
+	agent.RetryBaseDelay = time.Minute
+	agent.RetryMaxDelay = time.Minute
+	agent.ShutdownGracePeriod = 100 * time.Millisecond
+	os.Setenv("COMPUTING_POWER", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		agent.RunServer(ctx)
+		close(stopped)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Retry backoff kept the agent running past the grace period")
+	}
+}
+
+func TestAgentApp_ResendsResultsFromOutbox(t *testing.T) {
+	outbox, err := agentapp.NewOutbox(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, outbox.Put(internal.TaskResult{Id: "left-over", Result: "42.0000000000"}))
+
+	delivered := make(chan internal.TaskResult, 1)
+	mockOrchestrator := newMockOrchestrator(t, nil, func(w http.ResponseWriter, res internal.TaskResult) {
+		w.WriteHeader(http.StatusOK)
+		delivered <- res
+	})
+	defer mockOrchestrator.Close()
+
+	agent := newTestAgent(mockOrchestrator.URL)
+	agent.Outbox = outbox
+	os.Setenv("COMPUTING_POWER", "1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go agent.RunServer(ctx)
+
+	select {
+	case res := <-delivered:
+		assert.Equal(t, "left-over", res.Id)
+		assert.Equal(t, "42.0000000000", res.Result)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Agent did not resend the result stored in the outbox")
+	}
+
+	assert.Eventually(t, func() bool {
+		pending, err := outbox.Pending()
+		return err == nil && len(pending) == 0
+	}, time.Second, 10*time.Millisecond, "Acknowledged result should be removed from the outbox")
+}
+
+func TestOutbox(t *testing.T) {
+	outbox, err := agentapp.NewOutbox(t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, outbox.Put(internal.TaskResult{Id: "id1", Result: "1"}))
+	require.NoError(t, outbox.Put(internal.TaskResult{Id: "id2", Result: "2"}))
+	require.NoError(t, outbox.Put(internal.TaskResult{Id: "id1", Result: "1"}))
+
+	pending, err := outbox.Pending()
+	require.NoError(t, err)
+	assert.Len(t, pending, 2)
+
+	require.NoError(t, outbox.Remove("id1"))
+	require.NoError(t, outbox.Remove("id1"), "Removing an absent entry is not an error")
+
+	pending, err = outbox.Pending()
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	assert.Equal(t, "id2", pending[0].Id)
+}
+
+func TestAgentApp_ShutdownFinishesRunningTask(t *testing.T) {
+	received := make(chan internal.TaskResult, 10)
+	mockOrchestrator := newMockOrchestrator(t,
+		[]internal.Task{{Id: "slow", Arg1: "1", Arg2: "2", Operation: "+", Operation_time: "200"}},
+		func(w http.ResponseWriter, res internal.TaskResult) {
+			w.WriteHeader(http.StatusOK)
+			received <- res
+		})
+	defer mockOrchestrator.Close()
+
+	agent := newTestAgent(mockOrchestrator.URL)
+	agent.ShutdownGracePeriod = 5 * time.Second
+	os.Setenv("COMPUTING_POWER", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		agent.RunServer(ctx)
+		close(stopped)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunServer did not return after cancellation")
+	}
+	require.Len(t, received, 1, "Running task should finish and its result be sent before exit")
+	res := <-received
+	assert.Equal(t, "slow", res.Id)
+	assert.Equal(t, "3.0000000000", res.Result)
+}
+
+func TestAgentApp_ShutdownReleasesTasksAfterGracePeriod(t *testing.T) {
+	received := make(chan internal.TaskResult, 10)
+	mockOrchestrator := newMockOrchestrator(t,
+		[]internal.Task{{Id: "very-slow", Arg1: "1", Arg2: "2", Operation: "+", Operation_time: "5000"}},
+		func(w http.ResponseWriter, res internal.TaskResult) {
+			w.WriteHeader(http.StatusOK)
+			received <- res
+		})
+	defer mockOrchestrator.Close()
+
+	agent := newTestAgent(mockOrchestrator.URL)
+	agent.ShutdownGracePeriod = 100 * time.Millisecond
+	os.Setenv("COMPUTING_POWER", "1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		agent.RunServer(ctx)
+		close(stopped)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-stopped:
+	case <-time.After(2 * time.Second):
+		t.Fatal("RunServer did not respect the grace period")
+	}
+	require.Len(t, received, 1)
+	res := <-received
+	assert.Equal(t, "very-slow", res.Id)
+	assert.Equal(t, "released", res.Result, "Unfinished task should be released back to the orchestrator")
+}
+
+func TestTaskDelay(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	tests := []struct {
+		name        string
+		task        internal.Task
+		expected    time.Duration
+		expectError bool
+	}{
+		{name: "Operation time is milliseconds", task: internal.Task{Operation_time: "100"}, expected: 100 * time.Millisecond},
+		{name: "Empty operation time", task: internal.Task{}, expected: 0},
+		{name: "Invalid operation time", task: internal.Task{Operation_time: "soon"}, expectError: true},
+		{name: "Negative operation time", task: internal.Task{Operation_time: "-5"}, expectError: true},
+		{name: "Latency model wins", task: internal.Task{Operation_time: "100", Latency: &latency.Spec{Model: latency.ModelFixed, BaseMs: 7}}, expected: 7 * time.Millisecond},
+		{name: "Unknown latency model", task: internal.Task{Latency: &latency.Spec{Model: "warp"}}, expectError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			delay, err := agentapp.TaskDelay(tt.task, rnd)
+			if tt.expectError {
+				assert.Error(t, err)
+				assert.Zero(t, delay)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, delay)
+		})
+	}
+}
+
+func TestAgentApp_ConfigureTLSUsesHTTPS(t *testing.T) {
+	orchestrator := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer orchestrator.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: orchestrator.Certificate().Raw}), 0o600))
+	t.Setenv("AGENT_TLS_CA_FILE", caFile)
+
+	t.Setenv("ORCHESTRATOR_URL", "")
+	app := agentapp.New()
+	require.NoError(t, app.ConfigureTLS())
+	assert.Equal(t, "https://localhost:8080/internal/task/new", app.OrchestratorTaskURL, "The default URL switches to https")
+	assert.Equal(t, "https://localhost:8080/internal/agent/login", app.OrchestratorLoginURL)
+
+	t.Setenv("ORCHESTRATOR_URL", orchestrator.URL)
+	app = agentapp.New()
+	require.NoError(t, app.ConfigureTLS())
+	assert.Equal(t, orchestrator.URL+"/internal/task", app.OrchestratorResultURL)
+
+	t.Setenv("ORCHESTRATOR_URL", "http://orchestrator:8080")
+	assert.Error(t, agentapp.New().ConfigureTLS(), "An explicit http URL with TLS configured fails fast")
+}
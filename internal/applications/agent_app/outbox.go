@@ -0,0 +1,89 @@
+package application
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/katierevinska/calculatorService/internal"
+)
+
+// Outbox keeps computed results on disk until the orchestrator acknowledges
+// them, so an agent restart does not lose finished work.
+type Outbox struct {
+	dir string
+}
+
+func NewOutbox(dir string) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating outbox directory %s: %w", dir, err)
+	}
+	return &Outbox{dir: dir}, nil
+}
+
+func (o *Outbox) path(taskID string) string {
+	return filepath.Join(o.dir, safeFileName(taskID)+".json")
+}
+
+// Put writes the result through a temporary file and a rename, so a crash
+// never leaves a half written entry behind.
+func (o *Outbox) Put(result internal.TaskResult) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(o.dir, "result-*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), o.path(result.Id))
+}
+
+func (o *Outbox) Remove(taskID string) error {
+	err := os.Remove(o.path(taskID))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (o *Outbox) Pending() ([]internal.TaskResult, error) {
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return nil, err
+	}
+	var results []internal.TaskResult
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(o.dir, entry.Name()))
+		if err != nil {
+			log.Printf("Outbox: cannot read %s: %v", entry.Name(), err)
+			continue
+		}
+		var result internal.TaskResult
+		if err := json.Unmarshal(data, &result); err != nil {
+			log.Printf("Outbox: skipping corrupt entry %s: %v", entry.Name(), err)
+			continue
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func safeFileName(id string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", "..", "_").Replace(id)
+}
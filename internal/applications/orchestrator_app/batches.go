@@ -0,0 +1,133 @@
+package orchestrator_app
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/middleware"
+	"github.com/katierevinska/calculatorService/internal/store"
+)
+
+// MaxBatchSize limits the expressions submitted in one batch.
+const MaxBatchSize = 1000
+
+// BatchExpressionRequest is an expression of a batch. The key is chosen by
+// the client to match the results to its own records and must be unique
+// within the batch.
+type BatchExpressionRequest struct {
+	Key string `json:"key,omitempty"`
+	ExpressionRequest
+}
+
+type BatchRequest struct {
+	Expressions []BatchExpressionRequest `json:"expressions"`
+}
+
+// BatchResponse has the ID or the error of every expression of the batch,
+// in request order.
+type BatchResponse struct {
+	ID    int64                `json:"id"`
+	Items []internal.BatchItem `json:"items"`
+}
+
+// CalculateBatchHandler accepts many expressions at once. Each one is
+// validated and saved on its own, so a rejected expression does not stop
+// the others.
+func (app *OrchestratorApp) CalculateBatchHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		log.Println("CalculateBatchHandler: Failed to get userID from context")
+		app.jsonErrorResponse(w, "Internal server error (userID missing in context)", http.StatusInternalServerError)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		app.jsonErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if len(request.Expressions) == 0 {
+		app.jsonErrorResponse(w, "Batch is empty", http.StatusBadRequest)
+		return
+	}
+	if len(request.Expressions) > MaxBatchSize {
+		app.jsonErrorResponse(w, "Too many expressions, the limit is "+strconv.Itoa(MaxBatchSize), http.StatusUnprocessableEntity)
+		return
+	}
+
+	items := make([]internal.BatchItem, len(request.Expressions))
+	keys := make(map[string]bool)
+	rejected := 0
+	for i, expression := range request.Expressions {
+		items[i].Key = expression.Key
+		if expression.Key != "" && keys[expression.Key] {
+			items[i].Error = "Duplicate key"
+			rejected++
+			continue
+		}
+		keys[expression.Key] = true
+
+		id, rejection := app.submit(&submission{ctx: r.Context(), userID: userID, request: expression.ExpressionRequest})
+		if rejection != nil {
+			items[i].Error = rejection.message
+			rejected++
+			continue
+		}
+		items[i].ExpressionID = id
+	}
+
+	batchID, err := app.BatchStore.CreateBatch(userID, items)
+	if err != nil {
+		app.jsonErrorResponse(w, "Failed to save batch", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Batch %d with %d expressions accepted from user %d, %d rejected", batchID, len(items), userID, rejected)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(BatchResponse{ID: batchID, Items: items})
+}
+
+// BatchByIDHandler shows the aggregate status of a batch,
+// GET /api/v1/batches/{id}.
+func (app *OrchestratorApp) BatchByIDHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		log.Println("BatchByIDHandler: Failed to get userID from context")
+		app.jsonErrorResponse(w, "Internal server error (userID missing in context)", http.StatusInternalServerError)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.URL.Path[len("/api/v1/batches/"):], 10, 64)
+	if err != nil {
+		app.jsonErrorResponse(w, "Batch ID is missing or invalid in path", http.StatusBadRequest)
+		return
+	}
+	batch, err := app.BatchStore.GetBatch(id, userID)
+	if err != nil {
+		if errors.Is(err, store.ErrBatchNotFound) {
+			app.jsonErrorResponse(w, "Batch not found", http.StatusNotFound)
+		} else {
+			app.jsonErrorResponse(w, "Failed to load batch", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(batch)
+}
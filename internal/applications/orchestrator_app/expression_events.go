@@ -0,0 +1,266 @@
+package orchestrator_app
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/events"
+	"github.com/katierevinska/calculatorService/internal/middleware"
+	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/katierevinska/calculatorService/internal/websocket"
+)
+
+// sseKeepAlive is how often an idle event stream sends a comment, so
+// proxies do not close it.
+const sseKeepAlive = 15 * time.Second
+
+// watchedTask links a task to the expression it is planned for.
+type watchedTask struct {
+	expressionID string
+	userID       int64
+}
+
+// subscribe subscribes to the events of an expression, or of all
+// expressions of the user if expressionID is empty, and counts the
+// subscriber as a watcher of the tasks of the user. Once the last watcher
+// unsubscribes, the expressions of the user are no longer watched.
+func (app *OrchestratorApp) subscribe(userID int64, expressionID string) (<-chan events.Event, func()) {
+	app.watchMu.Lock()
+	app.watchers[userID]++
+	app.watchMu.Unlock()
+	stream, unsubscribe := app.Events.Subscribe(userID, expressionID)
+	return stream, func() {
+		unsubscribe()
+		app.watchMu.Lock()
+		defer app.watchMu.Unlock()
+		if app.watchers[userID]--; app.watchers[userID] > 0 {
+			return
+		}
+		delete(app.watchers, userID)
+		for id, watched := range app.watchedTasks {
+			if watched.userID == userID {
+				delete(app.watchedExpressions, watched.expressionID)
+				delete(app.watchedTasks, id)
+			}
+		}
+	}
+}
+
+// watchExpression starts reporting the progress of the tasks of an
+// expression that is still in progress, if anybody watches the tasks of
+// the user. Tasks planned later, for the branches of computed
+// conditionals, are not reported.
+func (app *OrchestratorApp) watchExpression(userID int64, expressionID string) {
+	if !app.watched(userID) {
+		return
+	}
+	roots, err := app.ExpressionStore.ResultTaskIDs(expressionID)
+	if err != nil {
+		return
+	}
+	if len(roots) == 0 {
+		roots = []string{expressionID}
+	}
+
+	app.watchMu.Lock()
+	if app.watchers[userID] == 0 {
+		app.watchMu.Unlock()
+		return
+	}
+	var ids []string
+	for _, trace := range app.TaskStore.Trace(roots) {
+		app.watchedTasks[trace.ID] = watchedTask{expressionID: expressionID, userID: userID}
+		ids = append(ids, trace.ID)
+	}
+	app.watchedExpressions[expressionID] = ids
+	app.watchMu.Unlock()
+
+	// the expression may have been calculated, and reported, before its
+	// tasks were watched
+	if expression, exists := app.ExpressionStore.GetExpression(expressionID, userID); !exists || expression.Status != "in progress" {
+		app.unwatchExpression(expressionID)
+	}
+}
+
+func (app *OrchestratorApp) watched(userID int64) bool {
+	app.watchMu.Lock()
+	defer app.watchMu.Unlock()
+	return app.watchers[userID] > 0
+}
+
+func (app *OrchestratorApp) unwatchExpression(expressionID string) {
+	app.watchMu.Lock()
+	defer app.watchMu.Unlock()
+	for _, id := range app.watchedExpressions[expressionID] {
+		delete(app.watchedTasks, id)
+	}
+	delete(app.watchedExpressions, expressionID)
+}
+
+// publishTask reports a task of a watched expression.
+func (app *OrchestratorApp) publishTask(task internal.Task, status, result, agentID string) {
+	app.watchMu.Lock()
+	watched, exists := app.watchedTasks[task.Id]
+	app.watchMu.Unlock()
+	if !exists {
+		return
+	}
+	app.Events.Publish(events.Event{
+		Type:         events.TaskEvent,
+		ExpressionID: watched.expressionID,
+		TaskID:       task.Id,
+		Operation:    task.Operation,
+		Status:       status,
+		Result:       result,
+		AgentID:      agentID,
+		UserID:       watched.userID,
+	})
+}
+
+// expressionFinished reports an expression that is no longer in progress
+// to event subscribers and webhooks and stops watching its tasks. The
+// expression store calls it when the last result of an expression comes
+// in, whether or not the expression is watched, e.g. after a restart.
+func (app *OrchestratorApp) expressionFinished(expression internal.Expression) {
+	app.unwatchExpression(expression.ID)
+	app.Events.Publish(expressionEvent(expression))
+	app.notifyWebhooks(expression)
+}
+
+// savedFinished reports an expression that was saved calculated already,
+// which the expression store does not report.
+func (app *OrchestratorApp) savedFinished(userID int64, expressionID string) {
+	if expression, exists := app.ExpressionStore.GetExpression(expressionID, userID); exists {
+		app.expressionFinished(expression)
+	}
+}
+
+func expressionEvent(expression internal.Expression) events.Event {
+	return events.Event{
+		Type:         events.ExpressionEvent,
+		ExpressionID: expression.ID,
+		Status:       expression.Status,
+		Result:       expression.Result,
+		UserID:       expression.UserID,
+	}
+}
+
+// expressionEvents streams the progress of the expression as Server-Sent
+// Events, starting with its current status, until it is calculated.
+func (app *OrchestratorApp) expressionEvents(w http.ResponseWriter, r *http.Request, userID int64, id string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		app.jsonErrorResponse(w, "Streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	// subscribe first, so nothing happens between reading the expression
+	// and listening
+	stream, unsubscribe := app.subscribe(userID, id)
+	defer unsubscribe()
+	expression, exists := app.ExpressionStore.GetExpression(id, userID)
+	if !exists {
+		app.jsonErrorResponse(w, "Expression not found", http.StatusNotFound)
+		return
+	}
+	if expression.Status == "in progress" {
+		app.watchExpression(userID, id)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	writeServerEvent(w, expressionEvent(expression))
+	flusher.Flush()
+	if expression.Status != "in progress" {
+		return
+	}
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			w.Write([]byte(": keep-alive\n\n"))
+			flusher.Flush()
+		case e, ok := <-stream:
+			if !ok {
+				return
+			}
+			writeServerEvent(w, e)
+			flusher.Flush()
+			if e.Type == events.ExpressionEvent && e.Status != "in progress" {
+				return
+			}
+		}
+	}
+}
+
+// watchInProgress watches the tasks of the expressions of the user that
+// are in progress, up to a page of them.
+func (app *OrchestratorApp) watchInProgress(userID int64) {
+	page, err := app.ExpressionStore.QueryExpressions(userID, store.ExpressionQuery{Status: "in progress", Limit: store.MaxPageSize})
+	if err != nil {
+		log.Printf("Error listing expressions in progress of user %d: %v", userID, err)
+		return
+	}
+	for _, expression := range page.Expressions {
+		app.watchExpression(userID, expression.ID)
+	}
+}
+
+func writeServerEvent(w http.ResponseWriter, e events.Event) {
+	data, _ := json.Marshal(e)
+	w.Write([]byte("event: " + e.Type + "\ndata: " + string(data) + "\n\n"))
+}
+
+// WebSocketHandler pushes the progress of all expressions of the user, one
+// JSON event per message, until the client disconnects. Messages from the
+// client are ignored.
+func (app *OrchestratorApp) WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		log.Println("WebSocketHandler: Failed to get userID from context")
+		app.jsonErrorResponse(w, "Internal server error (userID missing in context)", http.StatusInternalServerError)
+		return
+	}
+	stream, unsubscribe := app.subscribe(userID, "")
+	defer unsubscribe()
+	app.watchInProgress(userID)
+	upgrader := websocket.Upgrader{AllowedOrigins: app.WebSocketOrigins, Protocols: []string{middleware.WebSocketProtocol}}
+	conn, err := upgrader.Upgrade(w, r)
+	if err != nil {
+		log.Printf("WebSocket upgrade for user %d failed: %v", userID, err)
+		return
+	}
+	defer conn.Close()
+
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-gone:
+			return
+		case e, ok := <-stream:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(e)
+			if err := conn.WriteText(data); err != nil {
+				return
+			}
+		}
+	}
+}
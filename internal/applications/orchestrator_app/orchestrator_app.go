@@ -1,38 +1,108 @@
 package orchestrator_app // Убедись, что имя пакета совпадает с директорией
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"errors"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/katierevinska/calculatorService/internal"
 	"github.com/katierevinska/calculatorService/internal/auth"
+	"github.com/katierevinska/calculatorService/internal/events"
 	"github.com/katierevinska/calculatorService/internal/middleware"
 	"github.com/katierevinska/calculatorService/internal/models"
 	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/katierevinska/calculatorService/internal/tlsconfig"
+	"github.com/katierevinska/calculatorService/internal/webhooks"
+	"github.com/katierevinska/calculatorService/pkg/operations"
 	"github.com/katierevinska/calculatorService/pkg/rpn"
+	"github.com/katierevinska/calculatorService/pkg/symbolic"
 )
 
 type OrchestratorApp struct {
-	db              *sql.DB
-	UserStore       *store.UserStore
-	ExpressionStore *store.ExpressionStore
-	TaskStore       *store.TaskStore
+	db                  *sql.DB
+	UserStore           *store.UserStore
+	ResultCache         *store.ResultCache
+	ExpressionStore     *store.ExpressionStore
+	FunctionStore       *store.FunctionStore
+	WebhookStore        *store.WebhookStore
+	BatchStore          *store.BatchStore
+	IdempotencyStore    *store.IdempotencyStore
+	TaskStore           *store.TaskStore
+	ShutdownGracePeriod time.Duration
+	// MaxEstimate rejects expressions estimated to take longer, 0 accepts
+	// all of them.
+	MaxEstimate time.Duration
+	// MaxWait limits how long POST /api/v1/calculate?wait= holds a request.
+	MaxWait time.Duration
+	// Events carries the progress of expressions to their watchers.
+	Events *events.Bus
+	// Webhooks delivers finished expressions to callback URLs and webhooks.
+	Webhooks *webhooks.Dispatcher
+	// WebSocketOrigins are the origins of pages on other sites allowed to
+	// open /api/v1/ws, see websocket.Upgrader.
+	WebSocketOrigins []string
+
+	watchMu sync.Mutex
+	// watchers counts the subscribers to the events of each user, see
+	// subscribe.
+	watchers           map[int64]int
+	watchedTasks       map[string]watchedTask
+	watchedExpressions map[string][]string
 }
 
 func New(db *sql.DB) *OrchestratorApp {
-	return &OrchestratorApp{
-		db:              db,
-		UserStore:       store.NewUserStore(db),
-		ExpressionStore: store.NewExpressionStore(db),
-		TaskStore:       store.NewTaskStore(),
+	app := &OrchestratorApp{
+		db:                  db,
+		UserStore:           store.NewUserStore(db),
+		ExpressionStore:     store.NewExpressionStore(db),
+		FunctionStore:       store.NewFunctionStore(db),
+		WebhookStore:        store.NewWebhookStore(db),
+		BatchStore:          store.NewBatchStore(db),
+		IdempotencyStore:    store.NewIdempotencyStore(db, internal.DurationEnv("IDEMPOTENCY_KEY_RETENTION", 24*time.Hour)),
+		TaskStore:           store.NewTaskStore(),
+		ShutdownGracePeriod: internal.DurationEnv("SHUTDOWN_GRACE_PERIOD", 10*time.Second),
+		MaxEstimate:         internal.DurationEnv("MAX_EXPRESSION_ESTIMATE", 0),
+		MaxWait:             internal.DurationEnv("CALCULATE_MAX_WAIT", time.Minute),
+		Events:              events.NewBus(),
+		WebSocketOrigins:    strings.FieldsFunc(os.Getenv("WEBSOCKET_ALLOWED_ORIGINS"), func(r rune) bool { return r == ',' || r == ' ' }),
+		watchers:            make(map[int64]int),
+		watchedTasks:        make(map[string]watchedTask),
+		watchedExpressions:  make(map[string][]string),
+	}
+	app.Webhooks = &webhooks.Dispatcher{
+		Client:         webhooks.NewClient(10*time.Second, internal.BoolEnv("WEBHOOK_ALLOW_PRIVATE_NETWORKS", false)),
+		MaxAttempts:    internal.IntEnv("WEBHOOK_MAX_ATTEMPTS", 6),
+		RetryBaseDelay: internal.DurationEnv("WEBHOOK_RETRY_BASE_DELAY", time.Second),
+		RetryMaxDelay:  internal.DurationEnv("WEBHOOK_RETRY_MAX_DELAY", time.Minute),
+		Record:         func(d internal.WebhookDelivery) { app.WebhookStore.RecordDelivery(d) },
+		Workers:        internal.IntEnv("WEBHOOK_WORKERS", webhooks.DefaultWorkers),
+	}
+	app.ExpressionStore.OnFinished(app.expressionFinished)
+	app.TaskStore.OnComplete(app.completeTask)
+	app.TaskStore.KeepTraces(internal.DurationEnv("TASK_TRACE_RETENTION", store.DefaultTraceRetention), internal.IntEnv("TASK_TRACE_LIMIT", store.DefaultTraceLimit))
+	if size := internal.IntEnv("RESULT_CACHE_SIZE", 0); size > 0 {
+		cache, err := store.NewResultCache(db, size, internal.DurationEnv("RESULT_CACHE_TTL", 24*time.Hour))
+		if err != nil {
+			log.Printf("Result cache disabled: %v", err)
+		} else {
+			app.ResultCache = cache
+			app.TaskStore.UseCache(cache)
+		}
 	}
+	return app
 }
 
-func (app *OrchestratorApp) RunServer() {
+// RunServer serves until ctx is cancelled, then stops accepting connections
+// and waits up to ShutdownGracePeriod for in-flight requests to complete.
+func (app *OrchestratorApp) RunServer(ctx context.Context) {
 	http.HandleFunc("/api/v1/register", app.RegisterUserHandler)
 	http.HandleFunc("/api/v1/login", app.LoginUserHandler)
 
@@ -40,25 +110,163 @@ func (app *OrchestratorApp) RunServer() {
 	expressionsHandler := http.HandlerFunc(app.GetExpressionsHandler)
 	expressionByIdHandler := http.HandlerFunc(app.GetExpressionByIdHandler)
 
-	http.Handle("/api/v1/calculate", middleware.AuthMiddleware(calculateHandler))
+	http.Handle("/api/v1/calculate", middleware.AuthMiddleware(middleware.IdempotencyMiddleware(app.IdempotencyStore, calculateHandler)))
+	http.Handle("/api/v1/calculate/batch", middleware.AuthMiddleware(http.HandlerFunc(app.CalculateBatchHandler)))
+	http.Handle("/api/v1/batches/", middleware.AuthMiddleware(http.HandlerFunc(app.BatchByIDHandler)))
 	http.Handle("/api/v1/expressions", middleware.AuthMiddleware(expressionsHandler))
 	http.Handle("/api/v1/expressions/", middleware.AuthMiddleware(expressionByIdHandler))
+	http.Handle("/api/v1/functions", middleware.AuthMiddleware(http.HandlerFunc(app.FunctionsHandler)))
+	http.Handle("/api/v1/functions/", middleware.AuthMiddleware(http.HandlerFunc(app.FunctionByNameHandler)))
+	http.Handle("/api/v1/webhooks", middleware.AuthMiddleware(http.HandlerFunc(app.WebhooksHandler)))
+	http.Handle("/api/v1/webhooks/", middleware.AuthMiddleware(http.HandlerFunc(app.WebhookByIDHandler)))
+	http.Handle("/api/v1/ws", middleware.WebSocketAuthMiddleware(http.HandlerFunc(app.WebSocketHandler)))
+	http.Handle("/api/v1/explain", middleware.AuthMiddleware(http.HandlerFunc(app.ExplainHandler)))
+	http.Handle("/api/v1/symbolic/derive", middleware.AuthMiddleware(http.HandlerFunc(app.DeriveHandler)))
+	http.Handle("/api/v1/symbolic/simplify", middleware.AuthMiddleware(http.HandlerFunc(app.SimplifyHandler)))
 
-	http.HandleFunc("/internal/task/new", app.GetInternalTaskHandler)
-	http.HandleFunc("/internal/task", app.InternalTaskResultHandler)
+	certFile := os.Getenv("TLS_CERT_FILE")
+	keyFile := os.Getenv("TLS_KEY_FILE")
+	clientCAFile := os.Getenv("TLS_CLIENT_CA_FILE")
 
-	log.Println("Orchestrator server starting on :8080")
-	err := http.ListenAndServe(":8080", nil)
-	if err != nil {
+	internalHandler := func(h http.Handler) http.Handler {
+		if clientCAFile != "" {
+			return middleware.ClientCertMiddleware(h)
+		}
+		return h
+	}
+	http.Handle("/internal/agent/login", internalHandler(http.HandlerFunc(app.AgentLoginHandler)))
+	http.Handle("/internal/task/new", internalHandler(middleware.AgentAuthMiddleware(http.HandlerFunc(app.GetInternalTaskHandler))))
+	http.Handle("/internal/task", internalHandler(middleware.AgentAuthMiddleware(http.HandlerFunc(app.InternalTaskResultHandler))))
+	http.Handle("/internal/task/release", internalHandler(middleware.AgentAuthMiddleware(http.HandlerFunc(app.InternalTaskReleaseHandler))))
+	// the cache is shared by all users, so its statistics are for operators
+	http.Handle("/internal/cache/stats", internalHandler(middleware.AgentAuthMiddleware(http.HandlerFunc(app.CacheStatsHandler))))
+
+	server := &http.Server{Addr: ":8080"}
+	// event streams never end on their own
+	server.RegisterOnShutdown(app.Events.Close)
+
+	var listen func() error
+	if certFile != "" || keyFile != "" {
+		var err error
+		server.TLSConfig, err = tlsconfig.ServerConfig(certFile, keyFile, clientCAFile)
+		if err != nil {
+			log.Fatalf("Could not configure TLS: %s\n", err)
+		}
+		log.Printf("Orchestrator server starting on :8080 with TLS (client certificates for /internal: %t)", clientCAFile != "")
+		listen = func() error { return server.ListenAndServeTLS("", "") }
+	} else {
+		if clientCAFile != "" {
+			log.Fatalf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		log.Println("Orchestrator server starting on :8080")
+		listen = server.ListenAndServe
+	}
+	if err := app.Serve(ctx, server, listen); err != nil {
 		log.Fatalf("Could not start server: %s\n", err)
 	}
+	log.Println("Orchestrator stopped")
+}
+
+// Serve runs listen, e.g. server.ListenAndServe, until ctx is cancelled.
+// Then it stops accepting connections and returns only once in-flight
+// requests have completed, or after ShutdownGracePeriod, so that nothing
+// they use is closed under them.
+func (app *OrchestratorApp) Serve(ctx context.Context, server *http.Server, listen func() error) error {
+	go app.TaskStore.PruneTracesPeriodically(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-ctx.Done()
+		log.Println("Orchestrator is shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), app.ShutdownGracePeriod)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Orchestrator shutdown did not complete: %v", err)
+		}
+		// deliveries record their attempts in the database
+		app.Webhooks.Close()
+		if app.ResultCache != nil {
+			app.ResultCache.Close()
+		}
+	}()
+
+	// listen returns as soon as the shutdown starts
+	if err := listen(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	<-done
+	return nil
 }
 
 type ExpressionRequest struct {
 	Expression string `json:"expression"`
+	// Numbers are available in the expression as the list "numbers".
+	Numbers []float64 `json:"numbers,omitempty"`
+	// Mode is "integer" for exact integer arithmetic, see rpn.IntegerMode.
+	Mode string `json:"mode,omitempty"`
+	// CallbackURL receives a webhook once the expression is finished, in
+	// addition to the webhooks of the user.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+type SymbolicRequest struct {
+	Expression string `json:"expression"`
+	// Variable to differentiate by, x by default.
+	Variable string `json:"variable,omitempty"`
+	// Points to evaluate the result at, each submitted as an expression.
+	Points []map[string]float64 `json:"points,omitempty"`
+	// Submit evaluates the result once even without points.
+	Submit bool `json:"submit,omitempty"`
+}
+type SymbolicEvaluation struct {
+	Point map[string]float64 `json:"point,omitempty"`
+	Id    string             `json:"id,omitempty"`
+	Error string             `json:"error,omitempty"`
+}
+type SymbolicResponse struct {
+	Result      string               `json:"result"`
+	Expressions []SymbolicEvaluation `json:"expressions,omitempty"`
+}
+type FunctionRequest struct {
+	Definition string `json:"definition"`
 }
 type SuccessResponse struct {
 	Id string `json:"id"`
+	// Status is set when the request waited for the expression in vain.
+	Status   string    `json:"status,omitempty"`
+	Estimate *Estimate `json:"estimate,omitempty"`
+}
+
+// Estimate predicts how long an expression takes from the operation times.
+// The tasks queued before it are spread over the workers of the connected
+// agents, then the expression takes at least its critical path and at
+// least its work spread over the workers. Results found in the cache and
+// branches of computed conditionals are not taken into account.
+type Estimate struct {
+	WorkMs         float64 `json:"work_ms"`
+	CriticalPathMs float64 `json:"critical_path_ms"`
+	QueuedTasks    int     `json:"queued_tasks"`
+	QueueMs        float64 `json:"queue_ms"`
+	Workers        int     `json:"workers"`
+	TotalMs        float64 `json:"total_ms"`
+}
+
+// ExpressionTasksResponse lists the tasks of an expression, dependencies
+// first.
+type ExpressionTasksResponse struct {
+	ID    string               `json:"id"`
+	Tasks []internal.TaskTrace `json:"tasks"`
+}
+
+// ExplainResponse is the plan of an expression that is not computed.
+// CriticalPath is the longest chain of dependent tasks, which takes about
+// CriticalPathMs with enough agents.
+type ExplainResponse struct {
+	Results        []string                     `json:"results"`
+	Tasks          []internal.Task              `json:"tasks"`
+	Metadata       *internal.ExpressionMetadata `json:"metadata"`
+	CriticalPath   []string                     `json:"critical_path"`
+	CriticalPathMs float64                      `json:"critical_path_ms"`
+	Estimate       *Estimate                    `json:"estimate"`
 }
 type ErrorResponse struct {
 	Error string `json:"error"`
@@ -66,6 +274,10 @@ type ErrorResponse struct {
 type TokenResponse struct {
 	Token string `json:"token"`
 }
+type AgentCredentials struct {
+	AgentID string `json:"agent_id"`
+	Secret  string `json:"secret"`
+}
 
 func (app *OrchestratorApp) GetExpressionByIdHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
@@ -80,6 +292,14 @@ func (app *OrchestratorApp) GetExpressionByIdHandler(w http.ResponseWriter, r *h
 		app.jsonErrorResponse(w, "Expression ID is missing in path", http.StatusBadRequest)
 		return
 	}
+	if id, found := strings.CutSuffix(idStr, "/tasks"); found {
+		app.expressionTasks(w, userID, id)
+		return
+	}
+	if id, found := strings.CutSuffix(idStr, "/events"); found {
+		app.expressionEvents(w, r, userID, id)
+		return
+	}
 
 	expression, exists := app.ExpressionStore.GetExpression(idStr, userID)
 	if !exists {
@@ -93,6 +313,77 @@ func (app *OrchestratorApp) GetExpressionByIdHandler(w http.ResponseWriter, r *h
 	json.NewEncoder(w).Encode(expression)
 }
 
+// expressionTasks shows how the expression was computed, as far as the
+// task store still remembers its tasks.
+func (app *OrchestratorApp) expressionTasks(w http.ResponseWriter, userID int64, id string) {
+	if _, exists := app.ExpressionStore.GetExpression(id, userID); !exists {
+		app.jsonErrorResponse(w, "Expression not found", http.StatusNotFound)
+		return
+	}
+	roots, err := app.ExpressionStore.ResultTaskIDs(id)
+	if err != nil {
+		app.jsonErrorResponse(w, "Failed to load expression tasks", http.StatusInternalServerError)
+		return
+	}
+	if len(roots) == 0 {
+		roots = []string{id}
+	}
+	tasks := app.TaskStore.Trace(roots)
+	if tasks == nil {
+		tasks = []internal.TaskTrace{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ExpressionTasksResponse{ID: id, Tasks: tasks})
+}
+
+// ExplainHandler plans the expression given in the query without computing
+// it, e.g. GET /api/v1/explain?expression=2%2B2*4&mode=integer.
+func (app *OrchestratorApp) ExplainHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		log.Println("ExplainHandler: Failed to get userID from context")
+		app.jsonErrorResponse(w, "Internal server error (userID missing in context)", http.StatusInternalServerError)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	expression := r.URL.Query().Get("expression")
+	if expression == "" {
+		app.jsonErrorResponse(w, "Expression is empty", http.StatusBadRequest)
+		return
+	}
+	mode, err := rpn.ParseMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		app.jsonErrorResponse(w, "Invalid mode: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	explanation, err := rpn.Explain(expression, app.functionLookup(userID, nil), nil, mode)
+	if err != nil {
+		app.jsonErrorResponse(w, "Expression is not valid or processing error: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	path, ms := explanation.CriticalPath()
+	if path == nil {
+		path = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ExplainResponse{
+		Results:        explanation.Results,
+		Tasks:          explanation.Tasks,
+		Metadata:       planMetadata(explanation.Stats),
+		CriticalPath:   path,
+		CriticalPathMs: ms,
+		Estimate:       app.estimate(explanation),
+	})
+}
+
 func (app *OrchestratorApp) GetExpressionsHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
 	if !ok {
@@ -101,29 +392,58 @@ func (app *OrchestratorApp) GetExpressionsHandler(w http.ResponseWriter, r *http
 		return
 	}
 
-	exps := app.ExpressionStore.GetAllExpressions(userID)
-	log.Printf("Path: %s - send all expressions for user %d, found %d", r.URL.Path, userID, len(exps))
+	params := r.URL.Query()
+	query := store.ExpressionQuery{
+		Status:   params.Get("status"),
+		Contains: params.Get("contains"),
+		Sort:     params.Get("sort"),
+		Cursor:   params.Get("cursor"),
+	}
+	if limit := params.Get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil || query.Limit < 1 {
+			app.jsonErrorResponse(w, "Invalid limit, expected a positive number", http.StatusBadRequest)
+			return
+		}
+	}
+	for name, bound := range map[string]*time.Time{"created_after": &query.CreatedAfter, "created_before": &query.CreatedBefore} {
+		if param := params.Get(name); param != "" {
+			t, err := parseTimeParam(param)
+			if err != nil {
+				app.jsonErrorResponse(w, "Invalid "+name+", expected a date such as 2024-01-31 or 2024-01-31T10:00:00Z", http.StatusBadRequest)
+				return
+			}
+			*bound = t
+		}
+	}
+
+	page, err := app.ExpressionStore.QueryExpressions(userID, query)
+	switch {
+	case errors.Is(err, store.ErrInvalidSort):
+		app.jsonErrorResponse(w, "Invalid sort, expected created_at or status, prefixed with - for descending order", http.StatusBadRequest)
+		return
+	case errors.Is(err, store.ErrInvalidCursor):
+		app.jsonErrorResponse(w, "Invalid cursor", http.StatusBadRequest)
+		return
+	case err != nil:
+		app.jsonErrorResponse(w, "Failed to load expressions", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Path: %s - send expressions for user %d, %d of %d", r.URL.Path, userID, len(page.Expressions), page.Total)
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	json.NewEncoder(w).Encode(exps)
-}
-
-func (app *OrchestratorApp) getTimeSetting(operation string) string {
-	switch operation {
-	case "+":
-		return os.Getenv("TIME_ADDITION_MS")
-	case "-":
-		return os.Getenv("TIME_SUBTRACTION_MS")
-	case "*":
-		return os.Getenv("TIME_MULTIPLICATIONS_MS")
-	case "/":
-		return os.Getenv("TIME_DIVISIONS_MS")
-	default:
-		log.Printf("Warning: Unknown operation '%s' requested for time setting, returning 0ms", operation)
-		return "0"
+	json.NewEncoder(w).Encode(page)
+}
+
+// parseTimeParam accepts a date or an RFC 3339 time.
+func parseTimeParam(param string) (time.Time, error) {
+	if t, err := time.Parse("2006-01-02", param); err == nil {
+		return t, nil
 	}
+	return time.Parse(time.RFC3339, param)
 }
+
 func (app *OrchestratorApp) CalculatorHandler(w http.ResponseWriter, r *http.Request) {
 	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
 	if !ok {
@@ -139,39 +459,509 @@ func (app *OrchestratorApp) CalculatorHandler(w http.ResponseWriter, r *http.Req
 	}
 	defer r.Body.Close()
 
-	if requestExrp.Expression == "" {
-		app.jsonErrorResponse(w, "Expression is empty", http.StatusBadRequest)
+	var wait time.Duration
+	if param := r.URL.Query().Get("wait"); param != "" {
+		var err error
+		if wait, err = time.ParseDuration(param); err != nil || wait < 0 {
+			app.jsonErrorResponse(w, "Invalid wait, expected a duration such as 5s", http.StatusBadRequest)
+			return
+		}
+		wait = min(wait, app.MaxWait)
+	}
+
+	sub := &submission{ctx: r.Context(), userID: userID, request: requestExrp, wait: wait}
+	defer sub.stopListening()
+	id, rejection := app.submit(sub)
+	if rejection != nil {
+		app.jsonErrorResponse(w, rejection.message, rejection.status)
 		return
 	}
+	app.respondSubmitted(w, sub, id)
+}
+
+// rejection is why an expression was not accepted, with the status code
+// to answer.
+type rejection struct {
+	status  int
+	message string
+}
+
+func reject(status int, message string) *rejection {
+	return &rejection{status: status, message: message}
+}
+
+// submit validates, plans and saves the expression of the submission and
+// returns its ID.
+func (app *OrchestratorApp) submit(sub *submission) (string, *rejection) {
+	requestExrp, userID := sub.request, sub.userID
+	if requestExrp.Expression == "" {
+		return "", reject(http.StatusBadRequest, "Expression is empty")
+	}
 
-	expressionID, err := rpn.Calc(requestExrp.Expression, app.TaskStore)
+	if len(requestExrp.Numbers) > rpn.MaxListLength {
+		return "", reject(http.StatusUnprocessableEntity, "Too many numbers, the limit is "+strconv.Itoa(rpn.MaxListLength))
+	}
+	mode, err := rpn.ParseMode(requestExrp.Mode)
 	if err != nil {
-		log.Printf("Error from rpn.Calc for expression '%s' by user %d: %v", requestExrp.Expression, userID, err)
-		app.jsonErrorResponse(w, "Expression is not valid or processing error: "+err.Error(), http.StatusUnprocessableEntity)
+		return "", reject(http.StatusBadRequest, "Invalid mode: "+err.Error())
+	}
+	if requestExrp.CallbackURL != "" {
+		if err := webhooks.ValidateURL(requestExrp.CallbackURL); err != nil {
+			return "", reject(http.StatusBadRequest, "Invalid callback_url: "+err.Error())
+		}
+	}
+	var inputs rpn.Inputs
+	if requestExrp.Numbers != nil {
+		inputs = rpn.Inputs{rpn.NumbersVariable: rpn.List(requestExrp.Numbers)}
+	}
+
+	// the plan is estimated before its tasks reach the agents
+	prepared, err := rpn.Prepare(requestExrp.Expression, app.TaskStore, app.functionLookup(userID, nil), inputs, mode)
+	if err != nil {
+		log.Printf("Error planning expression '%s' by user %d: %v", requestExrp.Expression, userID, err)
+		return "", reject(http.StatusUnprocessableEntity, "Expression is not valid or processing error: "+err.Error())
+	}
+	sub.estimate = app.estimate(prepared.Explanation)
+	if limit := app.MaxEstimate; limit > 0 && sub.estimate.TotalMs > float64(limit.Milliseconds()) {
+		log.Printf("Expression '%s' by user %d rejected, estimated at %.0f ms", requestExrp.Expression, userID, sub.estimate.TotalMs)
+		return "", reject(http.StatusUnprocessableEntity, "Expression is estimated to take "+strconv.FormatFloat(sub.estimate.TotalMs, 'f', 0, 64)+" ms, the limit is "+strconv.FormatInt(limit.Milliseconds(), 10)+" ms")
+	}
+
+	prepared.Commit()
+	if rpn.IsScript(requestExrp.Expression) {
+		return app.saveScript(sub, prepared.Script, prepared.Stats)
+	}
+
+	expressionID := prepared.ID
+	if operations.IsNumber(expressionID) {
+		newExpr := app.literalExpression(userID, requestExrp.Expression, expressionID, prepared.Stats)
+		newExpr.CallbackURL = requestExrp.CallbackURL
+		app.listen(sub, newExpr.ID)
+		if err := app.addCalculated(newExpr); err != nil {
+			return "", reject(http.StatusInternalServerError, "Failed to save expression")
+		}
+		log.Printf("Expression '%s' (ID: %s) by user %d needs no tasks", requestExrp.Expression, newExpr.ID, userID)
+		return newExpr.ID, nil
+	}
+	app.listen(sub, expressionID)
+	if err := app.addExpression(userID, requestExrp.Expression, expressionID, prepared.Stats, requestExrp.CallbackURL); err != nil {
+		return "", reject(http.StatusInternalServerError, "Failed to save expression")
+	}
+
+	log.Printf("Expression '%s' (ID: %s) accepted from user %d", requestExrp.Expression, expressionID, userID)
+	return expressionID, nil
+}
+
+// submission is an accepted calculate request on its way to the response.
+type submission struct {
+	ctx      context.Context
+	userID   int64
+	request  ExpressionRequest
+	estimate *Estimate
+	// wait holds the response until the expression is finished, at most
+	// this long; events are listened to from before the expression is
+	// saved, so its completion cannot be missed.
+	wait        time.Duration
+	events      <-chan events.Event
+	unsubscribe func()
+}
+
+func (sub *submission) stopListening() {
+	if sub.unsubscribe != nil {
+		sub.unsubscribe()
+	}
+}
+
+// listen subscribes to the status of the expression if the request waits
+// for it. It must be called before the expression is saved.
+func (app *OrchestratorApp) listen(sub *submission, id string) {
+	if sub.wait > 0 {
+		sub.events, sub.unsubscribe = app.Events.Subscribe(sub.userID, id, events.ExpressionEvent)
+	}
+}
+
+// respondSubmitted answers 201 with the expression ID, or, when the request
+// waits, 200 with the whole expression once it is finished and 202 with its
+// ID and status if the wait runs out first.
+func (app *OrchestratorApp) respondSubmitted(w http.ResponseWriter, sub *submission, id string) {
+	w.Header().Set("Content-Type", "application/json")
+	if sub.wait <= 0 {
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(SuccessResponse{Id: id, Estimate: sub.estimate})
+		return
+	}
+
+	expression, _ := app.ExpressionStore.GetExpression(id, sub.userID)
+	if expression.Status == "in progress" {
+		timer := time.NewTimer(sub.wait)
+		defer timer.Stop()
+	waiting:
+		for {
+			select {
+			case <-timer.C:
+				break waiting
+			case <-sub.ctx.Done():
+				// the expression exists, so a client retrying with the
+				// same Idempotency-Key must get its ID
+				break waiting
+			case e, ok := <-sub.events:
+				if ok {
+					if e.Status != "in progress" {
+						break waiting
+					}
+					continue
+				}
+				// dropped by the bus: subscribe again, then read the
+				// status in case the completion was missed meanwhile
+				if app.Events.Closed() {
+					break waiting
+				}
+				app.listen(sub, id)
+				if expression, _ = app.ExpressionStore.GetExpression(id, sub.userID); expression.Status != "in progress" {
+					break waiting
+				}
+			}
+		}
+		expression, _ = app.ExpressionStore.GetExpression(id, sub.userID)
+	}
+
+	if expression.Status == "in progress" {
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(SuccessResponse{Id: id, Status: expression.Status, Estimate: sub.estimate})
 		return
 	}
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(expression)
+}
 
+// addExpression saves an expression whose tasks have been planned.
+func (app *OrchestratorApp) addExpression(userID int64, expression, expressionID string, stats rpn.PlanStats, callbackURL string) error {
 	newExpr := internal.Expression{
 		ID:               expressionID,
 		UserID:           userID,
-		ExpressionString: requestExrp.Expression,
+		ExpressionString: expression,
 		Status:           "in progress",
 		Result:           "",
+		Unit:             stats.Unit,
+		Metadata:         planMetadata(stats),
+		CallbackURL:      callbackURL,
+	}
+	if stats.Shape != nil {
+		return app.addMatrix(newExpr, stats)
 	}
 	if err := app.ExpressionStore.AddExpression(newExpr); err != nil {
 		log.Printf("Failed to add expression %s to store for user %d: %v", expressionID, userID, err)
-		app.jsonErrorResponse(w, "Failed to save expression", http.StatusInternalServerError)
+		return err
+	}
+
+	// the result may have come from the cache before the expression was saved
+	if result, exists := app.TaskStore.TasksResStore.GetTaskRes(expressionID); exists {
+		app.completeTask(result)
+	}
+	app.watchExpression(userID, expressionID)
+	return nil
+}
+
+// addMatrix saves an expression whose value is a vector or matrix. Its
+// elements are stored like the results of a script, without names, and
+// the matrix is assembled once all of them are calculated.
+func (app *OrchestratorApp) addMatrix(newExpr internal.Expression, stats rpn.PlanStats) error {
+	elements := make([]internal.NamedResult, len(stats.Elements))
+	values := make([]string, len(stats.Elements))
+	computed := true
+	for i, element := range stats.Elements {
+		if operations.IsNumber(element) {
+			elements[i].Result = element
+			values[i] = element
+		} else {
+			elements[i].TaskID = element
+			computed = false
+		}
+	}
+	if computed {
+		newExpr.Status = "calculated"
+		newExpr.Result = internal.AssembleMatrix(stats.Shape, values)
+	}
+
+	if err := app.ExpressionStore.AddExpressionResults(newExpr, elements); err != nil {
+		log.Printf("Failed to add matrix %s to store for user %d: %v", newExpr.ID, newExpr.UserID, err)
+		return err
+	}
+	if computed {
+		app.savedFinished(newExpr.UserID, newExpr.ID)
+		return nil
+	}
+	for _, element := range elements {
+		if result, exists := app.TaskStore.TasksResStore.GetTaskRes(element.TaskID); element.TaskID != "" && exists {
+			app.ExpressionStore.RecordTaskResult(element.TaskID, result.Result)
+		}
+	}
+	app.watchExpression(newExpr.UserID, newExpr.ID)
+	return nil
+}
+
+// saveScript stores the planned statements of the script as results of one
+// parent expression, which is calculated once all of them are.
+func (app *OrchestratorApp) saveScript(sub *submission, planned []rpn.ScriptResult, stats rpn.PlanStats) (string, *rejection) {
+	userID := sub.userID
+	newExpr := internal.Expression{
+		ID:               "id" + strconv.Itoa(app.TaskStore.Counter.GetValueAndInc()),
+		UserID:           userID,
+		ExpressionString: sub.request.Expression,
+		Status:           "calculated",
+		Metadata:         planMetadata(stats),
+		CallbackURL:      sub.request.CallbackURL,
+	}
+	results := make([]internal.NamedResult, len(planned))
+	for i, p := range planned {
+		results[i] = internal.NamedResult{Name: p.Name, Unit: p.Unit}
+		if operations.IsNumber(p.ID) {
+			results[i].Result = p.ID
+		} else {
+			results[i].TaskID = p.ID
+			newExpr.Status = "in progress"
+		}
+	}
+	newExpr.Unit = results[len(results)-1].Unit
+	if newExpr.Status == "calculated" {
+		newExpr.Result = results[len(results)-1].Result
+	}
+
+	app.listen(sub, newExpr.ID)
+	if err := app.ExpressionStore.AddExpressionResults(newExpr, results); err != nil {
+		log.Printf("Failed to add script %s to store for user %d: %v", newExpr.ID, userID, err)
+		return "", reject(http.StatusInternalServerError, "Failed to save expression")
+	}
+	if newExpr.Status == "calculated" {
+		app.savedFinished(userID, newExpr.ID)
+	} else {
+		// agents or the cache may have finished some tasks before the
+		// script was saved
+		for _, result := range results {
+			if computed, exists := app.TaskStore.TasksResStore.GetTaskRes(result.TaskID); result.TaskID != "" && exists {
+				app.ExpressionStore.RecordTaskResult(result.TaskID, computed.Result)
+			}
+		}
+		app.watchExpression(userID, newExpr.ID)
+	}
+
+	log.Printf("Script (ID: %s) with %d statements accepted from user %d", newExpr.ID, len(results), userID)
+	return newExpr.ID, nil
+}
+
+// estimate predicts how long the explained expression takes given the
+// current queue and agents, see Estimate.
+func (app *OrchestratorApp) estimate(explanation rpn.Explanation) *Estimate {
+	load := app.TaskStore.Load()
+	_, criticalPath := explanation.CriticalPath()
+	estimate := &Estimate{
+		WorkMs:         explanation.Work(),
+		CriticalPathMs: criticalPath,
+		QueuedTasks:    load.QueuedTasks,
+		Workers:        load.Workers,
+	}
+	// without agents nothing is computed, the estimate assumes one worker
+	workers := float64(max(load.Workers, 1))
+	estimate.QueueMs = load.QueuedMs / workers
+	estimate.TotalMs = estimate.QueueMs + max(estimate.CriticalPathMs, estimate.WorkMs/workers)
+	return estimate
+}
+
+func planMetadata(stats rpn.PlanStats) *internal.ExpressionMetadata {
+	return &internal.ExpressionMetadata{
+		Operations: stats.Operations,
+		Tasks:      stats.Tasks,
+		DedupRatio: stats.DedupRatio(),
+		Shape:      stats.Shape,
+		Mode:       string(stats.Mode),
+	}
+}
+
+func (app *OrchestratorApp) FunctionsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		log.Println("FunctionsHandler: Failed to get userID from context")
+		app.jsonErrorResponse(w, "Internal server error (userID missing in context)", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Expression '%s' (ID: %s) accepted from user %d", requestExrp.Expression, expressionID, userID)
-	res := SuccessResponse{Id: expressionID}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(res)
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(app.FunctionStore.GetAllFunctions(userID))
+
+	case http.MethodPost:
+		var request FunctionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			app.jsonErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		def, err := app.validateFunction(userID, request.Definition)
+		if err != nil {
+			app.jsonErrorResponse(w, "Function is not valid: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		fn := internal.Function{Name: def.Name, UserID: userID, Definition: strings.TrimSpace(request.Definition)}
+		if err := app.FunctionStore.CreateFunction(fn); err != nil {
+			if errors.Is(err, store.ErrFunctionExists) {
+				app.jsonErrorResponse(w, "Function with this name already exists", http.StatusConflict)
+			} else {
+				app.jsonErrorResponse(w, "Failed to save function", http.StatusInternalServerError)
+			}
+			return
+		}
+		log.Printf("Function %s defined by user %d", fn.Name, userID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(fn)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (app *OrchestratorApp) FunctionByNameHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		log.Println("FunctionByNameHandler: Failed to get userID from context")
+		app.jsonErrorResponse(w, "Internal server error (userID missing in context)", http.StatusInternalServerError)
+		return
+	}
+
+	name := r.URL.Path[len("/api/v1/functions/"):]
+	if name == "" {
+		app.jsonErrorResponse(w, "Function name is missing in path", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		fn, exists := app.FunctionStore.GetFunction(name, userID)
+		if !exists {
+			app.jsonErrorResponse(w, "Function not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(fn)
+
+	case http.MethodPut:
+		var request FunctionRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			app.jsonErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		def, err := app.validateFunction(userID, request.Definition)
+		if err != nil {
+			app.jsonErrorResponse(w, "Function is not valid: "+err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if def.Name != name {
+			app.jsonErrorResponse(w, "Function name in definition does not match the path", http.StatusBadRequest)
+			return
+		}
+		fn := internal.Function{Name: name, UserID: userID, Definition: strings.TrimSpace(request.Definition)}
+		if err := app.FunctionStore.UpdateFunction(fn); err != nil {
+			if errors.Is(err, store.ErrFunctionNotFound) {
+				app.jsonErrorResponse(w, "Function not found", http.StatusNotFound)
+			} else {
+				app.jsonErrorResponse(w, "Failed to save function", http.StatusInternalServerError)
+			}
+			return
+		}
+		log.Printf("Function %s redefined by user %d", name, userID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(fn)
+
+	case http.MethodDelete:
+		if dependents := app.functionDependents(userID, name); len(dependents) > 0 {
+			app.jsonErrorResponse(w, "Function is called by "+strings.Join(dependents, ", "), http.StatusConflict)
+			return
+		}
+		if err := app.FunctionStore.DeleteFunction(name, userID); err != nil {
+			if errors.Is(err, store.ErrFunctionNotFound) {
+				app.jsonErrorResponse(w, "Function not found", http.StatusNotFound)
+			} else {
+				app.jsonErrorResponse(w, "Failed to delete function", http.StatusInternalServerError)
+			}
+			return
+		}
+		log.Printf("Function %s deleted by user %d", name, userID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Only GET, PUT and DELETE methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validateFunction parses the definition and expands its body against the
+// user's other functions, so that unknown functions, recursion and
+// oversized bodies are rejected when the function is saved.
+func (app *OrchestratorApp) validateFunction(userID int64, text string) (*rpn.Definition, error) {
+	def, err := rpn.ParseDefinition(text)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := rpn.Expand(def.Body, app.functionLookup(userID, def)); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// functionDependents lists the other functions of the user that call the
+// named one, which would stop working without it.
+func (app *OrchestratorApp) functionDependents(userID int64, name string) []string {
+	var dependents []string
+	for _, fn := range app.FunctionStore.GetAllFunctions(userID) {
+		if fn.Name == name {
+			continue
+		}
+		if def, err := rpn.ParseDefinition(fn.Definition); err == nil && def.Calls(name) {
+			dependents = append(dependents, fn.Name)
+		}
+	}
+	return dependents
+}
+
+// functionLookup resolves the user's stored functions, parsing each one at
+// most once. override takes the place of the stored function with its name.
+func (app *OrchestratorApp) functionLookup(userID int64, override *rpn.Definition) rpn.FunctionLookup {
+	parsed := make(map[string]*rpn.Definition)
+	return func(name string) (*rpn.Definition, bool) {
+		if override != nil && name == override.Name {
+			return override, true
+		}
+		if def, exists := parsed[name]; exists {
+			return def, true
+		}
+		fn, exists := app.FunctionStore.GetFunction(name, userID)
+		if !exists {
+			return nil, false
+		}
+		def, err := rpn.ParseDefinition(fn.Definition)
+		if err != nil {
+			log.Printf("Stored function %s of user %d no longer parses: %v", name, userID, err)
+			return nil, false
+		}
+		parsed[name] = def
+		return def, true
+	}
 }
 
 func (app *OrchestratorApp) InternalTaskResultHandler(w http.ResponseWriter, r *http.Request) {
+	agentID, ok := r.Context().Value(middleware.AgentIDKey).(string)
+	if !ok {
+		log.Println("InternalTaskResultHandler: Failed to get agentID from context")
+		http.Error(w, "Internal server error (agentID missing in context)", http.StatusInternalServerError)
+		return
+	}
+
 	var resultData internal.TaskResult
 
 	if r.Header.Get("Content-Type") != "application/json" {
@@ -185,23 +975,98 @@ func (app *OrchestratorApp) InternalTaskResultHandler(w http.ResponseWriter, r *
 	}
 	defer r.Body.Close()
 
-	log.Printf("Received task result from agent: ID %s, Result %s", resultData.Id, resultData.Result)
-	app.TaskStore.TasksResStore.AddTaskRes(resultData)
+	applied, err := app.TaskStore.AcceptResult(resultData, agentID)
+	if err != nil {
+		log.Printf("Rejected result for task %s from agent %s: %v", resultData.Id, agentID, err)
+		if errors.Is(err, store.ErrResultConflict) {
+			http.Error(w, "Task already has a different result", http.StatusConflict)
+		} else {
+			http.Error(w, "Task is not held by this agent", http.StatusForbidden)
+		}
+		return
+	}
+	if !applied {
+		log.Printf("Duplicate result for task %s from agent %s acknowledged", resultData.Id, agentID)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	log.Printf("Received task result from agent %s: ID %s, Result %s", agentID, resultData.Id, resultData.Result)
+
+	app.completeTask(resultData)
+	w.WriteHeader(http.StatusOK)
+}
 
-	err := app.ExpressionStore.UpdateExpressionStatusResult(resultData.Id, "calculated", resultData.Result)
+// completeTask updates the expressions waiting for the task; those it
+// finishes are reported by expressionFinished. It is called for results
+// from agents and for tasks the task store completes itself.
+func (app *OrchestratorApp) completeTask(result internal.TaskResult) {
+	app.publishTask(internal.Task{Id: result.Id}, "done", result.Result, "")
+	err := app.ExpressionStore.UpdateExpressionStatusResult(result.Id, "calculated", result.Result)
 	if err != nil {
-		log.Printf("Could not update expression status for ID %s, perhaps it's an intermediate task or DB error.", resultData.Id)
+		log.Printf("Could not update expression status for ID %s, perhaps it's an intermediate task or DB error.", result.Id)
 	} else {
-		log.Printf("Expression with ID %s (assumed final task) updated to 'calculated' with result '%s'", resultData.Id, resultData.Result)
+		log.Printf("Expression with ID %s (assumed final task) updated to 'calculated' with result '%s'", result.Id, result.Result)
+	}
+	if err := app.ExpressionStore.RecordTaskResult(result.Id, result.Result); err != nil {
+		log.Printf("Could not record result of task %s for scripts: %v", result.Id, err)
+	}
+}
+
+func (app *OrchestratorApp) InternalTaskReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	agentID, ok := r.Context().Value(middleware.AgentIDKey).(string)
+	if !ok {
+		log.Println("InternalTaskReleaseHandler: Failed to get agentID from context")
+		http.Error(w, "Internal server error (agentID missing in context)", http.StatusInternalServerError)
+		return
 	}
 
+	var released internal.TaskResult
+	if err := json.NewDecoder(r.Body).Decode(&released); err != nil {
+		http.Error(w, "Invalid input: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	defer r.Body.Close()
+
+	if err := app.TaskStore.ReleaseTask(released.Id, agentID); err != nil {
+		log.Printf("Agent %s could not release task %s: %v", agentID, released.Id, err)
+		http.Error(w, "Task is not held by this agent", http.StatusForbidden)
+		return
+	}
+	log.Printf("Agent %s released task %s back to the queue", agentID, released.Id)
+	app.publishTask(internal.Task{Id: released.Id}, "waiting", "", agentID)
 	w.WriteHeader(http.StatusOK)
 }
 
+// maxAgentWorkers bounds the workers an agent may report, so one agent
+// cannot make the estimates assume any capacity.
+const maxAgentWorkers = 256
+
 func (app *OrchestratorApp) GetInternalTaskHandler(w http.ResponseWriter, r *http.Request) {
-	task, exists := app.TaskStore.GetFirstCorrectTask()
+	agentID, ok := r.Context().Value(middleware.AgentIDKey).(string)
+	if !ok {
+		log.Println("GetInternalTaskHandler: Failed to get agentID from context")
+		http.Error(w, "Internal server error (agentID missing in context)", http.StatusInternalServerError)
+		return
+	}
+
+	var supported []string
+	if ops := r.URL.Query().Get("operations"); ops != "" {
+		supported = strings.Split(ops, ",")
+	}
+
+	// agents that do not report their workers compute one task at a time
+	workers, err := strconv.Atoi(r.URL.Query().Get("workers"))
+	if err != nil || workers < 1 {
+		workers = 1
+	}
+	workers = min(workers, maxAgentWorkers)
+	app.TaskStore.ReportWorkers(agentID, workers)
+
+	task, exists := app.TaskStore.LeaseTask(agentID, supported)
 	if exists {
-		log.Println("Agent asked for task, sending task ID: " + task.Id)
+		log.Println("Agent " + agentID + " asked for task, sending task ID: " + task.Id)
+		app.publishTask(task, "running", "", agentID)
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
 		json.NewEncoder(w).Encode(task)
@@ -211,6 +1076,175 @@ func (app *OrchestratorApp) GetInternalTaskHandler(w http.ResponseWriter, r *htt
 	w.WriteHeader(http.StatusNotFound)
 }
 
+func (app *OrchestratorApp) CacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if app.ResultCache == nil {
+		app.jsonErrorResponse(w, "Result cache is disabled", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(app.ResultCache.Stats())
+}
+
+// maxSymbolicPoints limits how many expressions one symbolic request may
+// submit.
+const maxSymbolicPoints = 100
+
+func (app *OrchestratorApp) DeriveHandler(w http.ResponseWriter, r *http.Request) {
+	app.symbolicHandler(w, r, func(root *rpn.Node, request SymbolicRequest) (*rpn.Node, error) {
+		variable := request.Variable
+		if variable == "" {
+			variable = "x"
+		}
+		return symbolic.Derive(root, variable)
+	})
+}
+
+func (app *OrchestratorApp) SimplifyHandler(w http.ResponseWriter, r *http.Request) {
+	app.symbolicHandler(w, r, func(root *rpn.Node, request SymbolicRequest) (*rpn.Node, error) {
+		return root, nil
+	})
+}
+
+// symbolicHandler transforms the expression, simplifies the result and
+// submits it for evaluation at every requested point.
+func (app *OrchestratorApp) symbolicHandler(w http.ResponseWriter, r *http.Request, transform func(*rpn.Node, SymbolicRequest) (*rpn.Node, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		log.Println("symbolicHandler: Failed to get userID from context")
+		app.jsonErrorResponse(w, "Internal server error (userID missing in context)", http.StatusInternalServerError)
+		return
+	}
+
+	var request SymbolicRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		app.jsonErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if request.Expression == "" {
+		app.jsonErrorResponse(w, "Expression is empty", http.StatusBadRequest)
+		return
+	}
+	if len(request.Points) > maxSymbolicPoints {
+		app.jsonErrorResponse(w, "Too many points, the limit is "+strconv.Itoa(maxSymbolicPoints), http.StatusUnprocessableEntity)
+		return
+	}
+	if rpn.IsScript(request.Expression) {
+		app.jsonErrorResponse(w, "Expression is not valid: scripts are not supported", http.StatusUnprocessableEntity)
+		return
+	}
+
+	root, err := rpn.Parse(request.Expression)
+	if err == nil {
+		root, err = rpn.Expand(root, app.functionLookup(userID, nil))
+	}
+	if err == nil {
+		root, err = transform(root, request)
+	}
+	if err != nil {
+		app.jsonErrorResponse(w, "Expression is not valid: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	result := symbolic.Simplify(root)
+	response := SymbolicResponse{Result: symbolic.Format(result)}
+
+	points := request.Points
+	if request.Submit && len(points) == 0 {
+		points = []map[string]float64{nil}
+	}
+	for _, point := range points {
+		evaluation := SymbolicEvaluation{Point: point}
+		evaluation.Id, err = app.submitTree(userID, symbolic.Substitute(result, point))
+		if err != nil {
+			evaluation.Error = err.Error()
+		}
+		response.Expressions = append(response.Expressions, evaluation)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
+
+// submitTree plans the tree and saves it as an expression of the user.
+// A tree that needs no computation is saved as calculated right away.
+func (app *OrchestratorApp) submitTree(userID int64, root *rpn.Node) (string, error) {
+	expressionID, stats, err := rpn.PlanWithStats(root, app.TaskStore)
+	if err != nil {
+		return "", err
+	}
+	expression := symbolic.Format(root)
+	if !operations.IsNumber(expressionID) {
+		return expressionID, app.addExpression(userID, expression, expressionID, stats, "")
+	}
+	newExpr := app.literalExpression(userID, expression, expressionID, stats)
+	return newExpr.ID, app.addCalculated(newExpr)
+}
+
+// literalExpression is an expression planned down to a number, e.g.
+// sum(7), which needs no task. The number is its result, not its ID, so
+// equal literals of different users do not collide.
+func (app *OrchestratorApp) literalExpression(userID int64, expression, literal string, stats rpn.PlanStats) internal.Expression {
+	return internal.Expression{
+		ID:               "id" + strconv.Itoa(app.TaskStore.Counter.GetValueAndInc()),
+		UserID:           userID,
+		ExpressionString: expression,
+		Status:           "calculated",
+		Result:           literal,
+		Unit:             stats.Unit,
+		Metadata:         planMetadata(stats),
+	}
+}
+
+// addCalculated saves an expression that is calculated already and
+// reports it like any finished expression.
+func (app *OrchestratorApp) addCalculated(newExpr internal.Expression) error {
+	if err := app.ExpressionStore.AddExpression(newExpr); err != nil {
+		log.Printf("Failed to add expression %s to store for user %d: %v", newExpr.ID, newExpr.UserID, err)
+		return err
+	}
+	app.savedFinished(newExpr.UserID, newExpr.ID)
+	return nil
+}
+
+func (app *OrchestratorApp) AgentLoginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var creds AgentCredentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		app.jsonErrorResponse(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer r.Body.Close()
+
+	if creds.AgentID == "" || !auth.CheckAgentSecret(creds.Secret) {
+		log.Printf("Agent '%s' failed to authenticate", creds.AgentID)
+		app.jsonErrorResponse(w, "Invalid agent credentials", http.StatusUnauthorized)
+		return
+	}
+
+	tokenString, err := auth.GenerateAgentToken(creds.AgentID)
+	if err != nil {
+		log.Printf("Error generating token for agent '%s': %v", creds.AgentID, err)
+		app.jsonErrorResponse(w, "Agent login failed (token generation)", http.StatusInternalServerError)
+		return
+	}
+
+	log.Printf("Agent '%s' authenticated", creds.AgentID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(TokenResponse{Token: tokenString})
+}
+
 func (app *OrchestratorApp) jsonErrorResponse(w http.ResponseWriter, message string, statusCode int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(statusCode)
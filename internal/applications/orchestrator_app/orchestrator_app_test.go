@@ -1,21 +1,36 @@
 package orchestrator_app_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/katierevinska/calculatorService/internal"
 	orchestratorApp "github.com/katierevinska/calculatorService/internal/applications/orchestrator_app"
 	"github.com/katierevinska/calculatorService/internal/auth"
 	"github.com/katierevinska/calculatorService/internal/database"
+	"github.com/katierevinska/calculatorService/internal/events"
 	"github.com/katierevinska/calculatorService/internal/middleware"
 	"github.com/katierevinska/calculatorService/internal/models"
 	store "github.com/katierevinska/calculatorService/internal/store"
+	"github.com/katierevinska/calculatorService/internal/webhooks"
+	"github.com/katierevinska/calculatorService/pkg/operations"
+	"github.com/katierevinska/calculatorService/pkg/rpn"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -35,9 +50,12 @@ func setupTestApp(t *testing.T) func() {
 	os.Setenv("TIME_MULTIPLICATIONS_MS", "20")
 	os.Setenv("TIME_DIVISIONS_MS", "20")
 	os.Setenv("JWT_SECRET", "testsecretforserver")
+	os.Setenv("AGENT_SECRET", "testagentsecret")
 
 	err := auth.InitJWT()
 	require.NoError(t, err, "Failed to init JWT")
+	err = auth.InitAgentAuth()
+	require.NoError(t, err, "Failed to init agent auth")
 
 	db, err := database.InitDB(":memory:")
 	require.NoError(t, err, "Failed to initialize test database")
@@ -71,11 +89,65 @@ func setupTestApp(t *testing.T) func() {
 	testUserID = claims.UserID
 
 	return func() {
+		if testApp.ResultCache != nil {
+			testApp.ResultCache.Close()
+		}
 		testDB.Close()
 		os.Unsetenv("JWT_SECRET")
+		os.Unsetenv("AGENT_SECRET")
 	}
 }
 
+func agentToken(t *testing.T, agentID string) string {
+	t.Helper()
+	body, _ := json.Marshal(orchestratorApp.AgentCredentials{AgentID: agentID, Secret: "testagentsecret"})
+	req := httptest.NewRequest(http.MethodPost, "/internal/agent/login", bytes.NewBuffer(body))
+	rec := httptest.NewRecorder()
+	testApp.AgentLoginHandler(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code, "Agent login failed")
+
+	var tokenResp orchestratorApp.TokenResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&tokenResp))
+	require.NotEmpty(t, tokenResp.Token)
+	return tokenResp.Token
+}
+
+// userRequest builds a request of the test user with the body, unless nil,
+// as JSON.
+func userRequest(method, target string, body any) *http.Request {
+	var reqBody []byte
+	if body != nil {
+		reqBody, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, target, bytes.NewBuffer(reqBody))
+	req.Header.Set("Authorization", "Bearer "+testUserToken)
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+// serve passes a request of the test user through the user authentication
+// to the handler.
+func serve(handler http.HandlerFunc, method, target string, body any) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	middleware.AuthMiddleware(handler).ServeHTTP(w, userRequest(method, target, body))
+	return w
+}
+
+// calculate submits the expression; query is appended to the URL.
+func calculate(query, expression string) *httptest.ResponseRecorder {
+	return serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate"+query, orchestratorApp.ExpressionRequest{Expression: expression})
+}
+
+// mustCalculate submits the expression and returns the ID it is saved under.
+func mustCalculate(t *testing.T, expression string) string {
+	t.Helper()
+	w := calculate("", expression)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created orchestratorApp.SuccessResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	return created.Id
+}
+
 func TestOrchestratorApp_AuthHandlers(t *testing.T) {
 	teardown := setupTestApp(t)
 	defer teardown()
@@ -189,6 +261,188 @@ func TestOrchestratorApp_CalculatorHandler(t *testing.T) {
 	}
 }
 
+func TestOrchestratorApp_CalculatorHandlerReportsDeduplication(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	reqBody, _ := json.Marshal(orchestratorApp.ExpressionRequest{Expression: "(1+2)*(1+2)+(1+2)"})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewBuffer(reqBody))
+	req.Header.Set("Authorization", "Bearer "+testUserToken)
+	w := httptest.NewRecorder()
+	middleware.AuthMiddleware(http.HandlerFunc(testApp.CalculatorHandler)).ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+
+	var created orchestratorApp.SuccessResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	assert.Len(t, testApp.TaskStore.GetTasks(), 3)
+
+	expr, exists := testApp.ExpressionStore.GetExpression(created.Id, testUserID)
+	require.True(t, exists)
+	require.NotNil(t, expr.Metadata)
+	assert.Equal(t, 5, expr.Metadata.Operations)
+	assert.Equal(t, 3, expr.Metadata.Tasks)
+	assert.InDelta(t, 0.4, expr.Metadata.DedupRatio, 1e-9)
+}
+
+func TestOrchestratorApp_CalculatorHandlerAcceptsNumbers(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	w := serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: "sum(numbers) * 2", Numbers: []float64{1, 2, 3, 4}})
+	require.Equal(t, http.StatusCreated, w.Code)
+	assert.Len(t, testApp.TaskStore.GetTasks(), 4, "Three additions and the multiplication")
+
+	w = serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: "sum(numbers)", Numbers: make([]float64, rpn.MaxListLength+1)})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+
+	w = serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: "sum(numbers)"})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code, "numbers is unknown without the array")
+}
+
+func TestOrchestratorApp_CalculatorHandlerUnits(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	w := calculate("", "1 km + 500 m")
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created orchestratorApp.SuccessResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	expr, exists := testApp.ExpressionStore.GetExpression(created.Id, testUserID)
+	require.True(t, exists)
+	assert.Equal(t, "km", expr.Unit)
+
+	w = calculate("", "1 m + 1 kg")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "cannot add m and kg")
+}
+
+func TestOrchestratorApp_CalculatorHandlerIntegerMode(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	w := serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: "30!", Mode: "integer"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created orchestratorApp.SuccessResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	expr, exists := testApp.ExpressionStore.GetExpression(created.Id, testUserID)
+	require.True(t, exists)
+	require.NotNil(t, expr.Metadata)
+	assert.Equal(t, "integer", expr.Metadata.Mode)
+	task, ok := testApp.TaskStore.LeaseTask("agent", nil)
+	require.True(t, ok)
+	assert.True(t, task.Integer)
+	assert.Equal(t, "factorial", task.Operation)
+
+	w = serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: "2.5 * 2", Mode: "integer"})
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "convert it with int(2.5)")
+
+	w = serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: "1 + 1", Mode: "rational"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestOrchestratorApp_CalculatorHandlerEstimate(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	w := calculate("", "(1+2)*(3+4)")
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created orchestratorApp.SuccessResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	require.NotNil(t, created.Estimate)
+	assert.Equal(t, orchestratorApp.Estimate{WorkMs: 40, CriticalPathMs: 30, TotalMs: 40}, *created.Estimate,
+		"Without agents the estimate assumes one worker")
+
+	req := httptest.NewRequest(http.MethodGet, "/internal/task/new?workers=4", nil)
+	req.Header.Set("Authorization", "Bearer "+agentToken(t, "agent-a"))
+	w = httptest.NewRecorder()
+	middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.GetInternalTaskHandler)).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = calculate("", "5*6")
+	require.Equal(t, http.StatusCreated, w.Code)
+	created = orchestratorApp.SuccessResponse{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	require.NotNil(t, created.Estimate)
+	assert.Equal(t, orchestratorApp.Estimate{WorkMs: 20, CriticalPathMs: 20, QueuedTasks: 3, QueueMs: 10, Workers: 4, TotalMs: 30}, *created.Estimate)
+
+	testApp.MaxEstimate = 30 * time.Millisecond
+	w = calculate("", "5*7")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	assert.Contains(t, w.Body.String(), "estimated to take 35 ms, the limit is 30 ms")
+	assert.Equal(t, 4, testApp.TaskStore.Load().QueuedTasks, "Rejected expressions are not planned")
+
+	req = httptest.NewRequest(http.MethodGet, "/internal/task/new?workers=1000000", nil)
+	req.Header.Set("Authorization", "Bearer "+agentToken(t, "agent-a"))
+	w = httptest.NewRecorder()
+	middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.GetInternalTaskHandler)).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, 256, testApp.TaskStore.Load().Workers, "Reported workers are bounded")
+}
+
+func TestOrchestratorApp_CalculatorHandlerWait(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	assert.Equal(t, http.StatusBadRequest, calculate("?wait=soon", "2+3").Code)
+	assert.Equal(t, http.StatusBadRequest, calculate("?wait=-1s", "2+3").Code)
+
+	w := calculate("?wait=50ms", "2+3")
+	require.Equal(t, http.StatusAccepted, w.Code, "The ID is returned once the wait runs out")
+	var pending orchestratorApp.SuccessResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&pending))
+	assert.NotEmpty(t, pending.Id)
+	assert.Equal(t, "in progress", pending.Status)
+
+	agent := agentToken(t, "agent-a")
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- calculate("?wait=5s", "4*5") }()
+	var task internal.Task
+	require.Eventually(t, func() bool {
+		var ok bool
+		task, ok = testApp.TaskStore.LeaseTask("agent-a", []string{"*"})
+		return ok
+	}, 5*time.Second, 5*time.Millisecond)
+	body, _ := json.Marshal(internal.TaskResult{Id: task.Id, Result: "20.0000000000"})
+	req := httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+agent)
+	w = httptest.NewRecorder()
+	middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.InternalTaskResultHandler)).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	w = <-done
+	require.Equal(t, http.StatusOK, w.Code, "The whole expression is returned once calculated")
+	var expression internal.Expression
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&expression))
+	assert.Equal(t, "calculated", expression.Status)
+	assert.Equal(t, "20.0000000000", expression.Result)
+
+	w = calculate("?wait=1s", "a = 7; a")
+	require.Equal(t, http.StatusOK, w.Code, "Scripts computed while planning are returned at once")
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&expression))
+	assert.Equal(t, "7", expression.Result)
+
+	w = calculate("?wait=1s", "sum(7)")
+	require.Equal(t, http.StatusOK, w.Code, "Expressions planned down to a number are returned at once")
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&expression))
+	assert.Equal(t, "calculated", expression.Status)
+	assert.Equal(t, "7", expression.Result)
+	assert.True(t, strings.HasPrefix(expression.ID, "id"), "The number is the result, not the ID")
+
+	var ids []string
+	for range 2 {
+		w = calculate("", "if(1, 5, 6)")
+		require.Equal(t, http.StatusCreated, w.Code, "Equal numbers do not collide")
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&pending))
+		ids = append(ids, pending.Id)
+	}
+	assert.NotEqual(t, ids[0], ids[1])
+	saved, exists := testApp.ExpressionStore.GetExpression(ids[1], testUserID)
+	require.True(t, exists)
+	assert.Equal(t, "5", saved.Result)
+}
+
 func TestOrchestratorApp_InternalTaskHandlers(t *testing.T) {
 	teardown := setupTestApp(t)
 	defer teardown()
@@ -205,10 +459,31 @@ func TestOrchestratorApp_InternalTaskHandlers(t *testing.T) {
 	json.NewDecoder(calcRec.Body).Decode(&successResp)
 	expressionID := successResp.Id
 
+	getTaskAuth := middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.GetInternalTaskHandler))
+	postResultAuth := middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.InternalTaskResultHandler))
+	agentTokenA := agentToken(t, "agent-a")
+	agentTokenB := agentToken(t, "agent-b")
+
+	t.Run("GetInternalTaskHandler - unauthenticated agent", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/internal/task/new", nil)
+		w := httptest.NewRecorder()
+		getTaskAuth.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
+	t.Run("GetInternalTaskHandler - user token is not an agent token", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/internal/task/new", nil)
+		req.Header.Set("Authorization", "Bearer "+testUserToken)
+		w := httptest.NewRecorder()
+		getTaskAuth.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+	})
+
 	t.Run("GetInternalTaskHandler - task available", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/internal/task/new", nil)
+		req.Header.Set("Authorization", "Bearer "+agentTokenA)
 		w := httptest.NewRecorder()
-		testApp.GetInternalTaskHandler(w, req)
+		getTaskAuth.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusOK, w.Code)
 		var task internal.Task
@@ -220,14 +495,30 @@ func TestOrchestratorApp_InternalTaskHandlers(t *testing.T) {
 		assert.Equal(t, "+", task.Operation)
 	})
 
+	t.Run("InternalTaskResultHandler - result from agent not holding the task", func(t *testing.T) {
+		resultData := internal.TaskResult{Id: expressionID, Result: "666"}
+		body, _ := json.Marshal(resultData)
+
+		req := httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+agentTokenB)
+		w := httptest.NewRecorder()
+		postResultAuth.ServeHTTP(w, req)
+
+		assert.Equal(t, http.StatusForbidden, w.Code)
+		_, exists := testApp.TaskStore.TasksResStore.GetTaskRes(expressionID)
+		assert.False(t, exists, "Result from foreign agent must not be stored")
+	})
+
 	t.Run("InternalTaskResultHandler - valid result", func(t *testing.T) {
 		resultData := internal.TaskResult{Id: expressionID, Result: "10.0000000000"}
 		body, _ := json.Marshal(resultData)
 
 		req := httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body))
 		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+agentTokenA)
 		w := httptest.NewRecorder()
-		testApp.InternalTaskResultHandler(w, req)
+		postResultAuth.ServeHTTP(w, req)
 
 		assert.Equal(t, http.StatusOK, w.Code)
 
@@ -240,14 +531,82 @@ func TestOrchestratorApp_InternalTaskHandlers(t *testing.T) {
 		assert.Equal(t, "10.0000000000", expr.Result)
 	})
 
+	t.Run("InternalTaskResultHandler - retried result is idempotent", func(t *testing.T) {
+		resultData := internal.TaskResult{Id: expressionID, Result: "10.0000000000"}
+		body, _ := json.Marshal(resultData)
+
+		req := httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+agentTokenA)
+		w := httptest.NewRecorder()
+		postResultAuth.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusOK, w.Code)
+
+		conflicting, _ := json.Marshal(internal.TaskResult{Id: expressionID, Result: "11"})
+		req = httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(conflicting))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+agentTokenA)
+		w = httptest.NewRecorder()
+		postResultAuth.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		expr, _ := testApp.ExpressionStore.GetExpression(expressionID, testUserID)
+		assert.Equal(t, "10.0000000000", expr.Result)
+	})
+
+	t.Run("GetInternalTaskHandler - agent does not support the operation", func(t *testing.T) {
+		testApp.TaskStore.AddTask(internal.Task{Id: "pow-task", Arg1: "2", Arg2: "8", Operation: "^"})
+
+		req := httptest.NewRequest(http.MethodGet, "/internal/task/new?operations=%2B,-", nil)
+		req.Header.Set("Authorization", "Bearer "+agentTokenA)
+		w := httptest.NewRecorder()
+		getTaskAuth.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		req = httptest.NewRequest(http.MethodGet, "/internal/task/new?operations=%5E", nil)
+		req.Header.Set("Authorization", "Bearer "+agentTokenA)
+		w = httptest.NewRecorder()
+		getTaskAuth.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var task internal.Task
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&task))
+		assert.Equal(t, "pow-task", task.Id)
+	})
+
 	t.Run("GetInternalTaskHandler - no tasks available", func(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "/internal/task/new", nil)
+		req.Header.Set("Authorization", "Bearer "+agentTokenA)
 		w := httptest.NewRecorder()
-		testApp.GetInternalTaskHandler(w, req)
+		getTaskAuth.ServeHTTP(w, req)
 		assert.Equal(t, http.StatusNotFound, w.Code)
 	})
 }
 
+func TestOrchestratorApp_AgentLoginHandler(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	tests := []struct {
+		name           string
+		creds          orchestratorApp.AgentCredentials
+		expectedStatus int
+	}{
+		{"Valid secret", orchestratorApp.AgentCredentials{AgentID: "agent-1", Secret: "testagentsecret"}, http.StatusOK},
+		{"Wrong secret", orchestratorApp.AgentCredentials{AgentID: "agent-1", Secret: "wrong"}, http.StatusUnauthorized},
+		{"Missing agent ID", orchestratorApp.AgentCredentials{Secret: "testagentsecret"}, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body, _ := json.Marshal(tt.creds)
+			req := httptest.NewRequest(http.MethodPost, "/internal/agent/login", bytes.NewBuffer(body))
+			rr := httptest.NewRecorder()
+			testApp.AgentLoginHandler(rr, req)
+			assert.Equal(t, tt.expectedStatus, rr.Code)
+		})
+	}
+}
+
 func TestOrchestratorApp_GetExpressionsHandlers(t *testing.T) {
 	teardown := setupTestApp(t)
 	defer teardown()
@@ -278,10 +637,49 @@ func TestOrchestratorApp_GetExpressionsHandlers(t *testing.T) {
 		getExpressionsAuth.ServeHTTP(w, req)
 		assert.Equal(t, http.StatusOK, w.Code)
 
-		var expressions []internal.Expression
-		err := json.NewDecoder(w.Body).Decode(&expressions)
+		var page store.ExpressionPage
+		err := json.NewDecoder(w.Body).Decode(&page)
 		require.NoError(t, err)
-		assert.Len(t, expressions, 2, "Should only retrieve expressions for the authenticated user")
+		assert.Len(t, page.Expressions, 2, "Should only retrieve expressions for the authenticated user")
+		assert.Equal(t, 2, page.Total)
+		assert.Empty(t, page.NextCursor)
+	})
+
+	t.Run("GetExpressionsHandler - pages and filters", func(t *testing.T) {
+		get := func(target string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, target, nil)
+			req.Header.Set("Authorization", "Bearer "+testUserToken)
+			w := httptest.NewRecorder()
+			getExpressionsAuth.ServeHTTP(w, req)
+			return w
+		}
+
+		w := get("/api/v1/expressions?limit=1&sort=created_at")
+		require.Equal(t, http.StatusOK, w.Code)
+		var page store.ExpressionPage
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+		require.Len(t, page.Expressions, 1)
+		assert.Equal(t, expr1.ID, page.Expressions[0].ID)
+		assert.Equal(t, 2, page.Total)
+		require.NotEmpty(t, page.NextCursor)
+
+		w = get("/api/v1/expressions?limit=1&sort=created_at&cursor=" + page.NextCursor)
+		require.Equal(t, http.StatusOK, w.Code)
+		page = store.ExpressionPage{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+		require.Len(t, page.Expressions, 1)
+		assert.Equal(t, expr2.ID, page.Expressions[0].ID)
+		assert.Empty(t, page.NextCursor)
+
+		w = get("/api/v1/expressions?status=" + url.QueryEscape("in progress"))
+		page = store.ExpressionPage{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&page))
+		assert.Equal(t, 1, page.Total)
+
+		assert.Equal(t, http.StatusBadRequest, get("/api/v1/expressions?limit=0").Code)
+		assert.Equal(t, http.StatusBadRequest, get("/api/v1/expressions?sort=result").Code)
+		assert.Equal(t, http.StatusBadRequest, get("/api/v1/expressions?cursor=abc").Code)
+		assert.Equal(t, http.StatusBadRequest, get("/api/v1/expressions?created_after=yesterday").Code)
 	})
 
 	t.Run("GetExpressionByIdHandler - successfully retrieves specific expression", func(t *testing.T) {
@@ -316,6 +714,729 @@ func TestOrchestratorApp_GetExpressionsHandlers(t *testing.T) {
 	})
 }
 
+func TestOrchestratorApp_ExpressionTasksAndExplain(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	get := func(handler http.HandlerFunc, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer "+testUserToken)
+		w := httptest.NewRecorder()
+		middleware.AuthMiddleware(handler).ServeHTTP(w, req)
+		return w
+	}
+
+	reqBody, _ := json.Marshal(orchestratorApp.ExpressionRequest{Expression: "2+3*4"})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewBuffer(reqBody))
+	req.Header.Set("Authorization", "Bearer "+testUserToken)
+	w := httptest.NewRecorder()
+	middleware.AuthMiddleware(http.HandlerFunc(testApp.CalculatorHandler)).ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created orchestratorApp.SuccessResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+
+	for {
+		task, ok := testApp.TaskStore.LeaseTask("agent-a", nil)
+		if !ok {
+			break
+		}
+		value, err := operations.Default.Evaluate(task.Operation, []string{task.Arg1, task.Arg2})
+		require.NoError(t, err)
+		_, err = testApp.TaskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: operations.FormatResult(value)}, "agent-a")
+		require.NoError(t, err)
+	}
+
+	w = get(testApp.GetExpressionByIdHandler, "/api/v1/expressions/"+created.Id+"/tasks")
+	require.Equal(t, http.StatusOK, w.Code)
+	var tasks orchestratorApp.ExpressionTasksResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&tasks))
+	require.Len(t, tasks.Tasks, 2)
+	assert.Equal(t, "*", tasks.Tasks[0].Operation)
+	assert.Equal(t, created.Id, tasks.Tasks[1].ID)
+	assert.Equal(t, []string{"2", "12.0000000000"}, tasks.Tasks[1].Values)
+	assert.Equal(t, "14.0000000000", tasks.Tasks[1].Result)
+	assert.Equal(t, "agent-a", tasks.Tasks[1].AgentID)
+
+	w = get(testApp.GetExpressionByIdHandler, "/api/v1/expressions/nonexistent-id/tasks")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	w = get(testApp.ExplainHandler, "/api/v1/explain?expression="+url.QueryEscape("(1+2)*(3+4)"))
+	require.Equal(t, http.StatusOK, w.Code)
+	var explained orchestratorApp.ExplainResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&explained))
+	assert.Len(t, explained.Tasks, 3)
+	assert.Equal(t, []string{"id3"}, explained.Results)
+	assert.Equal(t, []string{"id1", "id3"}, explained.CriticalPath)
+	assert.Equal(t, 30.0, explained.CriticalPathMs)
+	assert.Equal(t, 3, explained.Metadata.Operations)
+	_, queued := testApp.TaskStore.LeaseTask("agent-a", nil)
+	assert.False(t, queued, "Explained expressions are not computed")
+
+	w = get(testApp.ExplainHandler, "/api/v1/explain?expression="+url.QueryEscape("1 +"))
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	w = get(testApp.ExplainHandler, "/api/v1/explain")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+// readServerEvent reads one Server-Sent Event.
+func readServerEvent(t *testing.T, r *bufio.Reader) (string, events.Event) {
+	t.Helper()
+	var name string
+	var event events.Event
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			return name, event
+		case strings.HasPrefix(line, "event: "):
+			name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+		}
+	}
+}
+
+// readWebSocketEvent reads one event sent as an unmasked text frame.
+func readWebSocketEvent(t *testing.T, r *bufio.Reader) events.Event {
+	t.Helper()
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	require.NoError(t, err)
+	require.Equal(t, byte(0x81), header[0], "Events are sent as text frames")
+	length := int(header[1])
+	if length == 126 {
+		var extended [2]byte
+		_, err := io.ReadFull(r, extended[:])
+		require.NoError(t, err)
+		length = int(binary.BigEndian.Uint16(extended[:]))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	var event events.Event
+	require.NoError(t, json.Unmarshal(payload, &event))
+	return event
+}
+
+func TestOrchestratorApp_ExpressionEvents(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	mux := http.NewServeMux()
+	mux.Handle("/api/v1/expressions/", middleware.AuthMiddleware(http.HandlerFunc(testApp.GetExpressionByIdHandler)))
+	mux.Handle("/api/v1/ws", middleware.AuthMiddleware(http.HandlerFunc(testApp.WebSocketHandler)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	reqBody, _ := json.Marshal(orchestratorApp.ExpressionRequest{Expression: "2+3"})
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/calculate", bytes.NewBuffer(reqBody))
+	req.Header.Set("Authorization", "Bearer "+testUserToken)
+	w := httptest.NewRecorder()
+	middleware.AuthMiddleware(http.HandlerFunc(testApp.CalculatorHandler)).ServeHTTP(w, req)
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created orchestratorApp.SuccessResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+
+	sseReq, _ := http.NewRequest(http.MethodGet, server.URL+"/api/v1/expressions/"+created.Id+"/events", nil)
+	sseReq.Header.Set("Authorization", "Bearer "+testUserToken)
+	sseResp, err := http.DefaultClient.Do(sseReq)
+	require.NoError(t, err)
+	defer sseResp.Body.Close()
+	assert.Equal(t, "text/event-stream", sseResp.Header.Get("Content-Type"))
+	sse := bufio.NewReader(sseResp.Body)
+	name, event := readServerEvent(t, sse)
+	assert.Equal(t, "expression", name)
+	assert.Equal(t, "in progress", event.Status, "The stream starts with the current status")
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET /api/v1/ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" +
+		"Authorization: Bearer " + testUserToken + "\r\n\r\n"))
+	ws := bufio.NewReader(conn)
+	handshake, err := http.ReadResponse(ws, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, handshake.StatusCode)
+
+	agent := agentToken(t, "agent-a")
+	req = httptest.NewRequest(http.MethodGet, "/internal/task/new", nil)
+	req.Header.Set("Authorization", "Bearer "+agent)
+	w = httptest.NewRecorder()
+	middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.GetInternalTaskHandler)).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	body, _ := json.Marshal(internal.TaskResult{Id: created.Id, Result: "5.0000000000"})
+	req = httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+agent)
+	w = httptest.NewRecorder()
+	middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.InternalTaskResultHandler)).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	expected := []events.Event{
+		{Type: events.TaskEvent, ExpressionID: created.Id, TaskID: created.Id, Operation: "+", Status: "running", AgentID: "agent-a"},
+		{Type: events.TaskEvent, ExpressionID: created.Id, TaskID: created.Id, Status: "done", Result: "5.0000000000"},
+		{Type: events.ExpressionEvent, ExpressionID: created.Id, Status: "calculated", Result: "5.0000000000"},
+	}
+	for _, want := range expected {
+		name, event := readServerEvent(t, sse)
+		assert.Equal(t, want.Type, name)
+		event.Time = time.Time{}
+		assert.Equal(t, want, event)
+
+		event = readWebSocketEvent(t, ws)
+		event.Time = time.Time{}
+		assert.Equal(t, want, event)
+	}
+	_, err = sse.ReadString('\n')
+	assert.Equal(t, io.EOF, err, "The stream ends once the expression is calculated")
+
+	sseReq, _ = http.NewRequest(http.MethodGet, server.URL+"/api/v1/expressions/id999/events", nil)
+	sseReq.Header.Set("Authorization", "Bearer "+testUserToken)
+	missing, err := http.DefaultClient.Do(sseReq)
+	require.NoError(t, err)
+	missing.Body.Close()
+	assert.Equal(t, http.StatusNotFound, missing.StatusCode)
+}
+
+func TestOrchestratorApp_WebSocketWatchesExpressionsInProgress(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	id := mustCalculate(t, "2+3")
+	server := httptest.NewServer(middleware.AuthMiddleware(http.HandlerFunc(testApp.WebSocketHandler)))
+	defer server.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET /api/v1/ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" +
+		"Authorization: Bearer " + testUserToken + "\r\n\r\n"))
+	ws := bufio.NewReader(conn)
+	handshake, err := http.ReadResponse(ws, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, handshake.StatusCode)
+
+	req := httptest.NewRequest(http.MethodGet, "/internal/task/new", nil)
+	req.Header.Set("Authorization", "Bearer "+agentToken(t, "agent-a"))
+	w := httptest.NewRecorder()
+	middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.GetInternalTaskHandler)).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	event := readWebSocketEvent(t, ws)
+	assert.Equal(t, events.TaskEvent, event.Type, "Expressions submitted before connecting are watched too")
+	assert.Equal(t, id, event.ExpressionID)
+	assert.Equal(t, "running", event.Status)
+}
+
+func TestOrchestratorApp_WebSocketAuth(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+	testApp.WebSocketOrigins = []string{"https://app.example.com"}
+
+	server := httptest.NewServer(middleware.WebSocketAuthMiddleware(http.HandlerFunc(testApp.WebSocketHandler)))
+	defer server.Close()
+	handshake := func(target, headers string) *http.Response {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		conn.Write([]byte("GET " + target + " HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" + headers + "\r\n"))
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		return resp
+	}
+
+	resp := handshake("/api/v1/ws", "Origin: https://app.example.com\r\nSec-WebSocket-Protocol: bearer, "+testUserToken+"\r\n")
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode, "Browsers send the token as a subprotocol")
+	assert.Equal(t, "bearer", resp.Header.Get("Sec-WebSocket-Protocol"))
+
+	resp = handshake("/api/v1/ws?token="+testUserToken, "")
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	resp = handshake("/api/v1/ws?token="+testUserToken, "Origin: https://evil.example.com\r\n")
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode, "Pages of other sites cannot connect")
+
+	resp = handshake("/api/v1/ws", "Authorization: Bearer "+testUserToken+"\r\n")
+	assert.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	resp = handshake("/api/v1/ws?token=invalid", "")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = handshake("/api/v1/ws", "Sec-WebSocket-Protocol: bearer\r\n")
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, "The token must follow the bearer subprotocol")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/expressions?token="+testUserToken, nil)
+	w := httptest.NewRecorder()
+	middleware.AuthMiddleware(http.HandlerFunc(testApp.GetExpressionsHandler)).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "Other routes only accept the Authorization header")
+}
+
+func TestOrchestratorApp_Webhooks(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	type delivery struct {
+		path, signature string
+		body            []byte
+	}
+	received := make(chan delivery, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- delivery{path: r.URL.Path, signature: r.Header.Get(webhooks.SignatureHeader), body: body}
+	}))
+	defer receiver.Close()
+	// the receiver listens on loopback
+	testApp.Webhooks.Client = webhooks.NewClient(5*time.Second, true)
+
+	w := serve(testApp.WebhooksHandler, http.MethodPost, "/api/v1/webhooks", orchestratorApp.WebhookRequest{URL: receiver.URL + "/default"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	var webhook internal.Webhook
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&webhook))
+	w = serve(testApp.WebhooksHandler, http.MethodPost, "/api/v1/webhooks", orchestratorApp.WebhookRequest{URL: "mailto:me@example.com"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = serve(testApp.WebhooksHandler, http.MethodGet, "/api/v1/webhooks", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var listed orchestratorApp.WebhooksResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&listed))
+	assert.Len(t, listed.Secret, 64)
+	assert.Len(t, listed.Webhooks, 1)
+
+	w = serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: "2+3", CallbackURL: "not a url"})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: "2+3", CallbackURL: receiver.URL + "/callback"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created orchestratorApp.SuccessResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+
+	agent := agentToken(t, "agent-a")
+	task, ok := testApp.TaskStore.LeaseTask("agent-a", nil)
+	require.True(t, ok)
+	body, _ := json.Marshal(internal.TaskResult{Id: task.Id, Result: "5.0000000000"})
+	req := httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+agent)
+	w = httptest.NewRecorder()
+	middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.InternalTaskResultHandler)).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	paths := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case d := <-received:
+			paths[d.path] = true
+			assert.Equal(t, webhooks.Sign(listed.Secret, d.body), d.signature, "Deliveries are signed with the secret of the user")
+			var payload webhooks.Payload
+			require.NoError(t, json.Unmarshal(d.body, &payload))
+			assert.Equal(t, webhooks.EventCompleted, payload.Event)
+			assert.Equal(t, created.Id, payload.Expression.ID)
+			assert.Equal(t, "5.0000000000", payload.Expression.Result)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Webhook was not delivered")
+		}
+	}
+	assert.Equal(t, map[string]bool{"/callback": true, "/default": true}, paths)
+
+	var deliveries []internal.WebhookDelivery
+	require.Eventually(t, func() bool {
+		w := serve(testApp.WebhookByIDHandler, http.MethodGet, "/api/v1/webhooks/deliveries?expression_id="+created.Id, nil)
+		deliveries = nil
+		json.NewDecoder(w.Body).Decode(&deliveries)
+		return len(deliveries) == 2
+	}, 5*time.Second, 10*time.Millisecond, "Delivery attempts are logged")
+	for _, d := range deliveries {
+		assert.True(t, d.Delivered)
+		assert.Equal(t, http.StatusOK, d.StatusCode)
+		assert.Equal(t, 1, d.Attempt)
+	}
+
+	// expressions are reported however they finish: saved calculated, or
+	// completed without being watched, e.g. after a restart
+	w = serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: "sum(7)", CallbackURL: receiver.URL + "/callback"})
+	require.Equal(t, http.StatusCreated, w.Code)
+	require.NoError(t, testApp.ExpressionStore.AddExpression(internal.Expression{ID: "restored", UserID: testUserID, ExpressionString: "1+1", Status: "in progress"}))
+	require.NoError(t, testApp.ExpressionStore.UpdateExpressionStatusResult("restored", "calculated", "2.0000000000"))
+	results := map[string]string{}
+	for i := 0; i < 3; i++ {
+		select {
+		case d := <-received:
+			var payload webhooks.Payload
+			require.NoError(t, json.Unmarshal(d.body, &payload))
+			results[d.path+" "+payload.Expression.ExpressionString] = payload.Expression.Result
+		case <-time.After(5 * time.Second):
+			t.Fatal("Webhook was not delivered")
+		}
+	}
+	assert.Equal(t, map[string]string{"/callback sum(7)": "7", "/default sum(7)": "7", "/default 1+1": "2.0000000000"}, results)
+
+	target := "/api/v1/webhooks/" + strconv.FormatInt(webhook.ID, 10)
+	assert.Equal(t, http.StatusNoContent, serve(testApp.WebhookByIDHandler, http.MethodDelete, target, nil).Code)
+	assert.Equal(t, http.StatusNotFound, serve(testApp.WebhookByIDHandler, http.MethodDelete, target, nil).Code)
+}
+
+func TestOrchestratorApp_IdempotencyKey(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	idempotent := middleware.IdempotencyMiddleware(testApp.IdempotencyStore, http.HandlerFunc(testApp.CalculatorHandler))
+	calculate := func(key string, expression string) *httptest.ResponseRecorder {
+		req := userRequest(http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: expression})
+		req.Header.Set(middleware.IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		middleware.AuthMiddleware(idempotent).ServeHTTP(w, req)
+		return w
+	}
+
+	first := calculate("retry-1", "2+3")
+	require.Equal(t, http.StatusCreated, first.Code)
+	var created orchestratorApp.SuccessResponse
+	require.NoError(t, json.Unmarshal(first.Body.Bytes(), &created))
+
+	replay := calculate("retry-1", "2+3")
+	assert.Equal(t, http.StatusCreated, replay.Code)
+	assert.Equal(t, "true", replay.Header().Get(middleware.IdempotentReplayedHeader))
+	assert.JSONEq(t, first.Body.String(), replay.Body.String(), "A retry gets the original response")
+	assert.Len(t, testApp.ExpressionStore.GetAllExpressions(testUserID), 1, "A retry does not submit the expression again")
+
+	assert.Equal(t, http.StatusUnprocessableEntity, calculate("retry-1", "2+4").Code, "A key cannot be reused for another expression")
+
+	other := calculate("retry-2", "2+3")
+	require.Equal(t, http.StatusCreated, other.Code)
+	assert.Empty(t, other.Header().Get(middleware.IdempotentReplayedHeader))
+	assert.Len(t, testApp.ExpressionStore.GetAllExpressions(testUserID), 2)
+
+	body, _ := json.Marshal(orchestratorApp.ExpressionRequest{Expression: "2+3"})
+	sum := sha256.Sum256(append([]byte("/api/v1/calculate\n"), body...))
+	_, reserved, err := testApp.IdempotencyStore.Reserve(testUserID, "in-flight", hex.EncodeToString(sum[:]))
+	require.NoError(t, err)
+	require.True(t, reserved)
+	assert.Equal(t, http.StatusConflict, calculate("in-flight", "2+3").Code)
+	testApp.IdempotencyStore.InFlightExpiry = 0
+	assert.Equal(t, http.StatusCreated, calculate("in-flight", "2+3").Code, "Reservations never completed expire")
+	testApp.IdempotencyStore.InFlightExpiry = store.DefaultInFlightExpiry
+
+	// a client that stops waiting has its expression created all the same
+	gone, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := userRequest(http.MethodPost, "/api/v1/calculate?wait=5s", orchestratorApp.ExpressionRequest{Expression: "2+3"}).WithContext(gone)
+	req.Header.Set(middleware.IdempotencyKeyHeader, "gone")
+	middleware.AuthMiddleware(idempotent).ServeHTTP(httptest.NewRecorder(), req)
+	count := len(testApp.ExpressionStore.GetAllExpressions(testUserID))
+	retry := calculate("gone", "2+3")
+	assert.Equal(t, http.StatusAccepted, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get(middleware.IdempotentReplayedHeader), "The retry gets the ID instead of submitting again")
+	assert.Len(t, testApp.ExpressionStore.GetAllExpressions(testUserID), count)
+}
+
+func TestOrchestratorApp_CalculateBatch(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	batchItem := func(key, expression string) orchestratorApp.BatchExpressionRequest {
+		return orchestratorApp.BatchExpressionRequest{Key: key, ExpressionRequest: orchestratorApp.ExpressionRequest{Expression: expression}}
+	}
+
+	w := serve(testApp.CalculateBatchHandler, http.MethodPost, "/api/v1/calculate/batch", orchestratorApp.BatchRequest{})
+	assert.Equal(t, http.StatusBadRequest, w.Code, "An empty batch is rejected")
+
+	w = serve(testApp.CalculateBatchHandler, http.MethodPost, "/api/v1/calculate/batch", orchestratorApp.BatchRequest{Expressions: []orchestratorApp.BatchExpressionRequest{
+		batchItem("sum", "2+3"),
+		batchItem("empty", ""),
+		batchItem("sum", "1+1"),
+		batchItem("product", "4*5"),
+	}})
+	require.Equal(t, http.StatusCreated, w.Code)
+	var created orchestratorApp.BatchResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&created))
+	require.Len(t, created.Items, 4)
+	assert.NotEmpty(t, created.Items[0].ExpressionID)
+	assert.Equal(t, "Expression is empty", created.Items[1].Error)
+	assert.Equal(t, "Duplicate key", created.Items[2].Error)
+	assert.Empty(t, created.Items[2].ExpressionID)
+	assert.NotEmpty(t, created.Items[3].ExpressionID)
+
+	target := "/api/v1/batches/" + strconv.FormatInt(created.ID, 10)
+	w = serve(testApp.BatchByIDHandler, http.MethodGet, target, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var batch internal.Batch
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&batch))
+	assert.Equal(t, "in progress", batch.Status)
+	assert.Equal(t, 4, batch.Total)
+	assert.Equal(t, 2, batch.InProgress)
+	assert.Equal(t, 2, batch.Failed)
+	assert.Equal(t, "rejected", batch.Items[1].Status)
+
+	agent := agentToken(t, "agent-a")
+	for i := 0; i < 2; i++ {
+		task, ok := testApp.TaskStore.LeaseTask("agent-a", nil)
+		require.True(t, ok)
+		body, _ := json.Marshal(internal.TaskResult{Id: task.Id, Result: "1.0000000000"})
+		req := httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+agent)
+		w = httptest.NewRecorder()
+		middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.InternalTaskResultHandler)).ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	w = serve(testApp.BatchByIDHandler, http.MethodGet, target, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	batch = internal.Batch{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&batch))
+	assert.Equal(t, "calculated", batch.Status)
+	assert.Equal(t, 2, batch.Calculated)
+	assert.Equal(t, 0, batch.InProgress)
+	assert.Equal(t, "sum", batch.Items[0].Key)
+	assert.Equal(t, "1.0000000000", batch.Items[0].Result)
+
+	assert.Equal(t, http.StatusNotFound, serve(testApp.BatchByIDHandler, http.MethodGet, "/api/v1/batches/999", nil).Code)
+	assert.Equal(t, http.StatusBadRequest, serve(testApp.BatchByIDHandler, http.MethodGet, "/api/v1/batches/abc", nil).Code)
+}
+
+func TestOrchestratorApp_Script(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	getTaskAuth := middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.GetInternalTaskHandler))
+	postResultAuth := middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.InternalTaskResultHandler))
+	token := agentToken(t, "agent-a")
+
+	id := mustCalculate(t, "a = 2+3; b = a*4; b/2")
+
+	results := map[string]float64{"+": 5, "*": 20, "/": 10}
+	for i := 0; i < 3; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/internal/task/new", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		getTaskAuth.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+		var task internal.Task
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&task))
+
+		expr, _ := testApp.ExpressionStore.GetExpression(id, testUserID)
+		assert.Equal(t, "in progress", expr.Status, "The script is done only after its last task")
+
+		body, _ := json.Marshal(internal.TaskResult{Id: task.Id, Result: strconv.FormatFloat(results[task.Operation], 'f', -1, 64)})
+		req = httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w = httptest.NewRecorder()
+		postResultAuth.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	expr, exists := testApp.ExpressionStore.GetExpression(id, testUserID)
+	require.True(t, exists)
+	assert.Equal(t, "calculated", expr.Status)
+	assert.Equal(t, "10", expr.Result)
+	assert.Equal(t, []internal.NamedResult{{Name: "a", Result: "5"}, {Name: "b", Result: "20"}}, expr.Results)
+}
+
+func TestOrchestratorApp_Matrix(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	getTaskAuth := middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.GetInternalTaskHandler))
+	postResultAuth := middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.InternalTaskResultHandler))
+	token := agentToken(t, "agent-a")
+
+	id := mustCalculate(t, "[[1,2],[3,4]] * [[5],[6]]")
+	for {
+		req := httptest.NewRequest(http.MethodGet, "/internal/task/new", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		getTaskAuth.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			break
+		}
+		var task internal.Task
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&task))
+
+		op, _ := operations.Default.Lookup(task.Operation)
+		value, err := operations.Default.Evaluate(task.Operation, []string{task.Arg1, task.Arg2}[:op.Arity])
+		require.NoError(t, err)
+		body, _ := json.Marshal(internal.TaskResult{Id: task.Id, Result: operations.FormatResult(value)})
+		req = httptest.NewRequest(http.MethodPost, "/internal/task", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		w = httptest.NewRecorder()
+		postResultAuth.ServeHTTP(w, req)
+		require.Equal(t, http.StatusOK, w.Code)
+	}
+
+	expr, exists := testApp.ExpressionStore.GetExpression(id, testUserID)
+	require.True(t, exists)
+	assert.Equal(t, "calculated", expr.Status)
+	assert.Equal(t, "[[17.0000000000], [39.0000000000]]", expr.Result)
+	assert.Equal(t, []int{2, 1}, expr.Metadata.Shape)
+
+	expr, _ = testApp.ExpressionStore.GetExpression(mustCalculate(t, "transpose([1,2])"), testUserID)
+	assert.Equal(t, "calculated", expr.Status, "Matrices of numbers need no tasks")
+	assert.Equal(t, "[[1, 2]]", expr.Result)
+}
+
+func TestOrchestratorApp_ResultCache(t *testing.T) {
+	os.Setenv("RESULT_CACHE_SIZE", "100")
+	defer os.Unsetenv("RESULT_CACHE_SIZE")
+	teardown := setupTestApp(t)
+	defer teardown()
+	require.NotNil(t, testApp.ResultCache)
+
+	statsAuth := middleware.AgentAuthMiddleware(http.HandlerFunc(testApp.CacheStatsHandler))
+
+	first := mustCalculate(t, "2*3")
+	task, ok := testApp.TaskStore.LeaseTask("agent-a", nil)
+	require.True(t, ok)
+	_, err := testApp.TaskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: "6.0000000000"}, "agent-a")
+	require.NoError(t, err)
+	require.Equal(t, first, task.Id)
+
+	second := mustCalculate(t, "2.0 * 3")
+	assert.Empty(t, testApp.TaskStore.GetTasks(), "The repeated calculation does not reach agents")
+	expr, exists := testApp.ExpressionStore.GetExpression(second, testUserID)
+	require.True(t, exists)
+	assert.Equal(t, "calculated", expr.Status)
+	assert.Equal(t, "6.0000000000", expr.Result)
+
+	script := mustCalculate(t, "a = 2*3; a+1")
+	expr, _ = testApp.ExpressionStore.GetExpression(script, testUserID)
+	assert.Equal(t, "in progress", expr.Status)
+	assert.Equal(t, []internal.NamedResult{{Name: "a", Result: "6.0000000000"}}, expr.Results)
+
+	req := httptest.NewRequest(http.MethodGet, "/internal/cache/stats", nil)
+	req.Header.Set("Authorization", "Bearer "+testUserToken)
+	w := httptest.NewRecorder()
+	statsAuth.ServeHTTP(w, req)
+	require.Equal(t, http.StatusUnauthorized, w.Code, "Users cannot read statistics of the shared cache")
+
+	req = httptest.NewRequest(http.MethodGet, "/internal/cache/stats", nil)
+	req.Header.Set("Authorization", "Bearer "+agentToken(t, "operator"))
+	w = httptest.NewRecorder()
+	statsAuth.ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var stats store.CacheStats
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&stats))
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+}
+
+func TestOrchestratorApp_FunctionHandlers(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	t.Run("Define and list functions", func(t *testing.T) {
+		w := serve(testApp.FunctionsHandler, http.MethodPost, "/api/v1/functions", orchestratorApp.FunctionRequest{Definition: "sq(x) = x*x"})
+		require.Equal(t, http.StatusCreated, w.Code)
+		w = serve(testApp.FunctionsHandler, http.MethodPost, "/api/v1/functions", orchestratorApp.FunctionRequest{Definition: "f(x, y) = sq(x) + 3*y"})
+		require.Equal(t, http.StatusCreated, w.Code)
+
+		w = serve(testApp.FunctionsHandler, http.MethodPost, "/api/v1/functions", orchestratorApp.FunctionRequest{Definition: "sq(x) = x^2"})
+		assert.Equal(t, http.StatusConflict, w.Code)
+
+		w = serve(testApp.FunctionsHandler, http.MethodGet, "/api/v1/functions", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var functions []internal.Function
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&functions))
+		assert.Len(t, functions, 2)
+	})
+
+	t.Run("Invalid definitions are rejected", func(t *testing.T) {
+		for _, definition := range []string{"g(x) = x + z", "g(x) = h(x)", "g(x) = g(x) + 1", "g(x) ="} {
+			w := serve(testApp.FunctionsHandler, http.MethodPost, "/api/v1/functions", orchestratorApp.FunctionRequest{Definition: definition})
+			assert.Equal(t, http.StatusUnprocessableEntity, w.Code, definition)
+		}
+	})
+
+	t.Run("Calculate expands user functions", func(t *testing.T) {
+		tasksBefore := len(testApp.TaskStore.GetTasks())
+		w := serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: "f(2, 1)"})
+		require.Equal(t, http.StatusCreated, w.Code)
+		assert.Len(t, testApp.TaskStore.GetTasks(), tasksBefore+3)
+	})
+
+	t.Run("Update and delete", func(t *testing.T) {
+		w := serve(testApp.FunctionByNameHandler, http.MethodPut, "/api/v1/functions/sq", orchestratorApp.FunctionRequest{Definition: "sq(x) = x^2"})
+		require.Equal(t, http.StatusOK, w.Code)
+
+		w = serve(testApp.FunctionByNameHandler, http.MethodPut, "/api/v1/functions/sq", orchestratorApp.FunctionRequest{Definition: "sq(x) = f(x, 1)"})
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code, "Mutual recursion is rejected")
+
+		w = serve(testApp.FunctionByNameHandler, http.MethodPut, "/api/v1/functions/sq", orchestratorApp.FunctionRequest{Definition: "cube(x) = x^3"})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w = serve(testApp.FunctionByNameHandler, http.MethodGet, "/api/v1/functions/sq", nil)
+		require.Equal(t, http.StatusOK, w.Code)
+		var fn internal.Function
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&fn))
+		assert.Equal(t, "sq(x) = x^2", fn.Definition)
+
+		w = serve(testApp.FunctionByNameHandler, http.MethodDelete, "/api/v1/functions/sq", nil)
+		assert.Equal(t, http.StatusConflict, w.Code, "f calls sq")
+		assert.Contains(t, w.Body.String(), "Function is called by f")
+
+		w = serve(testApp.FunctionByNameHandler, http.MethodDelete, "/api/v1/functions/f", nil)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		w = serve(testApp.FunctionByNameHandler, http.MethodDelete, "/api/v1/functions/sq", nil)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		w = serve(testApp.FunctionByNameHandler, http.MethodGet, "/api/v1/functions/sq", nil)
+		assert.Equal(t, http.StatusNotFound, w.Code)
+
+		w = serve(testApp.CalculatorHandler, http.MethodPost, "/api/v1/calculate", orchestratorApp.ExpressionRequest{Expression: "f(2, 1)"})
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	})
+}
+
+func TestOrchestratorApp_ServeFinishesInFlightRequests(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+	testApp.ShutdownGracePeriod = 5 * time.Second
+
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(300 * time.Millisecond)
+		w.Write([]byte("done"))
+		close(finished)
+	})}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- testApp.Serve(ctx, server, func() error { return server.Serve(listener) }) }()
+
+	responses := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + listener.Addr().String())
+		if err != nil {
+			responses <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		responses <- string(body)
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-served:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return")
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("Serve returned before the in-flight request completed")
+	}
+	assert.Equal(t, "done", <-responses)
+}
+
 func TestOrchestratorApp_getTimeSetting(t *testing.T) {
 	os.Setenv("TIME_ADDITION_MS", "101")
 	os.Setenv("TIME_SUBTRACTION_MS", "102")
@@ -341,7 +1462,7 @@ func TestOrchestratorApp_getTimeSetting(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.operation, func(t *testing.T) {
-			t.Skip("getTimeSetting is unexported. Test it indirectly or export it.")
+			assert.Equal(t, tt.expected, operations.Default.TimeSetting(tt.operation))
 		})
 	}
 }
@@ -463,3 +1584,137 @@ func TestTaskStore_GetFirstCorrectTask(t *testing.T) {
 		assert.False(t, exists)
 	})
 }
+
+func TestTaskStore_Leases(t *testing.T) {
+	ts := store.NewTaskStore()
+	ts.AddTask(internal.Task{Id: "t1", Arg1: "2", Arg2: "3", Operation: "+", Operation_time: "10"})
+
+	task, exists := ts.LeaseTask("agent-a", nil)
+	require.True(t, exists)
+	holder, leased := ts.GetLeaseHolder(task.Id)
+	assert.True(t, leased)
+	assert.Equal(t, "agent-a", holder)
+
+	_, err := ts.AcceptResult(internal.TaskResult{Id: task.Id, Result: "5"}, "agent-b")
+	assert.ErrorIs(t, err, store.ErrTaskLeasedByOther)
+	_, err = ts.AcceptResult(internal.TaskResult{Id: "unknown", Result: "5"}, "agent-a")
+	assert.ErrorIs(t, err, store.ErrTaskNotLeased)
+
+	applied, err := ts.AcceptResult(internal.TaskResult{Id: task.Id, Result: "5"}, "agent-a")
+	assert.NoError(t, err)
+	assert.True(t, applied)
+
+	applied, err = ts.AcceptResult(internal.TaskResult{Id: task.Id, Result: "5"}, "agent-a")
+	assert.NoError(t, err, "Retried delivery of the same result must be acknowledged")
+	assert.False(t, applied, "Retried delivery must not be applied twice")
+
+	_, err = ts.AcceptResult(internal.TaskResult{Id: task.Id, Result: "6"}, "agent-a")
+	assert.ErrorIs(t, err, store.ErrResultConflict)
+
+	ts.AddTask(internal.Task{Id: "t2", Arg1: "2", Arg2: "3", Operation: "+", Operation_time: "10"})
+	_, exists = ts.LeaseTask("agent-a", nil)
+	require.True(t, exists)
+	ts.TasksResStore.AddTaskRes(internal.TaskResult{Id: "t2", Result: "5"})
+	_, err = ts.AcceptResult(internal.TaskResult{Id: "t2", Result: "5"}, "agent-b")
+	assert.ErrorIs(t, err, store.ErrTaskLeasedByOther, "Only the lease holder may report a task, even a known result")
+	_, err = ts.AcceptResult(internal.TaskResult{Id: "t2", Result: "6"}, "agent-b")
+	assert.ErrorIs(t, err, store.ErrTaskLeasedByOther)
+}
+
+func TestTaskStore_LeaseTaskHonoursSupportedOperations(t *testing.T) {
+	ts := store.NewTaskStore()
+	ts.AddTask(internal.Task{Id: "pow", Arg1: "2", Arg2: "3", Operation: "^"})
+	ts.AddTask(internal.Task{Id: "sum", Arg1: "2", Arg2: "3", Operation: "+"})
+	ts.AddTask(internal.Task{Id: "root", Arg1: "9", Operation: "sqrt"})
+
+	task, exists := ts.LeaseTask("basic-agent", []string{"+", "-"})
+	require.True(t, exists)
+	assert.Equal(t, "sum", task.Id)
+
+	_, exists = ts.LeaseTask("basic-agent", []string{"+", "-"})
+	assert.False(t, exists, "Agent must not receive operations it does not support")
+
+	task, exists = ts.LeaseTask("full-agent", nil)
+	require.True(t, exists)
+	assert.Equal(t, "pow", task.Id)
+
+	task, exists = ts.LeaseTask("full-agent", []string{"sqrt"})
+	require.True(t, exists, "Unary task with empty second argument should be ready")
+	assert.Equal(t, "root", task.Id)
+}
+
+func TestTaskStore_ReleaseTask(t *testing.T) {
+	ts := store.NewTaskStore()
+	ts.AddTask(internal.Task{Id: "t1", Arg1: "2", Arg2: "3", Operation: "+", Operation_time: "10"})
+	ts.AddTask(internal.Task{Id: "t2", Arg1: "4", Arg2: "5", Operation: "+", Operation_time: "10"})
+
+	task, exists := ts.LeaseTask("agent-a", nil)
+	require.True(t, exists)
+	assert.Equal(t, "t1", task.Id)
+
+	assert.ErrorIs(t, ts.ReleaseTask("t1", "agent-b"), store.ErrTaskLeasedByOther)
+	require.NoError(t, ts.ReleaseTask("t1", "agent-a"))
+	assert.ErrorIs(t, ts.ReleaseTask("t1", "agent-a"), store.ErrTaskNotLeased)
+
+	task, exists = ts.LeaseTask("agent-b", nil)
+	require.True(t, exists)
+	assert.Equal(t, "t1", task.Id, "Released task should be handed out first")
+}
+
+func TestOrchestratorApp_SymbolicHandlers(t *testing.T) {
+	teardown := setupTestApp(t)
+	defer teardown()
+
+	send := func(handler http.HandlerFunc, body orchestratorApp.SymbolicRequest) (*httptest.ResponseRecorder, orchestratorApp.SymbolicResponse) {
+		reqBody, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/symbolic", bytes.NewBuffer(reqBody))
+		req.Header.Set("Authorization", "Bearer "+testUserToken)
+		w := httptest.NewRecorder()
+		middleware.AuthMiddleware(handler).ServeHTTP(w, req)
+		var response orchestratorApp.SymbolicResponse
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	t.Run("Derive and evaluate at points", func(t *testing.T) {
+		w, response := send(testApp.DeriveHandler, orchestratorApp.SymbolicRequest{
+			Expression: "x^3 + 2*x",
+			Points:     []map[string]float64{{"x": 2}, {"x": -1}},
+		})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "3*x^2 + 2", response.Result)
+		require.Len(t, response.Expressions, 2)
+
+		expr, exists := testApp.ExpressionStore.GetExpression(response.Expressions[0].Id, testUserID)
+		require.True(t, exists)
+		assert.Equal(t, "3*2^2 + 2", expr.ExpressionString)
+		assert.Equal(t, "in progress", expr.Status)
+	})
+
+	t.Run("Simplify a constant", func(t *testing.T) {
+		w, response := send(testApp.SimplifyHandler, orchestratorApp.SymbolicRequest{Expression: "y - y + 2*3", Submit: true})
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "6", response.Result)
+		require.Len(t, response.Expressions, 1)
+
+		expr, exists := testApp.ExpressionStore.GetExpression(response.Expressions[0].Id, testUserID)
+		require.True(t, exists)
+		assert.Equal(t, "calculated", expr.Status)
+		assert.Equal(t, "6", expr.Result)
+	})
+
+	t.Run("Free variables are reported per point", func(t *testing.T) {
+		w, response := send(testApp.SimplifyHandler, orchestratorApp.SymbolicRequest{Expression: "x*y", Points: []map[string]float64{{"x": 1}}})
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Len(t, response.Expressions, 1)
+		assert.Empty(t, response.Expressions[0].Id)
+		assert.Contains(t, response.Expressions[0].Error, "unknown variable y")
+	})
+
+	t.Run("Invalid expressions", func(t *testing.T) {
+		w, _ := send(testApp.DeriveHandler, orchestratorApp.SymbolicRequest{Expression: "x > 1"})
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+		w, _ = send(testApp.DeriveHandler, orchestratorApp.SymbolicRequest{Expression: "a = x; a"})
+		assert.Equal(t, http.StatusUnprocessableEntity, w.Code)
+	})
+}
@@ -0,0 +1,146 @@
+package orchestrator_app
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/middleware"
+	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/katierevinska/calculatorService/internal/webhooks"
+)
+
+type WebhookRequest struct {
+	URL string `json:"url"`
+}
+
+// WebhooksResponse lists the webhooks of the user with the secret their
+// deliveries are signed with.
+type WebhooksResponse struct {
+	Secret   string             `json:"secret"`
+	Webhooks []internal.Webhook `json:"webhooks"`
+}
+
+// notifyWebhooks delivers the finished expression to its callback URL and
+// to the webhooks of its user, each URL once.
+func (app *OrchestratorApp) notifyWebhooks(expression internal.Expression) {
+	var targets []string
+	if expression.CallbackURL != "" {
+		targets = append(targets, expression.CallbackURL)
+	}
+	for _, webhook := range app.WebhookStore.GetAllWebhooks(expression.UserID) {
+		if webhook.URL != expression.CallbackURL {
+			targets = append(targets, webhook.URL)
+		}
+	}
+	if len(targets) == 0 {
+		return
+	}
+
+	secret, err := app.WebhookStore.Secret(expression.UserID)
+	if err != nil {
+		log.Printf("Webhooks of expression %s not sent, no secret for user %d: %v", expression.ID, expression.UserID, err)
+		return
+	}
+	event := webhooks.EventFor(expression)
+	body, err := json.Marshal(webhooks.Payload{Event: event, Expression: expression, Time: time.Now()})
+	if err != nil {
+		return
+	}
+	for _, target := range targets {
+		app.Webhooks.Send(expression.UserID, target, secret, event, expression.ID, body)
+	}
+}
+
+func (app *OrchestratorApp) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		log.Println("WebhooksHandler: Failed to get userID from context")
+		app.jsonErrorResponse(w, "Internal server error (userID missing in context)", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		secret, err := app.WebhookStore.Secret(userID)
+		if err != nil {
+			app.jsonErrorResponse(w, "Failed to load webhook secret", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(WebhooksResponse{Secret: secret, Webhooks: app.WebhookStore.GetAllWebhooks(userID)})
+
+	case http.MethodPost:
+		var request WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			app.jsonErrorResponse(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		defer r.Body.Close()
+
+		if err := webhooks.ValidateURL(request.URL); err != nil {
+			app.jsonErrorResponse(w, "Invalid webhook url: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		webhook, err := app.WebhookStore.CreateWebhook(userID, request.URL)
+		if err != nil {
+			app.jsonErrorResponse(w, "Failed to save webhook", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Webhook %d added by user %d", webhook.ID, userID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(webhook)
+
+	default:
+		http.Error(w, "Only GET and POST methods are allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// WebhookByIDHandler deletes a webhook, DELETE /api/v1/webhooks/{id}, and
+// shows the delivery log, GET /api/v1/webhooks/deliveries?expression_id=.
+func (app *OrchestratorApp) WebhookByIDHandler(w http.ResponseWriter, r *http.Request) {
+	userID, ok := r.Context().Value(middleware.UserIDKey).(int64)
+	if !ok {
+		log.Println("WebhookByIDHandler: Failed to get userID from context")
+		app.jsonErrorResponse(w, "Internal server error (userID missing in context)", http.StatusInternalServerError)
+		return
+	}
+
+	idStr := r.URL.Path[len("/api/v1/webhooks/"):]
+	if idStr == "deliveries" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Only GET method is allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(app.WebhookStore.GetDeliveries(userID, r.URL.Query().Get("expression_id")))
+		return
+	}
+
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		app.jsonErrorResponse(w, "Webhook ID is missing or invalid in path", http.StatusBadRequest)
+		return
+	}
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Only DELETE method is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := app.WebhookStore.DeleteWebhook(id, userID); err != nil {
+		if errors.Is(err, store.ErrWebhookNotFound) {
+			app.jsonErrorResponse(w, "Webhook not found", http.StatusNotFound)
+		} else {
+			app.jsonErrorResponse(w, "Failed to delete webhook", http.StatusInternalServerError)
+		}
+		return
+	}
+	log.Printf("Webhook %d deleted by user %d", id, userID)
+	w.WriteHeader(http.StatusNoContent)
+}
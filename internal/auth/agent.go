@@ -0,0 +1,90 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const agentAudience = "calculatorService-agent"
+
+var agentSecret []byte
+
+func InitAgentAuth() error {
+	secret := os.Getenv("AGENT_SECRET")
+	if secret == "" {
+		return errors.New("AGENT_SECRET environment variable not set")
+	}
+	agentSecret = []byte(secret)
+	return nil
+}
+
+func CheckAgentSecret(secret string) bool {
+	if len(agentSecret) == 0 {
+		return false
+	}
+	return subtle.ConstantTimeCompare(agentSecret, []byte(secret)) == 1
+}
+
+type AgentClaims struct {
+	AgentID string `json:"agent_id"`
+	jwt.RegisteredClaims
+}
+
+func GenerateAgentToken(agentID string) (string, error) {
+	if len(jwtKey) == 0 {
+		return "", errors.New("JWT key not initialized. Call auth.InitJWT() first")
+	}
+	if agentID == "" {
+		return "", errors.New("agent ID is empty")
+	}
+	claims := &AgentClaims{
+		AgentID: agentID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   agentID,
+			Audience:  jwt.ClaimStrings{agentAudience},
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(1 * time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    "calculatorService",
+		},
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(jwtKey)
+}
+
+func ValidateAgentToken(tokenString string) (*AgentClaims, error) {
+	if len(jwtKey) == 0 {
+		return nil, errors.New("JWT key not initialized. Call auth.InitJWT() first")
+	}
+	claims := &AgentClaims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return jwtKey, nil
+	}, jwt.WithAudience(agentAudience))
+
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenMalformed) {
+			return nil, errors.New("malformed token")
+		} else if errors.Is(err, jwt.ErrTokenExpired) || errors.Is(err, jwt.ErrTokenNotValidYet) {
+			return nil, errors.New("token is expired or not valid yet")
+		} else if errors.Is(err, jwt.ErrSignatureInvalid) {
+			return nil, errors.New("invalid token signature")
+		} else if errors.Is(err, jwt.ErrTokenInvalidAudience) || errors.Is(err, jwt.ErrTokenRequiredClaimMissing) {
+			return nil, errors.New("token is not an agent token")
+		}
+		return nil, fmt.Errorf("couldn't parse token: %w", err)
+	}
+
+	if !token.Valid || claims.AgentID == "" {
+		return nil, errors.New("invalid token")
+	}
+
+	return claims, nil
+}
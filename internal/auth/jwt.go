@@ -77,6 +77,9 @@ func ValidateToken(tokenString string) (*Claims, error) {
 	if !token.Valid {
 		return nil, errors.New("invalid token")
 	}
+	if len(claims.Audience) > 0 {
+		return nil, errors.New("invalid token")
+	}
 
 	return claims, nil
 }
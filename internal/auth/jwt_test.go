@@ -15,8 +15,13 @@ func TestMain(m *testing.M) {
 	if err := auth.InitJWT(); err != nil {
 		panic("Failed to initialize JWT for tests: " + err.Error())
 	}
+	os.Setenv("AGENT_SECRET", "testagentsecret")
+	if err := auth.InitAgentAuth(); err != nil {
+		panic("Failed to initialize agent auth for tests: " + err.Error())
+	}
 	code := m.Run()
 	os.Unsetenv("JWT_SECRET")
+	os.Unsetenv("AGENT_SECRET")
 	os.Exit(code)
 }
 
@@ -79,3 +84,37 @@ func TestInitJWT_NoSecret(t *testing.T) {
 		auth.InitJWT()
 	}
 }
+
+func TestAgentTokens(t *testing.T) {
+	t.Run("CheckAgentSecret", func(t *testing.T) {
+		assert.True(t, auth.CheckAgentSecret("testagentsecret"))
+		assert.False(t, auth.CheckAgentSecret("wrong"))
+		assert.False(t, auth.CheckAgentSecret(""))
+	})
+
+	t.Run("GenerateAndValidateAgentToken", func(t *testing.T) {
+		tokenString, err := auth.GenerateAgentToken("agent-1")
+		require.NoError(t, err)
+
+		claims, err := auth.ValidateAgentToken(tokenString)
+		require.NoError(t, err)
+		assert.Equal(t, "agent-1", claims.AgentID)
+	})
+
+	t.Run("AgentTokenIsNotUserToken", func(t *testing.T) {
+		tokenString, err := auth.GenerateAgentToken("agent-1")
+		require.NoError(t, err)
+
+		_, err = auth.ValidateToken(tokenString)
+		assert.Error(t, err)
+	})
+
+	t.Run("UserTokenIsNotAgentToken", func(t *testing.T) {
+		tokenString, err := auth.GenerateToken(42)
+		require.NoError(t, err)
+
+		_, err = auth.ValidateAgentToken(tokenString)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not an agent token")
+	})
+}
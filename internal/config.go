@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// DurationEnv reads a duration such as "15s" from the environment variable,
+// falling back to the default when it is unset or malformed.
+func DurationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %s", name, value, fallback)
+		return fallback
+	}
+	return d
+}
+
+// IntEnv reads an integer from the environment variable, falling back to
+// the default when it is unset or malformed.
+func IntEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %d", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// BoolEnv reads a flag such as "true" or "1" from the environment variable,
+// falling back to the default when it is unset or malformed.
+func BoolEnv(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Invalid %s %q, using %t", name, value, fallback)
+		return fallback
+	}
+	return b
+}
@@ -65,5 +65,191 @@ func createTables(db *sql.DB) error {
 		log.Printf("Error creating expressions table: %v", err)
 		return err
 	}
+	if err = addColumnIfMissing(db, "expressions", "metadata", "TEXT"); err != nil {
+		log.Printf("Error adding metadata column to expressions table: %v", err)
+		return err
+	}
+	if err = addColumnIfMissing(db, "expressions", "unit", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Printf("Error adding unit column to expressions table: %v", err)
+		return err
+	}
+	if err = addColumnIfMissing(db, "expressions", "callback_url", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Printf("Error adding callback_url column to expressions table: %v", err)
+		return err
+	}
+	// индексы для постраничного списка выражений пользователя
+	_, err = db.Exec(`
+	CREATE INDEX IF NOT EXISTS expressions_user_created_at ON expressions (user_id, created_at);
+	CREATE INDEX IF NOT EXISTS expressions_user_status ON expressions (user_id, status);`)
+	if err != nil {
+		log.Printf("Error creating expressions indexes: %v", err)
+		return err
+	}
+	if err = addColumnIfMissing(db, "users", "webhook_secret", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Printf("Error adding webhook_secret column to users table: %v", err)
+		return err
+	}
+
+	createExpressionResultsTableSQL := `
+	CREATE TABLE IF NOT EXISTS expression_results (
+		expression_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		task_id TEXT NOT NULL, -- пустой, если значение известно сразу
+		result TEXT,
+		PRIMARY KEY (expression_id, position),
+		FOREIGN KEY (expression_id) REFERENCES expressions(id)
+	);`
+
+	_, err = db.Exec(createExpressionResultsTableSQL)
+	if err != nil {
+		log.Printf("Error creating expression_results table: %v", err)
+		return err
+	}
+	if err = addColumnIfMissing(db, "expression_results", "unit", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		log.Printf("Error adding unit column to expression_results table: %v", err)
+		return err
+	}
+
+	createResultCacheTableSQL := `
+	CREATE TABLE IF NOT EXISTS result_cache (
+		key TEXT PRIMARY KEY,
+		result TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		last_used INTEGER NOT NULL
+	);`
+
+	_, err = db.Exec(createResultCacheTableSQL)
+	if err != nil {
+		log.Printf("Error creating result_cache table: %v", err)
+		return err
+	}
+
+	createFunctionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS functions (
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		definition TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (user_id, name),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+
+	_, err = db.Exec(createFunctionsTableSQL)
+	if err != nil {
+		log.Printf("Error creating functions table: %v", err)
+		return err
+	}
+
+	createWebhooksTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		url TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+
+	_, err = db.Exec(createWebhooksTableSQL)
+	if err != nil {
+		log.Printf("Error creating webhooks table: %v", err)
+		return err
+	}
+
+	createWebhookDeliveriesTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		expression_id TEXT NOT NULL,
+		url TEXT NOT NULL,
+		event TEXT NOT NULL,
+		attempt INTEGER NOT NULL,
+		status_code INTEGER NOT NULL, -- 0, если ответ не получен
+		error TEXT NOT NULL,
+		delivered BOOLEAN NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS webhook_deliveries_user_expression ON webhook_deliveries (user_id, expression_id);`
+
+	_, err = db.Exec(createWebhookDeliveriesTableSQL)
+	if err != nil {
+		log.Printf("Error creating webhook_deliveries table: %v", err)
+		return err
+	}
+
+	createBatchesTableSQL := `
+	CREATE TABLE IF NOT EXISTS batches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);`
+
+	_, err = db.Exec(createBatchesTableSQL)
+	if err != nil {
+		log.Printf("Error creating batches table: %v", err)
+		return err
+	}
+
+	createBatchItemsTableSQL := `
+	CREATE TABLE IF NOT EXISTS batch_items (
+		batch_id INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		expression_id TEXT NOT NULL, -- пустой, если выражение не принято
+		error TEXT NOT NULL,
+		PRIMARY KEY (batch_id, position),
+		FOREIGN KEY (batch_id) REFERENCES batches(id)
+	);`
+
+	_, err = db.Exec(createBatchItemsTableSQL)
+	if err != nil {
+		log.Printf("Error creating batch_items table: %v", err)
+		return err
+	}
+
+	createIdempotencyKeysTableSQL := `
+	CREATE TABLE IF NOT EXISTS idempotency_keys (
+		user_id INTEGER NOT NULL,
+		key TEXT NOT NULL,
+		request_hash TEXT NOT NULL,
+		status_code INTEGER NOT NULL, -- 0, пока запрос обрабатывается
+		response TEXT NOT NULL,
+		expression_id TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (user_id, key),
+		FOREIGN KEY (user_id) REFERENCES users(id)
+	);
+	CREATE INDEX IF NOT EXISTS idempotency_keys_created_at ON idempotency_keys (created_at);`
+
+	_, err = db.Exec(createIdempotencyKeysTableSQL)
+	if err != nil {
+		log.Printf("Error creating idempotency_keys table: %v", err)
+		return err
+	}
 	return nil
 }
+
+// addColumnIfMissing upgrades tables created by earlier versions, since
+// CREATE TABLE IF NOT EXISTS leaves existing tables as they are.
+func addColumnIfMissing(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query("SELECT name FROM pragma_table_info(?)", table)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		if name == column {
+			rows.Close()
+			return nil
+		}
+	}
+	rows.Close()
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
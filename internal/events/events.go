@@ -0,0 +1,131 @@
+// Package events delivers expression and task progress to the clients
+// watching it.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types.
+const (
+	// ExpressionEvent reports the status of an expression, with its result
+	// once calculated.
+	ExpressionEvent = "expression"
+	// TaskEvent reports a task of an expression being handed to an agent or
+	// getting its result.
+	TaskEvent = "task"
+)
+
+// SubscriberBuffer is how many events a subscriber may fall behind before
+// it is disconnected.
+const SubscriberBuffer = 256
+
+type Event struct {
+	Type         string    `json:"type"`
+	ExpressionID string    `json:"expression_id"`
+	TaskID       string    `json:"task_id,omitempty"`
+	Operation    string    `json:"operation,omitempty"`
+	Status       string    `json:"status"`
+	Result       string    `json:"result,omitempty"`
+	AgentID      string    `json:"agent_id,omitempty"`
+	Time         time.Time `json:"time"`
+	UserID       int64     `json:"-"`
+}
+
+type subscriber struct {
+	userID       int64
+	expressionID string
+	types        []string
+	events       chan Event
+}
+
+// Bus passes events to the subscribers of their user. Publishing never
+// blocks: a subscriber whose buffer is full is dropped and its channel
+// closed, so it can reconnect and start from the current state.
+type Bus struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+	closed      bool
+}
+
+func NewBus() *Bus {
+	return &Bus{subscribers: make(map[*subscriber]struct{})}
+}
+
+// Subscribe returns the events of the user, only those of one expression
+// unless expressionID is empty and only those of the given types if any,
+// and a function to unsubscribe. The channel is closed when the subscriber
+// is dropped or the bus closed.
+func (b *Bus) Subscribe(userID int64, expressionID string, types ...string) (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := &subscriber{userID: userID, expressionID: expressionID, types: types, events: make(chan Event, SubscriberBuffer)}
+	if b.closed {
+		close(s.events)
+		return s.events, func() {}
+	}
+	b.subscribers[s] = struct{}{}
+	return s.events, func() { b.drop(s) }
+}
+
+func (b *Bus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscribers {
+		if !s.wants(e) {
+			continue
+		}
+		select {
+		case s.events <- e:
+		default:
+			delete(b.subscribers, s)
+			close(s.events)
+		}
+	}
+}
+
+// Closed tells whether the bus is closed, so subscribing again is useless.
+func (b *Bus) Closed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// Close ends all subscriptions, e.g. when the server shuts down.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for s := range b.subscribers {
+		delete(b.subscribers, s)
+		close(s.events)
+	}
+}
+
+func (s *subscriber) wants(e Event) bool {
+	if s.userID != e.UserID || (s.expressionID != "" && s.expressionID != e.ExpressionID) {
+		return false
+	}
+	if len(s.types) == 0 {
+		return true
+	}
+	for _, t := range s.types {
+		if t == e.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Bus) drop(s *subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, exists := b.subscribers[s]; exists {
+		delete(b.subscribers, s)
+		close(s.events)
+	}
+}
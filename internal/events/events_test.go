@@ -0,0 +1,72 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/katierevinska/calculatorService/internal/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus(t *testing.T) {
+	bus := events.NewBus()
+	all, unsubscribeAll := bus.Subscribe(1, "")
+	defer unsubscribeAll()
+	one, unsubscribeOne := bus.Subscribe(1, "id2")
+	defer unsubscribeOne()
+
+	bus.Publish(events.Event{Type: events.TaskEvent, ExpressionID: "id1", TaskID: "id1", UserID: 1})
+	bus.Publish(events.Event{Type: events.TaskEvent, ExpressionID: "id2", TaskID: "id2", UserID: 1})
+	bus.Publish(events.Event{Type: events.TaskEvent, ExpressionID: "id3", TaskID: "id3", UserID: 2})
+
+	require.Len(t, all, 2, "Subscribers only get the events of their user")
+	first := <-all
+	assert.Equal(t, "id1", first.TaskID)
+	assert.False(t, first.Time.IsZero(), "Events are timestamped")
+	assert.Equal(t, "id2", (<-all).TaskID)
+	require.Len(t, one, 1, "Subscribers of an expression only get its events")
+	assert.Equal(t, "id2", (<-one).TaskID)
+
+	unsubscribeOne()
+	_, open := <-one
+	assert.False(t, open, "Unsubscribing closes the channel")
+
+	bus.Close()
+	_, open = <-all
+	assert.False(t, open, "Closing the bus ends all subscriptions")
+	late, _ := bus.Subscribe(1, "")
+	_, open = <-late
+	assert.False(t, open)
+}
+
+func TestBus_DropsSlowSubscribers(t *testing.T) {
+	bus := events.NewBus()
+	slow, unsubscribe := bus.Subscribe(1, "")
+	defer unsubscribe()
+
+	for i := 0; i <= events.SubscriberBuffer; i++ {
+		bus.Publish(events.Event{Type: events.TaskEvent, UserID: 1})
+	}
+	received := 0
+	for range slow {
+		received++
+	}
+	assert.Equal(t, events.SubscriberBuffer, received, "A subscriber that falls behind is dropped instead of blocking the bus")
+}
+
+func TestBus_SubscribeTypes(t *testing.T) {
+	bus := events.NewBus()
+	status, unsubscribe := bus.Subscribe(1, "id1", events.ExpressionEvent)
+	defer unsubscribe()
+
+	for i := 0; i <= events.SubscriberBuffer; i++ {
+		bus.Publish(events.Event{Type: events.TaskEvent, ExpressionID: "id1", UserID: 1})
+	}
+	bus.Publish(events.Event{Type: events.ExpressionEvent, ExpressionID: "id1", Status: "calculated", UserID: 1})
+
+	require.Len(t, status, 1, "Events of other types neither reach nor overflow the subscriber")
+	assert.Equal(t, "calculated", (<-status).Status)
+	assert.False(t, bus.Closed())
+	bus.Close()
+	assert.True(t, bus.Closed())
+}
@@ -1,23 +1,167 @@
 package internal
 
+import (
+	"strings"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal/latency"
+)
+
 type Task struct {
-	Id             string `json:"id"`
-	Arg1           string `json:"arg1"`
-	Arg2           string `json:"arg2"`
-	Operation      string `json:"operation"`
-	Operation_time string `json:"operation_time"`
+	Id             string        `json:"id"`
+	Arg1           string        `json:"arg1"`
+	Arg2           string        `json:"arg2"`
+	Operation      string        `json:"operation"`
+	Operation_time string        `json:"operation_time"`
+	Latency        *latency.Spec `json:"latency,omitempty"`
+	// Unit of the result in SI base units, for information only: agents
+	// compute plain numbers.
+	Unit string `json:"unit,omitempty"`
+	// Complex asks the agent to compute in complex arithmetic: arguments
+	// and the result are written as "1+2i", so sqrt(-4) is 2i instead of
+	// an error.
+	Complex bool `json:"complex,omitempty"`
+	// Integer asks the agent to compute exactly on integers of any length,
+	// reported without a fraction, e.g. "265252859812191058636308480000000".
+	Integer bool `json:"integer,omitempty"`
 }
 
+// TaskResult carries the result as text: a number, a complex number such
+// as "1.0000000000-2.0000000000i" for complex tasks, an integer for integer
+// tasks, or an error starting with "Error".
 type TaskResult struct {
 	Id     string `json:"id"`
 	Result string `json:"result"`
 }
 
+// TaskTrace is what the orchestrator remembers about a task, see
+// store.TaskStore.Trace. Conditionals whose condition is computed appear
+// with the operation "if", the condition as their argument and the chosen
+// branch, a task ID or a number, in Branch.
+type TaskTrace struct {
+	ID        string   `json:"id"`
+	Operation string   `json:"operation"`
+	Args      []string `json:"args"`
+	// Values are the arguments with task IDs replaced by their results,
+	// known once the task is ready.
+	Values []string `json:"values,omitempty"`
+	Branch string   `json:"branch,omitempty"`
+	// Status is "waiting", "running" or "done".
+	Status string `json:"status"`
+	Result string `json:"result,omitempty"`
+	// CompletedBy is "agent", "cache", "argument" when an argument failed,
+	// or "branch" for conditionals.
+	CompletedBy string     `json:"completed_by,omitempty"`
+	AgentID     string     `json:"agent_id,omitempty"`
+	Attempts    int        `json:"attempts"`
+	CreatedAt   time.Time  `json:"created_at"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+}
+
 type Expression struct {
 	ID               string `json:"id"`
 	UserID           int64  `json:"-"`
 	ExpressionString string `json:"expression"`
 	Status           string `json:"status"`
 	Result           string `json:"result,omitempty"`
+	Unit             string `json:"unit,omitempty"`
 	CreatedAt        string `json:"created_at,omitempty"`
+	// Results lists the named results of a script, see rpn.ParseScript.
+	Results  []NamedResult       `json:"results,omitempty"`
+	Metadata *ExpressionMetadata `json:"metadata,omitempty"`
+	// CallbackURL receives a webhook once the expression is finished.
+	CallbackURL string `json:"callback_url,omitempty"`
+}
+
+// ExpressionMetadata describes how the expression was planned.
+type ExpressionMetadata struct {
+	Operations int     `json:"operations"`
+	Tasks      int     `json:"tasks"`
+	DedupRatio float64 `json:"dedup_ratio"`
+	// Shape is set for vectors ([n]) and matrices ([rows, cols]).
+	Shape []int `json:"shape,omitempty"`
+	// Mode is "integer" for expressions computed in integer mode.
+	Mode string `json:"mode,omitempty"`
+}
+
+// AssembleMatrix writes the elements of a vector or matrix, row by row,
+// as "[[1, 2], [3, 4]]". A failed element fails the whole matrix.
+func AssembleMatrix(shape []int, elements []string) string {
+	for _, element := range elements {
+		if strings.HasPrefix(element, "Error") {
+			return element
+		}
+	}
+	if len(shape) == 1 {
+		return "[" + strings.Join(elements, ", ") + "]"
+	}
+	rows := make([]string, shape[0])
+	for i := range rows {
+		rows[i] = "[" + strings.Join(elements[i*shape[1]:(i+1)*shape[1]], ", ") + "]"
+	}
+	return "[" + strings.Join(rows, ", ") + "]"
+}
+
+type NamedResult struct {
+	Name   string `json:"name"`
+	Result string `json:"result,omitempty"`
+	Unit   string `json:"unit,omitempty"`
+	TaskID string `json:"-"`
+}
+
+// Webhook receives all expressions of its user once they are finished.
+type Webhook struct {
+	ID        int64  `json:"id"`
+	UserID    int64  `json:"-"`
+	URL       string `json:"url"`
+	CreatedAt string `json:"created_at,omitempty"`
+}
+
+// WebhookDelivery is one attempt to deliver a webhook.
+type WebhookDelivery struct {
+	ID           int64  `json:"id"`
+	UserID       int64  `json:"-"`
+	ExpressionID string `json:"expression_id"`
+	URL          string `json:"url"`
+	Event        string `json:"event"`
+	Attempt      int    `json:"attempt"`
+	// StatusCode is 0 when the receiver did not answer.
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+	Delivered  bool   `json:"delivered"`
+	CreatedAt  string `json:"created_at,omitempty"`
+}
+
+// Batch is a group of expressions submitted in one request. Its status is
+// "in progress" until every accepted expression is finished, then
+// "calculated".
+type Batch struct {
+	ID         int64  `json:"id"`
+	UserID     int64  `json:"-"`
+	Status     string `json:"status"`
+	Total      int    `json:"total"`
+	InProgress int    `json:"in_progress"`
+	Calculated int    `json:"calculated"`
+	// Failed counts the items that were rejected or ended with an error.
+	Failed    int         `json:"failed"`
+	Items     []BatchItem `json:"items"`
+	CreatedAt string      `json:"created_at,omitempty"`
+}
+
+// BatchItem is an expression of a batch. Items rejected on submission have
+// no expression ID, only the error.
+type BatchItem struct {
+	Key          string `json:"key,omitempty"`
+	ExpressionID string `json:"id,omitempty"`
+	Status       string `json:"status,omitempty"`
+	Result       string `json:"result,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+type Function struct {
+	Name       string `json:"name"`
+	UserID     int64  `json:"-"`
+	Definition string `json:"definition"`
+	CreatedAt  string `json:"created_at,omitempty"`
 }
@@ -0,0 +1,107 @@
+package latency
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ModelFixed       = "fixed"
+	ModelJitter      = "jitter"
+	ModelNormal      = "normal"
+	ModelExponential = "exponential"
+)
+
+// Spec describes how long an agent should pretend an operation takes. It is
+// chosen by the orchestrator and travels with the task, the agent samples
+// the actual delay from it.
+type Spec struct {
+	Model    string  `json:"model"`
+	BaseMs   float64 `json:"base_ms"`
+	JitterMs float64 `json:"jitter_ms,omitempty"`
+	StdDevMs float64 `json:"stddev_ms,omitempty"`
+}
+
+func (s Spec) Validate() error {
+	if s.BaseMs < 0 || s.JitterMs < 0 || s.StdDevMs < 0 {
+		return errors.New("latency values must not be negative")
+	}
+	switch s.Model {
+	case ModelFixed, ModelJitter, ModelNormal, ModelExponential:
+		return nil
+	}
+	return fmt.Errorf("unknown latency model %q", s.Model)
+}
+
+// Sample draws one delay from the model. Results are never negative.
+func (s Spec) Sample(rnd *rand.Rand) time.Duration {
+	ms := s.BaseMs
+	switch s.Model {
+	case ModelJitter:
+		ms += (rnd.Float64()*2 - 1) * s.JitterMs
+	case ModelNormal:
+		ms += rnd.NormFloat64() * s.StdDevMs
+	case ModelExponential:
+		ms = rnd.ExpFloat64() * s.BaseMs
+	}
+	if ms < 0 || math.IsNaN(ms) {
+		ms = 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// ParseModel reads a model description such as "fixed", "jitter:20",
+// "normal:15" or "exponential" on top of the given base time.
+func ParseModel(description string, baseMs float64) (Spec, error) {
+	name, param, hasParam := strings.Cut(strings.TrimSpace(description), ":")
+	spec := Spec{Model: strings.ToLower(name), BaseMs: baseMs}
+	if spec.Model == "" {
+		spec.Model = ModelFixed
+	}
+
+	var value float64
+	if hasParam {
+		var err error
+		value, err = strconv.ParseFloat(param, 64)
+		if err != nil {
+			return Spec{}, fmt.Errorf("invalid latency parameter %q: %w", param, err)
+		}
+	}
+	switch spec.Model {
+	case ModelJitter:
+		spec.JitterMs = value
+	case ModelNormal:
+		spec.StdDevMs = value
+	}
+	return spec, spec.Validate()
+}
+
+// FromEnv builds the spec for an operation whose base time lives in timeKey
+// (e.g. TIME_ADDITION_MS). The model comes from the per-operation variable
+// with the _MS suffix replaced by _MODEL, or from LATENCY_MODEL.
+func FromEnv(timeKey string) (Spec, error) {
+	baseMs := 0.0
+	if base := os.Getenv(timeKey); base != "" {
+		var err error
+		baseMs, err = strconv.ParseFloat(base, 64)
+		if err != nil {
+			return Spec{Model: ModelFixed}, fmt.Errorf("%s: invalid time %q", timeKey, base)
+		}
+	}
+
+	description := os.Getenv(strings.TrimSuffix(timeKey, "_MS") + "_MODEL")
+	if description == "" {
+		description = os.Getenv("LATENCY_MODEL")
+	}
+	spec, err := ParseModel(description, baseMs)
+	if err != nil {
+		return Spec{Model: ModelFixed, BaseMs: baseMs}, fmt.Errorf("%s: %w", timeKey, err)
+	}
+	return spec, nil
+}
@@ -0,0 +1,101 @@
+package latency_test
+
+import (
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal/latency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseModel(t *testing.T) {
+	tests := []struct {
+		description string
+		expected    latency.Spec
+		expectError bool
+	}{
+		{"", latency.Spec{Model: latency.ModelFixed, BaseMs: 100}, false},
+		{"fixed", latency.Spec{Model: latency.ModelFixed, BaseMs: 100}, false},
+		{"jitter:20", latency.Spec{Model: latency.ModelJitter, BaseMs: 100, JitterMs: 20}, false},
+		{"Normal:15", latency.Spec{Model: latency.ModelNormal, BaseMs: 100, StdDevMs: 15}, false},
+		{"exponential", latency.Spec{Model: latency.ModelExponential, BaseMs: 100}, false},
+		{"jitter:abc", latency.Spec{}, true},
+		{"jitter:-5", latency.Spec{}, true},
+		{"pareto", latency.Spec{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.description, func(t *testing.T) {
+			spec, err := latency.ParseModel(tt.description, 100)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, spec)
+		})
+	}
+}
+
+func TestSpec_Sample(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	t.Run("Fixed", func(t *testing.T) {
+		spec := latency.Spec{Model: latency.ModelFixed, BaseMs: 100}
+		assert.Equal(t, 100*time.Millisecond, spec.Sample(rnd))
+	})
+
+	t.Run("Jitter stays within bounds", func(t *testing.T) {
+		spec := latency.Spec{Model: latency.ModelJitter, BaseMs: 100, JitterMs: 20}
+		for i := 0; i < 1000; i++ {
+			d := spec.Sample(rnd)
+			assert.GreaterOrEqual(t, d, 80*time.Millisecond)
+			assert.LessOrEqual(t, d, 120*time.Millisecond)
+		}
+	})
+
+	t.Run("Normal is never negative", func(t *testing.T) {
+		spec := latency.Spec{Model: latency.ModelNormal, BaseMs: 1, StdDevMs: 100}
+		for i := 0; i < 1000; i++ {
+			assert.GreaterOrEqual(t, spec.Sample(rnd), time.Duration(0))
+		}
+	})
+
+	t.Run("Exponential averages to base", func(t *testing.T) {
+		spec := latency.Spec{Model: latency.ModelExponential, BaseMs: 100}
+		var total time.Duration
+		const n = 5000
+		for i := 0; i < n; i++ {
+			total += spec.Sample(rnd)
+		}
+		assert.InDelta(t, float64(100*time.Millisecond), float64(total/n), float64(10*time.Millisecond))
+	})
+}
+
+func TestFromEnv(t *testing.T) {
+	os.Setenv("TIME_ADDITION_MS", "100")
+	os.Setenv("LATENCY_MODEL", "jitter:10")
+	os.Setenv("TIME_ADDITION_MODEL", "normal:5")
+	os.Setenv("TIME_SUBTRACTION_MS", "50")
+	defer func() {
+		os.Unsetenv("TIME_ADDITION_MS")
+		os.Unsetenv("LATENCY_MODEL")
+		os.Unsetenv("TIME_ADDITION_MODEL")
+		os.Unsetenv("TIME_SUBTRACTION_MS")
+	}()
+
+	spec, err := latency.FromEnv("TIME_ADDITION_MS")
+	require.NoError(t, err)
+	assert.Equal(t, latency.Spec{Model: latency.ModelNormal, BaseMs: 100, StdDevMs: 5}, spec, "Per-operation model overrides the default")
+
+	spec, err = latency.FromEnv("TIME_SUBTRACTION_MS")
+	require.NoError(t, err)
+	assert.Equal(t, latency.Spec{Model: latency.ModelJitter, BaseMs: 50, JitterMs: 10}, spec)
+
+	os.Setenv("TIME_SUBTRACTION_MS", "fast")
+	_, err = latency.FromEnv("TIME_SUBTRACTION_MS")
+	assert.Error(t, err)
+}
@@ -35,9 +35,12 @@ func TestFullIntegration_ExpressionCalculation(t *testing.T) {
 	os.Setenv("TIME_MULTIPLICATIONS_MS", "50")
 	os.Setenv("TIME_DIVISIONS_MS", "50")
 	os.Setenv("JWT_SECRET", "integrationtestsecret")
+	os.Setenv("AGENT_SECRET", "integrationagentsecret")
 
 	err := auth.InitJWT()
 	require.NoError(t, err)
+	err = auth.InitAgentAuth()
+	require.NoError(t, err)
 
 	db, err := database.InitDB(":memory:")
 	require.NoError(t, err)
@@ -66,10 +69,12 @@ func TestFullIntegration_ExpressionCalculation(t *testing.T) {
 			} else {
 				http.NotFound(w, r)
 			}
+		case r.URL.Path == "/internal/agent/login" && r.Method == http.MethodPost:
+			orchApp.AgentLoginHandler(w, r)
 		case r.URL.Path == "/internal/task/new" && r.Method == http.MethodGet:
-			orchApp.GetInternalTaskHandler(w, r)
+			middleware.AgentAuthMiddleware(http.HandlerFunc(orchApp.GetInternalTaskHandler)).ServeHTTP(w, r)
 		case r.URL.Path == "/internal/task" && r.Method == http.MethodPost:
-			orchApp.InternalTaskResultHandler(w, r)
+			middleware.AgentAuthMiddleware(http.HandlerFunc(orchApp.InternalTaskResultHandler)).ServeHTTP(w, r)
 		default:
 			http.NotFound(w, r)
 		}
@@ -119,7 +124,34 @@ func TestFullIntegration_ExpressionCalculation(t *testing.T) {
 	expressionID := successResp.Id
 	require.NotEmpty(t, expressionID)
 
-	getTaskResp1, err := regClient.Get(testOrchestrator.URL + "/internal/task/new")
+	agentLoginBody, _ := json.Marshal(orchestratorApp.AgentCredentials{AgentID: "integ-agent", Secret: "integrationagentsecret"})
+	agentLoginResp, err := regClient.Post(testOrchestrator.URL+"/internal/agent/login", "application/json", bytes.NewBuffer(agentLoginBody))
+	require.NoError(t, err)
+	require.Equal(t, http.StatusOK, agentLoginResp.StatusCode, "Agent login failed")
+	var agentTokenResp orchestratorApp.TokenResponse
+	err = json.NewDecoder(agentLoginResp.Body).Decode(&agentTokenResp)
+	require.NoError(t, err)
+	agentLoginResp.Body.Close()
+	agentToken := agentTokenResp.Token
+
+	agentGet := func(url string) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer "+agentToken)
+		return regClient.Do(req)
+	}
+	agentPost := func(url string, body []byte) (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodPost, url, bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+agentToken)
+		req.Header.Set("Content-Type", "application/json")
+		return regClient.Do(req)
+	}
+
+	unauthResp, err := regClient.Get(testOrchestrator.URL + "/internal/task/new")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusUnauthorized, unauthResp.StatusCode)
+	unauthResp.Body.Close()
+
+	getTaskResp1, err := agentGet(testOrchestrator.URL + "/internal/task/new")
 	require.NoError(t, err)
 	require.Equal(t, http.StatusOK, getTaskResp1.StatusCode)
 	var task1 internal.Task
@@ -131,12 +163,12 @@ func TestFullIntegration_ExpressionCalculation(t *testing.T) {
 
 	task1Result := internal.TaskResult{Id: task1.Id, Result: "6.0000000000"}
 	task1ResultBody, _ := json.Marshal(task1Result)
-	postResult1Resp, err := regClient.Post(testOrchestrator.URL+"/internal/task", "application/json", bytes.NewBuffer(task1ResultBody))
+	postResult1Resp, err := agentPost(testOrchestrator.URL+"/internal/task", task1ResultBody)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, postResult1Resp.StatusCode)
 	postResult1Resp.Body.Close()
 
-	getTaskResp2, err := regClient.Get(testOrchestrator.URL + "/internal/task/new")
+	getTaskResp2, err := agentGet(testOrchestrator.URL + "/internal/task/new")
 	require.NoError(t, err)
 	require.Equal(t, http.StatusOK, getTaskResp2.StatusCode)
 	var task2 internal.Task
@@ -149,7 +181,7 @@ func TestFullIntegration_ExpressionCalculation(t *testing.T) {
 
 	task2Result := internal.TaskResult{Id: task2.Id, Result: "10.0000000000"}
 	task2ResultBody, _ := json.Marshal(task2Result)
-	postResult2Resp, err := regClient.Post(testOrchestrator.URL+"/internal/task", "application/json", bytes.NewBuffer(task2ResultBody))
+	postResult2Resp, err := agentPost(testOrchestrator.URL+"/internal/task", task2ResultBody)
 	require.NoError(t, err)
 	assert.Equal(t, http.StatusOK, postResult2Resp.StatusCode)
 	postResult2Resp.Body.Close()
@@ -3,10 +3,12 @@ package middleware
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
 	"github.com/katierevinska/calculatorService/internal/auth"
+	"github.com/katierevinska/calculatorService/internal/websocket"
 )
 
 type contextKey string
@@ -14,8 +16,43 @@ type contextKey string
 const UserIDKey contextKey = "userID"
 
 func AuthMiddleware(next http.Handler) http.Handler {
+	return userAuth(auth.ExtractTokenFromHeader, next)
+}
+
+// WebSocketProtocol is offered by browsers, which cannot set headers on a
+// WebSocket handshake, followed by the token as the next subprotocol:
+// new WebSocket(url, ["bearer", token]).
+const WebSocketProtocol = "bearer"
+
+// WebSocketAuthMiddleware is AuthMiddleware for WebSocket handshakes, which
+// may also carry the token as a subprotocol or query parameter, see
+// webSocketToken.
+func WebSocketAuthMiddleware(next http.Handler) http.Handler {
+	return userAuth(webSocketToken, next)
+}
+
+// webSocketToken takes the token of a WebSocket handshake from the
+// Authorization header, the WebSocketProtocol subprotocols or the token
+// query parameter.
+func webSocketToken(r *http.Request) (string, error) {
+	if r.Header.Get("Authorization") != "" {
+		return auth.ExtractTokenFromHeader(r)
+	}
+	protocols := websocket.Protocols(r)
+	for i, protocol := range protocols {
+		if protocol == WebSocketProtocol && i+1 < len(protocols) {
+			return protocols[i+1], nil
+		}
+	}
+	if token := r.URL.Query().Get("token"); token != "" {
+		return token, nil
+	}
+	return "", errors.New("token is missing, send it in the Authorization header, the bearer subprotocol or the token parameter")
+}
+
+func userAuth(extractToken func(*http.Request) (string, error), next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		tokenString, err := auth.ExtractTokenFromHeader(r)
+		tokenString, err := extractToken(r)
 		if err != nil {
 			log.Printf("AuthMiddleware: Error extracting token: %v (Path: %s)", err, r.URL.Path)
 			w.Header().Set("Content-Type", "application/json")
@@ -38,3 +75,45 @@ func AuthMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
+
+const AgentIDKey contextKey = "agentID"
+
+func AgentAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenString, err := auth.ExtractTokenFromHeader(r)
+		if err != nil {
+			log.Printf("AgentAuthMiddleware: Error extracting token: %v (Path: %s)", err, r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized: " + err.Error()})
+			return
+		}
+
+		claims, err := auth.ValidateAgentToken(tokenString)
+		if err != nil {
+			log.Printf("AgentAuthMiddleware: Error validating agent token: %v (Path: %s)", err, r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized: Invalid agent token"})
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), AgentIDKey, claims.AgentID)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ClientCertMiddleware rejects requests that did not present a client
+// certificate verified during the TLS handshake.
+func ClientCertMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			log.Printf("ClientCertMiddleware: No verified client certificate (Path: %s)", r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unauthorized: client certificate required"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
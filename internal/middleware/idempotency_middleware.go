@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/katierevinska/calculatorService/internal/store"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader marks a response repeated for a retry.
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+	MaxIdempotencyKeyLength  = 255
+)
+
+// IdempotencyMiddleware handles a request with an Idempotency-Key header
+// once per user and key and answers its retries with the stored response.
+// Reusing a key for a different request is rejected. Server errors and
+// requests that got no response are not stored, so they can be retried;
+// handlers must therefore respond once they have created something, even
+// to a client that went away. It must run after AuthMiddleware.
+func IdempotencyMiddleware(keys *store.IdempotencyStore, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		userID, ok := r.Context().Value(UserIDKey).(int64)
+		if !ok {
+			log.Println("IdempotencyMiddleware: Failed to get userID from context")
+			jsonError(w, "Internal server error (userID missing in context)", http.StatusInternalServerError)
+			return
+		}
+		if len(key) > MaxIdempotencyKeyLength {
+			jsonError(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			jsonError(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(append([]byte(r.URL.Path+"\n"), body...))
+		requestHash := hex.EncodeToString(sum[:])
+
+		stored, reserved, err := keys.Reserve(userID, key, requestHash)
+		if err != nil {
+			jsonError(w, "Failed to check Idempotency-Key", http.StatusInternalServerError)
+			return
+		}
+		if !reserved {
+			switch {
+			case stored.RequestHash != requestHash:
+				jsonError(w, "Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+			case stored.StatusCode == 0:
+				jsonError(w, "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+			default:
+				log.Printf("Replaying response for Idempotency-Key of user %d (expression %s)", userID, stored.ExpressionID)
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set(IdempotentReplayedHeader, "true")
+				w.WriteHeader(stored.StatusCode)
+				w.Write(stored.Body)
+			}
+			return
+		}
+
+		recorder := &recordingWriter{ResponseWriter: w}
+		defer func() {
+			if p := recover(); p != nil {
+				keys.Release(userID, key)
+				panic(p)
+			}
+		}()
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 || recorder.status >= http.StatusInternalServerError {
+			keys.Release(userID, key)
+			return
+		}
+		var created struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(recorder.body.Bytes(), &created)
+		err = keys.Complete(userID, key, store.StoredResponse{StatusCode: recorder.status, Body: recorder.body.Bytes(), ExpressionID: created.ID})
+		if err != nil && created.ID == "" {
+			keys.Release(userID, key)
+		} else if err != nil {
+			// releasing would let a retry create expression again, the
+			// reservation expires instead, see IdempotencyStore.InFlightExpiry
+			log.Printf("Idempotency-Key of user %d stays reserved for expression %s", userID, created.ID)
+		}
+	})
+}
+
+// recordingWriter keeps a copy of the response it writes.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(statusCode int) {
+	if w.status == 0 {
+		w.status = statusCode
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func jsonError(w http.ResponseWriter, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,111 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/katierevinska/calculatorService/internal"
+)
+
+var ErrBatchNotFound = errors.New("batch not found")
+
+type BatchStore struct {
+	db *sql.DB
+}
+
+func NewBatchStore(db *sql.DB) *BatchStore {
+	return &BatchStore{db: db}
+}
+
+// CreateBatch saves the items of a batch in order and returns its ID. The
+// batch is saved with all of its items or not at all.
+func (s *BatchStore) CreateBatch(userID int64, items []internal.BatchItem) (int64, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction for batch of user %d: %v", userID, err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("INSERT INTO batches (user_id) VALUES (?)", userID)
+	if err != nil {
+		log.Printf("Error inserting batch for user %d: %v", userID, err)
+		return 0, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO batch_items (batch_id, position, key, expression_id, error) VALUES (?, ?, ?, ?, ?)")
+	if err != nil {
+		log.Printf("Error preparing insert statement for batch items: %v", err)
+		return 0, err
+	}
+	defer stmt.Close()
+	for i, item := range items {
+		if _, err := stmt.Exec(id, i, item.Key, item.ExpressionID, item.Error); err != nil {
+			log.Printf("Error inserting item %d of batch %d: %v", i, id, err)
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error committing batch %d: %v", id, err)
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetBatch returns the batch with the current status and result of each of
+// its expressions, and the counts of them.
+func (s *BatchStore) GetBatch(id, userID int64) (internal.Batch, error) {
+	batch := internal.Batch{ID: id, UserID: userID, Items: []internal.BatchItem{}}
+	err := s.db.QueryRow("SELECT created_at FROM batches WHERE id = ? AND user_id = ?", id, userID).Scan(&batch.CreatedAt)
+	if err == sql.ErrNoRows {
+		return internal.Batch{}, ErrBatchNotFound
+	} else if err != nil {
+		log.Printf("Error getting batch %d for user %d: %v", id, userID, err)
+		return internal.Batch{}, err
+	}
+
+	rows, err := s.db.Query(`SELECT b.key, b.expression_id, b.error, COALESCE(e.status, ''), COALESCE(e.result, '')
+		FROM batch_items b LEFT JOIN expressions e ON e.id = b.expression_id AND e.user_id = ?
+		WHERE b.batch_id = ? ORDER BY b.position`, userID, id)
+	if err != nil {
+		log.Printf("Error getting items of batch %d: %v", id, err)
+		return internal.Batch{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var item internal.BatchItem
+		if err := rows.Scan(&item.Key, &item.ExpressionID, &item.Error, &item.Status, &item.Result); err != nil {
+			log.Printf("Error scanning item of batch %d: %v", id, err)
+			return internal.Batch{}, err
+		}
+		switch {
+		case item.Error != "":
+			item.Status = "rejected"
+			batch.Failed++
+		case item.Status == "in progress":
+			batch.InProgress++
+		case item.Status == "calculated" && !strings.HasPrefix(item.Result, "Error"):
+			batch.Calculated++
+		default:
+			batch.Failed++
+		}
+		batch.Items = append(batch.Items, item)
+	}
+	if err := rows.Err(); err != nil {
+		return internal.Batch{}, err
+	}
+
+	batch.Total = len(batch.Items)
+	batch.Status = "calculated"
+	if batch.InProgress > 0 {
+		batch.Status = "in progress"
+	}
+	return batch, nil
+}
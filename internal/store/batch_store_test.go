@@ -0,0 +1,55 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/database"
+	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchStore(t *testing.T) {
+	db, err := database.InitDB(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	userStore := store.NewUserStore(db)
+	userID, err := userStore.CreateUser("batchuser", "password")
+	require.NoError(t, err)
+	otherID, err := userStore.CreateUser("otherbatchuser", "password")
+	require.NoError(t, err)
+
+	expressionStore := store.NewExpressionStore(db)
+	require.NoError(t, expressionStore.AddExpression(internal.Expression{ID: "id1", UserID: userID, ExpressionString: "2+3", Status: "in progress"}))
+	require.NoError(t, expressionStore.AddExpression(internal.Expression{ID: "id2", UserID: userID, ExpressionString: "1/0", Status: "calculated", Result: "Error: division by zero"}))
+
+	batchStore := store.NewBatchStore(db)
+	id, err := batchStore.CreateBatch(userID, []internal.BatchItem{
+		{Key: "a", ExpressionID: "id1"},
+		{Key: "b", ExpressionID: "id2"},
+		{Key: "c", Error: "Expression is empty"},
+	})
+	require.NoError(t, err)
+
+	batch, err := batchStore.GetBatch(id, userID)
+	require.NoError(t, err)
+	assert.Equal(t, "in progress", batch.Status)
+	assert.Equal(t, 3, batch.Total)
+	assert.Equal(t, 1, batch.InProgress)
+	assert.Equal(t, 2, batch.Failed, "Rejected items and error results are failures")
+	require.Len(t, batch.Items, 3)
+	assert.Equal(t, "a", batch.Items[0].Key)
+	assert.Equal(t, "rejected", batch.Items[2].Status)
+
+	require.NoError(t, expressionStore.UpdateExpressionStatusResult("id1", "calculated", "5"))
+	batch, err = batchStore.GetBatch(id, userID)
+	require.NoError(t, err)
+	assert.Equal(t, "calculated", batch.Status)
+	assert.Equal(t, 1, batch.Calculated)
+	assert.Equal(t, "5", batch.Items[0].Result)
+
+	_, err = batchStore.GetBatch(id, otherID)
+	assert.ErrorIs(t, err, store.ErrBatchNotFound, "Batches are per user")
+}
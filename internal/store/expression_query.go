@@ -0,0 +1,196 @@
+package store
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal"
+)
+
+var (
+	ErrInvalidSort   = errors.New("invalid sort")
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// Page sizes of QueryExpressions.
+const (
+	DefaultPageSize = 100
+	MaxPageSize     = 1000
+)
+
+// sortColumns are the columns expressions can be sorted by. Each is indexed
+// together with user_id, and ties are broken by insertion order.
+var sortColumns = map[string]string{
+	"created_at": "created_at",
+	"status":     "status",
+}
+
+// ExpressionQuery selects expressions of a user. Empty fields do not filter.
+type ExpressionQuery struct {
+	Status string
+	// CreatedAfter and CreatedBefore bound the creation time, the first
+	// inclusively.
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	// Contains is a substring of the expression text.
+	Contains string
+	// Sort is a key of sortColumns, descending with a "-" prefix. The newest
+	// expressions come first by default.
+	Sort  string
+	Limit int
+	// Cursor is the NextCursor of the previous page, requested with the
+	// same sort and filters.
+	Cursor string
+}
+
+// cursor is where a page ends: the sort value and rowid of its last row,
+// and the query it belongs to.
+type cursor struct {
+	Value string `json:"v"`
+	Row   int64  `json:"r"`
+	Query string `json:"q"`
+}
+
+type ExpressionPage struct {
+	Expressions []internal.Expression `json:"expressions"`
+	// Total counts the expressions matching the filters on all pages.
+	Total int `json:"total"`
+	// NextCursor is empty on the last page.
+	NextCursor string `json:"next_cursor,omitempty"`
+}
+
+// QueryExpressions returns a page of the expressions of the user. Pages
+// continue after the sort value and row of the cursor rather than an
+// offset, so they stay consistent while expressions are added or change.
+// A cursor of another user, sort or filters is ErrInvalidCursor.
+func (s *ExpressionStore) QueryExpressions(userID int64, query ExpressionQuery) (ExpressionPage, error) {
+	sort := query.Sort
+	if sort == "" {
+		sort = "-created_at"
+	}
+	direction, after := "ASC", ">"
+	if strings.HasPrefix(sort, "-") {
+		sort = sort[1:]
+		direction, after = "DESC", "<"
+	}
+	column, ok := sortColumns[sort]
+	if !ok {
+		return ExpressionPage{}, ErrInvalidSort
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultPageSize
+	}
+	limit = min(limit, MaxPageSize)
+
+	where := "user_id = ?"
+	args := []any{userID}
+	if query.Status != "" {
+		where += " AND status = ?"
+		args = append(args, query.Status)
+	}
+	if !query.CreatedAfter.IsZero() {
+		where += " AND created_at >= ?"
+		args = append(args, sqliteTime(query.CreatedAfter))
+	}
+	if !query.CreatedBefore.IsZero() {
+		where += " AND created_at < ?"
+		args = append(args, sqliteTime(query.CreatedBefore))
+	}
+	if query.Contains != "" {
+		where += " AND instr(expression_string, ?) > 0"
+		args = append(args, query.Contains)
+	}
+
+	page := ExpressionPage{Expressions: []internal.Expression{}}
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM expressions WHERE "+where, args...).Scan(&page.Total); err != nil {
+		log.Printf("Error counting expressions for user %d: %v", userID, err)
+		return ExpressionPage{}, err
+	}
+
+	fingerprint := queryFingerprint(userID, query, sort, direction)
+	if query.Cursor != "" {
+		from, err := decodeCursor(query.Cursor)
+		if err != nil || from.Query != fingerprint {
+			return ExpressionPage{}, ErrInvalidCursor
+		}
+		where += " AND (" + column + ", rowid) " + after + " (?, ?)"
+		args = append(args, from.Value, from.Row)
+	}
+	rows, err := s.db.Query("SELECT rowid, CAST("+column+" AS TEXT), id, user_id, expression_string, status, result, unit, created_at, metadata, callback_url FROM expressions WHERE "+
+		where+" ORDER BY "+column+" "+direction+", rowid "+direction+" LIMIT ?", append(args, limit+1)...)
+	if err != nil {
+		log.Printf("Error querying expressions for user %d: %v", userID, err)
+		return ExpressionPage{}, err
+	}
+	defer rows.Close()
+
+	var last []cursor
+	for rows.Next() {
+		var end cursor
+		expr := internal.Expression{}
+		var metadata sql.NullString
+		if err := rows.Scan(&end.Row, &end.Value, &expr.ID, &expr.UserID, &expr.ExpressionString, &expr.Status, &expr.Result, &expr.Unit, &expr.CreatedAt, &metadata, &expr.CallbackURL); err != nil {
+			log.Printf("Error scanning expression row for user %d: %v", userID, err)
+			return ExpressionPage{}, err
+		}
+		expr.Metadata = decodeMetadata(metadata)
+		page.Expressions = append(page.Expressions, expr)
+		last = append(last, end)
+	}
+	if err := rows.Err(); err != nil {
+		return ExpressionPage{}, err
+	}
+	rows.Close()
+
+	if len(page.Expressions) > limit {
+		page.Expressions = page.Expressions[:limit]
+		end := last[limit-1]
+		end.Query = fingerprint
+		page.NextCursor = encodeCursor(end)
+	}
+	s.loadAllResults(page.Expressions)
+	return page, nil
+}
+
+// queryFingerprint identifies the user, sort and filters of a query, so a
+// cursor is only used to continue the pages it was made for.
+func queryFingerprint(userID int64, query ExpressionQuery, sort, direction string) string {
+	key := strings.Join([]string{
+		strconv.FormatInt(userID, 10), sort, direction, query.Status,
+		query.CreatedAfter.UTC().Format(time.RFC3339Nano), query.CreatedBefore.UTC().Format(time.RFC3339Nano), query.Contains,
+	}, "\x00")
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+func encodeCursor(c cursor) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(raw string) (cursor, error) {
+	var c cursor
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return cursor{}, err
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return cursor{}, err
+	}
+	return c, nil
+}
+
+// sqliteTime formats a time like CURRENT_TIMESTAMP, so that it compares
+// with stored timestamps as text.
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
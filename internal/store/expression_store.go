@@ -2,31 +2,72 @@ package store
 
 import (
 	"database/sql"
+	"encoding/json"
 	"log"
+	"strings"
 
 	"github.com/katierevinska/calculatorService/internal"
 )
 
 type ExpressionStore struct {
-	db *sql.DB
+	db         *sql.DB
+	onFinished func(internal.Expression)
 }
 
 func NewExpressionStore(db *sql.DB) *ExpressionStore {
 	return &ExpressionStore{db: db}
 }
 
+// OnFinished registers fn to be told, once, about every expression that
+// UpdateExpressionStatusResult takes out of progress. Expressions saved
+// finished already are not reported. It must be called before the store is
+// used.
+func (s *ExpressionStore) OnFinished(fn func(internal.Expression)) {
+	s.onFinished = fn
+}
+
+// dbtx is what saving needs from *sql.DB and *sql.Tx.
+type dbtx interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
 func (s *ExpressionStore) AddExpression(expr internal.Expression) error {
+	return addExpression(s.db, expr)
+}
+
+// AddExpressionResults saves the expression with the results of its
+// statements or elements in one transaction, so that neither is saved
+// without the other.
+func (s *ExpressionStore) AddExpressionResults(expr internal.Expression, results []internal.NamedResult) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		log.Printf("Error starting transaction for expression %s: %v", expr.ID, err)
+		return err
+	}
+	defer tx.Rollback()
+	if err := addExpression(tx, expr); err != nil {
+		return err
+	}
+	if err := addResults(tx, expr.ID, results); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func addExpression(db dbtx, expr internal.Expression) error {
 	var existingStatus string
-	err := s.db.QueryRow("SELECT status FROM expressions WHERE id = ? AND user_id = ?", expr.ID, expr.UserID).Scan(&existingStatus)
+	err := db.QueryRow("SELECT status FROM expressions WHERE id = ? AND user_id = ?", expr.ID, expr.UserID).Scan(&existingStatus)
 
 	if err == sql.ErrNoRows {
-		stmt, err := s.db.Prepare("INSERT INTO expressions (id, user_id, expression_string, status, result) VALUES (?, ?, ?, ?, ?)")
+		stmt, err := db.Prepare("INSERT INTO expressions (id, user_id, expression_string, status, result, metadata, unit, callback_url) VALUES (?, ?, ?, ?, ?, ?, ?, ?)")
 		if err != nil {
 			log.Printf("Error preparing insert statement for expression: %v", err)
 			return err
 		}
 		defer stmt.Close()
-		_, err = stmt.Exec(expr.ID, expr.UserID, expr.ExpressionString, expr.Status, expr.Result)
+		_, err = stmt.Exec(expr.ID, expr.UserID, expr.ExpressionString, expr.Status, expr.Result, encodeMetadata(expr.Metadata), expr.Unit, expr.CallbackURL)
 		if err != nil {
 			log.Printf("Error executing insert for expression %s: %v", expr.ID, err)
 		}
@@ -36,43 +77,69 @@ func (s *ExpressionStore) AddExpression(expr internal.Expression) error {
 		return err
 	}
 
-	stmt, err := s.db.Prepare("UPDATE expressions SET status = ?, result = ?, expression_string = ? WHERE id = ? AND user_id = ?")
+	stmt, err := db.Prepare("UPDATE expressions SET status = ?, result = ?, expression_string = ?, metadata = ?, unit = ?, callback_url = ? WHERE id = ? AND user_id = ?")
 	if err != nil {
 		log.Printf("Error preparing update statement for expression: %v", err)
 		return err
 	}
 	defer stmt.Close()
-	_, err = stmt.Exec(expr.Status, expr.Result, expr.ExpressionString, expr.ID, expr.UserID)
+	_, err = stmt.Exec(expr.Status, expr.Result, expr.ExpressionString, encodeMetadata(expr.Metadata), expr.Unit, expr.CallbackURL, expr.ID, expr.UserID)
 	if err != nil {
 		log.Printf("Error executing update for expression %s: %v", expr.ID, err)
 	}
 	return err
 }
 
+// UpdateExpressionStatusResult sets the status and result of the
+// expressions with the ID, one per user who submitted it. Only those that
+// were in progress are reported to OnFinished.
 func (s *ExpressionStore) UpdateExpressionStatusResult(expressionID, status, result string) error {
-	stmt, err := s.db.Prepare("UPDATE expressions SET status = ?, result = ? WHERE id = ?")
+	res, err := s.db.Exec("UPDATE expressions SET status = ?, result = ? WHERE id = ? AND status != 'in progress'", status, result, expressionID)
 	if err != nil {
-		log.Printf("Error preparing update statement for expression status/result: %v", err)
+		log.Printf("Error executing update for expression status/result %s: %v", expressionID, err)
 		return err
 	}
-	defer stmt.Close()
+	rowsAffected, _ := res.RowsAffected()
 
-	res, err := stmt.Exec(status, result, expressionID)
+	rows, err := s.db.Query("UPDATE expressions SET status = ?, result = ? WHERE id = ? AND status = 'in progress' RETURNING user_id", status, result, expressionID)
 	if err != nil {
 		log.Printf("Error executing update for expression status/result %s: %v", expressionID, err)
 		return err
 	}
-	rowsAffected, _ := res.RowsAffected()
-	if rowsAffected == 0 {
+	var userIDs []int64
+	for rows.Next() {
+		var userID int64
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		log.Printf("Error executing update for expression status/result %s: %v", expressionID, err)
+		return err
+	}
+	if rowsAffected == 0 && len(userIDs) == 0 {
 		log.Printf("No expression found with ID %s to update status/result.", expressionID)
+		return nil
+	}
+
+	if s.onFinished != nil && status != "in progress" {
+		for _, userID := range userIDs {
+			if expr, exists := s.GetExpression(expressionID, userID); exists {
+				s.onFinished(expr)
+			}
+		}
 	}
 	return nil
 }
 
 func (s *ExpressionStore) GetExpression(id string, userID int64) (internal.Expression, bool) {
 	expr := internal.Expression{}
-	err := s.db.QueryRow("SELECT id, user_id, expression_string, status, result, created_at FROM expressions WHERE id = ? AND user_id = ?", id, userID).
-		Scan(&expr.ID, &expr.UserID, &expr.ExpressionString, &expr.Status, &expr.Result, &expr.CreatedAt)
+	var metadata sql.NullString
+	err := s.db.QueryRow("SELECT id, user_id, expression_string, status, result, unit, created_at, metadata, callback_url FROM expressions WHERE id = ? AND user_id = ?", id, userID).
+		Scan(&expr.ID, &expr.UserID, &expr.ExpressionString, &expr.Status, &expr.Result, &expr.Unit, &expr.CreatedAt, &metadata, &expr.CallbackURL)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return internal.Expression{}, false
@@ -80,11 +147,13 @@ func (s *ExpressionStore) GetExpression(id string, userID int64) (internal.Expre
 		log.Printf("Error getting expression %s for user %d: %v", id, userID, err)
 		return internal.Expression{}, false
 	}
+	expr.Metadata = decodeMetadata(metadata)
+	s.loadResults(&expr)
 	return expr, true
 }
 
 func (s *ExpressionStore) GetAllExpressions(userID int64) []internal.Expression {
-	rows, err := s.db.Query("SELECT id, user_id, expression_string, status, result, created_at FROM expressions WHERE user_id = ? ORDER BY created_at DESC", userID)
+	rows, err := s.db.Query("SELECT id, user_id, expression_string, status, result, unit, created_at, metadata, callback_url FROM expressions WHERE user_id = ? ORDER BY created_at DESC", userID)
 	if err != nil {
 		log.Printf("Error getting all expressions for user %d: %v", userID, err)
 		return []internal.Expression{}
@@ -94,15 +163,230 @@ func (s *ExpressionStore) GetAllExpressions(userID int64) []internal.Expression
 	expressionsList := []internal.Expression{}
 	for rows.Next() {
 		expr := internal.Expression{}
-		err := rows.Scan(&expr.ID, &expr.UserID, &expr.ExpressionString, &expr.Status, &expr.Result, &expr.CreatedAt)
+		var metadata sql.NullString
+		err := rows.Scan(&expr.ID, &expr.UserID, &expr.ExpressionString, &expr.Status, &expr.Result, &expr.Unit, &expr.CreatedAt, &metadata, &expr.CallbackURL)
 		if err != nil {
 			log.Printf("Error scanning expression row for user %d: %v", userID, err)
 			continue
 		}
+		expr.Metadata = decodeMetadata(metadata)
 		expressionsList = append(expressionsList, expr)
 	}
 	if err = rows.Err(); err != nil {
 		log.Printf("Error after iterating expression rows for user %d: %v", userID, err)
 	}
+	rows.Close()
+	s.loadAllResults(expressionsList)
 	return expressionsList
 }
+
+// AddResults stores the statement results of a script in order. Results
+// with a TaskID stay pending until RecordTaskResult receives the task.
+func (s *ExpressionStore) AddResults(expressionID string, results []internal.NamedResult) error {
+	return addResults(s.db, expressionID, results)
+}
+
+func addResults(db dbtx, expressionID string, results []internal.NamedResult) error {
+	stmt, err := db.Prepare("INSERT INTO expression_results (expression_id, position, name, task_id, result, unit) VALUES (?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		log.Printf("Error preparing insert statement for expression results: %v", err)
+		return err
+	}
+	defer stmt.Close()
+
+	for i, result := range results {
+		value := sql.NullString{String: result.Result, Valid: result.TaskID == ""}
+		if _, err := stmt.Exec(expressionID, i, result.Name, result.TaskID, value, result.Unit); err != nil {
+			log.Printf("Error inserting result %s of expression %s: %v", result.Name, expressionID, err)
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordTaskResult fills in the script results computed by the task. Once
+// a script has no pending results left it is marked as calculated, its
+// result being the value of the last statement.
+func (s *ExpressionStore) RecordTaskResult(taskID, value string) error {
+	rows, err := s.db.Query("SELECT DISTINCT expression_id FROM expression_results WHERE task_id = ? AND result IS NULL", taskID)
+	if err != nil {
+		log.Printf("Error finding expressions waiting for task %s: %v", taskID, err)
+		return err
+	}
+	var expressionIDs []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		expressionIDs = append(expressionIDs, id)
+	}
+	rows.Close()
+	if len(expressionIDs) == 0 {
+		return nil
+	}
+
+	if _, err := s.db.Exec("UPDATE expression_results SET result = ? WHERE task_id = ? AND result IS NULL", value, taskID); err != nil {
+		log.Printf("Error recording result of task %s: %v", taskID, err)
+		return err
+	}
+
+	for _, id := range expressionIDs {
+		var pending int
+		if err := s.db.QueryRow("SELECT COUNT(*) FROM expression_results WHERE expression_id = ? AND result IS NULL", id).Scan(&pending); err != nil {
+			return err
+		}
+		if pending > 0 {
+			continue
+		}
+		final, err := s.finalResult(id)
+		if err != nil {
+			return err
+		}
+		if err := s.UpdateExpressionStatusResult(id, "calculated", final); err != nil {
+			return err
+		}
+		log.Printf("Script %s calculated with result '%s'", id, final)
+	}
+	return nil
+}
+
+// ResultTaskIDs lists the tasks computing the results of a script or the
+// elements of a matrix, in order; it is empty for other expressions,
+// whose ID is the ID of their final task.
+func (s *ExpressionStore) ResultTaskIDs(expressionID string) ([]string, error) {
+	rows, err := s.db.Query("SELECT task_id FROM expression_results WHERE expression_id = ? AND task_id != '' ORDER BY position", expressionID)
+	if err != nil {
+		log.Printf("Error getting result tasks of expression %s: %v", expressionID, err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// finalResult is the value of the last statement of a script, or the
+// assembled matrix for expressions whose results are matrix elements.
+func (s *ExpressionStore) finalResult(expressionID string) (string, error) {
+	var metadata sql.NullString
+	if err := s.db.QueryRow("SELECT metadata FROM expressions WHERE id = ?", expressionID).Scan(&metadata); err != nil {
+		return "", err
+	}
+	planned := decodeMetadata(metadata)
+	if planned == nil || planned.Shape == nil {
+		var final string
+		err := s.db.QueryRow("SELECT result FROM expression_results WHERE expression_id = ? ORDER BY position DESC LIMIT 1", expressionID).Scan(&final)
+		return final, err
+	}
+
+	rows, err := s.db.Query("SELECT result FROM expression_results WHERE expression_id = ? ORDER BY position", expressionID)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	var elements []string
+	for rows.Next() {
+		var element string
+		if err := rows.Scan(&element); err != nil {
+			return "", err
+		}
+		elements = append(elements, element)
+	}
+	return internal.AssembleMatrix(planned.Shape, elements), rows.Err()
+}
+
+// resultsBatch bounds the expressions whose results loadAllResults reads
+// with one query, below the SQLite limit on query parameters.
+const resultsBatch = 500
+
+// loadAllResults attaches the named script results of the expressions like
+// loadResults, with one query per resultsBatch expressions.
+func (s *ExpressionStore) loadAllResults(exprs []internal.Expression) {
+	for start := 0; start < len(exprs); start += resultsBatch {
+		batch := exprs[start:min(start+resultsBatch, len(exprs))]
+		positions := make(map[string][]int, len(batch))
+		args := make([]any, 0, len(batch))
+		for i, expr := range batch {
+			if _, seen := positions[expr.ID]; !seen {
+				args = append(args, expr.ID)
+			}
+			positions[expr.ID] = append(positions[expr.ID], i)
+		}
+
+		rows, err := s.db.Query("SELECT expression_id, name, result, unit FROM expression_results WHERE expression_id IN (?"+
+			strings.Repeat(", ?", len(args)-1)+") AND name != '' ORDER BY expression_id, position", args...)
+		if err != nil {
+			log.Printf("Error getting results of %d expressions: %v", len(batch), err)
+			return
+		}
+		for rows.Next() {
+			var id string
+			var result internal.NamedResult
+			var value sql.NullString
+			if err := rows.Scan(&id, &result.Name, &value, &result.Unit); err != nil {
+				log.Printf("Error scanning result row of expression %s: %v", id, err)
+				continue
+			}
+			result.Result = value.String
+			for _, i := range positions[id] {
+				batch[i].Results = append(batch[i].Results, result)
+			}
+		}
+		rows.Close()
+	}
+}
+
+// loadResults attaches the named script results, pending ones without a
+// value.
+func (s *ExpressionStore) loadResults(expr *internal.Expression) {
+	rows, err := s.db.Query("SELECT name, result, unit FROM expression_results WHERE expression_id = ? AND name != '' ORDER BY position", expr.ID)
+	if err != nil {
+		log.Printf("Error getting results of expression %s: %v", expr.ID, err)
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result internal.NamedResult
+		var value sql.NullString
+		if err := rows.Scan(&result.Name, &value, &result.Unit); err != nil {
+			log.Printf("Error scanning result row of expression %s: %v", expr.ID, err)
+			continue
+		}
+		result.Result = value.String
+		expr.Results = append(expr.Results, result)
+	}
+}
+
+func encodeMetadata(metadata *internal.ExpressionMetadata) sql.NullString {
+	if metadata == nil {
+		return sql.NullString{}
+	}
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		log.Printf("Error encoding expression metadata: %v", err)
+		return sql.NullString{}
+	}
+	return sql.NullString{String: string(data), Valid: true}
+}
+
+func decodeMetadata(value sql.NullString) *internal.ExpressionMetadata {
+	if !value.Valid {
+		return nil
+	}
+	metadata := &internal.ExpressionMetadata{}
+	if err := json.Unmarshal([]byte(value.String), metadata); err != nil {
+		log.Printf("Error decoding expression metadata: %v", err)
+		return nil
+	}
+	return metadata
+}
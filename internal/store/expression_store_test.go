@@ -2,7 +2,10 @@ package store_test
 
 import (
 	"database/sql"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/katierevinska/calculatorService/internal"
 	"github.com/katierevinska/calculatorService/internal/database"
@@ -116,3 +119,212 @@ func TestExpressionStore(t *testing.T) {
 		assert.False(t, exists)
 	})
 }
+
+func TestExpressionStore_QueryExpressions(t *testing.T) {
+	db, userID, teardown := setupExpressionStoreTestDB(t)
+	defer teardown()
+
+	exprStore := store.NewExpressionStore(db)
+	for i, expression := range []string{"1+1", "2*3", "4+5", "sqrt(16)", "7-1"} {
+		status := "calculated"
+		if i%2 == 1 {
+			status = "in progress"
+		}
+		require.NoError(t, exprStore.AddExpression(internal.Expression{ID: "q" + strconv.Itoa(i), UserID: userID, ExpressionString: expression, Status: status}))
+	}
+	otherID, err := store.NewUserStore(db).CreateUser("queryother", "password")
+	require.NoError(t, err)
+	require.NoError(t, exprStore.AddExpression(internal.Expression{ID: "other", UserID: otherID, ExpressionString: "1+1", Status: "calculated"}))
+
+	var ids []string
+	cursor := ""
+	for {
+		page, err := exprStore.QueryExpressions(userID, store.ExpressionQuery{Limit: 2, Cursor: cursor})
+		require.NoError(t, err)
+		assert.Equal(t, 5, page.Total)
+		for _, expr := range page.Expressions {
+			ids = append(ids, expr.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+	assert.Equal(t, []string{"q4", "q3", "q2", "q1", "q0"}, ids, "Newest first by default, every expression once")
+
+	page, err := exprStore.QueryExpressions(userID, store.ExpressionQuery{Sort: "status"})
+	require.NoError(t, err)
+	assert.Equal(t, "calculated", page.Expressions[0].Status)
+	assert.Equal(t, "in progress", page.Expressions[4].Status)
+
+	page, err = exprStore.QueryExpressions(userID, store.ExpressionQuery{Status: "in progress"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, page.Total)
+
+	page, err = exprStore.QueryExpressions(userID, store.ExpressionQuery{Contains: "+"})
+	require.NoError(t, err)
+	assert.Equal(t, 2, page.Total)
+
+	page, err = exprStore.QueryExpressions(userID, store.ExpressionQuery{CreatedAfter: time.Now().Add(-time.Hour), CreatedBefore: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Equal(t, 5, page.Total)
+	page, err = exprStore.QueryExpressions(userID, store.ExpressionQuery{CreatedAfter: time.Now().Add(time.Hour)})
+	require.NoError(t, err)
+	assert.Zero(t, page.Total)
+	assert.NotNil(t, page.Expressions)
+
+	_, err = exprStore.QueryExpressions(userID, store.ExpressionQuery{Sort: "result"})
+	assert.ErrorIs(t, err, store.ErrInvalidSort)
+	other, err := exprStore.QueryExpressions(otherID, store.ExpressionQuery{Limit: 1})
+	require.NoError(t, err)
+	_, err = exprStore.QueryExpressions(otherID, store.ExpressionQuery{Cursor: cursor})
+	assert.ErrorIs(t, err, store.ErrInvalidCursor, "Cursors only continue the expressions of their user")
+	assert.Len(t, other.Expressions, 1)
+
+	first, err := exprStore.QueryExpressions(userID, store.ExpressionQuery{Sort: "status", Limit: 2})
+	require.NoError(t, err)
+	_, err = exprStore.QueryExpressions(userID, store.ExpressionQuery{Cursor: first.NextCursor})
+	assert.ErrorIs(t, err, store.ErrInvalidCursor, "Cursors only continue the sort they were made for")
+	_, err = exprStore.QueryExpressions(userID, store.ExpressionQuery{Sort: "status", Status: "calculated", Cursor: first.NextCursor})
+	assert.ErrorIs(t, err, store.ErrInvalidCursor, "Cursors only continue the filters they were made for")
+	_, err = exprStore.QueryExpressions(userID, store.ExpressionQuery{Sort: "status", Cursor: "bm90IGEgY3Vyc29y"})
+	assert.ErrorIs(t, err, store.ErrInvalidCursor)
+
+	// the last row of the page changing its status moves the row, not the
+	// place the next page starts from
+	require.NoError(t, exprStore.UpdateExpressionStatusResult(first.Expressions[1].ID, "in progress", ""))
+	rest, err := exprStore.QueryExpressions(userID, store.ExpressionQuery{Sort: "status", Cursor: first.NextCursor})
+	require.NoError(t, err)
+	require.NotEmpty(t, rest.Expressions)
+	assert.Equal(t, "q4", rest.Expressions[0].ID)
+}
+
+func TestExpressionStore_ScriptResults(t *testing.T) {
+	db, userID, teardown := setupExpressionStoreTestDB(t)
+	defer teardown()
+
+	exprStore := store.NewExpressionStore(db)
+	require.NoError(t, exprStore.AddExpression(internal.Expression{ID: "script-1", UserID: userID, ExpressionString: "a = 2+3; b = 4; a*b", Status: "in progress"}))
+	require.NoError(t, exprStore.AddResults("script-1", []internal.NamedResult{
+		{Name: "a", TaskID: "id1"},
+		{Name: "b", Result: "4", Unit: "m"},
+		{Name: "", TaskID: "id2"},
+	}))
+
+	expr, exists := exprStore.GetExpression("script-1", userID)
+	require.True(t, exists)
+	assert.Equal(t, []internal.NamedResult{{Name: "a"}, {Name: "b", Result: "4", Unit: "m"}}, expr.Results)
+
+	require.NoError(t, exprStore.RecordTaskResult("id1", "5"))
+	expr, _ = exprStore.GetExpression("script-1", userID)
+	assert.Equal(t, "in progress", expr.Status)
+	assert.Equal(t, "5", expr.Results[0].Result)
+
+	require.NoError(t, exprStore.RecordTaskResult("unrelated", "1"))
+	require.NoError(t, exprStore.RecordTaskResult("id2", "20"))
+	expr, _ = exprStore.GetExpression("script-1", userID)
+	assert.Equal(t, "calculated", expr.Status)
+	assert.Equal(t, "20", expr.Result)
+
+	all := exprStore.GetAllExpressions(userID)
+	require.Len(t, all, 1)
+	assert.Len(t, all[0].Results, 2)
+}
+
+func TestExpressionStore_AddExpressionResults(t *testing.T) {
+	db, userID, teardown := setupExpressionStoreTestDB(t)
+	defer teardown()
+
+	exprStore := store.NewExpressionStore(db)
+	script := internal.Expression{ID: "script-1", UserID: userID, ExpressionString: "a = 2+3; a", Status: "in progress"}
+	results := []internal.NamedResult{{Name: "a", TaskID: "id1"}}
+	require.NoError(t, exprStore.AddExpressionResults(script, results))
+
+	script.Status, script.Result = "calculated", "5"
+	assert.Error(t, exprStore.AddExpressionResults(script, results), "The results are saved already")
+	expr, exists := exprStore.GetExpression("script-1", userID)
+	require.True(t, exists)
+	assert.Equal(t, "in progress", expr.Status, "The expression is not saved without its results")
+	assert.Equal(t, []internal.NamedResult{{Name: "a"}}, expr.Results)
+}
+
+func TestExpressionStore_OnFinished(t *testing.T) {
+	db, userID, teardown := setupExpressionStoreTestDB(t)
+	defer teardown()
+
+	exprStore := store.NewExpressionStore(db)
+	var finished []internal.Expression
+	exprStore.OnFinished(func(expr internal.Expression) { finished = append(finished, expr) })
+	require.NoError(t, exprStore.AddExpression(internal.Expression{ID: "id1", UserID: userID, ExpressionString: "2+3", Status: "in progress"}))
+	require.NoError(t, exprStore.AddExpression(internal.Expression{ID: "script-1", UserID: userID, ExpressionString: "a = 2+3; a", Status: "in progress"}))
+	require.NoError(t, exprStore.AddResults("script-1", []internal.NamedResult{{Name: "a", TaskID: "id1"}}))
+
+	require.NoError(t, exprStore.UpdateExpressionStatusResult("id1", "calculated", "5"))
+	require.NoError(t, exprStore.RecordTaskResult("id1", "5"))
+	require.Len(t, finished, 2, "Expressions and scripts are reported when their last result comes in")
+	assert.Equal(t, "5", finished[0].Result)
+	assert.Equal(t, "script-1", finished[1].ID)
+	assert.Equal(t, []internal.NamedResult{{Name: "a", Result: "5"}}, finished[1].Results)
+
+	require.NoError(t, exprStore.UpdateExpressionStatusResult("id1", "calculated", "5"))
+	assert.Len(t, finished, 2, "Finished expressions are reported once")
+}
+
+func TestExpressionStore_MatrixResults(t *testing.T) {
+	db, userID, teardown := setupExpressionStoreTestDB(t)
+	defer teardown()
+
+	exprStore := store.NewExpressionStore(db)
+	metadata := &internal.ExpressionMetadata{Operations: 4, Tasks: 4, Shape: []int{2, 2}}
+	require.NoError(t, exprStore.AddExpression(internal.Expression{ID: "matrix-1", UserID: userID, ExpressionString: "[[1,2],[3,4]] * 2", Status: "in progress", Metadata: metadata}))
+	require.NoError(t, exprStore.AddResults("matrix-1", []internal.NamedResult{
+		{TaskID: "id1"}, {Result: "4"}, {TaskID: "id2"}, {TaskID: "id1"},
+	}))
+	ids, err := exprStore.ResultTaskIDs("matrix-1")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id1", "id2", "id1"}, ids)
+
+	require.NoError(t, exprStore.RecordTaskResult("id1", "2"))
+	require.NoError(t, exprStore.RecordTaskResult("id2", "6"))
+	expr, exists := exprStore.GetExpression("matrix-1", userID)
+	require.True(t, exists)
+	assert.Equal(t, "calculated", expr.Status)
+	assert.Equal(t, "[[2, 4], [6, 2]]", expr.Result)
+	assert.Empty(t, expr.Results, "Elements have no names")
+	assert.Equal(t, []int{2, 2}, expr.Metadata.Shape)
+}
+
+func TestExpressionStore_Metadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "old.db")
+	oldDB, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = oldDB.Exec(`CREATE TABLE expressions (
+		id TEXT PRIMARY KEY,
+		user_id INTEGER NOT NULL,
+		expression_string TEXT NOT NULL,
+		status TEXT NOT NULL,
+		result TEXT,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	)`)
+	require.NoError(t, err)
+	_, err = oldDB.Exec("INSERT INTO expressions (id, user_id, expression_string, status, result) VALUES ('old', 1, '1+1', 'calculated', '2')")
+	require.NoError(t, err)
+	oldDB.Close()
+
+	db, err := database.InitDB(path)
+	require.NoError(t, err, "Databases without the metadata column are upgraded")
+	defer db.Close()
+	exprStore := store.NewExpressionStore(db)
+
+	old, exists := exprStore.GetExpression("old", 1)
+	require.True(t, exists)
+	assert.Nil(t, old.Metadata)
+	assert.Empty(t, old.Unit)
+
+	metadata := &internal.ExpressionMetadata{Operations: 5, Tasks: 3, DedupRatio: 0.4}
+	require.NoError(t, exprStore.AddExpression(internal.Expression{ID: "new", UserID: 1, ExpressionString: "(1 km+2 m)*(1+2)", Status: "in progress", Unit: "km", Metadata: metadata}))
+	retrieved, exists := exprStore.GetExpression("new", 1)
+	require.True(t, exists)
+	assert.Equal(t, metadata, retrieved.Metadata)
+	assert.Equal(t, "km", retrieved.Unit)
+}
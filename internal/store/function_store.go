@@ -0,0 +1,96 @@
+package store
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	"github.com/katierevinska/calculatorService/internal"
+)
+
+var ErrFunctionNotFound = errors.New("function not found")
+var ErrFunctionExists = errors.New("function with this name already exists")
+
+type FunctionStore struct {
+	db *sql.DB
+}
+
+func NewFunctionStore(db *sql.DB) *FunctionStore {
+	return &FunctionStore{db: db}
+}
+
+func (s *FunctionStore) CreateFunction(fn internal.Function) error {
+	var existing string
+	err := s.db.QueryRow("SELECT name FROM functions WHERE user_id = ? AND name = ?", fn.UserID, fn.Name).Scan(&existing)
+	if err == nil {
+		return ErrFunctionExists
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+
+	_, err = s.db.Exec("INSERT INTO functions (user_id, name, definition) VALUES (?, ?, ?)", fn.UserID, fn.Name, fn.Definition)
+	if err != nil {
+		log.Printf("Error inserting function %s for user %d: %v", fn.Name, fn.UserID, err)
+	}
+	return err
+}
+
+func (s *FunctionStore) UpdateFunction(fn internal.Function) error {
+	res, err := s.db.Exec("UPDATE functions SET definition = ? WHERE user_id = ? AND name = ?", fn.Definition, fn.UserID, fn.Name)
+	if err != nil {
+		log.Printf("Error updating function %s for user %d: %v", fn.Name, fn.UserID, err)
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return ErrFunctionNotFound
+	}
+	return nil
+}
+
+func (s *FunctionStore) DeleteFunction(name string, userID int64) error {
+	res, err := s.db.Exec("DELETE FROM functions WHERE user_id = ? AND name = ?", userID, name)
+	if err != nil {
+		log.Printf("Error deleting function %s for user %d: %v", name, userID, err)
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return ErrFunctionNotFound
+	}
+	return nil
+}
+
+func (s *FunctionStore) GetFunction(name string, userID int64) (internal.Function, bool) {
+	fn := internal.Function{}
+	err := s.db.QueryRow("SELECT name, user_id, definition, created_at FROM functions WHERE user_id = ? AND name = ?", userID, name).
+		Scan(&fn.Name, &fn.UserID, &fn.Definition, &fn.CreatedAt)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error getting function %s for user %d: %v", name, userID, err)
+		}
+		return internal.Function{}, false
+	}
+	return fn, true
+}
+
+func (s *FunctionStore) GetAllFunctions(userID int64) []internal.Function {
+	rows, err := s.db.Query("SELECT name, user_id, definition, created_at FROM functions WHERE user_id = ? ORDER BY name", userID)
+	if err != nil {
+		log.Printf("Error getting functions for user %d: %v", userID, err)
+		return []internal.Function{}
+	}
+	defer rows.Close()
+
+	functions := []internal.Function{}
+	for rows.Next() {
+		fn := internal.Function{}
+		if err := rows.Scan(&fn.Name, &fn.UserID, &fn.Definition, &fn.CreatedAt); err != nil {
+			log.Printf("Error scanning function row for user %d: %v", userID, err)
+			continue
+		}
+		functions = append(functions, fn)
+	}
+	if err = rows.Err(); err != nil {
+		log.Printf("Error after iterating function rows for user %d: %v", userID, err)
+	}
+	return functions
+}
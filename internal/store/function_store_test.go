@@ -0,0 +1,51 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/database"
+	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFunctionStore(t *testing.T) {
+	db, err := database.InitDB(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	userStore := store.NewUserStore(db)
+	userID, err := userStore.CreateUser("funcuser", "password")
+	require.NoError(t, err)
+	otherID, err := userStore.CreateUser("otherfuncuser", "password")
+	require.NoError(t, err)
+
+	functionStore := store.NewFunctionStore(db)
+	fn := internal.Function{Name: "f", UserID: userID, Definition: "f(x) = x+1"}
+
+	require.NoError(t, functionStore.CreateFunction(fn))
+	assert.ErrorIs(t, functionStore.CreateFunction(fn), store.ErrFunctionExists)
+	require.NoError(t, functionStore.CreateFunction(internal.Function{Name: "f", UserID: otherID, Definition: "f(x) = x"}),
+		"Function names are per user")
+
+	retrieved, exists := functionStore.GetFunction("f", userID)
+	require.True(t, exists)
+	assert.Equal(t, fn.Definition, retrieved.Definition)
+	assert.NotEmpty(t, retrieved.CreatedAt)
+
+	fn.Definition = "f(x) = x+2"
+	require.NoError(t, functionStore.UpdateFunction(fn))
+	retrieved, _ = functionStore.GetFunction("f", userID)
+	assert.Equal(t, "f(x) = x+2", retrieved.Definition)
+	assert.ErrorIs(t, functionStore.UpdateFunction(internal.Function{Name: "g", UserID: userID, Definition: "g(x) = x"}), store.ErrFunctionNotFound)
+
+	assert.Len(t, functionStore.GetAllFunctions(userID), 1)
+
+	require.NoError(t, functionStore.DeleteFunction("f", userID))
+	assert.ErrorIs(t, functionStore.DeleteFunction("f", userID), store.ErrFunctionNotFound)
+	_, exists = functionStore.GetFunction("f", userID)
+	assert.False(t, exists)
+	_, exists = functionStore.GetFunction("f", otherID)
+	assert.True(t, exists)
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"database/sql"
+	"log"
+	"time"
+)
+
+// StoredResponse is the response remembered for an idempotency key. A zero
+// StatusCode means the first request with the key is still being handled.
+type StoredResponse struct {
+	RequestHash  string
+	StatusCode   int
+	Body         []byte
+	ExpressionID string
+}
+
+// IdempotencyStore remembers the responses to requests sent with an
+// idempotency key, so that retried requests get the same response instead
+// of being handled again. Keys are per user and expire after the retention.
+type IdempotencyStore struct {
+	db        *sql.DB
+	retention time.Duration
+	// InFlightExpiry frees keys whose request never completed them, e.g.
+	// because the server crashed, so retries are not refused for the
+	// whole retention. It must exceed the longest request.
+	InFlightExpiry time.Duration
+}
+
+// DefaultInFlightExpiry covers the longest wait of a calculate request.
+const DefaultInFlightExpiry = 5 * time.Minute
+
+func NewIdempotencyStore(db *sql.DB, retention time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{db: db, retention: retention, InFlightExpiry: DefaultInFlightExpiry}
+}
+
+// Reserve claims the key for a request. It reports true if the key was
+// free; otherwise it returns what is stored for the key.
+func (s *IdempotencyStore) Reserve(userID int64, key, requestHash string) (StoredResponse, bool, error) {
+	now := time.Now()
+	if _, err := s.db.Exec("DELETE FROM idempotency_keys WHERE created_at < ? OR (status_code = 0 AND created_at < ?)",
+		now.Add(-s.retention).UnixNano(), now.Add(-s.InFlightExpiry).UnixNano()); err != nil {
+		log.Printf("Error removing expired idempotency keys: %v", err)
+		return StoredResponse{}, false, err
+	}
+
+	res, err := s.db.Exec("INSERT OR IGNORE INTO idempotency_keys (user_id, key, request_hash, status_code, response, expression_id, created_at) VALUES (?, ?, ?, 0, '', '', ?)",
+		userID, key, requestHash, now.UnixNano())
+	if err != nil {
+		log.Printf("Error reserving idempotency key for user %d: %v", userID, err)
+		return StoredResponse{}, false, err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 1 {
+		return StoredResponse{}, true, nil
+	}
+
+	var stored StoredResponse
+	var body string
+	err = s.db.QueryRow("SELECT request_hash, status_code, response, expression_id FROM idempotency_keys WHERE user_id = ? AND key = ?", userID, key).
+		Scan(&stored.RequestHash, &stored.StatusCode, &body, &stored.ExpressionID)
+	if err != nil {
+		log.Printf("Error getting idempotency key for user %d: %v", userID, err)
+		return StoredResponse{}, false, err
+	}
+	stored.Body = []byte(body)
+	return stored, false, nil
+}
+
+// Complete stores the response to the request that reserved the key.
+func (s *IdempotencyStore) Complete(userID int64, key string, response StoredResponse) error {
+	_, err := s.db.Exec("UPDATE idempotency_keys SET status_code = ?, response = ?, expression_id = ? WHERE user_id = ? AND key = ?",
+		response.StatusCode, string(response.Body), response.ExpressionID, userID, key)
+	if err != nil {
+		log.Printf("Error saving response for idempotency key of user %d: %v", userID, err)
+	}
+	return err
+}
+
+// Release frees the key of a request that failed, so it can be retried.
+func (s *IdempotencyStore) Release(userID int64, key string) error {
+	_, err := s.db.Exec("DELETE FROM idempotency_keys WHERE user_id = ? AND key = ?", userID, key)
+	if err != nil {
+		log.Printf("Error releasing idempotency key of user %d: %v", userID, err)
+	}
+	return err
+}
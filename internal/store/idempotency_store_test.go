@@ -0,0 +1,56 @@
+package store_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal/database"
+	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotencyStore(t *testing.T) {
+	db, err := database.InitDB(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	userStore := store.NewUserStore(db)
+	userID, err := userStore.CreateUser("idempotentuser", "password")
+	require.NoError(t, err)
+	otherID, err := userStore.CreateUser("otheridempotentuser", "password")
+	require.NoError(t, err)
+
+	keys := store.NewIdempotencyStore(db, time.Hour)
+	_, reserved, err := keys.Reserve(userID, "key", "hash")
+	require.NoError(t, err)
+	assert.True(t, reserved)
+
+	stored, reserved, err := keys.Reserve(userID, "key", "hash")
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Zero(t, stored.StatusCode, "The first request is still being handled")
+
+	require.NoError(t, keys.Complete(userID, "key", store.StoredResponse{StatusCode: 201, Body: []byte(`{"id":"id1"}`), ExpressionID: "id1"}))
+	stored, reserved, err = keys.Reserve(userID, "key", "other hash")
+	require.NoError(t, err)
+	assert.False(t, reserved)
+	assert.Equal(t, "hash", stored.RequestHash)
+	assert.Equal(t, 201, stored.StatusCode)
+	assert.Equal(t, `{"id":"id1"}`, string(stored.Body))
+	assert.Equal(t, "id1", stored.ExpressionID)
+
+	_, reserved, err = keys.Reserve(otherID, "key", "hash")
+	require.NoError(t, err)
+	assert.True(t, reserved, "Keys are per user")
+
+	require.NoError(t, keys.Release(otherID, "key"))
+	_, reserved, err = keys.Reserve(otherID, "key", "hash")
+	require.NoError(t, err)
+	assert.True(t, reserved, "A released key can be used again")
+
+	expired := store.NewIdempotencyStore(db, 0)
+	_, reserved, err = expired.Reserve(userID, "key", "other hash")
+	require.NoError(t, err)
+	assert.True(t, reserved, "Keys older than the retention are forgotten")
+}
@@ -0,0 +1,298 @@
+package store
+
+import (
+	"container/list"
+	"database/sql"
+	"log"
+	"math/big"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/pkg/operations"
+)
+
+// CacheKey identifies a computation independently of who asked for it:
+// the operation, its normalised arguments and the precision results are
+// reported with. ok is false while an argument is not a number yet.
+// Complex tasks get keys of their own, since sqrt(-4) is 2i for them and
+// an error otherwise, and so do integer tasks, whose 7/2 is an error.
+func CacheKey(task internal.Task) (key string, ok bool) {
+	normalise := normaliseArg
+	if task.Integer {
+		normalise = normaliseInteger
+	}
+	arg1, ok1 := normalise(task.Arg1)
+	arg2, ok2 := normalise(task.Arg2)
+	if !ok1 || !ok2 {
+		return "", false
+	}
+	key = task.Operation + "|" + arg1 + "|" + arg2 + "|" + strconv.Itoa(operations.ResultPrecision)
+	switch {
+	case task.Complex:
+		key += "|complex"
+	case task.Integer:
+		key += "|integer"
+	}
+	return key, true
+}
+
+// normaliseInteger keeps every digit: integers above 2^53 that float64
+// cannot tell apart are different arguments.
+func normaliseInteger(arg string) (string, bool) {
+	if arg == "" {
+		return "", true
+	}
+	v, ok := new(big.Int).SetString(arg, 10)
+	if !ok {
+		return "", false
+	}
+	return v.String(), true
+}
+
+// normaliseArg makes "2", "2.0" and "2.0000000000" the same argument.
+func normaliseArg(arg string) (string, bool) {
+	if arg == "" {
+		return "", true
+	}
+	v, err := strconv.ParseComplex(arg, 128)
+	if err != nil {
+		return "", false
+	}
+	if imag(v) != 0 {
+		return strconv.FormatComplex(v, 'g', -1, 128), true
+	}
+	return strconv.FormatFloat(real(v), 'g', -1, 64), true
+}
+
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+}
+
+type cacheEntry struct {
+	key       string
+	result    string
+	createdAt time.Time
+	lastUsed  time.Time
+}
+
+// cacheFlushInterval is how often changed entries are written to SQLite.
+const cacheFlushInterval = time.Second
+
+// ResultCache is an LRU cache of task results shared by all users. Entries
+// live at most ttl (0 means forever) and are kept in SQLite, so the cache
+// survives restarts. Get and Put only touch memory, as the task store
+// calls them while it is locked; changes are written in the background
+// every cacheFlushInterval and by Close.
+type ResultCache struct {
+	db       *sql.DB
+	capacity int
+	ttl      time.Duration
+	entries  map[string]*list.Element
+	order    *list.List // most recently used first
+	stats    CacheStats
+	// dirty are the keys changed since the last flush, including removed
+	// ones.
+	dirty map[string]bool
+	mu    sync.Mutex
+
+	flushMu sync.Mutex
+	stop    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+func NewResultCache(db *sql.DB, capacity int, ttl time.Duration) (*ResultCache, error) {
+	c := &ResultCache{
+		db:       db,
+		capacity: capacity,
+		ttl:      ttl,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		dirty:    make(map[string]bool),
+		stop:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	go c.flushPeriodically()
+	return c, nil
+}
+
+func (c *ResultCache) flushPeriodically() {
+	defer close(c.stopped)
+	ticker := time.NewTicker(cacheFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Flush()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// Close stops the background writes and writes the pending changes.
+func (c *ResultCache) Close() {
+	c.once.Do(func() {
+		close(c.stop)
+		<-c.stopped
+		c.Flush()
+	})
+}
+
+// Flush writes the entries changed since the last flush in one
+// transaction.
+func (c *ResultCache) Flush() {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	if len(c.dirty) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	var changed []cacheEntry
+	var removed []string
+	for key := range c.dirty {
+		if element, exists := c.entries[key]; exists {
+			changed = append(changed, *element.Value.(*cacheEntry))
+		} else {
+			removed = append(removed, key)
+		}
+	}
+	c.dirty = make(map[string]bool)
+	c.mu.Unlock()
+
+	tx, err := c.db.Begin()
+	if err != nil {
+		log.Printf("Error writing result cache: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	for _, entry := range changed {
+		_, err := tx.Exec("INSERT OR REPLACE INTO result_cache (key, result, created_at, last_used) VALUES (?, ?, ?, ?)",
+			entry.key, entry.result, entry.createdAt.UnixNano(), entry.lastUsed.UnixNano())
+		if err != nil {
+			log.Printf("Error persisting cached result %s: %v", entry.key, err)
+			return
+		}
+	}
+	for _, key := range removed {
+		if _, err := tx.Exec("DELETE FROM result_cache WHERE key = ?", key); err != nil {
+			log.Printf("Error deleting cached result %s: %v", key, err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Error writing result cache: %v", err)
+	}
+}
+
+// load restores the persisted entries, least recently used first, so that
+// the in-memory order matches the order before the restart.
+func (c *ResultCache) load() error {
+	rows, err := c.db.Query("SELECT key, result, created_at, last_used FROM result_cache ORDER BY last_used")
+	if err != nil {
+		return err
+	}
+	var loaded []cacheEntry
+	for rows.Next() {
+		var entry cacheEntry
+		var createdAt, lastUsed int64
+		if err := rows.Scan(&entry.key, &entry.result, &createdAt, &lastUsed); err != nil {
+			rows.Close()
+			return err
+		}
+		entry.createdAt, entry.lastUsed = time.Unix(0, createdAt), time.Unix(0, lastUsed)
+		loaded = append(loaded, entry)
+	}
+	rows.Close()
+
+	c.mu.Lock()
+	for _, entry := range loaded {
+		if c.expired(entry) {
+			c.dirty[entry.key] = true
+			continue
+		}
+		c.entries[entry.key] = c.order.PushFront(&entry)
+	}
+	for c.order.Len() > c.capacity {
+		c.evictOldest()
+	}
+	log.Printf("Result cache loaded with %d entries", c.order.Len())
+	c.mu.Unlock()
+	c.Flush()
+	return nil
+}
+
+func (c *ResultCache) Get(key string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, exists := c.entries[key]
+	if exists && c.expired(*element.Value.(*cacheEntry)) {
+		c.remove(element)
+		exists = false
+	}
+	if !exists {
+		c.stats.Misses++
+		return "", false
+	}
+	c.stats.Hits++
+	c.order.MoveToFront(element)
+	entry := element.Value.(*cacheEntry)
+	entry.lastUsed = time.Now()
+	c.dirty[key] = true
+	return entry.result, true
+}
+
+func (c *ResultCache) Put(key, result string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if element, exists := c.entries[key]; exists {
+		c.order.MoveToFront(element)
+		entry := element.Value.(*cacheEntry)
+		entry.result = result
+		entry.createdAt, entry.lastUsed = now, now
+	} else {
+		c.entries[key] = c.order.PushFront(&cacheEntry{key: key, result: result, createdAt: now, lastUsed: now})
+	}
+	c.dirty[key] = true
+	for c.order.Len() > c.capacity {
+		c.evictOldest()
+	}
+}
+
+func (c *ResultCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Size = c.order.Len()
+	stats.Capacity = c.capacity
+	return stats
+}
+
+func (c *ResultCache) expired(entry cacheEntry) bool {
+	return c.ttl > 0 && time.Since(entry.createdAt) > c.ttl
+}
+
+func (c *ResultCache) evictOldest() {
+	c.remove(c.order.Back())
+	c.stats.Evictions++
+}
+
+func (c *ResultCache) remove(element *list.Element) {
+	entry := c.order.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.dirty[entry.key] = true
+}
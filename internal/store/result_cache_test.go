@@ -0,0 +1,156 @@
+package store_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/database"
+	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheKey(t *testing.T) {
+	key1, ok := store.CacheKey(internal.Task{Operation: "+", Arg1: "2", Arg2: "3.0000000000"})
+	require.True(t, ok)
+	key2, _ := store.CacheKey(internal.Task{Operation: "+", Arg1: "2.0", Arg2: "3"})
+	assert.Equal(t, key1, key2, "Numerically equal arguments share a key")
+
+	key3, _ := store.CacheKey(internal.Task{Operation: "+", Arg1: "3", Arg2: "2"})
+	assert.NotEqual(t, key1, key3)
+	key4, _ := store.CacheKey(internal.Task{Operation: "-", Arg1: "2", Arg2: "3"})
+	assert.NotEqual(t, key1, key4)
+
+	_, ok = store.CacheKey(internal.Task{Operation: "+", Arg1: "id1", Arg2: "3"})
+	assert.False(t, ok)
+	_, ok = store.CacheKey(internal.Task{Operation: "sqrt", Arg1: "4"})
+	assert.True(t, ok)
+
+	realKey, _ := store.CacheKey(internal.Task{Operation: "sqrt", Arg1: "-4"})
+	complexKey, ok := store.CacheKey(internal.Task{Operation: "sqrt", Arg1: "-4+0i", Complex: true})
+	require.True(t, ok)
+	assert.NotEqual(t, realKey, complexKey, "Complex tasks do not share results with real ones")
+	key5, _ := store.CacheKey(internal.Task{Operation: "*", Arg1: "1+2i", Arg2: "3", Complex: true})
+	key6, _ := store.CacheKey(internal.Task{Operation: "*", Arg1: "1.0000000000+2.0000000000i", Arg2: "3.0", Complex: true})
+	assert.Equal(t, key5, key6)
+
+	integerKey, ok := store.CacheKey(internal.Task{Operation: "/", Arg1: "7", Arg2: "2", Integer: true})
+	require.True(t, ok)
+	divisionKey, _ := store.CacheKey(internal.Task{Operation: "/", Arg1: "7", Arg2: "2"})
+	assert.NotEqual(t, divisionKey, integerKey, "Integer tasks do not share results with real ones")
+	key7, _ := store.CacheKey(internal.Task{Operation: "+", Arg1: "9007199254740993", Arg2: "1", Integer: true})
+	key8, _ := store.CacheKey(internal.Task{Operation: "+", Arg1: "9007199254740992", Arg2: "1", Integer: true})
+	assert.NotEqual(t, key7, key8, "Integer arguments keep every digit")
+}
+
+func TestResultCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	db, err := database.InitDB(path)
+	require.NoError(t, err)
+
+	cache, err := store.NewResultCache(db, 2, 0)
+	require.NoError(t, err)
+
+	_, hit := cache.Get("a")
+	assert.False(t, hit)
+	cache.Put("a", "1")
+	cache.Put("b", "2")
+	value, hit := cache.Get("a")
+	require.True(t, hit)
+	assert.Equal(t, "1", value)
+
+	cache.Put("c", "3")
+	_, hit = cache.Get("b")
+	assert.False(t, hit, "The least recently used entry is evicted")
+
+	assert.Equal(t, store.CacheStats{Hits: 1, Misses: 2, Evictions: 1, Size: 2, Capacity: 2}, cache.Stats())
+	var rows int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM result_cache").Scan(&rows))
+	assert.Zero(t, rows, "Entries are written in the background")
+	cache.Close()
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM result_cache").Scan(&rows))
+	assert.Equal(t, 2, rows, "Close writes the pending changes")
+	db.Close()
+
+	t.Run("Entries survive a restart", func(t *testing.T) {
+		db, err := database.InitDB(path)
+		require.NoError(t, err)
+		defer db.Close()
+
+		restored, err := store.NewResultCache(db, 1, 0)
+		require.NoError(t, err)
+		defer restored.Close()
+		assert.Equal(t, 1, restored.Stats().Size, "Loading trims to the new capacity")
+		value, hit := restored.Get("c")
+		require.True(t, hit, "The most recently used entry is kept")
+		assert.Equal(t, "3", value)
+		_, hit = restored.Get("a")
+		assert.False(t, hit)
+	})
+
+	t.Run("Entries expire after the TTL", func(t *testing.T) {
+		db, err := database.InitDB(":memory:")
+		require.NoError(t, err)
+		defer db.Close()
+
+		cache, err := store.NewResultCache(db, 10, 50*time.Millisecond)
+		require.NoError(t, err)
+		defer cache.Close()
+		cache.Put("a", "1")
+		_, hit := cache.Get("a")
+		assert.True(t, hit)
+		time.Sleep(100 * time.Millisecond)
+		_, hit = cache.Get("a")
+		assert.False(t, hit)
+		assert.Equal(t, 0, cache.Stats().Size)
+	})
+}
+
+func TestTaskStore_CompletesTasksFromCache(t *testing.T) {
+	db, err := database.InitDB(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+	cache, err := store.NewResultCache(db, 100, 0)
+	require.NoError(t, err)
+	defer cache.Close()
+
+	var cached []internal.TaskResult
+	taskStore := store.NewTaskStore()
+	taskStore.UseCache(cache)
+	taskStore.OnComplete(func(result internal.TaskResult) { cached = append(cached, result) })
+
+	// (1+2)*4 is computed by an agent once
+	taskStore.AddTask(internal.Task{Id: "id1", Arg1: "1", Arg2: "2", Operation: "+"})
+	taskStore.AddTask(internal.Task{Id: "id2", Arg1: "id1", Arg2: "4", Operation: "*"})
+	for _, result := range []string{"3.0000000000", "12.0000000000"} {
+		task, ok := taskStore.LeaseTask("agent", nil)
+		require.True(t, ok)
+		applied, err := taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: result}, "agent")
+		require.NoError(t, err)
+		require.True(t, applied)
+	}
+	assert.Empty(t, cached)
+
+	// the same calculation again never reaches an agent
+	taskStore.AddTask(internal.Task{Id: "id3", Arg1: "1.0", Arg2: "2", Operation: "+"})
+	taskStore.AddTask(internal.Task{Id: "id4", Arg1: "id3", Arg2: "4", Operation: "*"})
+	assert.Empty(t, taskStore.GetTasks())
+	assert.Equal(t, []internal.TaskResult{{Id: "id3", Result: "3.0000000000"}, {Id: "id4", Result: "12.0000000000"}}, cached)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(2), stats.Hits)
+	assert.Equal(t, uint64(2), stats.Misses)
+
+	t.Run("Error results are not cached", func(t *testing.T) {
+		taskStore.AddTask(internal.Task{Id: "id5", Arg1: "-1", Operation: "sqrt"})
+		task, ok := taskStore.LeaseTask("agent", nil)
+		require.True(t, ok)
+		_, err := taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: "Error: square root of a negative number"}, "agent")
+		require.NoError(t, err)
+
+		taskStore.AddTask(internal.Task{Id: "id6", Arg1: "-1", Operation: "sqrt"})
+		assert.Len(t, taskStore.GetTasks(), 1)
+	})
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal"
+)
+
+// agentActivityWindow is how long an agent counts as connected after its
+// last task request. Idle agents poll every 20 seconds by default.
+const agentActivityWindow = time.Minute
+
+// Load describes the work waiting for agents and the agents to do it.
+type Load struct {
+	// QueuedTasks are the tasks not computed yet, including those held by
+	// agents, and QueuedMs the sum of their operation times.
+	QueuedTasks int
+	QueuedMs    float64
+	// Workers is the number of tasks the connected agents compute at once.
+	Workers int
+}
+
+type agentWorkers struct {
+	workers int
+	seen    time.Time
+}
+
+// ReportWorkers records that the agent asked for a task and how many tasks
+// it computes at once.
+func (store *TaskStore) ReportWorkers(agentID string, workers int) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.agents[agentID] = agentWorkers{workers: workers, seen: time.Now()}
+}
+
+// Load returns the current queue and the workers of the agents that asked
+// for tasks within the last minute.
+func (store *TaskStore) Load() Load {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	load := Load{QueuedTasks: store.queuedTasks, QueuedMs: store.queuedMs}
+	now := time.Now()
+	for agentID, agent := range store.agents {
+		if now.Sub(agent.seen) > agentActivityWindow {
+			delete(store.agents, agentID)
+			continue
+		}
+		load.Workers += agent.workers
+	}
+	return load
+}
+
+// countQueued keeps the totals of Load up to date as tasks enter and leave
+// the queue; leased tasks still count as queued.
+func (store *TaskStore) countQueued(task internal.Task, delta int) {
+	store.queuedTasks += delta
+	store.queuedMs += float64(delta) * operationMs(task.Operation_time)
+	if store.queuedTasks == 0 {
+		// no rounding errors are left behind
+		store.queuedMs = 0
+	}
+}
+
+func operationMs(operationTime string) float64 {
+	ms, _ := strconv.ParseFloat(operationTime, 64)
+	return ms
+}
@@ -1,12 +1,19 @@
 package store
 
 import (
-	"strconv"
+	"errors"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/pkg/operations"
 )
 
+var ErrTaskNotLeased = errors.New("task is not leased")
+var ErrTaskLeasedByOther = errors.New("task is leased by another agent")
+var ErrResultConflict = errors.New("task already has a different result")
+
 type Counter struct {
 	value int
 	mu    sync.RWMutex
@@ -19,6 +26,15 @@ func (c *Counter) GetValueAndInc() int {
 	return c.value
 }
 
+// Reserve takes n consecutive values and returns the first of them.
+func (c *Counter) Reserve(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	first := c.value + 1
+	c.value += n
+	return first
+}
+
 func NewCounter() *Counter {
 	return &Counter{
 		value: 0,
@@ -49,25 +65,110 @@ func (store *TaskResultStore) GetTaskRes(id string) (internal.TaskResult, bool)
 	return task, exists
 }
 
+type lease struct {
+	agentID string
+	task    internal.Task
+}
+
 type TaskStore struct {
 	tasks         []internal.Task
+	leases        map[string]lease
 	TasksResStore TaskResultStore
 	Counter       Counter
 	mu            sync.Mutex
+
+	cache        *ResultCache
+	cacheChecked map[string]bool
+	onComplete   func(internal.TaskResult)
+	deferred     []deferredTask
+	// aliases maps a task to the IDs that take over its result once known
+	aliases map[string][]string
+	settled []internal.TaskResult
+
+	traces map[string]*internal.TaskTrace
+	// traceOrder lists the traced IDs oldest first, and may still hold
+	// pruned ones
+	traceOrder     []string
+	traceRetention time.Duration
+	traceLimit     int
+
+	agents map[string]agentWorkers
+	// queuedTasks and queuedMs are the totals of Load, see countQueued
+	queuedTasks int
+	queuedMs    float64
+}
+
+// conditionalOperation names deferred IDs in traces, which are only added
+// for conditionals.
+const conditionalOperation = "if"
+
+// Resolver decides what a deferred ID stands for once the value it waits
+// for is known: another task ID, a number formatted as a result, or an
+// error.
+type Resolver func(value string) (target string, err error)
+
+type deferredTask struct {
+	id      string
+	waitFor string
+	resolve Resolver
+}
+
+type readyDeferred struct {
+	deferredTask
+	value string
 }
 
 func NewTaskStore() *TaskStore {
 	return &TaskStore{
-		TasksResStore: *NewTaskResultStore(),
-		tasks:         []internal.Task{},
-		Counter:       *NewCounter(),
+		TasksResStore:  *NewTaskResultStore(),
+		tasks:          []internal.Task{},
+		leases:         make(map[string]lease),
+		Counter:        *NewCounter(),
+		cacheChecked:   make(map[string]bool),
+		aliases:        make(map[string][]string),
+		traces:         make(map[string]*internal.TaskTrace),
+		traceRetention: DefaultTraceRetention,
+		traceLimit:     DefaultTraceLimit,
+		agents:         make(map[string]agentWorkers),
 	}
 }
 
-func (store *TaskStore) AddTask(t internal.Task) {
+// OnComplete registers fn to be told about every task the store completes
+// without an agent: from the cache, because an argument failed, or through
+// a deferred ID.
+func (store *TaskStore) OnComplete(fn func(internal.TaskResult)) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.onComplete = fn
+}
+
+// UseCache makes the store complete ready tasks from the cache instead of
+// handing them to agents, and fill the cache with the results agents
+// report.
+func (store *TaskStore) UseCache(cache *ResultCache) {
 	store.mu.Lock()
 	defer store.mu.Unlock()
+	store.cache = cache
+}
+
+func (store *TaskStore) AddTask(t internal.Task) {
+	store.mu.Lock()
 	store.tasks = append(store.tasks, t)
+	store.countQueued(t, 1)
+	store.traceAdded(t.Id, t.Operation, taskArgs(t))
+	store.mu.Unlock()
+	store.settle()
+}
+
+// AddDeferred registers an ID whose result is decided once waitFor has a
+// result, e.g. a conditional waiting for its condition. An error result of
+// waitFor becomes the result of id without calling resolve.
+func (store *TaskStore) AddDeferred(id, waitFor string, resolve Resolver) {
+	store.mu.Lock()
+	store.deferred = append(store.deferred, deferredTask{id: id, waitFor: waitFor, resolve: resolve})
+	store.traceAdded(id, conditionalOperation, []string{waitFor})
+	store.mu.Unlock()
+	store.settle()
 }
 
 func (store *TaskStore) GetTasks() []internal.Task {
@@ -81,42 +182,282 @@ func (store *TaskStore) GetTasks() []internal.Task {
 func (store *TaskStore) GetFirstCorrectTask() (internal.Task, bool) {
 	store.mu.Lock()
 	defer store.mu.Unlock()
+	task, exists := store.takeFirstCorrectTask(nil)
+	if exists {
+		store.countQueued(task, -1)
+		store.traceLeased(task, "")
+	}
+	return task, exists
+}
 
-	if len(store.tasks) == 0 {
-		return internal.Task{}, false
+// LeaseTask hands the first ready task the agent can compute to the agent
+// and remembers it as the task holder, so only that agent may later report
+// the result. An empty operation list means the agent supports everything.
+func (store *TaskStore) LeaseTask(agentID string, operations []string) (internal.Task, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var accept func(internal.Task) bool
+	if len(operations) > 0 {
+		supported := make(map[string]bool, len(operations))
+		for _, op := range operations {
+			supported[op] = true
+		}
+		accept = func(t internal.Task) bool { return supported[t.Operation] }
 	}
+	task, exists := store.takeFirstCorrectTask(accept)
+	if exists {
+		store.leases[task.Id] = lease{agentID: agentID, task: task}
+		store.traceLeased(task, agentID)
+	}
+	return task, exists
+}
 
-	for i, task := range store.tasks {
-		resolvedArg1 := task.Arg1
-		isArg1Numeric := false
-		if _, err := strconv.ParseFloat(task.Arg1, 64); err == nil {
-			isArg1Numeric = true
-		} else {
-			if res, exists := store.TasksResStore.GetTaskRes(task.Arg1); exists {
-				resolvedArg1 = res.Result
-				isArg1Numeric = true
+func (store *TaskStore) GetLeaseHolder(taskID string) (string, bool) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	l, exists := store.leases[taskID]
+	return l.agentID, exists
+}
+
+// ReleaseTask puts a leased task back at the front of the queue, e.g. when
+// its agent shuts down before computing it.
+func (store *TaskStore) ReleaseTask(taskID, agentID string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	l, exists := store.leases[taskID]
+	if !exists {
+		return ErrTaskNotLeased
+	}
+	if l.agentID != agentID {
+		return ErrTaskLeasedByOther
+	}
+	delete(store.leases, taskID)
+	store.tasks = append([]internal.Task{l.task}, store.tasks...)
+	store.traceReleased(taskID)
+	return nil
+}
+
+// AcceptResult records the result reported by the agent holding the task.
+// A repeated delivery of the same result is acknowledged without being
+// applied again, so agents can safely retry; applied reports whether this
+// call stored the result.
+func (store *TaskStore) AcceptResult(result internal.TaskResult, agentID string) (applied bool, err error) {
+	store.mu.Lock()
+	task, applied, err := store.acceptResult(result, agentID)
+	cache := store.cache
+	store.mu.Unlock()
+	if !applied {
+		return false, err
+	}
+	if cache != nil && !isError(result.Result) {
+		if key, ok := CacheKey(task); ok {
+			cache.Put(key, result.Result)
+		}
+	}
+	store.settle()
+	return true, nil
+}
+
+// acceptResult returns the leased task the result was applied to.
+func (store *TaskStore) acceptResult(result internal.TaskResult, agentID string) (internal.Task, bool, error) {
+	// only the holder of a lease may report, even a result the task has
+	// already; a retry from the holder whose lease is gone is acknowledged
+	l, leased := store.leases[result.Id]
+	if leased && l.agentID != agentID {
+		return internal.Task{}, false, ErrTaskLeasedByOther
+	}
+	if existing, exists := store.TasksResStore.GetTaskRes(result.Id); exists {
+		if existing.Result != result.Result {
+			return internal.Task{}, false, ErrResultConflict
+		}
+		return internal.Task{}, false, nil
+	}
+	if !leased {
+		return internal.Task{}, false, ErrTaskNotLeased
+	}
+	delete(store.leases, result.Id)
+	store.countQueued(l.task, -1)
+	store.TasksResStore.AddTaskRes(result)
+	store.traceCompleted(result.Id, result.Result, "agent", nil)
+	return l.task, true, nil
+}
+
+func isError(value string) bool {
+	return strings.HasPrefix(value, "Error")
+}
+
+// settle completes everything that can be completed without an agent and
+// runs the resolvers of deferred IDs whose values became known. Resolvers
+// run without the lock because they usually add tasks.
+func (store *TaskStore) settle() {
+	for {
+		store.mu.Lock()
+		completed, ready := store.settleLocked()
+		onComplete := store.onComplete
+		store.mu.Unlock()
+
+		if onComplete != nil {
+			for _, result := range completed {
+				onComplete(result)
+			}
+		}
+		if len(ready) == 0 {
+			return
+		}
+
+		for _, r := range ready {
+			target, err := r.resolve(r.value)
+			store.mu.Lock()
+			switch {
+			case err != nil:
+				store.settled = append(store.settled, internal.TaskResult{Id: r.id, Result: "Error: " + err.Error()})
+			case operations.IsNumber(target):
+				store.settled = append(store.settled, internal.TaskResult{Id: r.id, Result: target})
+			default:
+				store.aliases[target] = append(store.aliases[target], r.id)
+			}
+			if err == nil {
+				store.traceBranch(r.id, r.value, target)
+			}
+			store.mu.Unlock()
+		}
+	}
+}
+
+func (store *TaskStore) settleLocked() ([]internal.TaskResult, []readyDeferred) {
+	var completed []internal.TaskResult
+	var ready []readyDeferred
+	complete := func(result internal.TaskResult, completedBy string, values []string) {
+		store.TasksResStore.AddTaskRes(result)
+		store.traceCompleted(result.Id, result.Result, completedBy, values)
+		completed = append(completed, result)
+	}
+
+	for _, result := range store.settled {
+		complete(result, "branch", nil)
+	}
+	store.settled = nil
+
+	for changed := true; changed; {
+		changed = false
+		for i := 0; i < len(store.tasks); i++ {
+			task := store.tasks[i]
+			value, completedBy := store.completeLocally(task)
+			if completedBy == "" {
+				continue
+			}
+			store.tasks = append(store.tasks[:i], store.tasks[i+1:]...)
+			store.countQueued(task, -1)
+			i--
+			ready, _ := store.resolveTask(task)
+			complete(internal.TaskResult{Id: task.Id, Result: value}, completedBy, taskArgs(ready))
+			changed = true
+		}
+
+		for target, ids := range store.aliases {
+			res, exists := store.TasksResStore.GetTaskRes(target)
+			if !exists {
+				continue
 			}
+			for _, id := range ids {
+				complete(internal.TaskResult{Id: id, Result: res.Result}, "branch", nil)
+			}
+			delete(store.aliases, target)
+			changed = true
 		}
 
-		resolvedArg2 := task.Arg2
-		isArg2Numeric := false
-		if _, err := strconv.ParseFloat(task.Arg2, 64); err == nil {
-			isArg2Numeric = true
-		} else {
-			if res, exists := store.TasksResStore.GetTaskRes(task.Arg2); exists {
-				resolvedArg2 = res.Result
-				isArg2Numeric = true
+		remaining := store.deferred[:0]
+		for _, d := range store.deferred {
+			res, exists := store.TasksResStore.GetTaskRes(d.waitFor)
+			switch {
+			case !exists:
+				remaining = append(remaining, d)
+			case isError(res.Result):
+				complete(internal.TaskResult{Id: d.id, Result: res.Result}, "argument", []string{res.Result})
+				changed = true
+			default:
+				ready = append(ready, readyDeferred{deferredTask: d, value: res.Result})
 			}
 		}
+		store.deferred = remaining
+	}
+	return completed, ready
+}
+
+// completeLocally tells whether a ready task can be completed without an
+// agent, and why: "argument" when one of its arguments failed, "cache" when
+// its result is cached. Each task is looked up in the cache once, so misses
+// count the tasks sent to agents.
+func (store *TaskStore) completeLocally(task internal.Task) (value, completedBy string) {
+	if store.cacheChecked[task.Id] {
+		return "", ""
+	}
+	ready, isReady := store.resolveTask(task)
+	if !isReady {
+		return "", ""
+	}
+	for _, arg := range []string{ready.Arg1, ready.Arg2} {
+		if isError(arg) {
+			return arg, "argument"
+		}
+	}
+	if store.cache == nil {
+		return "", ""
+	}
 
-		if isArg1Numeric && isArg2Numeric {
-			readyTask := task
-			readyTask.Arg1 = resolvedArg1
-			readyTask.Arg2 = resolvedArg2
+	store.cacheChecked[task.Id] = true
+	key, ok := CacheKey(ready)
+	if !ok {
+		return "", ""
+	}
+	value, hit := store.cache.Get(key)
+	if !hit {
+		return "", ""
+	}
+	delete(store.cacheChecked, task.Id)
+	return value, "cache"
+}
 
+func (store *TaskStore) takeFirstCorrectTask(accept func(internal.Task) bool) (internal.Task, bool) {
+	if len(store.tasks) == 0 {
+		return internal.Task{}, false
+	}
+
+	for i, task := range store.tasks {
+		if accept != nil && !accept(task) {
+			continue
+		}
+		if readyTask, isReady := store.resolveTask(task); isReady {
+			delete(store.cacheChecked, task.Id)
 			store.tasks = append(store.tasks[:i], store.tasks[i+1:]...)
 			return readyTask, true
 		}
 	}
 	return internal.Task{}, false
 }
+
+// resolveTask returns the task with its arguments replaced by their values,
+// if all of them are known.
+func (store *TaskStore) resolveTask(task internal.Task) (internal.Task, bool) {
+	resolvedArg1, isArg1Numeric := store.resolveArg(task.Arg1)
+	resolvedArg2, isArg2Numeric := store.resolveArg(task.Arg2)
+	task.Arg1 = resolvedArg1
+	task.Arg2 = resolvedArg2
+	return task, isArg1Numeric && isArg2Numeric
+}
+
+// resolveArg replaces a task ID with its result. An empty argument is the
+// unused second argument of a unary operation and is always resolved.
+func (store *TaskStore) resolveArg(arg string) (string, bool) {
+	if arg == "" {
+		return "", true
+	}
+	if operations.IsNumber(arg) {
+		return arg, true
+	}
+	if res, exists := store.TasksResStore.GetTaskRes(arg); exists {
+		return res.Result, true
+	}
+	return arg, false
+}
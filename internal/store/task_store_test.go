@@ -0,0 +1,126 @@
+package store_test
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskStore_Trace(t *testing.T) {
+	taskStore := store.NewTaskStore()
+	// if(2+3 > 4, (2+3)*2, 0)
+	taskStore.AddTask(internal.Task{Id: "id1", Arg1: "2", Arg2: "3", Operation: "+"})
+	taskStore.AddTask(internal.Task{Id: "id2", Arg1: "id1", Arg2: "4", Operation: ">"})
+	taskStore.AddDeferred("id3", "id2", func(value string) (string, error) {
+		taskStore.AddTask(internal.Task{Id: "id4", Arg1: "id1", Arg2: "2", Operation: "*"})
+		return "id4", nil
+	})
+
+	lease := func(agentID string) internal.Task {
+		task, ok := taskStore.LeaseTask(agentID, nil)
+		require.True(t, ok)
+		return task
+	}
+	complete := func(task internal.Task, agentID, result string) {
+		_, err := taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: result}, agentID)
+		require.NoError(t, err)
+	}
+
+	waiting := taskStore.Trace([]string{"id3"})
+	require.Len(t, waiting, 3)
+	assert.Equal(t, "waiting", waiting[2].Status)
+	assert.Equal(t, "if", waiting[2].Operation)
+
+	task := lease("agent-a")
+	require.NoError(t, taskStore.ReleaseTask(task.Id, "agent-a"))
+	complete(lease("agent-b"), "agent-b", "5.0000000000")
+	complete(lease("agent-b"), "agent-b", "1.0000000000")
+	task = lease("agent-a")
+	running := taskStore.Trace([]string{"id4"})
+	require.Len(t, running, 2)
+	assert.Equal(t, "running", running[1].Status)
+	assert.Equal(t, []string{"5.0000000000", "2"}, running[1].Values)
+	complete(task, "agent-a", "10.0000000000")
+
+	traces := taskStore.Trace([]string{"id3"})
+	ids := make([]string, len(traces))
+	for i, trace := range traces {
+		ids[i] = trace.ID
+		assert.Equal(t, "done", trace.Status, trace.ID)
+		assert.NotNil(t, trace.CompletedAt, trace.ID)
+	}
+	assert.Equal(t, []string{"id1", "id2", "id4", "id3"}, ids, "Dependencies come first")
+
+	sum := traces[0]
+	assert.Equal(t, []string{"2", "3"}, sum.Args)
+	assert.Equal(t, "agent-b", sum.AgentID)
+	assert.Equal(t, 2, sum.Attempts, "Released tasks are leased again")
+	assert.Equal(t, "agent", sum.CompletedBy)
+
+	conditional := traces[3]
+	assert.Equal(t, []string{"id2"}, conditional.Args)
+	assert.Equal(t, []string{"1.0000000000"}, conditional.Values)
+	assert.Equal(t, "id4", conditional.Branch)
+	assert.Equal(t, "10.0000000000", conditional.Result)
+	assert.Equal(t, "branch", conditional.CompletedBy)
+
+	assert.Empty(t, taskStore.Trace([]string{"unknown"}))
+}
+
+func TestTaskStore_Load(t *testing.T) {
+	taskStore := store.NewTaskStore()
+	taskStore.AddTask(internal.Task{Id: "id1", Arg1: "1", Arg2: "2", Operation: "+", Operation_time: "10"})
+	taskStore.AddTask(internal.Task{Id: "id2", Arg1: "id1", Arg2: "0", Operation: "/", Operation_time: "20"})
+	taskStore.AddTask(internal.Task{Id: "id3", Arg1: "id2", Arg2: "1", Operation: "*", Operation_time: "15"})
+	assert.Equal(t, store.Load{QueuedTasks: 3, QueuedMs: 45}, taskStore.Load())
+
+	task, ok := taskStore.LeaseTask("agent-a", nil)
+	require.True(t, ok)
+	require.NoError(t, taskStore.ReleaseTask(task.Id, "agent-a"))
+	task, ok = taskStore.LeaseTask("agent-a", nil)
+	require.True(t, ok)
+	assert.Equal(t, 3, taskStore.Load().QueuedTasks, "Leased tasks are still queued")
+	_, err := taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: "3.0000000000"}, "agent-a")
+	require.NoError(t, err)
+	assert.Equal(t, store.Load{QueuedTasks: 2, QueuedMs: 35}, taskStore.Load())
+
+	task, ok = taskStore.LeaseTask("agent-a", nil)
+	require.True(t, ok)
+	_, err = taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: "Error: division by zero"}, "agent-a")
+	require.NoError(t, err)
+	assert.Equal(t, store.Load{}, taskStore.Load(), "Tasks completed without an agent leave the queue")
+
+	taskStore.ReportWorkers("agent-a", 4)
+	taskStore.ReportWorkers("agent-b", 2)
+	taskStore.ReportWorkers("agent-a", 3)
+	assert.Equal(t, 5, taskStore.Load().Workers)
+}
+
+func TestTaskStore_PruneTraces(t *testing.T) {
+	taskStore := store.NewTaskStore()
+	taskStore.KeepTraces(time.Hour, 3)
+	for i, operation := range []string{"+", "-", "*", "/"} {
+		taskStore.AddTask(internal.Task{Id: "id" + strconv.Itoa(i+1), Arg1: "1", Arg2: "0", Operation: operation})
+	}
+	assert.Empty(t, taskStore.Trace([]string{"id1"}), "The oldest tasks are forgotten beyond the limit")
+	assert.Len(t, taskStore.Trace([]string{"id2", "id3", "id4"}), 3)
+
+	for _, result := range []string{"1.0000000000", "1.0000000000", "0.0000000000", "Error: division by zero"} {
+		task, ok := taskStore.LeaseTask("agent-a", nil)
+		require.True(t, ok)
+		_, err := taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: result}, "agent-a")
+		require.NoError(t, err)
+	}
+	taskStore.PruneTraces()
+	assert.Len(t, taskStore.Trace([]string{"id2", "id3"}), 2)
+	assert.Empty(t, taskStore.Trace([]string{"id4"}), "Failed tasks are forgotten")
+
+	taskStore.KeepTraces(0, 3)
+	taskStore.PruneTraces()
+	assert.Empty(t, taskStore.Trace([]string{"id2", "id3"}), "Done tasks are forgotten after the retention")
+}
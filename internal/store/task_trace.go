@@ -0,0 +1,162 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal"
+)
+
+// DefaultTraceRetention is how long finished tasks are remembered for
+// Trace.
+const DefaultTraceRetention = time.Hour
+
+// DefaultTraceLimit is how many tasks are remembered at most; the oldest
+// are forgotten first.
+const DefaultTraceLimit = 100000
+
+// abandonedTraceAge is how long a task that is never done is remembered,
+// e.g. one of an expression no agent can calculate.
+const abandonedTraceAge = 24 * time.Hour
+
+// tracePruneInterval is how often PruneTracesPeriodically prunes.
+const tracePruneInterval = time.Minute
+
+// KeepTraces sets how long the store remembers tasks after they are done,
+// and how many it remembers at most, without a limit if not positive.
+func (store *TaskStore) KeepTraces(retention time.Duration, limit int) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.traceRetention = retention
+	store.traceLimit = limit
+}
+
+// PruneTracesPeriodically prunes the traces every tracePruneInterval until
+// ctx is done.
+func (store *TaskStore) PruneTracesPeriodically(ctx context.Context) {
+	ticker := time.NewTicker(tracePruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			store.PruneTraces()
+		}
+	}
+}
+
+// PruneTraces forgets tasks done longer than the retention ago, failed
+// tasks, whose expressions are finished with the error already, and tasks
+// that were never done within abandonedTraceAge.
+func (store *TaskStore) PruneTraces() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	now := time.Now()
+	for id, trace := range store.traces {
+		switch {
+		case trace.CompletedAt == nil && now.Sub(trace.CreatedAt) > abandonedTraceAge,
+			trace.CompletedAt != nil && isError(trace.Result),
+			trace.CompletedAt != nil && now.Sub(*trace.CompletedAt) > store.traceRetention:
+			delete(store.traces, id)
+		}
+	}
+	order := store.traceOrder[:0]
+	for _, id := range store.traceOrder {
+		if _, exists := store.traces[id]; exists {
+			order = append(order, id)
+		}
+	}
+	store.traceOrder = order
+}
+
+// Trace returns the tasks the given IDs depend on, including themselves,
+// dependencies first. Tasks finished longer than the retention ago are
+// forgotten and left out.
+func (store *TaskStore) Trace(ids []string) []internal.TaskTrace {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	var traces []internal.TaskTrace
+	visited := make(map[string]bool)
+	var visit func(id string)
+	visit = func(id string) {
+		trace, exists := store.traces[id]
+		if !exists || visited[id] {
+			return
+		}
+		visited[id] = true
+		for _, arg := range trace.Args {
+			visit(arg)
+		}
+		if trace.Branch != "" {
+			visit(trace.Branch)
+		}
+		copied := *trace
+		copied.Args = append([]string(nil), trace.Args...)
+		copied.Values = append([]string(nil), trace.Values...)
+		traces = append(traces, copied)
+	}
+	for _, id := range ids {
+		visit(id)
+	}
+	return traces
+}
+
+func (store *TaskStore) traceAdded(id, operation string, args []string) {
+	store.traces[id] = &internal.TaskTrace{ID: id, Operation: operation, Args: args, Status: "waiting", CreatedAt: time.Now()}
+	store.traceOrder = append(store.traceOrder, id)
+	// pruned traces are skipped over
+	for store.traceLimit > 0 && len(store.traces) > store.traceLimit && len(store.traceOrder) > 0 {
+		delete(store.traces, store.traceOrder[0])
+		store.traceOrder = store.traceOrder[1:]
+	}
+}
+
+func taskArgs(t internal.Task) []string {
+	if t.Arg2 == "" {
+		return []string{t.Arg1}
+	}
+	return []string{t.Arg1, t.Arg2}
+}
+
+func (store *TaskStore) traceLeased(ready internal.Task, agentID string) {
+	trace, exists := store.traces[ready.Id]
+	if !exists {
+		return
+	}
+	now := time.Now()
+	trace.Status = "running"
+	trace.Values = taskArgs(ready)
+	trace.AgentID = agentID
+	trace.Attempts++
+	trace.StartedAt = &now
+}
+
+func (store *TaskStore) traceReleased(id string) {
+	if trace, exists := store.traces[id]; exists {
+		trace.Status = "waiting"
+	}
+}
+
+func (store *TaskStore) traceCompleted(id, result, completedBy string, values []string) {
+	trace, exists := store.traces[id]
+	if !exists {
+		return
+	}
+	now := time.Now()
+	trace.Status = "done"
+	trace.Result = result
+	trace.CompletedBy = completedBy
+	trace.CompletedAt = &now
+	if values != nil {
+		trace.Values = values
+	}
+}
+
+func (store *TaskStore) traceBranch(id, condition, target string) {
+	if trace, exists := store.traces[id]; exists {
+		trace.Values = []string{condition}
+		trace.Branch = target
+	}
+}
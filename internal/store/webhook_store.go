@@ -0,0 +1,128 @@
+package store
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"log"
+
+	"github.com/katierevinska/calculatorService/internal"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// MaxDeliveries limits the delivery log returned at once.
+const MaxDeliveries = 100
+
+type WebhookStore struct {
+	db *sql.DB
+}
+
+func NewWebhookStore(db *sql.DB) *WebhookStore {
+	return &WebhookStore{db: db}
+}
+
+func (s *WebhookStore) CreateWebhook(userID int64, url string) (internal.Webhook, error) {
+	res, err := s.db.Exec("INSERT INTO webhooks (user_id, url) VALUES (?, ?)", userID, url)
+	if err != nil {
+		log.Printf("Error inserting webhook for user %d: %v", userID, err)
+		return internal.Webhook{}, err
+	}
+	webhook := internal.Webhook{UserID: userID, URL: url}
+	if webhook.ID, err = res.LastInsertId(); err != nil {
+		return internal.Webhook{}, err
+	}
+	err = s.db.QueryRow("SELECT created_at FROM webhooks WHERE id = ?", webhook.ID).Scan(&webhook.CreatedAt)
+	return webhook, err
+}
+
+func (s *WebhookStore) GetAllWebhooks(userID int64) []internal.Webhook {
+	rows, err := s.db.Query("SELECT id, user_id, url, created_at FROM webhooks WHERE user_id = ? ORDER BY id", userID)
+	if err != nil {
+		log.Printf("Error getting webhooks for user %d: %v", userID, err)
+		return []internal.Webhook{}
+	}
+	defer rows.Close()
+
+	webhooks := []internal.Webhook{}
+	for rows.Next() {
+		var webhook internal.Webhook
+		if err := rows.Scan(&webhook.ID, &webhook.UserID, &webhook.URL, &webhook.CreatedAt); err != nil {
+			log.Printf("Error scanning webhook row for user %d: %v", userID, err)
+			continue
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks
+}
+
+func (s *WebhookStore) DeleteWebhook(id, userID int64) error {
+	res, err := s.db.Exec("DELETE FROM webhooks WHERE id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		log.Printf("Error deleting webhook %d for user %d: %v", id, userID, err)
+		return err
+	}
+	if rowsAffected, _ := res.RowsAffected(); rowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// Secret returns the key the webhooks of the user are signed with,
+// generating it on first use.
+func (s *WebhookStore) Secret(userID int64) (string, error) {
+	var secret string
+	if err := s.db.QueryRow("SELECT webhook_secret FROM users WHERE id = ?", userID).Scan(&secret); err != nil {
+		return "", err
+	}
+	if secret != "" {
+		return secret, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	// a concurrent call may have generated the secret meanwhile, so only an
+	// empty one is replaced and the stored one is returned
+	if _, err := s.db.Exec("UPDATE users SET webhook_secret = ? WHERE id = ? AND webhook_secret = ''", hex.EncodeToString(key), userID); err != nil {
+		log.Printf("Error saving webhook secret for user %d: %v", userID, err)
+		return "", err
+	}
+	err := s.db.QueryRow("SELECT webhook_secret FROM users WHERE id = ?", userID).Scan(&secret)
+	return secret, err
+}
+
+func (s *WebhookStore) RecordDelivery(d internal.WebhookDelivery) error {
+	_, err := s.db.Exec("INSERT INTO webhook_deliveries (user_id, expression_id, url, event, attempt, status_code, error, delivered) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		d.UserID, d.ExpressionID, d.URL, d.Event, d.Attempt, d.StatusCode, d.Error, d.Delivered)
+	if err != nil {
+		log.Printf("Error recording webhook delivery for expression %s: %v", d.ExpressionID, err)
+	}
+	return err
+}
+
+// GetDeliveries returns the latest delivery attempts of the user, newest
+// first, only those of one expression unless expressionID is empty.
+func (s *WebhookStore) GetDeliveries(userID int64, expressionID string) []internal.WebhookDelivery {
+	rows, err := s.db.Query(`SELECT id, user_id, expression_id, url, event, attempt, status_code, error, delivered, created_at
+		FROM webhook_deliveries WHERE user_id = ? AND (? = '' OR expression_id = ?) ORDER BY id DESC LIMIT ?`,
+		userID, expressionID, expressionID, MaxDeliveries)
+	if err != nil {
+		log.Printf("Error getting webhook deliveries for user %d: %v", userID, err)
+		return []internal.WebhookDelivery{}
+	}
+	defer rows.Close()
+
+	deliveries := []internal.WebhookDelivery{}
+	for rows.Next() {
+		var d internal.WebhookDelivery
+		if err := rows.Scan(&d.ID, &d.UserID, &d.ExpressionID, &d.URL, &d.Event, &d.Attempt, &d.StatusCode, &d.Error, &d.Delivered, &d.CreatedAt); err != nil {
+			log.Printf("Error scanning webhook delivery row for user %d: %v", userID, err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries
+}
@@ -0,0 +1,57 @@
+package store_test
+
+import (
+	"testing"
+
+	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/database"
+	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookStore(t *testing.T) {
+	db, err := database.InitDB(":memory:")
+	require.NoError(t, err)
+	defer db.Close()
+
+	userStore := store.NewUserStore(db)
+	userID, err := userStore.CreateUser("hookuser", "password")
+	require.NoError(t, err)
+	otherID, err := userStore.CreateUser("otherhookuser", "password")
+	require.NoError(t, err)
+
+	webhookStore := store.NewWebhookStore(db)
+	webhook, err := webhookStore.CreateWebhook(userID, "http://example.com/hook")
+	require.NoError(t, err)
+	assert.NotZero(t, webhook.ID)
+	assert.NotEmpty(t, webhook.CreatedAt)
+	assert.Len(t, webhookStore.GetAllWebhooks(userID), 1)
+	assert.Empty(t, webhookStore.GetAllWebhooks(otherID))
+
+	assert.ErrorIs(t, webhookStore.DeleteWebhook(webhook.ID, otherID), store.ErrWebhookNotFound, "Webhooks are per user")
+	require.NoError(t, webhookStore.DeleteWebhook(webhook.ID, userID))
+	assert.Empty(t, webhookStore.GetAllWebhooks(userID))
+
+	secret, err := webhookStore.Secret(userID)
+	require.NoError(t, err)
+	assert.Len(t, secret, 64)
+	again, err := webhookStore.Secret(userID)
+	require.NoError(t, err)
+	assert.Equal(t, secret, again, "The secret is generated once")
+	other, err := webhookStore.Secret(otherID)
+	require.NoError(t, err)
+	assert.NotEqual(t, secret, other)
+
+	require.NoError(t, webhookStore.RecordDelivery(internal.WebhookDelivery{UserID: userID, ExpressionID: "id1", URL: "http://a", Event: "expression.completed", Attempt: 1, Error: "connection refused"}))
+	require.NoError(t, webhookStore.RecordDelivery(internal.WebhookDelivery{UserID: userID, ExpressionID: "id1", URL: "http://a", Event: "expression.completed", Attempt: 2, StatusCode: 200, Delivered: true}))
+	require.NoError(t, webhookStore.RecordDelivery(internal.WebhookDelivery{UserID: userID, ExpressionID: "id2", URL: "http://a", Event: "expression.error", Attempt: 1, StatusCode: 200, Delivered: true}))
+
+	deliveries := webhookStore.GetDeliveries(userID, "id1")
+	require.Len(t, deliveries, 2)
+	assert.Equal(t, 2, deliveries[0].Attempt, "Newest deliveries come first")
+	assert.True(t, deliveries[0].Delivered)
+	assert.Equal(t, "connection refused", deliveries[1].Error)
+	assert.Len(t, webhookStore.GetDeliveries(userID, ""), 3)
+	assert.Empty(t, webhookStore.GetDeliveries(otherID, ""))
+}
@@ -0,0 +1,214 @@
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// fileStamp remembers modification times of a set of files so a reloader
+// can cheaply tell whether anything changed on disk since the last load.
+type fileStamp struct {
+	paths    []string
+	modTimes []time.Time
+}
+
+func newFileStamp(paths ...string) *fileStamp {
+	return &fileStamp{paths: paths, modTimes: make([]time.Time, len(paths))}
+}
+
+func (f *fileStamp) changed() bool {
+	for i, path := range f.paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(f.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fileStamp) update() {
+	for i, path := range f.paths {
+		if info, err := os.Stat(path); err == nil {
+			f.modTimes[i] = info.ModTime()
+		}
+	}
+}
+
+// KeyPairReloader serves a certificate/key pair and reloads it from disk
+// when either file changes, so certificates can be rotated without restart.
+type KeyPairReloader struct {
+	certFile string
+	keyFile  string
+	stamp    *fileStamp
+	cert     *tls.Certificate
+	mu       sync.Mutex
+}
+
+func NewKeyPairReloader(certFile, keyFile string) (*KeyPairReloader, error) {
+	r := &KeyPairReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stamp:    newFileStamp(certFile, keyFile),
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *KeyPairReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading key pair %s/%s: %w", r.certFile, r.keyFile, err)
+	}
+	r.cert = &cert
+	r.stamp.update()
+	return nil
+}
+
+func (r *KeyPairReloader) current() *tls.Certificate {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stamp.changed() {
+		if err := r.reload(); err != nil {
+			log.Printf("Keeping previous certificate, reload failed: %v", err)
+		} else {
+			log.Printf("Reloaded certificate %s", r.certFile)
+		}
+	}
+	return r.cert
+}
+
+func (r *KeyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+func (r *KeyPairReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.current(), nil
+}
+
+// CAPoolReloader holds a CA bundle and reloads it when the file changes.
+type CAPoolReloader struct {
+	caFile string
+	stamp  *fileStamp
+	pool   *x509.CertPool
+	mu     sync.Mutex
+}
+
+func NewCAPoolReloader(caFile string) (*CAPoolReloader, error) {
+	r := &CAPoolReloader{caFile: caFile, stamp: newFileStamp(caFile)}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CAPoolReloader) reload() error {
+	pemData, err := os.ReadFile(r.caFile)
+	if err != nil {
+		return fmt.Errorf("reading CA file %s: %w", r.caFile, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pemData) {
+		return fmt.Errorf("no certificates found in CA file %s", r.caFile)
+	}
+	r.pool = pool
+	r.stamp.update()
+	return nil
+}
+
+func (r *CAPoolReloader) Pool() *x509.CertPool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stamp.changed() {
+		if err := r.reload(); err != nil {
+			log.Printf("Keeping previous CA pool, reload failed: %v", err)
+		} else {
+			log.Printf("Reloaded CA pool %s", r.caFile)
+		}
+	}
+	return r.pool
+}
+
+// ServerConfig builds the orchestrator listener config. When clientCAFile is
+// set, client certificates are requested and verified against it; whether a
+// certificate is required is decided per endpoint by the HTTP middleware.
+func ServerConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("both certificate and key files are required for TLS")
+	}
+	keyPair, err := NewKeyPairReloader(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: keyPair.GetCertificate,
+	}
+	if clientCAFile == "" {
+		return config, nil
+	}
+
+	caPool, err := NewCAPoolReloader(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		perClient := config.Clone()
+		perClient.GetConfigForClient = nil
+		perClient.ClientCAs = caPool.Pool()
+		return perClient, nil
+	}
+	return config, nil
+}
+
+// ClientConfig builds the agent side config. certFile/keyFile enable the
+// client certificate for mutual TLS, caFile replaces the system roots used
+// to verify the orchestrator.
+func ClientConfig(certFile, keyFile, caFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" || keyFile != "" {
+		keyPair, err := NewKeyPairReloader(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.GetClientCertificate = keyPair.GetClientCertificate
+	}
+
+	if caFile != "" {
+		caPool, err := NewCAPoolReloader(caFile)
+		if err != nil {
+			return nil, err
+		}
+		// RootCAs cannot be swapped after the config is in use, so the
+		// default verification is replaced with one using the current pool.
+		config.InsecureSkipVerify = true
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("orchestrator presented no certificate")
+			}
+			opts := x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         caPool.Pool(),
+				Intermediates: x509.NewCertPool(),
+			}
+			for _, cert := range cs.PeerCertificates[1:] {
+				opts.Intermediates.AddCert(cert)
+			}
+			_, err := cs.PeerCertificates[0].Verify(opts)
+			return err
+		}
+	}
+	return config, nil
+}
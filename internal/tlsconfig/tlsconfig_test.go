@@ -0,0 +1,181 @@
+package tlsconfig_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal/middleware"
+	"github.com/katierevinska/calculatorService/internal/tlsconfig"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a leaf certificate signed by the CA and returns the paths.
+func (ca *testCA) issue(t *testing.T, dir, name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certPath, keyPath
+}
+
+func writeCA(t *testing.T, dir string, ca *testCA) string {
+	t.Helper()
+	path := filepath.Join(dir, ca.cert.Subject.CommonName+".pem")
+	require.NoError(t, os.WriteFile(path, ca.pem, 0600))
+	return path
+}
+
+// startServer serves through tls.NewListener directly, because
+// httptest.Server.StartTLS would inject its own certificate.
+func startServer(t *testing.T, config *tls.Config) (string, func()) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{Handler: middleware.ClientCertMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))}
+	go server.Serve(tls.NewListener(listener, config))
+	return listener.Addr().String(), func() { server.Close() }
+}
+
+func clientFor(t *testing.T, certFile, keyFile, caFile string) *http.Client {
+	t.Helper()
+	config, err := tlsconfig.ClientConfig(certFile, keyFile, caFile)
+	require.NoError(t, err)
+	return &http.Client{Transport: &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}}
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "test-ca")
+	caFile := writeCA(t, dir, ca)
+	serverCert, serverKey := ca.issue(t, dir, "orchestrator", 10, x509.ExtKeyUsageServerAuth)
+	agentCert, agentKey := ca.issue(t, dir, "agent", 11, x509.ExtKeyUsageClientAuth)
+
+	serverConfig, err := tlsconfig.ServerConfig(serverCert, serverKey, caFile)
+	require.NoError(t, err)
+	addr, stop := startServer(t, serverConfig)
+	defer stop()
+	serverURL := "https://localhost:" + addr[len("127.0.0.1:"):]
+
+	t.Run("Client with certificate is accepted", func(t *testing.T) {
+		resp, err := clientFor(t, agentCert, agentKey, caFile).Get(serverURL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("Client without certificate is rejected by middleware", func(t *testing.T) {
+		resp, err := clientFor(t, "", "", caFile).Get(serverURL)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	})
+
+	t.Run("Client certificate from unknown CA fails handshake", func(t *testing.T) {
+		otherCA := newTestCA(t, "other-ca")
+		otherCert, otherKey := otherCA.issue(t, dir, "rogue-agent", 12, x509.ExtKeyUsageClientAuth)
+		_, err := clientFor(t, otherCert, otherKey, caFile).Get(serverURL)
+		assert.Error(t, err)
+	})
+
+	t.Run("Server certificate from unknown CA is not trusted", func(t *testing.T) {
+		otherCA := newTestCA(t, "untrusted-ca")
+		otherCAFile := writeCA(t, dir, otherCA)
+		_, err := clientFor(t, agentCert, agentKey, otherCAFile).Get(serverURL)
+		assert.Error(t, err)
+	})
+}
+
+func TestServerCertificateHotReload(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, "reload-ca")
+	writeCA(t, dir, ca)
+	serverCert, serverKey := ca.issue(t, dir, "orchestrator", 100, x509.ExtKeyUsageServerAuth)
+
+	serverConfig, err := tlsconfig.ServerConfig(serverCert, serverKey, "")
+	require.NoError(t, err)
+	addr, stop := startServer(t, serverConfig)
+	defer stop()
+
+	servedSerial := func() int64 {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		require.NoError(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+
+	assert.Equal(t, int64(100), servedSerial())
+
+	ca.issue(t, dir, "orchestrator", 200, x509.ExtKeyUsageServerAuth)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(serverCert, future, future))
+	require.NoError(t, os.Chtimes(serverKey, future, future))
+
+	assert.Equal(t, int64(200), servedSerial())
+}
+
+func TestServerConfig_MissingFiles(t *testing.T) {
+	_, err := tlsconfig.ServerConfig("", "", "")
+	assert.Error(t, err)
+
+	_, err = tlsconfig.ServerConfig("/nonexistent.crt", "/nonexistent.key", "")
+	assert.Error(t, err)
+}
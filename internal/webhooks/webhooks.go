@@ -0,0 +1,322 @@
+// Package webhooks delivers finished expressions to the URLs of their
+// users.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal"
+)
+
+// Headers of a delivery. The signature is "sha256=" followed by the hex
+// HMAC-SHA256 of the body keyed with the secret of the user.
+const (
+	SignatureHeader = "X-Calculator-Signature"
+	EventHeader     = "X-Calculator-Event"
+)
+
+// Events, see EventFor.
+const (
+	EventCompleted = "expression.completed"
+	EventError     = "expression.error"
+)
+
+// Payload is the body of a delivery.
+type Payload struct {
+	Event      string              `json:"event"`
+	Expression internal.Expression `json:"expression"`
+	Time       time.Time           `json:"time"`
+}
+
+// EventFor names what happened to a finished expression: it was calculated
+// or failed with an error result.
+func EventFor(expression internal.Expression) string {
+	if strings.HasPrefix(expression.Result, "Error") {
+		return EventError
+	}
+	return EventCompleted
+}
+
+// Sign returns the signature header value of the body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ValidateURL accepts absolute http and https URLs. Where they may point is
+// checked when connecting, see NewClient.
+func ValidateURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("only http and https URLs are supported")
+	}
+	if u.Host == "" {
+		return errors.New("the URL has no host")
+	}
+	return nil
+}
+
+// ErrForbiddenAddress is returned for deliveries to addresses outside the
+// public internet.
+var ErrForbiddenAddress = errors.New("delivery to a loopback, private or link-local address is not allowed")
+
+// forbiddenPrefixes are not covered by the netip predicates used in
+// publicAddress.
+var forbiddenPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+}
+
+func publicAddress(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() {
+		return false
+	}
+	for _, prefix := range forbiddenPrefixes {
+		if prefix.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewClient returns the client deliveries are sent with. Unless
+// allowPrivate is set it refuses to connect to loopback, private,
+// link-local and other non-public addresses, so users cannot make the
+// orchestrator call itself or its network. The check is made on the
+// address being dialed, after DNS resolution and for every redirect.
+func NewClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil || !publicAddress(addrPort.Addr()) {
+				return ErrForbiddenAddress
+			}
+			return nil
+		}
+	}
+	// no proxy: the dialed address must be the destination
+	return &http.Client{Timeout: timeout, Transport: &http.Transport{DialContext: dialer.DialContext}}
+}
+
+// Defaults of a Dispatcher.
+const (
+	DefaultWorkers   = 4
+	DefaultQueueSize = 1024
+)
+
+// Dispatcher sends deliveries in the background with a fixed number of
+// workers, retrying failed ones with exponential backoff, and records every
+// attempt. A retry waits on a timer rather than holding a worker. Delivery
+// is best effort: deliveries that do not fit in the queue are dropped, and
+// pending retries are given up when Close is called.
+type Dispatcher struct {
+	Client         *http.Client
+	MaxAttempts    int
+	RetryBaseDelay time.Duration
+	RetryMaxDelay  time.Duration
+	Record         func(internal.WebhookDelivery)
+	// Workers is how many deliveries are attempted at once, DefaultWorkers
+	// if not set; QueueSize how many may wait for a worker,
+	// DefaultQueueSize if not set.
+	Workers   int
+	QueueSize int
+
+	mu      sync.Mutex
+	closed  bool
+	queue   chan *job
+	retries map[*time.Timer]*job
+	pending sync.WaitGroup
+}
+
+// job is a delivery and its attempts so far.
+type job struct {
+	delivery  internal.WebhookDelivery
+	signature string
+	body      []byte
+}
+
+// Send queues the delivery of the body to the URL without waiting for it.
+func (d *Dispatcher) Send(userID int64, target, secret, event, expressionID string, body []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		log.Printf("Webhook %s for expression %s not sent, the dispatcher is closed", target, expressionID)
+		return
+	}
+	if d.queue == nil {
+		d.start()
+	}
+	d.pending.Add(1)
+	d.enqueueLocked(&job{
+		delivery:  internal.WebhookDelivery{UserID: userID, ExpressionID: expressionID, URL: target, Event: event},
+		signature: Sign(secret, body),
+		body:      body,
+	})
+}
+
+func (d *Dispatcher) start() {
+	workers, size := d.Workers, d.QueueSize
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	if size <= 0 {
+		size = DefaultQueueSize
+	}
+	d.queue = make(chan *job, size)
+	d.retries = make(map[*time.Timer]*job)
+	for i := 0; i < workers; i++ {
+		go d.work(d.queue)
+	}
+}
+
+// enqueueLocked hands the job, counted in pending, to the workers, or
+// drops it if they are too far behind.
+func (d *Dispatcher) enqueueLocked(j *job) {
+	select {
+	case d.queue <- j:
+	default:
+		d.pending.Done()
+		log.Printf("Webhook %s for expression %s dropped, the delivery queue is full", j.delivery.URL, j.delivery.ExpressionID)
+	}
+}
+
+// Close gives up pending retries and waits for the queued attempts to be
+// made and recorded, e.g. before the database is closed.
+func (d *Dispatcher) Close() {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		for timer, j := range d.retries {
+			if timer.Stop() {
+				d.pending.Done()
+				log.Printf("Webhook %s for expression %s given up on shutdown after %d attempts", j.delivery.URL, j.delivery.ExpressionID, j.delivery.Attempt)
+			}
+		}
+		d.retries = nil
+	}
+	d.mu.Unlock()
+	d.pending.Wait()
+
+	// nothing is queued once closed, so the workers can stop
+	d.mu.Lock()
+	if d.queue != nil {
+		close(d.queue)
+		d.queue = nil
+	}
+	d.mu.Unlock()
+}
+
+func (d *Dispatcher) work(queue <-chan *job) {
+	for j := range queue {
+		d.attempt(j)
+	}
+}
+
+// attempt makes the next attempt of the job and schedules a retry if it
+// failed and may succeed later.
+func (d *Dispatcher) attempt(j *job) {
+	delivery := &j.delivery
+	delivery.Attempt++
+	delivery.StatusCode, delivery.Error, delivery.Delivered = 0, "", false
+	retry := d.post(delivery, j.signature, j.body)
+	if d.Record != nil {
+		d.Record(*delivery)
+	}
+	if delivery.Delivered || !retry {
+		d.pending.Done()
+		return
+	}
+	if delivery.Attempt >= d.MaxAttempts {
+		log.Printf("Webhook %s for expression %s not delivered after %d attempts", delivery.URL, delivery.ExpressionID, delivery.Attempt)
+		d.pending.Done()
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		log.Printf("Webhook %s for expression %s given up on shutdown after %d attempts", delivery.URL, delivery.ExpressionID, delivery.Attempt)
+		d.pending.Done()
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(d.retryDelay(delivery.Attempt), func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		delete(d.retries, timer)
+		if d.closed {
+			d.pending.Done()
+			return
+		}
+		d.enqueueLocked(j)
+	})
+	d.retries[timer] = j
+}
+
+// post makes one attempt and reports whether a failed one is worth
+// repeating: forbidden addresses and client errors other than timeouts and
+// rate limits are not.
+func (d *Dispatcher) post(delivery *internal.WebhookDelivery, signature string, body []byte) (retry bool) {
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(body))
+	if err != nil {
+		delivery.Error = err.Error()
+		return false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SignatureHeader, signature)
+	req.Header.Set(EventHeader, delivery.Event)
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		delivery.Error = err.Error()
+		return !errors.Is(err, ErrForbiddenAddress)
+	}
+	resp.Body.Close()
+
+	delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		delivery.Delivered = true
+		return false
+	}
+	delivery.Error = "unexpected status " + strconv.Itoa(resp.StatusCode)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests
+}
+
+// retryDelay doubles the base delay per attempt up to RetryMaxDelay and
+// picks a random point in the upper half, like the agents do.
+func (d *Dispatcher) retryDelay(attempt int) time.Duration {
+	delay := d.RetryBaseDelay
+	for i := 1; i < attempt && delay < d.RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > d.RetryMaxDelay {
+		delay = d.RetryMaxDelay
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
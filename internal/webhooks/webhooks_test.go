@@ -0,0 +1,182 @@
+package webhooks_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/webhooks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSign(t *testing.T) {
+	// HMAC-SHA256 test case 2 from RFC 4231
+	assert.Equal(t, "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843",
+		webhooks.Sign("Jefe", []byte("what do ya want for nothing?")))
+}
+
+func TestEventFor(t *testing.T) {
+	assert.Equal(t, webhooks.EventCompleted, webhooks.EventFor(internal.Expression{Status: "calculated", Result: "4.0000000000"}))
+	assert.Equal(t, webhooks.EventError, webhooks.EventFor(internal.Expression{Status: "calculated", Result: "Error: division by zero"}))
+}
+
+func TestValidateURL(t *testing.T) {
+	assert.NoError(t, webhooks.ValidateURL("https://example.com/hooks?source=calc"))
+	assert.Error(t, webhooks.ValidateURL("ftp://example.com"))
+	assert.Error(t, webhooks.ValidateURL("/relative"))
+	assert.Error(t, webhooks.ValidateURL("http://%zz"))
+}
+
+func TestDispatcher(t *testing.T) {
+	var mu sync.Mutex
+	var received []*http.Request
+	failures := 2
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, r)
+		switch {
+		case r.URL.Path == "/gone":
+			w.WriteHeader(http.StatusGone)
+		case failures > 0:
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer receiver.Close()
+
+	deliveries := make(chan internal.WebhookDelivery, 10)
+	dispatcher := &webhooks.Dispatcher{
+		Client:         receiver.Client(),
+		MaxAttempts:    5,
+		RetryBaseDelay: time.Millisecond,
+		RetryMaxDelay:  5 * time.Millisecond,
+		Record:         func(d internal.WebhookDelivery) { deliveries <- d },
+	}
+
+	body := []byte(`{"event":"expression.completed"}`)
+	dispatcher.Send(1, receiver.URL+"/hook", "secret", webhooks.EventCompleted, "id1", body)
+	for attempt := 1; attempt <= 3; attempt++ {
+		d := <-deliveries
+		assert.Equal(t, attempt, d.Attempt)
+		assert.Equal(t, attempt == 3, d.Delivered, "Failed deliveries are retried")
+		assert.Equal(t, "id1", d.ExpressionID)
+	}
+	mu.Lock()
+	require.Len(t, received, 3)
+	assert.Equal(t, webhooks.Sign("secret", body), received[2].Header.Get(webhooks.SignatureHeader))
+	assert.Equal(t, webhooks.EventCompleted, received[2].Header.Get(webhooks.EventHeader))
+	mu.Unlock()
+
+	dispatcher.Send(1, receiver.URL+"/gone", "secret", webhooks.EventCompleted, "id2", body)
+	d := <-deliveries
+	assert.Equal(t, http.StatusGone, d.StatusCode)
+	assert.False(t, d.Delivered)
+	select {
+	case d := <-deliveries:
+		t.Fatalf("Client errors are not retried, got attempt %d", d.Attempt)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNewClientRefusesPrivateAddresses(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+	target := strings.Replace(receiver.URL, "127.0.0.1", "localhost", 1)
+
+	_, err := webhooks.NewClient(time.Second, false).Post(target, "application/json", nil)
+	assert.ErrorIs(t, err, webhooks.ErrForbiddenAddress, "Names resolving to loopback are refused when dialing")
+	for _, address := range []string{"http://10.0.0.1/", "http://169.254.169.254/", "http://[::1]/", "http://0.0.0.0/", "http://100.64.0.1/"} {
+		_, err := webhooks.NewClient(time.Second, false).Get(address)
+		assert.ErrorIs(t, err, webhooks.ErrForbiddenAddress, address)
+	}
+
+	deliveries := make(chan internal.WebhookDelivery, 10)
+	dispatcher := &webhooks.Dispatcher{
+		Client:         webhooks.NewClient(time.Second, false),
+		MaxAttempts:    3,
+		RetryBaseDelay: time.Millisecond,
+		RetryMaxDelay:  time.Millisecond,
+		Record:         func(d internal.WebhookDelivery) { deliveries <- d },
+	}
+	dispatcher.Send(1, target, "secret", webhooks.EventCompleted, "id1", []byte("{}"))
+	dispatcher.Close()
+	require.Len(t, deliveries, 1, "Forbidden addresses are not retried")
+	assert.False(t, (<-deliveries).Delivered)
+
+	resp, err := webhooks.NewClient(time.Second, true).Post(target, "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+}
+
+func TestDispatcherCloseGivesUpRetries(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	deliveries := make(chan internal.WebhookDelivery, 10)
+	dispatcher := &webhooks.Dispatcher{
+		Client:         receiver.Client(),
+		MaxAttempts:    5,
+		RetryBaseDelay: time.Minute,
+		RetryMaxDelay:  time.Minute,
+		Record:         func(d internal.WebhookDelivery) { deliveries <- d },
+	}
+	dispatcher.Send(1, receiver.URL, "secret", webhooks.EventCompleted, "id1", []byte("{}"))
+	<-deliveries
+
+	closed := make(chan struct{})
+	go func() {
+		dispatcher.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Close waited for the retry delay")
+	}
+	dispatcher.Send(1, receiver.URL, "secret", webhooks.EventCompleted, "id2", []byte("{}"))
+	assert.Empty(t, deliveries, "Nothing is sent after Close")
+}
+
+func TestDispatcherBoundsConcurrentDeliveries(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		most = max(most, inFlight)
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	deliveries := make(chan internal.WebhookDelivery, 10)
+	dispatcher := &webhooks.Dispatcher{
+		Client:      receiver.Client(),
+		MaxAttempts: 1,
+		Workers:     2,
+		Record:      func(d internal.WebhookDelivery) { deliveries <- d },
+	}
+	for i := 0; i < 6; i++ {
+		dispatcher.Send(1, receiver.URL, "secret", webhooks.EventCompleted, "id1", []byte("{}"))
+	}
+	dispatcher.Close()
+	require.Len(t, deliveries, 6, "Close waits for the queued deliveries")
+	assert.Equal(t, 2, most, "Deliveries are attempted by the workers only")
+}
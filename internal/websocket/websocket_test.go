@@ -0,0 +1,143 @@
+package websocket_test
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/katierevinska/calculatorService/internal/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// the example from RFC 6455
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", websocket.AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+// clientFrame is a masked frame as clients send them.
+func clientFrame(opcode byte, payload []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func readServerFrame(t *testing.T, r *bufio.Reader) (opcode byte, payload []byte) {
+	t.Helper()
+	var header [2]byte
+	_, err := io.ReadFull(r, header[:])
+	require.NoError(t, err)
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		var extended [2]byte
+		_, err := io.ReadFull(r, extended[:])
+		require.NoError(t, err)
+		length = int(binary.BigEndian.Uint16(extended[:]))
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+	return header[0] & 0x0F, payload
+}
+
+func TestUpgrade(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteText([]byte(strings.ToUpper(string(message))))
+			conn.WriteText([]byte(strings.Repeat("x", 300)))
+		}
+	}))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode, "Plain requests are not upgraded")
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: keep-alive, Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	handshake, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusSwitchingProtocols, handshake.StatusCode)
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", handshake.Header.Get("Sec-WebSocket-Accept"))
+
+	conn.Write(clientFrame(0x9, []byte("ping")))
+	opcode, payload := readServerFrame(t, reader)
+	assert.Equal(t, byte(0xA), opcode, "Pings are answered with pongs")
+	assert.Equal(t, "ping", string(payload))
+
+	conn.Write(clientFrame(0x1, []byte("hello")))
+	opcode, payload = readServerFrame(t, reader)
+	assert.Equal(t, byte(0x1), opcode)
+	assert.Equal(t, "HELLO", string(payload))
+	_, payload = readServerFrame(t, reader)
+	assert.Len(t, payload, 300)
+
+	conn.Write(clientFrame(0x8, nil))
+	opcode, _ = readServerFrame(t, reader)
+	assert.Equal(t, byte(0x8), opcode, "Closing is confirmed")
+}
+
+func handshake(t *testing.T, serverURL, headers string) *http.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(serverURL, "http://"))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: calc.example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n" + headers + "\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(t, err)
+	return resp
+}
+
+func TestUpgrader(t *testing.T) {
+	upgrader := websocket.Upgrader{AllowedOrigins: []string{"https://app.example.com"}, Protocols: []string{"bearer"}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := upgrader.Upgrade(w, r); err == nil {
+			conn.Close()
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name, headers string
+		status        int
+	}{
+		{"Clients without an Origin are not browsers", "", http.StatusSwitchingProtocols},
+		{"Pages of the server itself", "Origin: https://calc.example.com\r\n", http.StatusSwitchingProtocols},
+		{"Allowed origins", "Origin: https://app.example.com\r\n", http.StatusSwitchingProtocols},
+		{"Other sites are refused", "Origin: https://evil.example.com\r\n", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.status, handshake(t, server.URL, tt.headers).StatusCode)
+		})
+	}
+
+	resp := handshake(t, server.URL, "Sec-WebSocket-Protocol: chat, bearer, token\r\n")
+	assert.Equal(t, "bearer", resp.Header.Get("Sec-WebSocket-Protocol"), "A supported subprotocol is selected")
+	resp = handshake(t, server.URL, "")
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Protocol"))
+}
@@ -0,0 +1,522 @@
+package operations
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"math/cmplx"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type Associativity int
+
+const (
+	LeftAssociative Associativity = iota
+	RightAssociative
+)
+
+// Operation describes one operator or function known to both the planner
+// and the agents.
+type Operation struct {
+	Symbol   string
+	Name     string
+	Arity    int
+	Function bool
+	// Prefix operators such as ! take one argument written after them.
+	Prefix        bool
+	Associativity Associativity
+	Precedence    int
+	// TimingKey is the environment variable holding the simulated
+	// execution time in milliseconds, e.g. TIME_ADDITION_MS.
+	TimingKey string
+	Eval      func(args []float64) (float64, error)
+	// EvalComplex computes the operation on complex numbers. Operations
+	// without it, such as comparisons, only accept complex arguments whose
+	// imaginary part is zero.
+	EvalComplex func(args []complex128) (complex128, error)
+	// EvalInteger computes the operation exactly on integers. Operations
+	// without it, such as ln, are not available in integer mode.
+	EvalInteger func(args []*big.Int) (*big.Int, error)
+	// CheckLiterals rejects arguments known at plan time that can never
+	// succeed, e.g. division by a literal zero. Non-literal arguments are "".
+	CheckLiterals func(args []string) error
+}
+
+type Registry struct {
+	ops map[string]*Operation
+	mu  sync.RWMutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry{ops: make(map[string]*Operation)}
+}
+
+func (r *Registry) Register(op Operation) error {
+	if op.Symbol == "" || op.Eval == nil {
+		return errors.New("operation needs a symbol and an evaluator")
+	}
+	if op.Arity < 1 {
+		return fmt.Errorf("operation %q: arity must be positive", op.Symbol)
+	}
+	if op.Prefix && (op.Function || op.Arity != 1) {
+		return fmt.Errorf("prefix operator %q must take exactly one argument", op.Symbol)
+	}
+	if !op.Function && !op.Prefix && op.Arity != 2 {
+		return fmt.Errorf("operator %q must be binary, use a function instead", op.Symbol)
+	}
+	// tasks carry at most two arguments, see internal.Task
+	if op.Arity > 2 {
+		return fmt.Errorf("function %q: at most two arguments are supported", op.Symbol)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, exists := r.ops[op.Symbol]; exists {
+		return fmt.Errorf("operation %q is already registered", op.Symbol)
+	}
+	r.ops[op.Symbol] = &op
+	return nil
+}
+
+func (r *Registry) MustRegister(op Operation) {
+	if err := r.Register(op); err != nil {
+		panic(err)
+	}
+}
+
+func (r *Registry) Lookup(symbol string) (*Operation, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	op, exists := r.ops[symbol]
+	return op, exists
+}
+
+// Symbols lists every registered symbol in a stable order.
+func (r *Registry) Symbols() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	symbols := make([]string, 0, len(r.ops))
+	for symbol := range r.ops {
+		symbols = append(symbols, symbol)
+	}
+	sort.Strings(symbols)
+	return symbols
+}
+
+// TimeSetting returns the configured execution time of the operation in
+// milliseconds, "0" for unknown operations.
+func (r *Registry) TimeSetting(symbol string) string {
+	op, exists := r.Lookup(symbol)
+	if !exists || op.TimingKey == "" {
+		return "0"
+	}
+	return os.Getenv(op.TimingKey)
+}
+
+// Evaluate applies the operation to string arguments as they travel in
+// tasks.
+func (r *Registry) Evaluate(symbol string, args []string) (float64, error) {
+	op, exists := r.Lookup(symbol)
+	if !exists {
+		return 0, fmt.Errorf("unknown operation %q", symbol)
+	}
+	if len(args) != op.Arity {
+		return 0, fmt.Errorf("operation %q expects %d arguments, got %d", symbol, op.Arity, len(args))
+	}
+	values := make([]float64, len(args))
+	for i, arg := range args {
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return 0, ErrInvalidNumber
+		}
+		values[i] = v
+	}
+	return op.Eval(values)
+}
+
+// EvaluateComplex is Evaluate for tasks computed in complex arithmetic,
+// see internal.Task.Complex. Arguments are read as "2", "-1.5i" or "1+2i".
+func (r *Registry) EvaluateComplex(symbol string, args []string) (complex128, error) {
+	op, exists := r.Lookup(symbol)
+	if !exists {
+		return 0, fmt.Errorf("unknown operation %q", symbol)
+	}
+	if len(args) != op.Arity {
+		return 0, fmt.Errorf("operation %q expects %d arguments, got %d", symbol, op.Arity, len(args))
+	}
+	values := make([]complex128, len(args))
+	for i, arg := range args {
+		v, err := strconv.ParseComplex(arg, 128)
+		if err != nil {
+			return 0, ErrInvalidNumber
+		}
+		values[i] = v
+	}
+	if op.EvalComplex != nil {
+		return op.EvalComplex(values)
+	}
+	reals := make([]float64, len(values))
+	for i, v := range values {
+		if imag(v) != 0 {
+			return 0, fmt.Errorf("%s is not defined for complex numbers", op.Name)
+		}
+		reals[i] = real(v)
+	}
+	v, err := op.Eval(reals)
+	return complex(v, 0), err
+}
+
+// EvaluateInteger is Evaluate for tasks computed exactly on integers, see
+// internal.Task.Integer. Arguments are decimal integers of any length.
+func (r *Registry) EvaluateInteger(symbol string, args []string) (*big.Int, error) {
+	op, exists := r.Lookup(symbol)
+	if !exists {
+		return nil, fmt.Errorf("unknown operation %q", symbol)
+	}
+	if len(args) != op.Arity {
+		return nil, fmt.Errorf("operation %q expects %d arguments, got %d", symbol, op.Arity, len(args))
+	}
+	if op.EvalInteger == nil {
+		return nil, fmt.Errorf("%s is not defined for integers", op.Name)
+	}
+	values := make([]*big.Int, len(args))
+	for i, arg := range args {
+		v, ok := new(big.Int).SetString(arg, 10)
+		if !ok {
+			return nil, ErrInvalidNumber
+		}
+		values[i] = v
+	}
+	return op.EvalInteger(values)
+}
+
+var ErrInvalidNumber = errors.New("invalid number")
+
+// IsNumber tells numbers from task IDs among task arguments and results.
+// Integers too long for float64 are numbers as well, see EvaluateInteger.
+func IsNumber(s string) bool {
+	_, err := strconv.ParseComplex(s, 128)
+	return err == nil || errors.Is(err, strconv.ErrRange)
+}
+
+// MaxIntegerBits bounds integer results, about 19700 decimal digits, so a
+// single task cannot exhaust an agent.
+const MaxIntegerBits = 1 << 16
+
+// maxFactorial is the largest n whose factorial fits in MaxIntegerBits.
+const maxFactorial = 5910
+
+var errTooLarge = errors.New("integer result is too large")
+
+func checkSize(v *big.Int) (*big.Int, error) {
+	if v.BitLen() > MaxIntegerBits {
+		return nil, errTooLarge
+	}
+	return v, nil
+}
+
+// ResultPrecision is the number of decimal places agents report results
+// with.
+const ResultPrecision = 10
+
+func FormatResult(v float64) string {
+	return strconv.FormatFloat(v, 'f', ResultPrecision, 64)
+}
+
+// FormatComplex reports complex results as "1.0000000000+2.0000000000i".
+// Results whose imaginary part rounds to zero look like real ones, so
+// sqrt(-4)^2 is -4.
+func FormatComplex(v complex128) string {
+	imaginary := FormatResult(imag(v))
+	if strings.Trim(imaginary, "-0.") == "" {
+		return FormatResult(real(v))
+	}
+	if !strings.HasPrefix(imaginary, "-") {
+		imaginary = "+" + imaginary
+	}
+	return FormatResult(real(v)) + imaginary + "i"
+}
+
+// Booleans travel as numbers: comparisons and logical operators return 1
+// for true and 0 for false, and any non-zero number counts as true.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func complexBool(b bool) complex128 {
+	return complex(boolValue(b), 0)
+}
+
+func integerBool(b bool) *big.Int {
+	return big.NewInt(int64(boolValue(b)))
+}
+
+// euclidean divides so that the remainder is never negative: -7 // 2 is -4
+// and -7 % 2 is 1. Integer mode divides the same way, see big.Int.Div.
+func euclidean(a, b float64) (quotient, remainder float64) {
+	remainder = math.Mod(a, b)
+	if remainder < 0 {
+		remainder += math.Abs(b)
+	}
+	return math.Round((a - remainder) / b), remainder
+}
+
+func checkDivisor(args []string) error {
+	if literalZero(args[1]) {
+		return errors.New("devision by 0")
+	}
+	return nil
+}
+
+func integerDivisor(b *big.Int) error {
+	if b.Sign() == 0 {
+		return errors.New("devision by 0")
+	}
+	return nil
+}
+
+func literalZero(arg string) bool {
+	v, err := strconv.ParseFloat(arg, 64)
+	return err == nil && v == 0
+}
+
+// Default holds the operations supported out of the box. Adding an
+// operation means registering it here.
+var Default = NewRegistry()
+
+func init() {
+	Default.MustRegister(Operation{
+		Symbol: "+", Name: "addition", Arity: 2, Precedence: 5, TimingKey: "TIME_ADDITION_MS",
+		Eval:        func(a []float64) (float64, error) { return a[0] + a[1], nil },
+		EvalComplex: func(a []complex128) (complex128, error) { return a[0] + a[1], nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) { return checkSize(new(big.Int).Add(a[0], a[1])) },
+	})
+	Default.MustRegister(Operation{
+		Symbol: "-", Name: "subtraction", Arity: 2, Precedence: 5, TimingKey: "TIME_SUBTRACTION_MS",
+		Eval:        func(a []float64) (float64, error) { return a[0] - a[1], nil },
+		EvalComplex: func(a []complex128) (complex128, error) { return a[0] - a[1], nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) { return checkSize(new(big.Int).Sub(a[0], a[1])) },
+	})
+	Default.MustRegister(Operation{
+		Symbol: "*", Name: "multiplication", Arity: 2, Precedence: 6, TimingKey: "TIME_MULTIPLICATIONS_MS",
+		Eval:        func(a []float64) (float64, error) { return a[0] * a[1], nil },
+		EvalComplex: func(a []complex128) (complex128, error) { return a[0] * a[1], nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) { return checkSize(new(big.Int).Mul(a[0], a[1])) },
+	})
+	Default.MustRegister(Operation{
+		Symbol: "/", Name: "division", Arity: 2, Precedence: 6, TimingKey: "TIME_DIVISIONS_MS",
+		Eval:        func(a []float64) (float64, error) { return a[0] / a[1], nil },
+		EvalComplex: func(a []complex128) (complex128, error) { return a[0] / a[1], nil },
+		// integers are only divided exactly, // and % give the quotient and
+		// the remainder
+		EvalInteger: func(a []*big.Int) (*big.Int, error) {
+			if err := integerDivisor(a[1]); err != nil {
+				return nil, err
+			}
+			quotient, remainder := new(big.Int).QuoRem(a[0], a[1], new(big.Int))
+			if remainder.Sign() != 0 {
+				return nil, fmt.Errorf("%s/%s is not an integer, use // and %%", a[0], a[1])
+			}
+			return quotient, nil
+		},
+		CheckLiterals: checkDivisor,
+	})
+	Default.MustRegister(Operation{
+		Symbol: "//", Name: "integer division", Arity: 2, Precedence: 6, TimingKey: "TIME_DIVISIONS_MS",
+		Eval: func(a []float64) (float64, error) {
+			if a[1] == 0 {
+				return 0, errors.New("devision by 0")
+			}
+			quotient, _ := euclidean(a[0], a[1])
+			return quotient, nil
+		},
+		EvalInteger: func(a []*big.Int) (*big.Int, error) {
+			if err := integerDivisor(a[1]); err != nil {
+				return nil, err
+			}
+			return new(big.Int).Div(a[0], a[1]), nil
+		},
+		CheckLiterals: checkDivisor,
+	})
+	Default.MustRegister(Operation{
+		Symbol: "%", Name: "remainder", Arity: 2, Precedence: 6, TimingKey: "TIME_DIVISIONS_MS",
+		Eval: func(a []float64) (float64, error) {
+			if a[1] == 0 {
+				return 0, errors.New("devision by 0")
+			}
+			_, remainder := euclidean(a[0], a[1])
+			return remainder, nil
+		},
+		EvalInteger: func(a []*big.Int) (*big.Int, error) {
+			if err := integerDivisor(a[1]); err != nil {
+				return nil, err
+			}
+			return new(big.Int).Mod(a[0], a[1]), nil
+		},
+		CheckLiterals: checkDivisor,
+	})
+	Default.MustRegister(Operation{
+		Symbol: "^", Name: "power", Arity: 2, Precedence: 7, Associativity: RightAssociative, TimingKey: "TIME_POWER_MS",
+		Eval:        func(a []float64) (float64, error) { return math.Pow(a[0], a[1]), nil },
+		EvalComplex: func(a []complex128) (complex128, error) { return cmplx.Pow(a[0], a[1]), nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) {
+			base, exponent := a[0], a[1]
+			if exponent.Sign() < 0 {
+				return nil, errors.New("negative exponents are not integers")
+			}
+			// 0, 1 and -1 stay small whatever the exponent. The result has
+			// between exponent*(BitLen-1) and exponent*BitLen bits, so the
+			// pre-check keeps Exp under twice the limit and checkSize settles it.
+			if base.CmpAbs(big.NewInt(1)) > 0 && (!exponent.IsInt64() || exponent.Int64() > MaxIntegerBits ||
+				exponent.Int64()*int64(base.BitLen()-1) > MaxIntegerBits) {
+				return nil, errTooLarge
+			}
+			return checkSize(new(big.Int).Exp(base, exponent, nil))
+		},
+	})
+	Default.MustRegister(Operation{
+		Symbol: "sqrt", Name: "square root", Arity: 1, Function: true, TimingKey: "TIME_SQRT_MS",
+		Eval: func(a []float64) (float64, error) {
+			if a[0] < 0 {
+				return 0, errors.New("square root of a negative number")
+			}
+			return math.Sqrt(a[0]), nil
+		},
+		EvalComplex: func(a []complex128) (complex128, error) { return cmplx.Sqrt(a[0]), nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) {
+			if a[0].Sign() < 0 {
+				return nil, errors.New("square root of a negative number")
+			}
+			root := new(big.Int).Sqrt(a[0])
+			if new(big.Int).Mul(root, root).Cmp(a[0]) != 0 {
+				return nil, fmt.Errorf("square root of %s is not an integer", a[0])
+			}
+			return root, nil
+		},
+	})
+	Default.MustRegister(Operation{
+		Symbol: "abs", Name: "absolute value", Arity: 1, Function: true, TimingKey: "TIME_ABS_MS",
+		Eval:        func(a []float64) (float64, error) { return math.Abs(a[0]), nil },
+		EvalComplex: func(a []complex128) (complex128, error) { return complex(cmplx.Abs(a[0]), 0), nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) { return new(big.Int).Abs(a[0]), nil },
+	})
+	Default.MustRegister(Operation{
+		Symbol: "ln", Name: "natural logarithm", Arity: 1, Function: true, TimingKey: "TIME_LN_MS",
+		Eval: func(a []float64) (float64, error) {
+			if a[0] <= 0 {
+				return 0, errors.New("logarithm of a non-positive number")
+			}
+			return math.Log(a[0]), nil
+		},
+		EvalComplex: func(a []complex128) (complex128, error) {
+			if a[0] == 0 {
+				return 0, errors.New("logarithm of zero")
+			}
+			return cmplx.Log(a[0]), nil
+		},
+	})
+	Default.MustRegister(Operation{
+		Symbol: "min", Name: "minimum", Arity: 2, Function: true, TimingKey: "TIME_COMPARISON_MS",
+		Eval: func(a []float64) (float64, error) { return math.Min(a[0], a[1]), nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) {
+			if a[0].Cmp(a[1]) < 0 {
+				return a[0], nil
+			}
+			return a[1], nil
+		},
+	})
+	Default.MustRegister(Operation{
+		Symbol: "max", Name: "maximum", Arity: 2, Function: true, TimingKey: "TIME_COMPARISON_MS",
+		Eval: func(a []float64) (float64, error) { return math.Max(a[0], a[1]), nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) {
+			if a[0].Cmp(a[1]) > 0 {
+				return a[0], nil
+			}
+			return a[1], nil
+		},
+	})
+	Default.MustRegister(Operation{
+		Symbol: "factorial", Name: "factorial", Arity: 1, Function: true, TimingKey: "TIME_FACTORIAL_MS",
+		Eval: func(a []float64) (float64, error) {
+			if a[0] < 0 || a[0] != math.Trunc(a[0]) {
+				return 0, errors.New("factorial of a negative or fractional number")
+			}
+			if a[0] > 170 {
+				return 0, errors.New("factorial is too large, use integer mode")
+			}
+			return math.Round(math.Gamma(a[0] + 1)), nil
+		},
+		EvalInteger: func(a []*big.Int) (*big.Int, error) {
+			if a[0].Sign() < 0 {
+				return nil, errors.New("factorial of a negative number")
+			}
+			if a[0].Cmp(big.NewInt(maxFactorial)) > 0 {
+				return nil, errTooLarge
+			}
+			return checkSize(new(big.Int).MulRange(1, a[0].Int64()))
+		},
+	})
+	// int converts numbers for integer mode, where int(2.5) is folded into 2
+	// by the planner; computed results are integers already.
+	Default.MustRegister(Operation{
+		Symbol: "int", Name: "integer part", Arity: 1, Function: true,
+		Eval:        func(a []float64) (float64, error) { return math.Trunc(a[0]), nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) { return a[0], nil },
+	})
+
+	comparisons := []struct {
+		symbol, name string
+		precedence   int
+		compare      func(a, b float64) bool
+	}{
+		{"<", "less", 4, func(a, b float64) bool { return a < b }},
+		{"<=", "less or equal", 4, func(a, b float64) bool { return a <= b }},
+		{">", "greater", 4, func(a, b float64) bool { return a > b }},
+		{">=", "greater or equal", 4, func(a, b float64) bool { return a >= b }},
+		{"==", "equal", 3, func(a, b float64) bool { return a == b }},
+		{"!=", "not equal", 3, func(a, b float64) bool { return a != b }},
+	}
+	for _, c := range comparisons {
+		compare := c.compare
+		op := Operation{
+			Symbol: c.symbol, Name: c.name, Arity: 2, Precedence: c.precedence, TimingKey: "TIME_COMPARISON_MS",
+			Eval: func(a []float64) (float64, error) { return boolValue(compare(a[0], a[1])), nil },
+			EvalInteger: func(a []*big.Int) (*big.Int, error) {
+				return integerBool(compare(float64(a[0].Cmp(a[1])), 0)), nil
+			},
+		}
+		// complex numbers can be equal, but not ordered
+		switch c.symbol {
+		case "==":
+			op.EvalComplex = func(a []complex128) (complex128, error) { return complexBool(a[0] == a[1]), nil }
+		case "!=":
+			op.EvalComplex = func(a []complex128) (complex128, error) { return complexBool(a[0] != a[1]), nil }
+		}
+		Default.MustRegister(op)
+	}
+	Default.MustRegister(Operation{
+		Symbol: "&&", Name: "and", Arity: 2, Precedence: 2, TimingKey: "TIME_LOGIC_MS",
+		Eval:        func(a []float64) (float64, error) { return boolValue(a[0] != 0 && a[1] != 0), nil },
+		EvalComplex: func(a []complex128) (complex128, error) { return complexBool(a[0] != 0 && a[1] != 0), nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) { return integerBool(a[0].Sign() != 0 && a[1].Sign() != 0), nil },
+	})
+	Default.MustRegister(Operation{
+		Symbol: "||", Name: "or", Arity: 2, Precedence: 1, TimingKey: "TIME_LOGIC_MS",
+		Eval:        func(a []float64) (float64, error) { return boolValue(a[0] != 0 || a[1] != 0), nil },
+		EvalComplex: func(a []complex128) (complex128, error) { return complexBool(a[0] != 0 || a[1] != 0), nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) { return integerBool(a[0].Sign() != 0 || a[1].Sign() != 0), nil },
+	})
+	Default.MustRegister(Operation{
+		Symbol: "!", Name: "not", Arity: 1, Prefix: true, TimingKey: "TIME_LOGIC_MS",
+		Eval:        func(a []float64) (float64, error) { return boolValue(a[0] == 0), nil },
+		EvalComplex: func(a []complex128) (complex128, error) { return complexBool(a[0] == 0), nil },
+		EvalInteger: func(a []*big.Int) (*big.Int, error) { return integerBool(a[0].Sign() == 0), nil },
+	})
+}
@@ -0,0 +1,159 @@
+package operations_test
+
+import (
+	"testing"
+
+	"github.com/katierevinska/calculatorService/pkg/operations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Register(t *testing.T) {
+	registry := operations.NewRegistry()
+	double := operations.Operation{
+		Symbol: "double", Arity: 1, Function: true,
+		Eval: func(a []float64) (float64, error) { return a[0] * 2, nil },
+	}
+
+	require.NoError(t, registry.Register(double))
+	assert.Error(t, registry.Register(double), "Duplicate symbols are rejected")
+	assert.Error(t, registry.Register(operations.Operation{Symbol: "~", Arity: 1, Eval: double.Eval}), "Operators must be binary")
+	assert.Error(t, registry.Register(operations.Operation{Symbol: "noeval", Arity: 1, Function: true}))
+	assert.Error(t, registry.Register(operations.Operation{
+		Symbol: "clamp", Arity: 3, Function: true,
+		Eval: func(a []float64) (float64, error) { return min(max(a[0], a[1]), a[2]), nil },
+	}), "Tasks carry at most two arguments")
+
+	op, exists := registry.Lookup("double")
+	require.True(t, exists)
+	assert.Equal(t, 1, op.Arity)
+	assert.Equal(t, []string{"double"}, registry.Symbols())
+}
+
+func TestDefault_Evaluate(t *testing.T) {
+	tests := []struct {
+		symbol      string
+		args        []string
+		expected    float64
+		expectError bool
+	}{
+		{"+", []string{"1", "2"}, 3, false},
+		{"-", []string{"1", "2"}, -1, false},
+		{"*", []string{"3", "2"}, 6, false},
+		{"/", []string{"3", "2"}, 1.5, false},
+		{"^", []string{"2", "0.5"}, 1.4142135623730951, false},
+		{"sqrt", []string{"9"}, 3, false},
+		{"abs", []string{"-9"}, 9, false},
+		{"ln", []string{"1"}, 0, false},
+		{"ln", []string{"0"}, 0, true},
+		{"min", []string{"4", "-1"}, -1, false},
+		{"max", []string{"4", "-1"}, 4, false},
+		{"<", []string{"1", "2"}, 1, false},
+		{">=", []string{"1", "2"}, 0, false},
+		{"==", []string{"2", "2.0"}, 1, false},
+		{"!=", []string{"2", "2"}, 0, false},
+		{"&&", []string{"1", "0"}, 0, false},
+		{"||", []string{"0", "-3"}, 1, false},
+		{"!", []string{"0"}, 1, false},
+		{"//", []string{"-7", "2"}, -4, false},
+		{"%", []string{"-7", "2"}, 1, false},
+		{"%", []string{"7.5", "2"}, 1.5, false},
+		{"%", []string{"1", "0"}, 0, true},
+		{"factorial", []string{"5"}, 120, false},
+		{"factorial", []string{"2.5"}, 0, true},
+		{"int", []string{"-2.7"}, -2, false},
+		{"sqrt", []string{"-9"}, 0, true},
+		{"+", []string{"1"}, 0, true},
+		{"+", []string{"1", "x"}, 0, true},
+		{"?", []string{"1", "2"}, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.symbol, func(t *testing.T) {
+			result, err := operations.Default.Evaluate(tt.symbol, tt.args)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.InDelta(t, tt.expected, result, 1e-12)
+		})
+	}
+}
+
+func TestDefault_EvaluateComplex(t *testing.T) {
+	tests := []struct {
+		symbol      string
+		args        []string
+		expected    string
+		expectError bool
+	}{
+		{"*", []string{"1+2i", "3-1i"}, "5.0000000000+5.0000000000i", false},
+		{"/", []string{"1", "1i"}, "0.0000000000-1.0000000000i", false},
+		{"sqrt", []string{"-4"}, "0.0000000000+2.0000000000i", false},
+		{"^", []string{"1i", "2"}, "-1.0000000000", false},
+		{"abs", []string{"3+4i"}, "5.0000000000", false},
+		{"ln", []string{"-1"}, "0.0000000000+3.1415926536i", false},
+		{"ln", []string{"0"}, "", true},
+		{"==", []string{"1+1i", "1.0+1.0i"}, "1.0000000000", false},
+		{"<", []string{"2", "3"}, "1.0000000000", false},
+		{"<", []string{"1i", "3"}, "", true},
+		{"max", []string{"2", "3+0i"}, "3.0000000000", false},
+		{"+", []string{"1", "i"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.symbol, func(t *testing.T) {
+			result, err := operations.Default.EvaluateComplex(tt.symbol, tt.args)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, operations.FormatComplex(result))
+		})
+	}
+}
+
+func TestDefault_EvaluateInteger(t *testing.T) {
+	tests := []struct {
+		symbol      string
+		args        []string
+		expected    string
+		expectError bool
+	}{
+		{"*", []string{"12345678901234567890", "98765432109876543210"}, "1219326311370217952237463801111263526900", false},
+		{"/", []string{"-8", "2"}, "-4", false},
+		{"/", []string{"7", "2"}, "", true},
+		{"/", []string{"7", "0"}, "", true},
+		{"//", []string{"7", "-2"}, "-3", false},
+		{"%", []string{"7", "-2"}, "1", false},
+		{"^", []string{"3", "40"}, "12157665459056928801", false},
+		{"^", []string{"2", "-1"}, "", true},
+		{"^", []string{"2", "1000000"}, "", true},
+		{"^", []string{"3", "65536"}, "", true},
+		{"^", []string{"-1", "1000000000001"}, "-1", false},
+		{"sqrt", []string{"144"}, "12", false},
+		{"sqrt", []string{"2"}, "", true},
+		{"factorial", []string{"20"}, "2432902008176640000", false},
+		{"factorial", []string{"-1"}, "", true},
+		{"factorial", []string{"100000"}, "", true},
+		{"factorial", []string{"5911"}, "", true},
+		{">=", []string{"10000000000000000000001", "10000000000000000000000"}, "1", false},
+		{"!", []string{"5"}, "0", false},
+		{"ln", []string{"1"}, "", true},
+		{"+", []string{"1.5", "1"}, "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.symbol, func(t *testing.T) {
+			result, err := operations.Default.EvaluateInteger(tt.symbol, tt.args)
+			if tt.expectError {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, result.String())
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package rpn
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Limits on list sizes. The median of computed values needs a sorting
+// network, i.e. far more tasks than the other aggregates, so it is limited
+// separately.
+const (
+	MaxListLength     = 10000
+	MaxComputedMedian = 128
+)
+
+// NumbersVariable is the name under which the numbers sent along with an
+// expression are available, e.g. "avg(numbers)".
+const NumbersVariable = "numbers"
+
+// Inputs bind variable names to values given outside of the expression
+// text.
+type Inputs map[string]*Node
+
+// List builds the list literal holding the numbers. They are written
+// without an exponent, so that whole numbers are integers in integer mode.
+func List(numbers []float64) *Node {
+	elements := make([]*Node, len(numbers))
+	for i, v := range numbers {
+		elements[i] = &Node{Kind: NumberNode, Value: strconv.FormatFloat(v, 'f', -1, 64)}
+	}
+	return &Node{Kind: ListNode, Args: elements}
+}
+
+type aggregate func(operands []*Node) (*Node, error)
+
+// aggregates are lowered into trees of ordinary operations before
+// planning. Reductions are balanced, so a list of n numbers is computed in
+// about log2(n) rounds of tasks that agents pick up in parallel.
+var aggregates = map[string]aggregate{
+	"sum":    reduction("+"),
+	"min":    reduction("min"),
+	"max":    reduction("max"),
+	"avg":    func(operands []*Node) (*Node, error) { return average(operands), nil },
+	"median": median,
+	"stddev": stddev,
+}
+
+func aggregateNames() string {
+	names := make([]string, 0, len(aggregates))
+	for name := range aggregates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// lowerAggregate replaces the aggregate with the operations computing it.
+// Lists among the arguments are flattened, so sum([1, 2], 3) is
+// sum(1, 2, 3).
+func lowerAggregate(n *Node) (*Node, error) {
+	operands := flatten(n.Args, nil)
+	if len(operands) == 0 {
+		return nil, errors.New("invalid expression: " + n.Value + " of an empty list")
+	}
+	if len(operands) > MaxListLength {
+		return nil, errors.New("invalid expression: lists are limited to " + strconv.Itoa(MaxListLength) + " numbers")
+	}
+	return aggregates[n.Value](operands)
+}
+
+func flatten(args []*Node, operands []*Node) []*Node {
+	for _, arg := range args {
+		if arg.Kind == ListNode {
+			operands = flatten(arg.Args, operands)
+			continue
+		}
+		operands = append(operands, arg)
+	}
+	return operands
+}
+
+func operation(symbol string, args ...*Node) *Node {
+	return &Node{Kind: OperationNode, Value: symbol, Args: args}
+}
+
+func number(v int) *Node {
+	return &Node{Kind: NumberNode, Value: strconv.Itoa(v)}
+}
+
+func reduction(symbol string) aggregate {
+	return func(operands []*Node) (*Node, error) {
+		return reduceBalanced(symbol, operands), nil
+	}
+}
+
+func reduceBalanced(symbol string, operands []*Node) *Node {
+	if len(operands) == 1 {
+		return operands[0]
+	}
+	mid := len(operands) / 2
+	return operation(symbol, reduceBalanced(symbol, operands[:mid]), reduceBalanced(symbol, operands[mid:]))
+}
+
+func average(operands []*Node) *Node {
+	if len(operands) == 1 {
+		return operands[0]
+	}
+	return operation("/", reduceBalanced("+", operands), number(len(operands)))
+}
+
+// stddev is the population standard deviation. The mean is a single shared
+// node, so it is computed once for all deviations.
+func stddev(operands []*Node) (*Node, error) {
+	if len(operands) == 1 {
+		return number(0), nil
+	}
+	mean := average(operands)
+	squares := make([]*Node, len(operands))
+	for i, x := range operands {
+		squares[i] = operation("^", operation("-", x, mean), number(2))
+	}
+	return operation("sqrt", operation("/", reduceBalanced("+", squares), number(len(operands)))), nil
+}
+
+func median(operands []*Node) (*Node, error) {
+	sorted, err := sortOperands(operands)
+	if err != nil {
+		return nil, err
+	}
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 1 {
+		return sorted[mid], nil
+	}
+	return operation("/", operation("+", sorted[mid-1], sorted[mid]), number(2)), nil
+}
+
+// sortOperands orders numbers right away. Computed values are ordered by
+// Batcher's odd-even merge sort built from min and max operations; only
+// the comparators the median depends on are ever planned.
+func sortOperands(operands []*Node) ([]*Node, error) {
+	sorted := append([]*Node(nil), operands...)
+	values := make([]float64, len(sorted))
+	literals := true
+	for i, operand := range sorted {
+		v, err := strconv.ParseFloat(operand.Value, 64)
+		if operand.Kind != NumberNode || err != nil {
+			literals = false
+			break
+		}
+		values[i] = v
+	}
+	if literals {
+		sort.Sort(byValue{sorted, values})
+		return sorted, nil
+	}
+
+	if len(sorted) > MaxComputedMedian {
+		return nil, errors.New("invalid expression: median of more than " + strconv.Itoa(MaxComputedMedian) + " computed values")
+	}
+	n := len(sorted)
+	for p := 1; p < n; p *= 2 {
+		for k := p; k >= 1; k /= 2 {
+			for j := k % p; j+k < n; j += 2 * k {
+				for i := 0; i < k && i+j+k < n; i++ {
+					if (i+j)/(2*p) == (i+j+k)/(2*p) {
+						a, b := sorted[i+j], sorted[i+j+k]
+						sorted[i+j], sorted[i+j+k] = operation("min", a, b), operation("max", a, b)
+					}
+				}
+			}
+		}
+	}
+	return sorted, nil
+}
+
+type byValue struct {
+	nodes  []*Node
+	values []float64
+}
+
+func (s byValue) Len() int           { return len(s.nodes) }
+func (s byValue) Less(i, j int) bool { return s.values[i] < s.values[j] }
+func (s byValue) Swap(i, j int) {
+	s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i]
+	s.values[i], s.values[j] = s.values[j], s.values[i]
+}
@@ -0,0 +1,141 @@
+package rpn
+
+import (
+	"slices"
+	"strconv"
+
+	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/store"
+)
+
+// Explanation is the plan of an expression that is not computed, see
+// Explain.
+type Explanation struct {
+	// Results are the task IDs or numbers the value comes from: one for
+	// numbers, one per statement of a script and one per element of a
+	// matrix.
+	Results []string
+	Tasks   []internal.Task
+	Stats   PlanStats
+}
+
+// Explain plans the expression or script into a task store of its own, so
+// no task reaches the agents and the task IDs start from id1.
+func Explain(expression string, lookup FunctionLookup, inputs Inputs, mode Mode) (Explanation, error) {
+	prepared, err := Prepare(expression, store.NewTaskStore(), lookup, inputs, mode)
+	if err != nil {
+		return Explanation{}, err
+	}
+	return prepared.Explanation, nil
+}
+
+// Prepared is a plan whose tasks are not in the task store yet, so that it
+// can be looked at, e.g. estimated, before Commit hands it to the agents.
+type Prepared struct {
+	Explanation
+	// ID is the result of an expression as CalcWithFunctions returns it,
+	// scripts have Script instead.
+	ID      string
+	Script  []ScriptResult
+	planner *planner
+}
+
+// Prepare plans the expression like CalcWithFunctions or the script like
+// PlanScript, with task IDs from the store. A plan that is never
+// committed only leaves a gap in the IDs.
+func Prepare(expression string, taskStore *store.TaskStore, lookup FunctionLookup, inputs Inputs, mode Mode) (*Prepared, error) {
+	prepared := &Prepared{}
+	if IsScript(expression) {
+		statements, err := ParseScript(expression)
+		if err != nil {
+			return nil, err
+		}
+		prepared.planner, prepared.Script, prepared.Stats, err = prepareScript(statements, taskStore, lookup, inputs, mode)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range prepared.Script {
+			prepared.Results = append(prepared.Results, result.ID)
+		}
+	} else {
+		root, err := expandExpression(expression, lookup, inputs)
+		if err != nil {
+			return nil, err
+		}
+		prepared.planner, prepared.ID, prepared.Stats, err = prepareTree(root, taskStore, mode)
+		if err != nil {
+			return nil, err
+		}
+		prepared.Results = []string{prepared.ID}
+		if prepared.Stats.Shape != nil {
+			prepared.Results = prepared.Stats.Elements
+		}
+	}
+	prepared.Tasks = slices.Clone(prepared.planner.tasks)
+	return prepared, nil
+}
+
+// Commit adds the tasks of the plan to the store it was prepared with.
+func (p *Prepared) Commit() {
+	p.planner.commit()
+}
+
+// CriticalPath is the longest chain of dependent tasks leading to the
+// results, weighted by the operation times: with enough agents the
+// expression takes about ms milliseconds. The branches of conditionals
+// whose condition is computed are planned later and not counted.
+func (e Explanation) CriticalPath() (ids []string, ms float64) {
+	byID := make(map[string]internal.Task, len(e.Tasks))
+	for _, task := range e.Tasks {
+		byID[task.Id] = task
+	}
+	finish := make(map[string]float64)
+	previous := make(map[string]string)
+	var visit func(id string) float64
+	visit = func(id string) float64 {
+		task, exists := byID[id]
+		if !exists {
+			return 0
+		}
+		if f, done := finish[id]; done {
+			return f
+		}
+		var start float64
+		for _, arg := range []string{task.Arg1, task.Arg2} {
+			if _, isTask := byID[arg]; !isTask {
+				continue
+			}
+			if f := visit(arg); previous[id] == "" || f > start {
+				start = f
+				previous[id] = arg
+			}
+		}
+		cost, _ := strconv.ParseFloat(task.Operation_time, 64)
+		finish[id] = start + cost
+		return finish[id]
+	}
+
+	last := ""
+	for _, id := range e.Results {
+		if _, exists := byID[id]; !exists {
+			continue
+		}
+		if f := visit(id); last == "" || f > ms {
+			last, ms = id, f
+		}
+	}
+	for id := last; id != ""; id = previous[id] {
+		ids = append([]string{id}, ids...)
+	}
+	return ids, ms
+}
+
+// Work is the sum of the operation times of all tasks: the time the
+// expression takes with a single agent worker.
+func (e Explanation) Work() (ms float64) {
+	for _, task := range e.Tasks {
+		cost, _ := strconv.ParseFloat(task.Operation_time, 64)
+		ms += cost
+	}
+	return ms
+}
@@ -0,0 +1,208 @@
+package rpn
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/katierevinska/calculatorService/pkg/operations"
+)
+
+// Limits that keep user functions from turning one request into an
+// unbounded amount of work.
+const (
+	MaxDefinitionLength = 1000
+	MaxExpansionDepth   = 16
+	MaxExpandedNodes    = 1000
+)
+
+// Definition is a user-defined function such as f(x, y) = x^2 + 3*y.
+type Definition struct {
+	Name   string
+	Params []string
+	Body   *Node
+}
+
+// FunctionLookup resolves a user function by name.
+type FunctionLookup func(name string) (*Definition, bool)
+
+// ParseDefinition parses "name(params) = body" with the same parser as
+// expressions. The body may only use the declared parameters.
+func ParseDefinition(text string) (*Definition, error) {
+	if len(text) > MaxDefinitionLength {
+		return nil, errors.New("invalid definition: too long")
+	}
+	head, body, found := strings.Cut(text, "=")
+	if !found {
+		return nil, errors.New("invalid definition: expected name(params) = expression")
+	}
+
+	call, err := Parse(head)
+	if err != nil {
+		return nil, errors.New("invalid definition: " + err.Error())
+	}
+	builtIn := call.Kind == AggregateNode
+	if call.Kind == OperationNode {
+		op, exists := operations.Default.Lookup(call.Value)
+		builtIn = exists && op.Function
+	}
+	if builtIn {
+		return nil, errors.New("invalid definition: " + call.Value + " is a built-in function")
+	}
+	if call.Kind != CallNode {
+		return nil, errors.New("invalid definition: expected name(params) = expression")
+	}
+
+	def := &Definition{Name: call.Value}
+	seen := make(map[string]bool)
+	for _, arg := range call.Args {
+		if arg.Kind != VariableNode {
+			return nil, errors.New("invalid definition: parameters must be names")
+		}
+		if seen[arg.Value] {
+			return nil, errors.New("invalid definition: duplicate parameter " + arg.Value)
+		}
+		seen[arg.Value] = true
+		def.Params = append(def.Params, arg.Value)
+	}
+
+	def.Body, err = Parse(body)
+	if err != nil {
+		return nil, errors.New("invalid definition: " + err.Error())
+	}
+	if err := checkVariables(def.Body, seen); err != nil {
+		return nil, err
+	}
+	return def, nil
+}
+
+// Calls reports whether the body of the function calls the named function
+// itself, not through other functions.
+func (d *Definition) Calls(name string) bool {
+	return calls(d.Body, name)
+}
+
+func calls(n *Node, name string) bool {
+	if n.Kind == CallNode && n.Value == name {
+		return true
+	}
+	for _, arg := range n.Args {
+		if calls(arg, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkVariables(n *Node, params map[string]bool) error {
+	if n.Kind == VariableNode && !params[n.Value] {
+		return errors.New("invalid definition: unknown variable " + n.Value)
+	}
+	for _, arg := range n.Args {
+		if err := checkVariables(arg, params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Expand replaces calls to user functions with their bodies, so that the
+// result only contains registered operations. Recursion is cut off by
+// MaxExpansionDepth and the size of the result by MaxExpandedNodes.
+func Expand(root *Node, lookup FunctionLookup) (*Node, error) {
+	e := &expander{lookup: lookup}
+	return e.expand(root, nil, 0)
+}
+
+type binding struct {
+	node *Node
+	size int
+}
+
+type expander struct {
+	lookup FunctionLookup
+	nodes  int
+}
+
+func (e *expander) count(n int) error {
+	e.nodes += n
+	if e.nodes > MaxExpandedNodes {
+		return errors.New("invalid expression: expression is too large after expanding functions")
+	}
+	return nil
+}
+
+func (e *expander) expand(n *Node, env map[string]binding, depth int) (*Node, error) {
+	switch n.Kind {
+	case NumberNode:
+		return n, e.count(1)
+	case VariableNode:
+		if bound, exists := env[n.Value]; exists {
+			return bound.node, e.count(bound.size)
+		}
+		return n, e.count(1)
+	}
+
+	args := make([]*Node, len(n.Args))
+	sizes := make([]int, len(n.Args))
+	for i, arg := range n.Args {
+		before := e.nodes
+		expanded, err := e.expand(arg, env, depth)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = expanded
+		sizes[i] = e.nodes - before
+	}
+	if n.Kind != CallNode {
+		return &Node{Kind: n.Kind, Value: n.Value, Args: args}, e.count(1)
+	}
+
+	if e.lookup == nil {
+		return nil, errors.New("invalid expression: unknown function " + n.Value)
+	}
+	def, exists := e.lookup(n.Value)
+	if !exists {
+		return nil, errors.New("invalid expression: unknown function " + n.Value)
+	}
+	if len(args) != len(def.Params) {
+		return nil, errors.New("invalid expression: " + n.Value + " expects " + pluralArgs(len(def.Params)))
+	}
+	if depth >= MaxExpansionDepth {
+		return nil, errors.New("invalid expression: functions are nested too deeply (recursive definition?)")
+	}
+
+	// the arguments are counted again wherever the body uses them
+	for _, size := range sizes {
+		e.nodes -= size
+	}
+	bindings := make(map[string]binding, len(args))
+	for i, param := range def.Params {
+		bindings[param] = binding{node: args[i], size: sizes[i]}
+	}
+	return e.expand(def.Body, bindings, depth+1)
+}
+
+// CalcWithFunctions is Calc for expressions that may call user functions
+// and use inputs, computed in the given mode.
+func CalcWithFunctions(expression string, taskStore *store.TaskStore, lookup FunctionLookup, inputs Inputs, mode Mode) (string, PlanStats, error) {
+	root, err := expandExpression(expression, lookup, inputs)
+	if err != nil {
+		return "", PlanStats{}, err
+	}
+	return PlanInMode(root, taskStore, mode)
+}
+
+// expandExpression parses the expression with user functions expanded and
+// inputs bound.
+func expandExpression(expression string, lookup FunctionLookup, inputs Inputs) (*Node, error) {
+	root, err := Parse(expression)
+	if err != nil {
+		return nil, err
+	}
+	root, err = Expand(root, lookup)
+	if err != nil {
+		return nil, err
+	}
+	return bindVariables(root, inputs), nil
+}
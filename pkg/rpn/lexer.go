@@ -0,0 +1,204 @@
+package rpn
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/katierevinska/calculatorService/pkg/operations"
+)
+
+type tokenKind int
+
+const (
+	tokenNumber tokenKind = iota
+	tokenIdent
+	tokenOperator
+	tokenLParen
+	tokenRParen
+	tokenComma
+	tokenLBracket
+	tokenRBracket
+	// tokenConvert is "to" with the unit after it, e.g. "to mi".
+	tokenConvert
+)
+
+const convertKeyword = "to"
+
+type token struct {
+	kind tokenKind
+	text string
+	// unit written after a number, e.g. "km" in "5 km"
+	unit string
+}
+
+// imaginarySuffix marks imaginary literals such as 2i, see
+// internal.Task.Complex.
+const imaginarySuffix = 'i'
+
+func isDigit(r rune) bool {
+	return r >= '0' && r <= '9' || r == '.'
+}
+
+func isIdentStart(r rune) bool {
+	return unicode.IsLetter(r) || r == '_'
+}
+
+func isIdentPart(r rune) bool {
+	return isIdentStart(r) || unicode.IsDigit(r)
+}
+
+// operatorSymbols returns the registered operator symbols, longest first, so
+// that a multi-character operator wins over its prefix.
+func operatorSymbols(registry *operations.Registry) []string {
+	var symbols []string
+	for _, symbol := range registry.Symbols() {
+		if op, _ := registry.Lookup(symbol); !op.Function {
+			symbols = append(symbols, symbol)
+		}
+	}
+	sort.SliceStable(symbols, func(i, j int) bool { return len(symbols[i]) > len(symbols[j]) })
+	return symbols
+}
+
+func tokenize(expression string, registry *operations.Registry) ([]token, error) {
+	symbols := operatorSymbols(registry)
+	runes := []rune(expression)
+	var tokens []token
+
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case isDigit(r):
+			start := i
+			for i < len(runes) && isDigit(runes[i]) {
+				i++
+			}
+			text := string(runes[start:i])
+			// numbers too large for float64 are checked by the planner, they
+			// are fine in integer mode
+			if _, err := strconv.ParseFloat(text, 64); err != nil && !errors.Is(err, strconv.ErrRange) {
+				return nil, errors.New("invalid expression: bad number " + text)
+			}
+			// 2i is imaginary, 2in two inches
+			if i < len(runes) && runes[i] == imaginarySuffix && (i+1 == len(runes) || !isIdentPart(runes[i+1])) {
+				text += string(imaginarySuffix)
+				i++
+			}
+			unit, end := scanUnit(runes, i)
+			i = end
+			tokens = append(tokens, token{kind: tokenNumber, text: text, unit: unit})
+		case isIdentStart(r):
+			start := i
+			for i < len(runes) && isIdentPart(runes[i]) {
+				i++
+			}
+			text := string(runes[start:i])
+			if text == convertKeyword {
+				unit, end := scanUnit(runes, i)
+				if unit == "" {
+					return nil, errors.New("invalid expression: expected a unit after " + convertKeyword)
+				}
+				i = end
+				tokens = append(tokens, token{kind: tokenConvert, text: unit})
+				continue
+			}
+			tokens = append(tokens, token{kind: tokenIdent, text: text})
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenLParen, text: "("})
+			i++
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenRParen, text: ")"})
+			i++
+		case r == ',':
+			tokens = append(tokens, token{kind: tokenComma, text: ","})
+			i++
+		case r == '[':
+			tokens = append(tokens, token{kind: tokenLBracket, text: "["})
+			i++
+		case r == ']':
+			tokens = append(tokens, token{kind: tokenRBracket, text: "]"})
+			i++
+		default:
+			matched := ""
+			for _, symbol := range symbols {
+				if hasPrefixAt(runes, i, symbol) {
+					matched = symbol
+					break
+				}
+			}
+			if matched == "" {
+				return nil, errors.New("invalid expression: unknown simbol")
+			}
+			tokens = append(tokens, token{kind: tokenOperator, text: matched})
+			i += len([]rune(matched))
+		}
+	}
+	return tokens, nil
+}
+
+// scanUnit reads the unit starting at i, e.g. "m/s^2" in "9.8 m/s^2".
+// Every part has to be a known unit, so in "2 m * x" the unit ends before
+// the "*". It returns the unit and where it ends, or "" and i.
+func scanUnit(runes []rune, i int) (string, int) {
+	var unit strings.Builder
+	separator := ""
+	end := i
+	for {
+		start := skipSpaces(runes, i)
+		j := start
+		for j < len(runes) && (isIdentStart(runes[j]) || j > start && isIdentPart(runes[j])) {
+			j++
+		}
+		if _, exists := lookupUnit(string(runes[start:j])); j == start || !exists {
+			break
+		}
+		if j < len(runes) && runes[j] == '^' {
+			k := j + 1
+			if k < len(runes) && runes[k] == '-' {
+				k++
+			}
+			digits := k
+			for k < len(runes) && unicode.IsDigit(runes[k]) {
+				k++
+			}
+			if k > digits {
+				j = k
+			}
+		}
+		unit.WriteString(separator + string(runes[start:j]))
+		end = j
+
+		next := skipSpaces(runes, j)
+		if next >= len(runes) || runes[next] != '*' && runes[next] != '/' {
+			break
+		}
+		separator = string(runes[next])
+		i = next + 1
+	}
+	return unit.String(), end
+}
+
+func skipSpaces(runes []rune, i int) int {
+	for i < len(runes) && unicode.IsSpace(runes[i]) {
+		i++
+	}
+	return i
+}
+
+func hasPrefixAt(runes []rune, i int, symbol string) bool {
+	s := []rune(symbol)
+	if i+len(s) > len(runes) {
+		return false
+	}
+	for j, r := range s {
+		if runes[i+j] != r {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,362 @@
+package rpn
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Limits on matrices. Multiplying n×n matrices takes n^3 products and the
+// determinant is expanded by minors, so both are kept small.
+const (
+	MaxMatrixDimension = 20
+	MaxDeterminantSize = 8
+)
+
+// matrixFunctions are lowered together with the matrices they take, see
+// matrixLowering. The values are the numbers of arguments.
+var matrixFunctions = map[string]int{"transpose": 1, "det": 1, "dot": 2}
+
+type shape int
+
+const (
+	scalarShape shape = iota
+	vectorShape
+	matrixShape
+)
+
+// tensor is the value of a sub-expression while matrices are lowered: one
+// element for numbers, n for vectors and rows*cols, row by row, for
+// matrices. Vectors are columns, except on the left of a product.
+type tensor struct {
+	shape      shape
+	rows, cols int
+	elements   []*Node
+}
+
+func scalar(n *Node) tensor {
+	return tensor{shape: scalarShape, rows: 1, cols: 1, elements: []*Node{n}}
+}
+
+func vector(elements []*Node) tensor {
+	return tensor{shape: vectorShape, rows: len(elements), cols: 1, elements: elements}
+}
+
+func (t tensor) at(i, j int) *Node {
+	return t.elements[i*t.cols+j]
+}
+
+// dimensions are reported with results: none for numbers, [n] for vectors
+// and [rows, cols] for matrices.
+func (t tensor) dimensions() []int {
+	switch t.shape {
+	case scalarShape:
+		return nil
+	case vectorShape:
+		return []int{t.rows}
+	}
+	return []int{t.rows, t.cols}
+}
+
+func (t tensor) describe() string {
+	switch t.shape {
+	case scalarShape:
+		return "a number"
+	case vectorShape:
+		return "a vector of " + strconv.Itoa(t.rows)
+	}
+	return "a " + strconv.Itoa(t.rows) + "x" + strconv.Itoa(t.cols) + " matrix"
+}
+
+func sameShape(a, b tensor) bool {
+	return a.shape == b.shape && a.rows == b.rows && a.cols == b.cols
+}
+
+// matrixLowering rewrites matrix arithmetic into element-wise trees of
+// ordinary operations and checks the shapes on the way. Every element of a
+// product is a balanced sum of products, so agents compute the elements,
+// and the products within them, in parallel. Nodes shared by pointer are
+// lowered once, so they stay shared.
+type matrixLowering map[*Node]tensor
+
+func (l matrixLowering) lower(n *Node) (tensor, error) {
+	if t, exists := l[n]; exists {
+		return t, nil
+	}
+	t, err := l.lowerNode(n)
+	if err != nil {
+		return tensor{}, err
+	}
+	l[n] = t
+	return t, nil
+}
+
+func (l matrixLowering) lowerNode(n *Node) (tensor, error) {
+	switch n.Kind {
+	case NumberNode, VariableNode, CallNode:
+		return scalar(n), nil
+	case ListNode:
+		return l.lowerList(n)
+	case AggregateNode:
+		args, err := l.lowerOperands(n.Args)
+		if err != nil {
+			return tensor{}, err
+		}
+		return scalar(rebuild(n, args)), nil
+	case MatrixNode:
+		return l.lowerFunction(n)
+	}
+
+	args := make([]tensor, len(n.Args))
+	scalars := make([]*Node, len(n.Args))
+	allScalars := true
+	for i, arg := range n.Args {
+		t, err := l.lower(arg)
+		if err != nil {
+			return tensor{}, err
+		}
+		args[i] = t
+		scalars[i] = t.elements[0]
+		allScalars = allScalars && t.shape == scalarShape
+	}
+	if allScalars {
+		return scalar(rebuild(n, scalars)), nil
+	}
+
+	switch {
+	case n.Kind == ConditionalNode && args[0].shape != scalarShape:
+		return tensor{}, errors.New("invalid expression: the condition of if must be a number")
+	case n.Kind == ConditionalNode && !sameShape(args[1], args[2]):
+		return tensor{}, errors.New("invalid expression: the branches of if must have the same shape, got " + args[1].describe() + " and " + args[2].describe())
+	case n.Kind == ConditionalNode, n.Kind == ConvertNode:
+		return elementwise(n, args)
+	case n.Kind != OperationNode:
+	case n.Value == "*":
+		return multiply(args[0], args[1])
+	case n.Value == "+", n.Value == "-":
+		return elementwise(n, args)
+	case n.Value == "/" && args[1].shape == scalarShape:
+		return elementwise(n, args)
+	}
+	return tensor{}, errors.New("invalid expression: " + n.Value + " is not defined for matrices")
+}
+
+// lowerList turns [a, b] into a vector and a list of vectors of the same
+// length into a matrix, one vector per row.
+func (l matrixLowering) lowerList(n *Node) (tensor, error) {
+	if len(n.Args) == 0 {
+		return tensor{}, errors.New("invalid expression: empty list")
+	}
+	rows := make([]tensor, len(n.Args))
+	for i, arg := range n.Args {
+		t, err := l.lower(arg)
+		if err != nil {
+			return tensor{}, err
+		}
+		rows[i] = t
+	}
+
+	if rows[0].shape == scalarShape {
+		if len(rows) > MaxListLength {
+			return tensor{}, errors.New("invalid expression: lists are limited to " + strconv.Itoa(MaxListLength) + " numbers")
+		}
+		elements := make([]*Node, len(rows))
+		for i, row := range rows {
+			if row.shape != scalarShape {
+				return tensor{}, errors.New("invalid expression: a list mixes numbers and lists")
+			}
+			elements[i] = row.elements[0]
+		}
+		return vector(elements), nil
+	}
+
+	m := tensor{shape: matrixShape, rows: len(rows), cols: rows[0].rows}
+	for _, row := range rows {
+		if row.shape != vectorShape || row.rows != m.cols {
+			return tensor{}, errors.New("invalid expression: matrix rows must be lists of numbers of the same length")
+		}
+		m.elements = append(m.elements, row.elements...)
+	}
+	if m.rows > MaxMatrixDimension || m.cols > MaxMatrixDimension {
+		return tensor{}, errors.New("invalid expression: matrices are limited to " + strconv.Itoa(MaxMatrixDimension) + " rows and columns")
+	}
+	return m, nil
+}
+
+// lowerOperands keeps the lists passed to aggregates, which flatten them,
+// and turns vectors and matrices computed in the arguments into lists of
+// their elements.
+func (l matrixLowering) lowerOperands(args []*Node) ([]*Node, error) {
+	operands := make([]*Node, len(args))
+	for i, arg := range args {
+		if arg.Kind == ListNode {
+			elements, err := l.lowerOperands(arg.Args)
+			if err != nil {
+				return nil, err
+			}
+			operands[i] = rebuild(arg, elements)
+			continue
+		}
+		t, err := l.lower(arg)
+		if err != nil {
+			return nil, err
+		}
+		if t.shape == scalarShape {
+			operands[i] = t.elements[0]
+		} else {
+			operands[i] = &Node{Kind: ListNode, Args: t.elements}
+		}
+	}
+	return operands, nil
+}
+
+func (l matrixLowering) lowerFunction(n *Node) (tensor, error) {
+	if arity := matrixFunctions[n.Value]; len(n.Args) != arity {
+		return tensor{}, errors.New("invalid expression: " + n.Value + " expects " + pluralArgs(arity))
+	}
+	args := make([]tensor, len(n.Args))
+	for i, arg := range n.Args {
+		t, err := l.lower(arg)
+		if err != nil {
+			return tensor{}, err
+		}
+		args[i] = t
+	}
+	m := args[0]
+
+	switch n.Value {
+	case "transpose":
+		if m.shape == scalarShape {
+			return m, nil
+		}
+		transposed := tensor{shape: matrixShape, rows: m.cols, cols: m.rows, elements: make([]*Node, len(m.elements))}
+		for i := 0; i < m.rows; i++ {
+			for j := 0; j < m.cols; j++ {
+				transposed.elements[j*m.rows+i] = m.at(i, j)
+			}
+		}
+		return transposed, nil
+	case "det":
+		if m.shape != matrixShape || m.rows != m.cols {
+			return tensor{}, errors.New("invalid expression: det needs a square matrix, got " + m.describe())
+		}
+		if m.rows > MaxDeterminantSize {
+			return tensor{}, errors.New("invalid expression: det is limited to " + strconv.Itoa(MaxDeterminantSize) + "x" + strconv.Itoa(MaxDeterminantSize) + " matrices")
+		}
+		return scalar(determinant(m)), nil
+	}
+	// dot
+	if m.shape != vectorShape || !sameShape(m, args[1]) {
+		return tensor{}, errors.New("invalid expression: dot needs two vectors of the same length, got " + m.describe() + " and " + args[1].describe())
+	}
+	return multiply(m, args[1])
+}
+
+// rebuild returns the node with new arguments, or the node itself when
+// they did not change.
+func rebuild(n *Node, args []*Node) *Node {
+	for i, arg := range args {
+		if arg != n.Args[i] {
+			return &Node{Kind: n.Kind, Value: n.Value, Unit: n.Unit, Args: args}
+		}
+	}
+	return n
+}
+
+// elementwise applies the node to every element. Numbers among the
+// arguments are used for every element, so M*2 and M+1 work.
+func elementwise(n *Node, args []tensor) (tensor, error) {
+	var result tensor
+	for _, arg := range args {
+		switch {
+		case arg.shape == scalarShape:
+		case result.elements == nil:
+			result = arg
+		case !sameShape(result, arg):
+			return tensor{}, errors.New("invalid expression: cannot combine " + result.describe() + " and " + arg.describe() + " with " + n.Value)
+		}
+	}
+	elements := make([]*Node, len(result.elements))
+	for k := range elements {
+		elementArgs := make([]*Node, len(args))
+		for i, arg := range args {
+			if arg.shape == scalarShape {
+				elementArgs[i] = arg.elements[0]
+			} else {
+				elementArgs[i] = arg.elements[k]
+			}
+		}
+		elements[k] = &Node{Kind: n.Kind, Value: n.Value, Unit: n.Unit, Args: elementArgs}
+	}
+	result.elements = elements
+	return result, nil
+}
+
+// multiply is the matrix product, a vector on the left being a row, so
+// the product of two vectors is their dot product.
+func multiply(a, b tensor) (tensor, error) {
+	if a.shape == scalarShape || b.shape == scalarShape {
+		return elementwise(operation("*"), []tensor{a, b})
+	}
+	left := a
+	if a.shape == vectorShape {
+		left.rows, left.cols = 1, a.rows
+	}
+	if left.cols != b.rows {
+		return tensor{}, errors.New("invalid expression: cannot multiply " + a.describe() + " by " + b.describe())
+	}
+
+	elements := make([]*Node, 0, left.rows*b.cols)
+	for i := 0; i < left.rows; i++ {
+		for j := 0; j < b.cols; j++ {
+			products := make([]*Node, left.cols)
+			for k := range products {
+				products[k] = operation("*", left.at(i, k), b.at(k, j))
+			}
+			elements = append(elements, reduceBalanced("+", products))
+		}
+	}
+	switch {
+	case a.shape == vectorShape && b.shape == vectorShape:
+		return scalar(elements[0]), nil
+	case a.shape == vectorShape:
+		return vector(elements), nil
+	case b.shape == vectorShape:
+		return vector(elements), nil
+	}
+	return tensor{shape: matrixShape, rows: left.rows, cols: b.cols, elements: elements}, nil
+}
+
+// determinant expands the determinant by minors along the rows. Each minor
+// is built once and shared by the terms using it, so an n×n determinant
+// takes about n*2^n operations instead of n!.
+func determinant(m tensor) *Node {
+	minors := make(map[int]*Node)
+	var minor func(row, columns int) *Node
+	minor = func(row, columns int) *Node {
+		if existing, exists := minors[columns]; exists {
+			return existing
+		}
+		var plus, minus []*Node
+		for j := 0; j < m.cols; j++ {
+			if columns&(1<<j) == 0 {
+				continue
+			}
+			if row == m.rows-1 {
+				return m.at(row, j)
+			}
+			term := operation("*", m.at(row, j), minor(row+1, columns&^(1<<j)))
+			if len(plus) == len(minus) {
+				plus = append(plus, term)
+			} else {
+				minus = append(minus, term)
+			}
+		}
+		result := reduceBalanced("+", plus)
+		if len(minus) > 0 {
+			result = operation("-", result, reduceBalanced("+", minus))
+		}
+		minors[columns] = result
+		return result
+	}
+	return minor(0, 1<<m.cols-1)
+}
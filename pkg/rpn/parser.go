@@ -0,0 +1,422 @@
+package rpn
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/katierevinska/calculatorService/pkg/operations"
+)
+
+type NodeKind int
+
+const (
+	NumberNode NodeKind = iota
+	VariableNode
+	OperationNode
+	// CallNode is a call to a user-defined function, see Expand.
+	CallNode
+	// ConditionalNode is if(condition, then, else). Only the branch chosen
+	// by the condition is ever computed.
+	ConditionalNode
+	// ListNode is a list literal [a, b, c]: a vector, or a matrix when its
+	// elements are lists. Aggregates flatten the lists passed to them.
+	ListNode
+	// AggregateNode is a call to a variadic aggregate such as sum or avg,
+	// see lowerAggregate.
+	AggregateNode
+	// ConvertNode is "x to unit"; Value holds the unit.
+	ConvertNode
+	// MatrixNode is a call to a matrix function such as det, see
+	// matrixLowering.
+	MatrixNode
+)
+
+const conditionalName = "if"
+
+// n! is written for factorial(n), see ParseWith.
+const (
+	factorialSymbol = "!"
+	factorialName   = "factorial"
+)
+
+// reservedNames cannot be used for user functions and script variables.
+var reservedNames = map[string]bool{conditionalName: true, "true": true, "false": true, convertKeyword: true}
+
+func isReserved(name string) bool {
+	_, isAggregate := aggregates[name]
+	_, isMatrixFunction := matrixFunctions[name]
+	return reservedNames[name] || isAggregate || isMatrixFunction
+}
+
+// Node is an expression tree node. Numbers and variables carry their text
+// in Value, operations carry the operation symbol and calls the function
+// name, both with their arguments. Numbers may have a Unit, see
+// unitResolver.
+type Node struct {
+	Kind  NodeKind
+	Value string
+	Unit  string
+	Args  []*Node
+}
+
+func (n *Node) String() string {
+	switch n.Kind {
+	case NumberNode, VariableNode:
+		if n.Unit != "" {
+			return n.Value + " " + n.Unit
+		}
+		return n.Value
+	}
+	args := make([]string, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = arg.String()
+	}
+	switch n.Kind {
+	case ListNode:
+		return "[" + strings.Join(args, ", ") + "]"
+	case ConvertNode:
+		return "(" + args[0] + " " + convertKeyword + " " + n.Value + ")"
+	}
+	if op, exists := operations.Default.Lookup(n.Value); exists && !op.Function && n.Kind == OperationNode {
+		if op.Prefix {
+			return n.Value + args[0]
+		}
+		return "(" + strings.Join(args, " "+n.Value+" ") + ")"
+	}
+	return n.Value + "(" + strings.Join(args, ", ") + ")"
+}
+
+// stackEntry is an item of the shunting-yard operator stack: an operator,
+// a prefix minus, an opening parenthesis or bracket or a function call
+// waiting for its closing parenthesis. Calls to user functions and
+// aggregates have no op, only a name.
+type stackEntry struct {
+	kind       stackKind
+	op         *operations.Operation
+	name       string
+	argCount   int
+	precedence int
+}
+
+type stackKind int
+
+const (
+	entryOperator stackKind = iota
+	entryNegate
+	entryPrefix
+	entryParen
+	entryFunction
+	entryList
+)
+
+func isOpening(kind stackKind) bool {
+	return kind == entryParen || kind == entryList
+}
+
+// prefix operators bind tighter than * and / but looser than ^, so -2^2
+// is -4.
+const prefixPrecedence = 65
+
+func operatorPrecedence(op *operations.Operation) int {
+	return op.Precedence * 10
+}
+
+// Parse builds the expression tree with the shunting-yard algorithm using
+// the default operation registry.
+func Parse(expression string) (*Node, error) {
+	return ParseWith(expression, operations.Default)
+}
+
+func ParseWith(expression string, registry *operations.Registry) (*Node, error) {
+	tokens, err := tokenize(expression, registry)
+	if err != nil {
+		return nil, err
+	}
+
+	var output []*Node
+	var stack []stackEntry
+	expectOperand := true
+
+	reduce := func(entry stackEntry) error {
+		switch entry.kind {
+		case entryNegate:
+			if len(output) < 1 {
+				return errors.New("invalid expression")
+			}
+			output[len(output)-1] = negate(output[len(output)-1])
+		case entryPrefix:
+			if len(output) < 1 {
+				return errors.New("invalid expression")
+			}
+			output[len(output)-1] = &Node{Kind: OperationNode, Value: entry.op.Symbol, Args: []*Node{output[len(output)-1]}}
+		case entryOperator:
+			if len(output) < 2 {
+				return errors.New("invalid expression")
+			}
+			b, a := output[len(output)-1], output[len(output)-2]
+			output = append(output[:len(output)-2], &Node{Kind: OperationNode, Value: entry.op.Symbol, Args: []*Node{a, b}})
+		case entryFunction:
+			if entry.op == nil {
+				kind := CallNode
+				if entry.name == conditionalName {
+					if entry.argCount != 3 {
+						return errors.New("invalid expression: if expects 3 arguments")
+					}
+					kind = ConditionalNode
+				}
+				if _, isAggregate := aggregates[entry.name]; isAggregate {
+					kind = AggregateNode
+				}
+				if _, isMatrixFunction := matrixFunctions[entry.name]; isMatrixFunction {
+					kind = MatrixNode
+				}
+				if len(output) < entry.argCount {
+					return errors.New("invalid expression")
+				}
+				args := append([]*Node(nil), output[len(output)-entry.argCount:]...)
+				output = append(output[:len(output)-entry.argCount], &Node{Kind: kind, Value: entry.name, Args: args})
+				return nil
+			}
+			if entry.argCount != entry.op.Arity {
+				return errors.New("invalid expression: " + entry.op.Symbol + " expects " + pluralArgs(entry.op.Arity))
+			}
+			if len(output) < entry.argCount {
+				return errors.New("invalid expression")
+			}
+			args := append([]*Node(nil), output[len(output)-entry.argCount:]...)
+			output = append(output[:len(output)-entry.argCount], &Node{Kind: OperationNode, Value: entry.op.Symbol, Args: args})
+		}
+		return nil
+	}
+
+	for i, tok := range tokens {
+		switch tok.kind {
+		case tokenNumber:
+			if !expectOperand {
+				return nil, errors.New("invalid expression")
+			}
+			output = append(output, &Node{Kind: NumberNode, Value: tok.text, Unit: tok.unit})
+			expectOperand = false
+
+		case tokenConvert:
+			// binds looser than every operator: 1 km + 500 m to mi converts
+			// the sum
+			if expectOperand {
+				return nil, errors.New("invalid expression")
+			}
+			for len(stack) > 0 && !isOpening(stack[len(stack)-1].kind) {
+				if err := reduce(stack[len(stack)-1]); err != nil {
+					return nil, err
+				}
+				stack = stack[:len(stack)-1]
+			}
+			if len(output) < 1 {
+				return nil, errors.New("invalid expression")
+			}
+			output[len(output)-1] = &Node{Kind: ConvertNode, Value: tok.text, Args: []*Node{output[len(output)-1]}}
+
+		case tokenIdent:
+			if !expectOperand {
+				return nil, errors.New("invalid expression")
+			}
+			_, isAggregate := aggregates[tok.text]
+			if _, isMatrixFunction := matrixFunctions[tok.text]; isAggregate || isMatrixFunction {
+				if i+1 >= len(tokens) || tokens[i+1].kind != tokenLParen {
+					return nil, errors.New("invalid expression: " + tok.text + " must be called with parentheses")
+				}
+				stack = append(stack, stackEntry{kind: entryFunction, name: tok.text})
+				continue
+			}
+			if op, exists := registry.Lookup(tok.text); exists && op.Function {
+				if i+1 >= len(tokens) || tokens[i+1].kind != tokenLParen {
+					return nil, errors.New("invalid expression: " + tok.text + " must be called with parentheses")
+				}
+				stack = append(stack, stackEntry{kind: entryFunction, op: op})
+				continue
+			}
+			if i+1 < len(tokens) && tokens[i+1].kind == tokenLParen {
+				stack = append(stack, stackEntry{kind: entryFunction, name: tok.text})
+				continue
+			}
+			switch tok.text {
+			case conditionalName:
+				return nil, errors.New("invalid expression: if must be called with parentheses")
+			case "true":
+				output = append(output, &Node{Kind: NumberNode, Value: "1"})
+			case "false":
+				output = append(output, &Node{Kind: NumberNode, Value: "0"})
+			default:
+				output = append(output, &Node{Kind: VariableNode, Value: tok.text})
+			}
+			expectOperand = false
+
+		case tokenLParen:
+			if !expectOperand {
+				return nil, errors.New("invalid expression")
+			}
+			stack = append(stack, stackEntry{kind: entryParen})
+			if n := len(stack); n > 1 && stack[n-2].kind == entryFunction {
+				if i+1 < len(tokens) && tokens[i+1].kind == tokenRParen {
+					continue
+				}
+				stack[n-2].argCount = 1
+			}
+
+		case tokenLBracket:
+			if !expectOperand {
+				return nil, errors.New("invalid expression")
+			}
+			entry := stackEntry{kind: entryList, argCount: 1}
+			if i+1 < len(tokens) && tokens[i+1].kind == tokenRBracket {
+				entry.argCount = 0
+			}
+			stack = append(stack, entry)
+
+		case tokenComma:
+			if expectOperand {
+				return nil, errors.New("invalid expression")
+			}
+			for len(stack) > 0 && !isOpening(stack[len(stack)-1].kind) {
+				if err := reduce(stack[len(stack)-1]); err != nil {
+					return nil, err
+				}
+				stack = stack[:len(stack)-1]
+			}
+			switch n := len(stack); {
+			case n > 0 && stack[n-1].kind == entryList:
+				stack[n-1].argCount++
+			case n > 1 && stack[n-2].kind == entryFunction:
+				stack[n-2].argCount++
+			default:
+				return nil, errors.New("invalid expression: comma outside of function call or list")
+			}
+			expectOperand = true
+
+		case tokenRBracket:
+			emptyList := expectOperand && i > 0 && tokens[i-1].kind == tokenLBracket
+			if expectOperand && !emptyList {
+				return nil, errors.New("invalid expression")
+			}
+			for len(stack) > 0 && !isOpening(stack[len(stack)-1].kind) {
+				if err := reduce(stack[len(stack)-1]); err != nil {
+					return nil, err
+				}
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) == 0 || stack[len(stack)-1].kind != entryList {
+				return nil, errors.New("invalid expression: unmatched brackets")
+			}
+			count := stack[len(stack)-1].argCount
+			stack = stack[:len(stack)-1]
+			if len(output) < count {
+				return nil, errors.New("invalid expression")
+			}
+			elements := append([]*Node(nil), output[len(output)-count:]...)
+			output = append(output[:len(output)-count], &Node{Kind: ListNode, Args: elements})
+			expectOperand = false
+
+		case tokenRParen:
+			emptyCall := expectOperand && i > 0 && tokens[i-1].kind == tokenLParen &&
+				len(stack) > 1 && stack[len(stack)-2].kind == entryFunction
+			if expectOperand && !emptyCall {
+				return nil, errors.New("invalid expression")
+			}
+			for len(stack) > 0 && !isOpening(stack[len(stack)-1].kind) {
+				if err := reduce(stack[len(stack)-1]); err != nil {
+					return nil, err
+				}
+				stack = stack[:len(stack)-1]
+			}
+			if len(stack) == 0 || stack[len(stack)-1].kind != entryParen {
+				return nil, errors.New("invalid expression: unmatched parentheses")
+			}
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 && stack[len(stack)-1].kind == entryFunction {
+				if err := reduce(stack[len(stack)-1]); err != nil {
+					return nil, err
+				}
+				stack = stack[:len(stack)-1]
+			}
+			expectOperand = false
+
+		case tokenOperator:
+			op, _ := registry.Lookup(tok.text)
+			if expectOperand {
+				switch {
+				case tok.text == "-":
+					stack = append(stack, stackEntry{kind: entryNegate, precedence: prefixPrecedence})
+				case op.Prefix:
+					stack = append(stack, stackEntry{kind: entryPrefix, op: op, precedence: prefixPrecedence})
+				default:
+					return nil, errors.New("invalid expression")
+				}
+				continue
+			}
+			if op.Prefix {
+				// after an operand ! is the factorial, binding tighter than
+				// everything else: 2^3! is 2^6 and -3! is -6
+				factorial, exists := registry.Lookup(factorialName)
+				if tok.text != factorialSymbol || !exists {
+					return nil, errors.New("invalid expression")
+				}
+				output[len(output)-1] = &Node{Kind: OperationNode, Value: factorial.Symbol, Args: []*Node{output[len(output)-1]}}
+				continue
+			}
+			precedence := operatorPrecedence(op)
+			for len(stack) > 0 {
+				top := stack[len(stack)-1]
+				if top.kind != entryOperator && top.kind != entryNegate && top.kind != entryPrefix {
+					break
+				}
+				if top.precedence < precedence || (top.precedence == precedence && op.Associativity == operations.RightAssociative) {
+					break
+				}
+				if err := reduce(top); err != nil {
+					return nil, err
+				}
+				stack = stack[:len(stack)-1]
+			}
+			stack = append(stack, stackEntry{kind: entryOperator, op: op, precedence: precedence})
+			expectOperand = true
+		}
+	}
+
+	if expectOperand {
+		return nil, errors.New("invalid expression")
+	}
+	for len(stack) > 0 {
+		top := stack[len(stack)-1]
+		if isOpening(top.kind) || top.kind == entryFunction {
+			return nil, errors.New("invalid expression: unmatched parentheses")
+		}
+		if err := reduce(top); err != nil {
+			return nil, err
+		}
+		stack = stack[:len(stack)-1]
+	}
+
+	if len(output) != 1 {
+		return nil, errors.New("invalid expression")
+	}
+	return output[0], nil
+}
+
+// negate folds a minus into number literals and turns it into 0 - x
+// for everything else.
+func negate(n *Node) *Node {
+	if n.Kind == NumberNode {
+		if strings.HasPrefix(n.Value, "-") {
+			return &Node{Kind: NumberNode, Value: n.Value[1:], Unit: n.Unit}
+		}
+		return &Node{Kind: NumberNode, Value: "-" + n.Value, Unit: n.Unit}
+	}
+	return &Node{Kind: OperationNode, Value: "-", Args: []*Node{{Kind: NumberNode, Value: "0"}, n}}
+}
+
+func pluralArgs(n int) string {
+	if n == 1 {
+		return "1 argument"
+	}
+	return strconv.Itoa(n) + " arguments"
+}
@@ -3,136 +3,576 @@ package rpn
 import (
 	"errors"
 	"log"
+	"maps"
+	"math/big"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/latency"
 	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/katierevinska/calculatorService/pkg/operations"
 )
 
+// Calc parses the expression and schedules one task per operation in the
+// task store. It returns the ID of the task producing the final result, or
+// the number itself when the expression needs no computation.
 func Calc(expression string, taskStore *store.TaskStore) (string, error) {
-	var nums []string
-	var ops []rune
-	var currNumStr strings.Builder
-
-	var err error
-	for _, char := range expression {
-		if isDigit(char) {
-			currNumStr.WriteRune(char)
-		} else {
-			if currNumStr.Len() > 0 {
-				nums = append(nums, currNumStr.String())
-				currNumStr.Reset()
-			}
-			if char == '(' {
-				ops = append(ops, char)
-			} else if char == ')' {
-				for len(ops) > 0 && ops[len(ops)-1] != '(' {
-					if len(nums) < 2 {
-						return "", errors.New("invalid expression: unmatched parentheses")
-					}
-					nums, ops, err = applyOperation(nums, ops, taskStore)
-					if err != nil {
-						return "", errors.New("invalid expression")
-					}
-				}
-				if len(ops) == 0 {
-					return "", errors.New("invalid expression: unmatched parentheses")
-				}
-				ops = ops[:len(ops)-1]
-			} else if isOperation(char) {
-				for len(ops) > 0 && precedence(ops[len(ops)-1]) >= precedence(char) {
-					if len(nums) < 2 {
-						return "", errors.New("invalid expression")
-					}
-					nums, ops, err = applyOperation(nums, ops, taskStore)
-					if err != nil {
-						return "", errors.New("invalid expression")
-					}
-				}
-				ops = append(ops, char)
-			} else {
-				return "", errors.New("invalid expression: unknown simbol")
-			}
-		}
+	root, err := Parse(expression)
+	if err != nil {
+		return "", err
+	}
+	return Plan(root, taskStore)
+}
+
+// Plan turns the tree into tasks, children before parents. Identical
+// sub-expressions, e.g. the three (1+2) in (1+2)*(1+2)+(1+2), become a
+// single task. Tasks are only added to the store once the whole tree has
+// been planned successfully.
+func Plan(root *Node, taskStore *store.TaskStore) (string, error) {
+	resultID, _, err := PlanWithStats(root, taskStore)
+	return resultID, err
+}
+
+// PlanStats tells how many operations the expression contains and how many
+// tasks were needed for them after common-subexpression elimination, and
+// the unit of the result, empty for plain numbers.
+type PlanStats struct {
+	Operations int
+	Tasks      int
+	Unit       string
+	// Shape is [n] for vectors and [rows, cols] for matrices, whose
+	// Elements, row by row, are task IDs or numbers. The result ID of a
+	// matrix is not a task: the matrix is done once all elements are.
+	Shape    []int
+	Elements []string
+	Mode     Mode
+}
+
+// DedupRatio is the share of operations that did not need a task of their
+// own.
+func (s PlanStats) DedupRatio() float64 {
+	if s.Operations == 0 {
+		return 0
 	}
+	return float64(s.Operations-s.Tasks) / float64(s.Operations)
+}
+
+func PlanWithStats(root *Node, taskStore *store.TaskStore) (string, PlanStats, error) {
+	return PlanInMode(root, taskStore, RealMode)
+}
 
-	if currNumStr.Len() > 0 {
-		nums = append(nums, currNumStr.String())
+// PlanInMode is PlanWithStats for the given arithmetic.
+func PlanInMode(root *Node, taskStore *store.TaskStore, mode Mode) (string, PlanStats, error) {
+	p, resultID, stats, err := prepareTree(root, taskStore, mode)
+	if err != nil {
+		return "", PlanStats{}, err
 	}
+	p.commit()
+	return resultID, stats, nil
+}
 
-	for len(ops) > 0 {
-		if ops[len(ops)-1] == '(' {
-			return "", errors.New("invalid expression: unmatched parentheses")
+// prepareTree is PlanInMode without adding the tasks to the store, see
+// Prepared.
+func prepareTree(root *Node, taskStore *store.TaskStore, mode Mode) (*planner, string, PlanStats, error) {
+	p := newPlanner(taskStore, mode)
+	value, err := p.matrices.lower(root)
+	if err != nil {
+		return nil, "", PlanStats{}, err
+	}
+	if value.shape == scalarShape {
+		resultID, unit, err := p.planWithUnits(value.elements[0])
+		if err != nil {
+			return nil, "", PlanStats{}, err
 		}
-		if len(nums) < 2 && len(ops) > 0 {
-			return "", errors.New("incorrect")
+		p.number()
+		stats := p.stats()
+		stats.Unit = unit.String()
+		return p, p.rename(resultID), stats, nil
+	}
+
+	elements, unit, err := p.planElements(value)
+	if err != nil {
+		return nil, "", PlanStats{}, err
+	}
+	p.number()
+	for i := range elements {
+		elements[i] = p.rename(elements[i])
+	}
+	stats := p.stats()
+	stats.Unit = unit.String()
+	stats.Shape = value.dimensions()
+	stats.Elements = elements
+	return p, "id" + strconv.Itoa(taskStore.Counter.GetValueAndInc()), stats, nil
+}
+
+type planner struct {
+	taskStore *store.TaskStore
+	tasks     []internal.Task
+	deferred  []deferredBranch
+	// planned remembers nodes reached more than once through shared
+	// pointers, byKey identical sub-expressions written out several times.
+	planned  map[*Node]string
+	byKey    map[string]string
+	units    unitResolver
+	matrices matrixLowering
+	// complex makes agents compute in complex arithmetic, see
+	// ComplexNumbersEnv, integer on integers, see IntegerMode.
+	complex    bool
+	integer    bool
+	operations int
+	taskCount  int
+	// pending counts the placeholder IDs handed out since the last number,
+	// numbered is the first ID that number took from the counter.
+	pending  int
+	numbered int
+	// mu guards the planner while the branches of conditionals are planned
+	// after the initial plan has been committed.
+	mu sync.Mutex
+}
+
+// deferredBranch is a conditional whose condition is computed by a task.
+type deferredBranch struct {
+	id        string
+	condition string
+	node      *Node
+}
+
+func newPlanner(taskStore *store.TaskStore, mode Mode) *planner {
+	integer := mode == IntegerMode
+	return &planner{
+		taskStore: taskStore,
+		planned:   make(map[*Node]string),
+		byKey:     make(map[string]string),
+		units:     make(unitResolver),
+		matrices:  make(matrixLowering),
+		complex:   !integer && internal.BoolEnv(ComplexNumbersEnv, false),
+		integer:   integer,
+	}
+}
+
+// Mode is the arithmetic agents compute an expression in.
+type Mode string
+
+const (
+	// RealMode computes in floating point, or in complex numbers on
+	// deployments with ComplexNumbersEnv.
+	RealMode Mode = ""
+	// IntegerMode computes exactly on integers of any length. "/" must
+	// divide evenly, "//" and "%" give the quotient and the remainder, and
+	// numbers with a fraction must be converted with int().
+	IntegerMode Mode = "integer"
+)
+
+// ParseMode reads the mode of a request, "real" or "integer"; empty is
+// RealMode.
+func ParseMode(text string) (Mode, error) {
+	switch text {
+	case "", "real":
+		return RealMode, nil
+	case string(IntegerMode):
+		return IntegerMode, nil
+	}
+	return "", errors.New("unknown mode " + text + ", expected real or integer")
+}
+
+// conversionName is int(), which integer mode folds into the planned
+// literal, see truncate.
+const conversionName = "int"
+
+var errUnitsInIntegerMode = errors.New("invalid expression: units are not supported in integer mode")
+
+// ComplexNumbersEnv enables complex numbers on the deployment. Without it
+// imaginary literals are rejected and sqrt(-1) fails as before.
+const ComplexNumbersEnv = "COMPLEX_NUMBERS"
+
+var errComplexDisabled = errors.New("invalid expression: complex numbers are not enabled, see " + ComplexNumbersEnv)
+
+func isImaginary(n *Node) bool {
+	return n.Kind == NumberNode && strings.HasSuffix(n.Value, string(imaginarySuffix))
+}
+
+// planWithUnits plans the tree after resolving its units, see
+// unitResolver.
+func (p *planner) planWithUnits(root *Node) (string, Unit, error) {
+	if p.integer {
+		id, err := p.plan(root)
+		return id, dimensionless, err
+	}
+	resolved, unit, err := p.units.resolve(root)
+	if err != nil {
+		return "", Unit{}, err
+	}
+	id, err := p.plan(showIn(resolved, unit))
+	return id, unit, err
+}
+
+// planElements plans every element of a matrix, all shown in the unit of
+// the first one.
+func (p *planner) planElements(m tensor) ([]string, Unit, error) {
+	ids := make([]string, len(m.elements))
+	var shown Unit
+	for i, element := range m.elements {
+		if p.integer {
+			var err error
+			if ids[i], err = p.plan(element); err != nil {
+				return nil, Unit{}, err
+			}
+			continue
 		}
-		nums, ops, err = applyOperation(nums, ops, taskStore)
+		resolved, unit, err := p.units.resolve(element)
 		if err != nil {
-			return "", errors.New("invalid expression")
+			return nil, Unit{}, err
+		}
+		if i == 0 {
+			shown = unit
+		} else if err := sameDimension("combine in a matrix", []Unit{shown, unit}); err != nil {
+			return nil, Unit{}, err
+		}
+		if ids[i], err = p.plan(showIn(resolved, shown)); err != nil {
+			return nil, Unit{}, err
+		}
+	}
+	return ids, shown, nil
+}
+
+func (p *planner) stats() PlanStats {
+	stats := PlanStats{Operations: p.operations, Tasks: p.taskCount}
+	if p.integer {
+		stats.Mode = IntegerMode
+	}
+	return stats
+}
+
+// pendingPrefix starts the placeholder IDs of tasks and conditionals being
+// planned. They only get IDs from the counter once planning succeeded, see
+// number, so failed plans do not use any.
+const pendingPrefix = "#"
+
+var pendingID = regexp.MustCompile(pendingPrefix + `\d+`)
+
+func (p *planner) newID() string {
+	p.pending++
+	return pendingPrefix + strconv.Itoa(p.pending)
+}
+
+// number replaces the placeholder IDs with consecutive IDs from the
+// counter, in the order they were handed out.
+func (p *planner) number() {
+	if p.pending == 0 {
+		return
+	}
+	p.numbered = p.taskStore.Counter.Reserve(p.pending)
+	p.pending = 0
+	for i := range p.tasks {
+		task := &p.tasks[i]
+		task.Id, task.Arg1, task.Arg2 = p.rename(task.Id), p.rename(task.Arg1), p.rename(task.Arg2)
+	}
+	for i := range p.deferred {
+		p.deferred[i].id, p.deferred[i].condition = p.rename(p.deferred[i].id), p.rename(p.deferred[i].condition)
+	}
+	for n, id := range p.planned {
+		p.planned[n] = p.rename(id)
+	}
+	byKey := make(map[string]string, len(p.byKey))
+	for key, id := range p.byKey {
+		byKey[p.rename(key)] = p.rename(id)
+	}
+	p.byKey = byKey
+}
+
+// rename replaces the placeholders in an ID or key planned before the last
+// number.
+func (p *planner) rename(id string) string {
+	return pendingID.ReplaceAllStringFunc(id, func(placeholder string) string {
+		n, _ := strconv.Atoi(placeholder[len(pendingPrefix):])
+		return "id" + strconv.Itoa(p.numbered+n-1)
+	})
+}
+
+func (p *planner) commit() {
+	p.add(p.take())
+}
+
+func (p *planner) take() ([]internal.Task, []deferredBranch) {
+	tasks, deferred := p.tasks, p.deferred
+	p.tasks, p.deferred = nil, nil
+	return tasks, deferred
+}
+
+func (p *planner) add(tasks []internal.Task, deferred []deferredBranch) {
+	for _, task := range tasks {
+		log.Println("want to add task " + task.Id + " " + task.Arg1 + " " + task.Arg2 + " " + task.Operation + " " + task.Operation_time)
+		p.taskStore.AddTask(task)
+	}
+	for _, d := range deferred {
+		p.taskStore.AddDeferred(d.id, d.condition, p.resolver(d.node))
+	}
+}
+
+// planConditional plans the branch right away when the condition is a
+// number. Otherwise the conditional gets an ID of its own, and its branch
+// is planned once the condition task has a result; until then only the
+// errors that do not depend on values are checked.
+func (p *planner) planConditional(n *Node) (string, error) {
+	condition, err := p.plan(n.Args[0])
+	if err != nil {
+		return "", err
+	}
+	if operations.IsNumber(condition) {
+		id, err := p.plan(chooseBranch(n, condition))
+		if err == nil {
+			p.planned[n] = id
 		}
+		return id, err
 	}
 
-	if len(nums) != 1 {
-		return "", errors.New("invalid expression")
+	for _, branch := range n.Args[1:] {
+		if err := p.check(branch); err != nil {
+			return "", err
+		}
 	}
-	return nums[0], nil
+	key := conditionalName + "(" + condition + "," + n.Args[1].String() + "," + n.Args[2].String() + ")"
+	if id, exists := p.byKey[key]; exists {
+		p.planned[n] = id
+		return id, nil
+	}
+	id := p.newID()
+	p.deferred = append(p.deferred, deferredBranch{id: id, condition: condition, node: n})
+	p.planned[n] = id
+	p.byKey[key] = id
+	return id, nil
 }
 
-func isOperation(r rune) bool {
-	return r == '+' || r == '-' || r == '*' || r == '/'
+// chooseBranch takes the then branch for any number but zero. Integers
+// too long for float64 are read as infinity, which is not zero either.
+func chooseBranch(n *Node, condition string) *Node {
+	if v, _ := strconv.ParseComplex(condition, 128); v != 0 {
+		return n.Args[1]
+	}
+	return n.Args[2]
 }
 
-func isDigit(r rune) bool {
-	return r >= '0' && r <= '9' || r == '.'
+// resolver plans the branch chosen by the condition value. A branch that
+// fails to plan, e.g. because it divides by a literal zero, makes the
+// conditional fail without leaving half of its tasks behind.
+func (p *planner) resolver(n *Node) store.Resolver {
+	return func(value string) (string, error) {
+		if !operations.IsNumber(value) {
+			return "", errors.New("condition is not a number")
+		}
+
+		p.mu.Lock()
+		planned, byKey := maps.Clone(p.planned), maps.Clone(p.byKey)
+		id, err := p.plan(chooseBranch(n, value))
+		if err != nil {
+			p.planned, p.byKey = planned, byKey
+			p.pending = 0
+			p.take()
+			p.mu.Unlock()
+			return "", err
+		}
+		p.number()
+		id = p.rename(id)
+		tasks, deferred := p.take()
+		p.mu.Unlock()
+
+		p.add(tasks, deferred)
+		if operations.IsNumber(id) {
+			return p.formatLiteral(id), nil
+		}
+		return id, nil
+	}
 }
 
-func precedence(op rune) int {
-	switch op {
-	case '+', '-':
-		return 1
-	case '*', '/':
-		return 2
+// formatLiteral reports a branch that is a number the way agents report
+// results.
+func (p *planner) formatLiteral(literal string) string {
+	if p.integer {
+		return literal
 	}
-	return 0
+	v, _ := strconv.ParseComplex(literal, 128)
+	return operations.FormatComplex(v)
 }
-func applyOperation(nums []string, ops []rune, taskStore *store.TaskStore) ([]string, []rune, error) {
-	if len(nums) < 2 || len(ops) == 0 {
-		return nums, ops, nil
+
+// checkNumber rejects literals the agents could not compute with.
+func (p *planner) checkNumber(n *Node) error {
+	switch {
+	case p.integer && n.Unit != "":
+		return errUnitsInIntegerMode
+	case p.integer && isImaginary(n):
+		return errors.New("invalid expression: complex numbers are not available in integer mode")
+	case p.integer:
+		if _, ok := new(big.Int).SetString(n.Value, 10); !ok {
+			return errors.New("invalid expression: " + n.Value + " is not an integer, convert it with int(" + n.Value + ")")
+		}
+	case isImaginary(n) && !p.complex:
+		return errComplexDisabled
+	default:
+		if _, err := strconv.ParseComplex(n.Value, 128); err != nil {
+			return errors.New("invalid expression: " + n.Value + " is too large")
+		}
 	}
+	return nil
+}
+
+// isConversion tells int(2.5), which integer mode plans as 2.
+func (p *planner) isConversion(n *Node) bool {
+	return p.integer && n.Kind == OperationNode && n.Value == conversionName &&
+		n.Args[0].Kind == NumberNode && n.Args[0].Unit == ""
+}
 
-	b := nums[len(nums)-1]
-	a := nums[len(nums)-2]
-	operator := ops[len(ops)-1]
+// truncate drops the fraction of a literal.
+func truncate(literal string) (string, error) {
+	v, _, err := big.ParseFloat(literal, 10, uint(len(literal))*4+64, big.ToZero)
+	if err != nil {
+		return "", errors.New("invalid expression: cannot convert " + literal + " to an integer")
+	}
+	if v.MantExp(nil) > operations.MaxIntegerBits {
+		return "", errors.New("invalid expression: " + literal + " is too large")
+	}
+	integer, _ := v.Int(nil)
+	return integer.String(), nil
+}
 
-	nums = nums[:len(nums)-2]
-	ops = ops[:len(ops)-1]
+// check reports the errors planning the tree would run into whatever the
+// values involved.
+func (p *planner) check(n *Node) error {
+	if _, exists := p.planned[n]; exists {
+		return nil
+	}
+	if p.isConversion(n) {
+		_, err := truncate(n.Args[0].Value)
+		return err
+	}
+	switch n.Kind {
+	case NumberNode:
+		return p.checkNumber(n)
+	case ConvertNode:
+		return errUnitsInIntegerMode
+	case VariableNode:
+		return errors.New("invalid expression: unknown variable " + n.Value)
+	case CallNode:
+		return errors.New("invalid expression: unknown function " + n.Value)
+	case OperationNode:
+		if _, exists := operations.Default.Lookup(n.Value); !exists {
+			return errors.New("invalid expression: unknown operation " + n.Value)
+		}
+	case ListNode:
+		return errListOutsideAggregate
+	case AggregateNode:
+		for _, operand := range flatten(n.Args, nil) {
+			if err := p.check(operand); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, arg := range n.Args {
+		if err := p.check(arg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	var opTime string
+func (p *planner) plan(n *Node) (string, error) {
+	if id, exists := p.planned[n]; exists {
+		return id, nil
+	}
+	if p.isConversion(n) {
+		return truncate(n.Args[0].Value)
+	}
+	switch n.Kind {
+	case NumberNode:
+		if err := p.checkNumber(n); err != nil {
+			return "", err
+		}
+		return n.Value, nil
+	case ConvertNode:
+		// only left over in integer mode, see planWithUnits
+		return "", errUnitsInIntegerMode
+	case VariableNode:
+		return "", errors.New("invalid expression: unknown variable " + n.Value)
+	case CallNode:
+		return "", errors.New("invalid expression: unknown function " + n.Value)
+	case ConditionalNode:
+		return p.planConditional(n)
+	case ListNode:
+		return "", errListOutsideAggregate
+	case AggregateNode:
+		lowered, err := lowerAggregate(n)
+		if err != nil {
+			return "", err
+		}
+		id, err := p.plan(lowered)
+		if err == nil {
+			p.planned[n] = id
+		}
+		return id, err
+	}
 
-	switch operator {
-	case '+':
-		opTime = os.Getenv("TIME_ADDITION_MS")
-	case '-':
-		opTime = os.Getenv("TIME_SUBTRACTION_MS")
-	case '*':
-		opTime = os.Getenv("TIME_MULTIPLICATIONS_MS")
-		if opTime == "" {
-			log.Println("something really wrong")
+	op, exists := operations.Default.Lookup(n.Value)
+	if !exists {
+		return "", errors.New("invalid expression: unknown operation " + n.Value)
+	}
+	args := make([]string, len(n.Args))
+	literals := make([]string, len(n.Args))
+	for i, child := range n.Args {
+		arg, err := p.plan(child)
+		if err != nil {
+			return "", err
+		}
+		args[i] = arg
+		if child.Kind == NumberNode {
+			literals[i] = arg
 		}
-	case '/':
-		bNum, _ := strconv.ParseFloat(b, 64)
-		if 0.0 == bNum {
-			return nums, ops, errors.New("invalid expression: devision by 0")
+	}
+	if op.CheckLiterals != nil {
+		if err := op.CheckLiterals(literals); err != nil {
+			return "", errors.New("invalid expression: " + err.Error())
 		}
-		opTime = os.Getenv("TIME_DIVISIONS_MS")
 	}
-	idResult := "id" + strconv.Itoa(taskStore.Counter.GetValueAndInc())
 
-	task := internal.Task{Id: idResult, Arg1: a, Arg2: b, Operation: string(operator), Operation_time: opTime}
-	log.Println("want to add task " + task.Id + " " + task.Arg1 + " " + task.Arg2 + " " + task.Operation + " " + task.Operation_time)
-	taskStore.AddTask(task)
-	return append(nums, idResult), ops, nil
+	p.operations++
+	// arguments are literals or IDs of already deduplicated tasks, so equal
+	// keys mean equal sub-trees
+	key := op.Symbol + "(" + strings.Join(args, ",") + ")"
+	if id, exists := p.byKey[key]; exists {
+		p.planned[n] = id
+		return id, nil
+	}
+
+	task := newTask(op, p.newID())
+	task.Unit = n.Unit
+	task.Complex = p.complex
+	task.Integer = p.integer
+	task.Arg1 = args[0]
+	if len(args) > 1 {
+		task.Arg2 = args[1]
+	}
+	p.tasks = append(p.tasks, task)
+	p.taskCount++
+	p.planned[n] = task.Id
+	p.byKey[key] = task.Id
+	return task.Id, nil
+}
+
+var errListOutsideAggregate = errors.New("invalid expression: lists can only be passed to " + aggregateNames())
+
+func newTask(op *operations.Operation, id string) internal.Task {
+	opTime := os.Getenv(op.TimingKey)
+	spec, err := latency.FromEnv(op.TimingKey)
+	if err != nil {
+		log.Printf("Latency settings ignored, using fixed %sms: %v", opTime, err)
+	}
+	return internal.Task{
+		Id:             id,
+		Operation:      op.Symbol,
+		Operation_time: opTime,
+		Latency:        &spec,
+	}
 }
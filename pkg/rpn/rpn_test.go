@@ -1,11 +1,15 @@
 package rpn_test
 
 import (
+	"math/big"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/katierevinska/calculatorService/internal"
+	"github.com/katierevinska/calculatorService/internal/latency"
 	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/katierevinska/calculatorService/pkg/operations"
 	"github.com/katierevinska/calculatorService/pkg/rpn"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -61,11 +65,60 @@ func TestCalc_AddsTasksWithCorrectArguments(t *testing.T) {
 			},
 			expectedLastID: "id3",
 		},
+		{
+			name:       "Power is right associative and binds tighter than *",
+			expression: "2*3^2^2",
+			expectedTasks: []internal.Task{
+				{Id: "id1", Arg1: "2", Arg2: "2", Operation: "^"},
+				{Id: "id2", Arg1: "3", Arg2: "id1", Operation: "^"},
+				{Id: "id3", Arg1: "2", Arg2: "id2", Operation: "*", Operation_time: "20"},
+			},
+			expectedLastID: "id3",
+		},
+		{
+			name:       "Function call with spaces",
+			expression: "sqrt(16) + abs( -2 )",
+			expectedTasks: []internal.Task{
+				{Id: "id1", Arg1: "16", Operation: "sqrt"},
+				{Id: "id2", Arg1: "-2", Operation: "abs"},
+				{Id: "id3", Arg1: "id1", Arg2: "id2", Operation: "+", Operation_time: "10"},
+			},
+			expectedLastID: "id3",
+		},
+		{
+			name:       "Unary minus on a sub-expression",
+			expression: "-(1+2)",
+			expectedTasks: []internal.Task{
+				{Id: "id1", Arg1: "1", Arg2: "2", Operation: "+", Operation_time: "10"},
+				{Id: "id2", Arg1: "0", Arg2: "id1", Operation: "-", Operation_time: "10"},
+			},
+			expectedLastID: "id2",
+		},
 		{
 			name:        "Division by zero",
 			expression:  "1/0",
 			expectError: true,
 		},
+		{
+			name:        "Function with wrong number of arguments",
+			expression:  "sqrt(1, 2)",
+			expectError: true,
+		},
+		{
+			name:        "Function without parentheses",
+			expression:  "sqrt 4",
+			expectError: true,
+		},
+		{
+			name:        "Unknown variable",
+			expression:  "x+1",
+			expectError: true,
+		},
+		{
+			name:        "Malformed number",
+			expression:  "1.2.3+1",
+			expectError: true,
+		},
 		{
 			name:        "Invalid expression - unmatched parenthesis",
 			expression:  "(2+3",
@@ -78,7 +131,7 @@ func TestCalc_AddsTasksWithCorrectArguments(t *testing.T) {
 		},
 		{
 			name:        "Invalid expression - unknown symbol",
-			expression:  "2%3",
+			expression:  "2$3",
 			expectError: true,
 		},
 	}
@@ -111,3 +164,845 @@ func TestCalc_AddsTasksWithCorrectArguments(t *testing.T) {
 		})
 	}
 }
+
+func TestCalc_AttachesLatencyModel(t *testing.T) {
+	setupEnvForRPN()
+	os.Setenv("LATENCY_MODEL", "jitter:3")
+	os.Setenv("TIME_MULTIPLICATIONS_MODEL", "exponential")
+	defer func() {
+		os.Unsetenv("LATENCY_MODEL")
+		os.Unsetenv("TIME_MULTIPLICATIONS_MODEL")
+	}()
+
+	taskStore := store.NewTaskStore()
+	_, err := rpn.Calc("1+2*3", taskStore)
+	require.NoError(t, err)
+
+	tasks := taskStore.GetTasks()
+	require.Len(t, tasks, 2)
+	require.NotNil(t, tasks[0].Latency)
+	assert.Equal(t, latency.Spec{Model: latency.ModelExponential, BaseMs: 20}, *tasks[0].Latency)
+	require.NotNil(t, tasks[1].Latency)
+	assert.Equal(t, latency.Spec{Model: latency.ModelJitter, BaseMs: 10, JitterMs: 3}, *tasks[1].Latency)
+}
+
+func TestParse_BuildsTree(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"1+2*3", "(1 + (2 * 3))"},
+		{"(1+2)*3", "((1 + 2) * 3)"},
+		{"8-4-2", "((8 - 4) - 2)"},
+		{"2^3^2", "(2 ^ (3 ^ 2))"},
+		{"-2^2", "(0 - (2 ^ 2))"},
+		{"2^-1", "(2 ^ -1)"},
+		{"--3", "3"},
+		{"sqrt(abs(-16))+x", "(sqrt(abs(-16)) + x)"},
+		{"1+2<4||x==2&&y!=3", "(((1 + 2) < 4) || ((x == 2) && (y != 3)))"},
+		{"!x&&y", "(!x && y)"},
+		{"!(x>=1)", "!(x >= 1)"},
+		{"true||false", "(1 || 0)"},
+		{"if(x>100, x*0.9, x)", "if((x > 100), (x * 0.9), x)"},
+		{"sum([1, 2], x*2) * 2", "(sum([1, 2], (x * 2)) * 2)"},
+		{"max([])", "max([])"},
+		{"min(1, 2)", "min(1, 2)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			root, err := rpn.Parse(tt.expression)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, root.String())
+		})
+	}
+}
+
+func TestParse_UsesGivenRegistry(t *testing.T) {
+	registry := operations.NewRegistry()
+	registry.MustRegister(operations.Operation{
+		Symbol: "%", Name: "modulo", Arity: 2, Precedence: 2,
+		Eval: func(a []float64) (float64, error) { return float64(int(a[0]) % int(a[1])), nil },
+	})
+
+	root, err := rpn.ParseWith("7%3", registry)
+	require.NoError(t, err)
+	assert.Equal(t, rpn.OperationNode, root.Kind)
+	assert.Equal(t, "%", root.Value)
+
+	_, err = rpn.ParseWith("7+3", registry)
+	assert.Error(t, err, "Operators missing from the registry are unknown symbols")
+}
+
+func TestParseDefinition(t *testing.T) {
+	def, err := rpn.ParseDefinition("f(x, y) = x^2 + 3*y")
+	require.NoError(t, err)
+	assert.Equal(t, "f", def.Name)
+	assert.Equal(t, []string{"x", "y"}, def.Params)
+	assert.Equal(t, "((x ^ 2) + (3 * y))", def.Body.String())
+
+	invalid := []string{
+		"f(x) x+1",
+		"f(x) = x + z",
+		"f(x, x) = x",
+		"f(1) = 1",
+		"sqrt(x) = x",
+		"f = 1",
+		"f(x) = " + strings.Repeat("x+", rpn.MaxDefinitionLength) + "x",
+	}
+	for _, text := range invalid {
+		_, err := rpn.ParseDefinition(text)
+		assert.Error(t, err, text)
+	}
+}
+
+func TestCalcWithFunctions(t *testing.T) {
+	defs := map[string]*rpn.Definition{}
+	for _, text := range []string{
+		"sq(x) = x*x",
+		"f(x, y) = sq(x) + y",
+		"loop(x) = loop(x) + 1",
+		"big(x) = sq(sq(sq(sq(x))))",
+	} {
+		def, err := rpn.ParseDefinition(text)
+		require.NoError(t, err)
+		defs[def.Name] = def
+	}
+	lookup := func(name string) (*rpn.Definition, bool) {
+		def, exists := defs[name]
+		return def, exists
+	}
+
+	t.Run("Calls are expanded into tasks", func(t *testing.T) {
+		taskStore := store.NewTaskStore()
+		lastID, _, err := rpn.CalcWithFunctions("f(2+1, 4)", taskStore, lookup, nil, rpn.RealMode)
+		require.NoError(t, err)
+
+		tasks := taskStore.GetTasks()
+		require.Len(t, tasks, 3, "The argument used twice by sq is computed once")
+		assert.Equal(t, internal.Task{Id: "id1", Arg1: "2", Arg2: "1", Operation: "+"}, stripTiming(tasks[0]))
+		assert.Equal(t, internal.Task{Id: "id2", Arg1: "id1", Arg2: "id1", Operation: "*"}, stripTiming(tasks[1]))
+		assert.Equal(t, internal.Task{Id: "id3", Arg1: "id2", Arg2: "4", Operation: "+"}, stripTiming(tasks[2]))
+		assert.Equal(t, "id3", lastID)
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		for _, expression := range []string{"g(1)", "sq(1, 2)", "loop(1)", "big(big(big(1)))"} {
+			taskStore := store.NewTaskStore()
+			_, _, err := rpn.CalcWithFunctions(expression, taskStore, lookup, nil, rpn.RealMode)
+			assert.Error(t, err, expression)
+			assert.Empty(t, taskStore.GetTasks(), expression)
+		}
+	})
+
+	t.Run("Calc without functions rejects calls", func(t *testing.T) {
+		_, err := rpn.Calc("sq(2)", store.NewTaskStore())
+		assert.Error(t, err)
+	})
+}
+
+func stripTiming(task internal.Task) internal.Task {
+	task.Operation_time = ""
+	task.Latency = nil
+	return task
+}
+
+func TestParseScript(t *testing.T) {
+	assert.True(t, rpn.IsScript("a = 2+3; a*2"))
+	assert.True(t, rpn.IsScript("a = 2"))
+	assert.False(t, rpn.IsScript("2+3"))
+	assert.False(t, rpn.IsScript("f(x) = x"))
+
+	statements, err := rpn.ParseScript("a = 2+3; b = a*4; b/2;")
+	require.NoError(t, err)
+	require.Len(t, statements, 3)
+	assert.Equal(t, "a", statements[0].Name)
+	assert.Equal(t, "(a * 4)", statements[1].Expr.String())
+	assert.Equal(t, "", statements[2].Name)
+
+	invalid := []string{
+		"a = 1; a = 2",
+		"1+1; a = 2",
+		"sqrt = 4",
+		"a = 1; b = (a",
+		";;",
+	}
+	for _, script := range invalid {
+		_, err := rpn.ParseScript(script)
+		assert.Error(t, err, script)
+	}
+}
+
+func TestPlanScript(t *testing.T) {
+	t.Run("Names become dependencies", func(t *testing.T) {
+		taskStore := store.NewTaskStore()
+		statements, err := rpn.ParseScript("a = 2+3; c = 7; b = a*4; d = 1+1; b/2")
+		require.NoError(t, err)
+
+		results, _, err := rpn.PlanScript(statements, taskStore, nil, nil, rpn.RealMode)
+		require.NoError(t, err)
+		assert.Equal(t, []rpn.ScriptResult{
+			{Name: "a", ID: "id1"},
+			{Name: "c", ID: "7"},
+			{Name: "b", ID: "id2"},
+			{Name: "d", ID: "id3"},
+			{Name: "", ID: "id4"},
+		}, results)
+
+		tasks := taskStore.GetTasks()
+		require.Len(t, tasks, 4)
+		assert.Equal(t, "id1", tasks[1].Arg1)
+		assert.Equal(t, "id2", tasks[3].Arg1)
+
+		first, ok := taskStore.GetFirstCorrectTask()
+		require.True(t, ok)
+		second, ok := taskStore.GetFirstCorrectTask()
+		require.True(t, ok)
+		assert.Equal(t, []string{"id1", "id3"}, []string{first.Id, second.Id}, "Independent statements are ready together")
+	})
+
+	t.Run("Unknown names fail the whole script", func(t *testing.T) {
+		taskStore := store.NewTaskStore()
+		statements, err := rpn.ParseScript("a = 2+3; b = c*4")
+		require.NoError(t, err)
+		_, _, err = rpn.PlanScript(statements, taskStore, nil, nil, rpn.RealMode)
+		assert.Error(t, err)
+		assert.Empty(t, taskStore.GetTasks())
+	})
+
+	t.Run("Names may hold matrices", func(t *testing.T) {
+		setupEnvForRPN()
+		taskStore := store.NewTaskStore()
+		statements, err := rpn.ParseScript("a = [[1,2],[3,4]]; b = a*a; d = det(b)")
+		require.NoError(t, err)
+
+		results, _, err := rpn.PlanScript(statements, taskStore, nil, nil, rpn.RealMode)
+		require.NoError(t, err)
+		require.Len(t, results, 1, "Matrices are bound, not listed")
+		assert.Equal(t, "4.0000000000", compute(t, taskStore, results[0].ID))
+
+		statements, err = rpn.ParseScript("a = [1,2]; a*2")
+		require.NoError(t, err)
+		_, _, err = rpn.PlanScript(statements, store.NewTaskStore(), nil, nil, rpn.RealMode)
+		assert.Error(t, err)
+	})
+
+	t.Run("Names keep their units", func(t *testing.T) {
+		setupEnvForRPN()
+		taskStore := store.NewTaskStore()
+		statements, err := rpn.ParseScript("d = 3 km + 0 m; t = 20 min; d/t to km/h")
+		require.NoError(t, err)
+
+		results, _, err := rpn.PlanScript(statements, taskStore, nil, nil, rpn.RealMode)
+		require.NoError(t, err)
+		require.Len(t, results, 3)
+		assert.Equal(t, []string{"km", "min", "km/h"}, []string{results[0].Unit, results[1].Unit, results[2].Unit})
+		assert.Equal(t, "9.0000000000", compute(t, taskStore, results[2].ID))
+	})
+}
+
+func TestPlan_CommonSubexpressions(t *testing.T) {
+	tests := []struct {
+		name          string
+		expression    string
+		expectedTasks []internal.Task
+		expectedStats rpn.PlanStats
+	}{
+		{
+			name:       "Repeated sum is computed once",
+			expression: "(1+2)*(1+2)+(1+2)",
+			expectedTasks: []internal.Task{
+				{Id: "id1", Arg1: "1", Arg2: "2", Operation: "+"},
+				{Id: "id2", Arg1: "id1", Arg2: "id1", Operation: "*"},
+				{Id: "id3", Arg1: "id2", Arg2: "id1", Operation: "+"},
+			},
+			expectedStats: rpn.PlanStats{Operations: 5, Tasks: 3},
+		},
+		{
+			name:       "Nested repeats share whole sub-trees",
+			expression: "sqrt(2*3+1) - sqrt(2*3+1)",
+			expectedTasks: []internal.Task{
+				{Id: "id1", Arg1: "2", Arg2: "3", Operation: "*"},
+				{Id: "id2", Arg1: "id1", Arg2: "1", Operation: "+"},
+				{Id: "id3", Arg1: "id2", Operation: "sqrt"},
+				{Id: "id4", Arg1: "id3", Arg2: "id3", Operation: "-"},
+			},
+			expectedStats: rpn.PlanStats{Operations: 7, Tasks: 4},
+		},
+		{
+			name:       "Operand order matters",
+			expression: "(1-2)+(2-1)",
+			expectedTasks: []internal.Task{
+				{Id: "id1", Arg1: "1", Arg2: "2", Operation: "-"},
+				{Id: "id2", Arg1: "2", Arg2: "1", Operation: "-"},
+				{Id: "id3", Arg1: "id1", Arg2: "id2", Operation: "+"},
+			},
+			expectedStats: rpn.PlanStats{Operations: 3, Tasks: 3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			taskStore := store.NewTaskStore()
+			root, err := rpn.Parse(tt.expression)
+			require.NoError(t, err)
+
+			_, stats, err := rpn.PlanWithStats(root, taskStore)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectedStats, stats)
+
+			tasks := taskStore.GetTasks()
+			require.Len(t, tasks, len(tt.expectedTasks))
+			for i := range tasks {
+				assert.Equal(t, tt.expectedTasks[i], stripTiming(tasks[i]))
+			}
+		})
+	}
+
+	assert.InDelta(t, 0.4, rpn.PlanStats{Operations: 5, Tasks: 3}.DedupRatio(), 1e-9)
+	assert.Equal(t, 0.0, rpn.PlanStats{}.DedupRatio())
+}
+
+func TestParse_RejectsMalformedExpressions(t *testing.T) {
+	for _, expression := range []string{"if(1, 2)", "if(1, 2, 3, 4)", "if+1", "1<", "sum", "[1, 2", "(1, 2)", "sum([1)]"} {
+		t.Run(expression, func(t *testing.T) {
+			_, err := rpn.Parse(expression)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestCalc_PlansOnlyTheTakenBranch(t *testing.T) {
+	setupEnvForRPN()
+
+	t.Run("Computed condition", func(t *testing.T) {
+		taskStore := store.NewTaskStore()
+		resultID, err := rpn.Calc("if(3>2, 1+1, 2*2)", taskStore)
+		require.NoError(t, err)
+		assert.Equal(t, "id2", resultID)
+
+		tasks := taskStore.GetTasks()
+		require.Len(t, tasks, 1)
+		assert.Equal(t, internal.Task{Id: "id1", Arg1: "3", Arg2: "2", Operation: ">"}, stripTiming(tasks[0]))
+
+		task, ok := taskStore.LeaseTask("agent", nil)
+		require.True(t, ok)
+		_, err = taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: "1.0000000000"}, "agent")
+		require.NoError(t, err)
+
+		tasks = taskStore.GetTasks()
+		require.Len(t, tasks, 1)
+		assert.Equal(t, internal.Task{Id: "id3", Arg1: "1", Arg2: "1", Operation: "+"}, stripTiming(tasks[0]))
+
+		task, ok = taskStore.LeaseTask("agent", nil)
+		require.True(t, ok)
+		_, err = taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: "2.0000000000"}, "agent")
+		require.NoError(t, err)
+
+		result, exists := taskStore.TasksResStore.GetTaskRes(resultID)
+		require.True(t, exists)
+		assert.Equal(t, "2.0000000000", result.Result)
+	})
+
+	t.Run("Literal condition", func(t *testing.T) {
+		taskStore := store.NewTaskStore()
+		resultID, err := rpn.Calc("if(0, 1/0, 2*3)", taskStore)
+		require.NoError(t, err)
+		assert.Equal(t, "id1", resultID)
+
+		tasks := taskStore.GetTasks()
+		require.Len(t, tasks, 1)
+		assert.Equal(t, "*", tasks[0].Operation)
+	})
+
+	t.Run("Unknown names are errors in either branch", func(t *testing.T) {
+		taskStore := store.NewTaskStore()
+		_, err := rpn.Calc("if(1>2, 1, x)", taskStore)
+		assert.Error(t, err)
+		assert.Empty(t, taskStore.GetTasks())
+
+		resultID, err := rpn.Calc("1+1", taskStore)
+		require.NoError(t, err)
+		assert.Equal(t, "id1", resultID, "Failed plans take no IDs")
+	})
+
+	t.Run("Failing branch fails the conditional", func(t *testing.T) {
+		taskStore := store.NewTaskStore()
+		resultID, err := rpn.Calc("if(2>1, (1+2)/0, 1)", taskStore)
+		require.NoError(t, err)
+
+		task, ok := taskStore.LeaseTask("agent", nil)
+		require.True(t, ok)
+		_, err = taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: "1.0000000000"}, "agent")
+		require.NoError(t, err)
+
+		assert.Empty(t, taskStore.GetTasks())
+		result, exists := taskStore.TasksResStore.GetTaskRes(resultID)
+		require.True(t, exists)
+		assert.Contains(t, result.Result, "Error")
+
+		resultID, err = rpn.Calc("1+1", taskStore)
+		require.NoError(t, err)
+		assert.Equal(t, "id3", resultID, "The failed branch took no IDs")
+	})
+}
+
+func TestCalc_PropagatesErrorsWithoutAgents(t *testing.T) {
+	setupEnvForRPN()
+	taskStore := store.NewTaskStore()
+	resultID, err := rpn.Calc("1/(2-2)+1", taskStore)
+	require.NoError(t, err)
+
+	task, ok := taskStore.LeaseTask("agent", nil)
+	require.True(t, ok)
+	_, err = taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: "0.0000000000"}, "agent")
+	require.NoError(t, err)
+	task, ok = taskStore.LeaseTask("agent", nil)
+	require.True(t, ok)
+	_, err = taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: "Error: division by zero"}, "agent")
+	require.NoError(t, err)
+
+	assert.Empty(t, taskStore.GetTasks())
+	result, exists := taskStore.TasksResStore.GetTaskRes(resultID)
+	require.True(t, exists)
+	assert.Equal(t, "Error: division by zero", result.Result)
+}
+
+// compute plays the agents: it computes tasks until none are left and
+// returns the result of the given ID.
+func compute(t *testing.T, taskStore *store.TaskStore, id string) string {
+	for {
+		task, ok := taskStore.LeaseTask("agent", nil)
+		if !ok {
+			break
+		}
+		args := []string{task.Arg1, task.Arg2}[:arity(task.Operation)]
+		value, err := operations.Default.Evaluate(task.Operation, args)
+		result := operations.FormatResult(value)
+		switch {
+		case task.Complex:
+			var c complex128
+			c, err = operations.Default.EvaluateComplex(task.Operation, args)
+			result = operations.FormatComplex(c)
+		case task.Integer:
+			var n *big.Int
+			n, err = operations.Default.EvaluateInteger(task.Operation, args)
+			result = n.String()
+		}
+		if err != nil {
+			result = "Error: " + err.Error()
+		}
+		_, err = taskStore.AcceptResult(internal.TaskResult{Id: task.Id, Result: result}, "agent")
+		require.NoError(t, err)
+	}
+	result, exists := taskStore.TasksResStore.GetTaskRes(id)
+	require.True(t, exists, "result of %s", id)
+	return result.Result
+}
+
+func arity(symbol string) int {
+	op, _ := operations.Default.Lookup(symbol)
+	return op.Arity
+}
+
+func TestCalc_Aggregates(t *testing.T) {
+	setupEnvForRPN()
+
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"sum([1,2,3]) * 2", "12.0000000000"},
+		{"avg(3, 7, 12, 9)", "7.7500000000"},
+		{"median(3, 7, 12, 9)", "8.0000000000"},
+		{"median([5, 1], 3)", "3"},
+		{"stddev(2, 4, 4, 4, 5, 5, 7, 9)", "2.0000000000"},
+		{"min(4, -1, 2) + max(4, -1, 2)", "3.0000000000"},
+		{"median(9-0, 1+0, 8*1, 2/1, 7-0, 3-0)", "5.0000000000"},
+		{"median(5+0, 1+0, 4-0, 2*1, 3/1)", "3.0000000000"},
+		{"sum(7)", "7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			taskStore := store.NewTaskStore()
+			id, err := rpn.Calc(tt.expression, taskStore)
+			require.NoError(t, err)
+			if operations.IsNumber(id) {
+				assert.Equal(t, tt.expected, id)
+				return
+			}
+			assert.Equal(t, tt.expected, compute(t, taskStore, id))
+		})
+	}
+}
+
+func TestCalc_AggregatesAreBalanced(t *testing.T) {
+	setupEnvForRPN()
+	taskStore := store.NewTaskStore()
+	_, err := rpn.Calc("sum(1, 2, 3, 4, 5, 6, 7, 8)", taskStore)
+	require.NoError(t, err)
+
+	// the four pairs can be computed in parallel right away
+	tasks := taskStore.GetTasks()
+	require.Len(t, tasks, 7)
+	ready := 0
+	for _, task := range tasks {
+		if !strings.HasPrefix(task.Arg1, "id") && !strings.HasPrefix(task.Arg2, "id") {
+			ready++
+		}
+	}
+	assert.Equal(t, 4, ready)
+}
+
+func TestCalc_AggregateErrors(t *testing.T) {
+	for _, expression := range []string{"sum([])", "[1, 2] ^ 2", "sum(1, x)", "if(1>0, 1, [2])"} {
+		t.Run(expression, func(t *testing.T) {
+			_, err := rpn.Calc(expression, store.NewTaskStore())
+			assert.Error(t, err)
+		})
+	}
+	_, err := rpn.ParseDefinition("avg(x) = x")
+	assert.Error(t, err)
+}
+
+func TestCalcWithFunctions_BindsInputs(t *testing.T) {
+	setupEnvForRPN()
+	numbers := make([]float64, 2000)
+	for i := range numbers {
+		numbers[i] = float64(i + 1)
+	}
+	inputs := rpn.Inputs{rpn.NumbersVariable: rpn.List(numbers)}
+
+	taskStore := store.NewTaskStore()
+	id, stats, err := rpn.CalcWithFunctions("avg(numbers)", taskStore, nil, inputs, rpn.RealMode)
+	require.NoError(t, err)
+	assert.Equal(t, 2000, stats.Tasks)
+	assert.Equal(t, "1000.5000000000", compute(t, taskStore, id))
+
+	id, err = rpn.Calc("median(numbers)", taskStore)
+	assert.Error(t, err, "Inputs are only bound when given")
+	assert.Empty(t, id)
+}
+
+func TestCalc_Units(t *testing.T) {
+	setupEnvForRPN()
+
+	tests := []struct {
+		expression string
+		expected   string
+		unit       string
+	}{
+		{"3 m * 2 s^-1 + 4 m/s", "10.0000000000", "m/s"},
+		{"1 km + 500 m", "1.5000000000", "km"},
+		{"5 km to mi", "3.1068559612", "mi"},
+		{"(2 m)^2", "4.0000000000", "m^2"},
+		{"sqrt(9 m^2) to cm", "300.0000000000", "cm"},
+		{"10 N / 2 kg to m/s^2", "5.0000000000", "m/s^2"},
+		{"2 h / 30 min", "4.0000000000", ""},
+		{"if(1 km > 900 m, 1, 0)", "1.0000000000", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			taskStore := store.NewTaskStore()
+			id, stats, err := rpn.CalcWithFunctions(tt.expression, taskStore, nil, nil, rpn.RealMode)
+			require.NoError(t, err)
+			assert.Equal(t, tt.unit, stats.Unit)
+			if operations.IsNumber(id) {
+				assert.Equal(t, tt.expected, id)
+				return
+			}
+			assert.Equal(t, tt.expected, compute(t, taskStore, id))
+		})
+	}
+}
+
+func TestCalc_UnitErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		message    string
+	}{
+		{"1 m + 1 kg", "cannot add m and kg"},
+		{"5 m to kg", "cannot convert m to kg"},
+		{"2^(1 s)", "exponent"},
+		{"3 furlong", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			_, err := rpn.Calc(tt.expression, store.NewTaskStore())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.message)
+		})
+	}
+}
+
+func TestCalc_ComplexNumbers(t *testing.T) {
+	setupEnvForRPN()
+
+	t.Run("Rejected unless enabled", func(t *testing.T) {
+		os.Unsetenv(rpn.ComplexNumbersEnv)
+		_, err := rpn.Calc("(1+2i)*(3-1i)", store.NewTaskStore())
+		assert.Error(t, err)
+
+		taskStore := store.NewTaskStore()
+		id, err := rpn.Calc("sqrt(0-4)", taskStore)
+		require.NoError(t, err)
+		assert.Equal(t, "Error: square root of a negative number", compute(t, taskStore, id))
+	})
+
+	t.Run("Enabled", func(t *testing.T) {
+		t.Setenv(rpn.ComplexNumbersEnv, "true")
+		tests := []struct {
+			expression string
+			expected   string
+		}{
+			{"(1+2i)*(3-1i)", "5.0000000000+5.0000000000i"},
+			{"sqrt(-4)", "0.0000000000+2.0000000000i"},
+			{"sqrt(-4)^2 + 1", "-3.0000000000"},
+			{"if(2i, 1, 0)", "1"},
+			{"abs(3 + 4i) * 2 m", "10.0000000000"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.expression, func(t *testing.T) {
+				taskStore := store.NewTaskStore()
+				id, err := rpn.Calc(tt.expression, taskStore)
+				require.NoError(t, err)
+				if operations.IsNumber(id) {
+					assert.Equal(t, tt.expected, id)
+					return
+				}
+				assert.Equal(t, tt.expected, compute(t, taskStore, id))
+			})
+		}
+
+		_, err := rpn.Calc("2i m", store.NewTaskStore())
+		assert.Error(t, err, "Imaginary numbers have no units")
+	})
+}
+
+func TestCalc_IntegerMode(t *testing.T) {
+	setupEnvForRPN()
+	large := "1" + strings.Repeat("0", 400)
+
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"30!", "265252859812191058636308480000000"},
+		{"7 // 2", "3"},
+		{"7 % 2", "1"},
+		{"-7 // 2", "-4"},
+		{"-7 % 2", "1"},
+		{"7 / 2", "Error: 7/2 is not an integer, use // and %"},
+		{"6 / 2 + 2^100", "1267650600228229401496703205379"},
+		{"int(2.5) * 3 - int(-1.9)", "7"},
+		{"-3! + 2^3!", "58"},
+		{"if(5! > 100, 7, 8)", "7"},
+		{large + " + 1", large[:400] + "1"},
+		{"sqrt(16) + sqrt(15)", "Error: square root of 15 is not an integer"},
+		{"ln(2) + 1", "Error: natural logarithm is not defined for integers"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			taskStore := store.NewTaskStore()
+			id, stats, err := rpn.CalcWithFunctions(tt.expression, taskStore, nil, nil, rpn.IntegerMode)
+			require.NoError(t, err)
+			assert.Equal(t, rpn.IntegerMode, stats.Mode)
+			assert.Equal(t, tt.expected, compute(t, taskStore, id))
+		})
+	}
+
+	t.Run("Numbers input", func(t *testing.T) {
+		taskStore := store.NewTaskStore()
+		inputs := rpn.Inputs{rpn.NumbersVariable: rpn.List([]float64{1e6, 2})}
+		id, _, err := rpn.CalcWithFunctions("sum(numbers)", taskStore, nil, inputs, rpn.IntegerMode)
+		require.NoError(t, err)
+		assert.Equal(t, "1000002", compute(t, taskStore, id))
+	})
+
+	for _, expression := range []string{"2.5 * 2", "1 km + 2", "(1 + 2) to m", "2i + 1", "if(1 + 1 > 2, 1.5, 2)", "int(2i)"} {
+		t.Run("Rejects "+expression, func(t *testing.T) {
+			_, _, err := rpn.CalcWithFunctions(expression, store.NewTaskStore(), nil, nil, rpn.IntegerMode)
+			assert.Error(t, err)
+		})
+	}
+
+	t.Run("Real mode", func(t *testing.T) {
+		for expression, expected := range map[string]string{"5!": "120.0000000000", "7 // 2": "3.0000000000", "-7 % 2": "1.0000000000", "int(2.5) + 1": "3.0000000000"} {
+			taskStore := store.NewTaskStore()
+			id, err := rpn.Calc(expression, taskStore)
+			require.NoError(t, err)
+			assert.Equal(t, expected, compute(t, taskStore, id), expression)
+		}
+		_, err := rpn.Calc(large+" + 1", store.NewTaskStore())
+		assert.Error(t, err, "Numbers beyond float64 only work in integer mode")
+		_, err = rpn.ParseMode("rational")
+		assert.Error(t, err)
+	})
+}
+
+func TestCalc_Matrices(t *testing.T) {
+	setupEnvForRPN()
+
+	tests := []struct {
+		expression string
+		shape      []int
+		expected   []string
+	}{
+		{"[[1,2],[3,4]] * [[5],[6]]", []int{2, 1}, []string{"17.0000000000", "39.0000000000"}},
+		{"[[1,2],[3,4]] * [5,6]", []int{2}, []string{"17.0000000000", "39.0000000000"}},
+		{"[1,2] * [[1,2],[3,4]]", []int{2}, []string{"7.0000000000", "10.0000000000"}},
+		{"transpose([[1,2,3],[4,5,6]])", []int{3, 2}, []string{"1", "4", "2", "5", "3", "6"}},
+		{"transpose([1,2])", []int{1, 2}, []string{"1", "2"}},
+		{"2*[1,2] - 1", []int{2}, []string{"1.0000000000", "3.0000000000"}},
+		{"-[[1,2]] / 2", []int{1, 2}, []string{"-0.5000000000", "-1.0000000000"}},
+		{"[1 km, 500 m]", []int{2}, []string{"1.0000000000", "0.5000000000"}},
+		{"if(1 > 0, [1,2], [3,4])", []int{2}, []string{"1.0000000000", "2.0000000000"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			taskStore := store.NewTaskStore()
+			_, stats, err := rpn.CalcWithFunctions(tt.expression, taskStore, nil, nil, rpn.RealMode)
+			require.NoError(t, err)
+			assert.Equal(t, tt.shape, stats.Shape)
+			results := make([]string, len(stats.Elements))
+			for i, element := range stats.Elements {
+				results[i] = element
+				if !operations.IsNumber(element) {
+					results[i] = compute(t, taskStore, element)
+				}
+			}
+			assert.Equal(t, tt.expected, results)
+		})
+	}
+}
+
+func TestCalc_MatrixFunctions(t *testing.T) {
+	setupEnvForRPN()
+
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"det([[1,2],[3,4]])", "-2.0000000000"},
+		{"det([[2,0,1],[1,3,2],[1,1,2]])", "6.0000000000"},
+		{"det([[7]])", "7"},
+		{"dot([1,2,3], [4,5,6])", "32.0000000000"},
+		{"[1,2,3] * [4,5,6]", "32.0000000000"},
+		{"sum([[1,2],[3,4]] * [1,1])", "10.0000000000"},
+		{"max(transpose([[1,9],[3,4]]))", "9.0000000000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			taskStore := store.NewTaskStore()
+			id, stats, err := rpn.CalcWithFunctions(tt.expression, taskStore, nil, nil, rpn.RealMode)
+			require.NoError(t, err)
+			assert.Nil(t, stats.Shape)
+			if operations.IsNumber(id) {
+				assert.Equal(t, tt.expected, id)
+				return
+			}
+			assert.Equal(t, tt.expected, compute(t, taskStore, id))
+		})
+	}
+}
+
+func TestCalc_MatrixMultiplicationIsDistributed(t *testing.T) {
+	setupEnvForRPN()
+	taskStore := store.NewTaskStore()
+	_, stats, err := rpn.CalcWithFunctions("[[1,2],[3,4]] * [[5,6],[7,8]]", taskStore, nil, nil, rpn.RealMode)
+	require.NoError(t, err)
+	require.Len(t, stats.Elements, 4)
+
+	// all eight products are ready at once, the four sums wait for them
+	ready := 0
+	for {
+		_, ok := taskStore.GetFirstCorrectTask()
+		if !ok {
+			break
+		}
+		ready++
+	}
+	assert.Equal(t, 8, ready)
+	assert.Len(t, taskStore.GetTasks(), 4)
+}
+
+func TestCalc_MatrixErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		message    string
+	}{
+		{"[[1,2],[3,4]] * [[1,2,3]]", "cannot multiply a 2x2 matrix by a 1x3 matrix"},
+		{"[[1,2],[3]]", "same length"},
+		{"[1,2] + [1,2,3]", "cannot combine"},
+		{"det([[1,2,3],[4,5,6]])", "square matrix"},
+		{"dot([1,2], [[1,2]])", "two vectors"},
+		{"sqrt([1,4])", "not defined for matrices"},
+		{"if([1,0], 1, 2)", "condition"},
+		{"if(1 > 0, [1,2], 3)", "branches"},
+		{"[1 m, 1 s]", "cannot combine in a matrix m and s"},
+		{"[]", "empty list"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			_, err := rpn.Calc(tt.expression, store.NewTaskStore())
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.message)
+		})
+	}
+}
+
+func TestExplain(t *testing.T) {
+	setupEnvForRPN()
+
+	explanation, err := rpn.Explain("(1+2)*(3+4) - 5/1", nil, nil, rpn.RealMode)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id5"}, explanation.Results)
+	require.Len(t, explanation.Tasks, 5)
+	assert.Equal(t, "id1", explanation.Tasks[0].Id, "Explained expressions get task IDs of their own")
+	path, ms := explanation.CriticalPath()
+	assert.Equal(t, []string{"id1", "id3", "id5"}, path)
+	assert.Equal(t, 40.0, ms)
+	assert.Equal(t, 70.0, explanation.Work())
+
+	explanation, err = rpn.Explain("a = 1+2; a*a", nil, nil, rpn.RealMode)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"id1", "id2"}, explanation.Results)
+	path, ms = explanation.CriticalPath()
+	assert.Equal(t, []string{"id1", "id2"}, path)
+	assert.Equal(t, 30.0, ms)
+
+	explanation, err = rpn.Explain("5", nil, nil, rpn.RealMode)
+	require.NoError(t, err)
+	path, ms = explanation.CriticalPath()
+	assert.Empty(t, path)
+	assert.Zero(t, ms)
+
+	_, err = rpn.Explain("1 +", nil, nil, rpn.RealMode)
+	assert.Error(t, err)
+}
+
+func TestPrepare(t *testing.T) {
+	setupEnvForRPN()
+	taskStore := store.NewTaskStore()
+
+	prepared, err := rpn.Prepare("(1+2)*(3+4)", taskStore, nil, nil, rpn.RealMode)
+	require.NoError(t, err)
+	assert.Equal(t, "id3", prepared.ID)
+	assert.Len(t, prepared.Tasks, 3)
+	assert.Empty(t, taskStore.GetTasks(), "Prepared tasks wait for Commit")
+	prepared.Commit()
+	assert.Equal(t, prepared.Tasks, taskStore.GetTasks(), "The committed tasks are the prepared ones")
+
+	prepared, err = rpn.Prepare("a = 2*3; a+1", taskStore, nil, nil, rpn.RealMode)
+	require.NoError(t, err)
+	require.Len(t, prepared.Script, 2)
+	assert.Equal(t, []string{prepared.Script[0].ID, prepared.Script[1].ID}, prepared.Results)
+	prepared.Commit()
+	assert.Len(t, taskStore.GetTasks(), 5)
+}
@@ -0,0 +1,172 @@
+package rpn
+
+import (
+	"errors"
+	"maps"
+	"strconv"
+	"strings"
+
+	"github.com/katierevinska/calculatorService/internal/store"
+	"github.com/katierevinska/calculatorService/pkg/operations"
+)
+
+// Statement is one part of a script such as "a = 2+3; b = a*4; b/2". Only
+// the last statement may be unnamed.
+type Statement struct {
+	Name string
+	Expr *Node
+}
+
+// ScriptResult tells where the value of a statement comes from: the ID of
+// the task computing it, or the number itself when nothing is computed.
+type ScriptResult struct {
+	Name string
+	ID   string
+	Unit string
+}
+
+// IsScript reports whether the text has to be parsed with ParseScript
+// rather than Parse.
+func IsScript(text string) bool {
+	if strings.Contains(text, ";") {
+		return true
+	}
+	_, _, isAssignment := splitAssignment(text)
+	return isAssignment
+}
+
+// splitAssignment splits "name = expression". An "=" that is part of a
+// comparison such as "==" or "<=" is not an assignment.
+func splitAssignment(statement string) (string, string, bool) {
+	i := strings.Index(statement, "=")
+	if i < 0 || strings.HasPrefix(statement[i+1:], "=") {
+		return "", "", false
+	}
+	name := strings.TrimSpace(statement[:i])
+	if name == "" {
+		return "", "", false
+	}
+	for j, r := range name {
+		if !(isIdentStart(r) || j > 0 && isIdentPart(r)) {
+			return "", "", false
+		}
+	}
+	return name, statement[i+1:], true
+}
+
+func ParseScript(text string) ([]Statement, error) {
+	var statements []Statement
+	parts := strings.Split(text, ";")
+	for i, part := range parts {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		position := "statement " + strconv.Itoa(i+1)
+		if len(statements) > 0 && statements[len(statements)-1].Name == "" {
+			return nil, errors.New("invalid expression: only the last statement may be unnamed")
+		}
+
+		statement := Statement{}
+		expression := part
+		if name, rest, isAssignment := splitAssignment(part); isAssignment {
+			if _, exists := operations.Default.Lookup(name); exists || isReserved(name) {
+				return nil, errors.New("invalid expression: " + position + ": " + name + " is a reserved name")
+			}
+			for _, previous := range statements {
+				if previous.Name == name {
+					return nil, errors.New("invalid expression: " + position + ": " + name + " is already defined")
+				}
+			}
+			statement.Name = name
+			expression = rest
+		}
+
+		var err error
+		statement.Expr, err = Parse(expression)
+		if err != nil {
+			return nil, errors.New(position + ": " + err.Error())
+		}
+		statements = append(statements, statement)
+	}
+	if len(statements) == 0 {
+		return nil, errors.New("invalid expression: script is empty")
+	}
+	return statements, nil
+}
+
+// PlanScript plans all statements together. A name used in a later
+// statement refers to the task of the statement that bound it, so the
+// statements depend on each other only where they use each other's names
+// and agents compute independent statements in parallel. Identical
+// sub-expressions are shared across statements as well.
+func PlanScript(statements []Statement, taskStore *store.TaskStore, lookup FunctionLookup, inputs Inputs, mode Mode) ([]ScriptResult, PlanStats, error) {
+	p, results, stats, err := prepareScript(statements, taskStore, lookup, inputs, mode)
+	if err != nil {
+		return nil, PlanStats{}, err
+	}
+	p.commit()
+	return results, stats, nil
+}
+
+// prepareScript is PlanScript without adding the tasks to the store, see
+// Prepared.
+func prepareScript(statements []Statement, taskStore *store.TaskStore, lookup FunctionLookup, inputs Inputs, mode Mode) (*planner, []ScriptResult, PlanStats, error) {
+	p := newPlanner(taskStore, mode)
+	bound := maps.Clone(inputs)
+	if bound == nil {
+		bound = make(Inputs)
+	}
+	results := make([]ScriptResult, 0, len(statements))
+
+	for i, statement := range statements {
+		expanded, err := Expand(statement.Expr, lookup)
+		if err != nil {
+			return nil, nil, PlanStats{}, err
+		}
+		root := bindVariables(expanded, bound)
+		value, err := p.matrices.lower(root)
+		if err != nil {
+			return nil, nil, PlanStats{}, err
+		}
+		if value.shape != scalarShape {
+			// matrices are only planned where later statements use them
+			if i == len(statements)-1 {
+				return nil, nil, PlanStats{}, errors.New("invalid expression: the last statement of a script must be a number")
+			}
+			bound[statement.Name] = root
+			continue
+		}
+		id, unit, err := p.planWithUnits(value.elements[0])
+		if err != nil {
+			return nil, nil, PlanStats{}, err
+		}
+		if statement.Name != "" {
+			bound[statement.Name] = root
+		}
+		results = append(results, ScriptResult{Name: statement.Name, ID: id, Unit: unit.String()})
+	}
+	p.number()
+	for i := range results {
+		results[i].ID = p.rename(results[i].ID)
+	}
+	return p, results, p.stats(), nil
+}
+
+// bindVariables replaces names bound by earlier statements with their
+// trees. The trees are shared, so the planner computes them only once.
+func bindVariables(n *Node, bound Inputs) *Node {
+	switch n.Kind {
+	case NumberNode:
+		return n
+	case VariableNode:
+		if root, exists := bound[n.Value]; exists {
+			return root
+		}
+		return n
+	}
+	args := make([]*Node, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = bindVariables(arg, bound)
+	}
+	return &Node{Kind: n.Kind, Value: n.Value, Args: args}
+}
@@ -0,0 +1,412 @@
+package rpn
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// The SI base dimensions, in the order of Unit.dims.
+var baseUnits = [...]string{"m", "kg", "s", "A", "K", "mol", "cd"}
+
+type dimension [len(baseUnits)]int
+
+// unitDef is a named unit: its factor relative to the SI base units and
+// its dimension.
+type unitDef struct {
+	factor     float64
+	dims       dimension
+	prefixable bool
+}
+
+var units = map[string]unitDef{
+	"m":   {1, dimension{1}, true},
+	"g":   {1e-3, dimension{0, 1}, true},
+	"s":   {1, dimension{0, 0, 1}, true},
+	"A":   {1, dimension{0, 0, 0, 1}, true},
+	"K":   {1, dimension{0, 0, 0, 0, 1}, true},
+	"mol": {1, dimension{0, 0, 0, 0, 0, 1}, true},
+	"cd":  {1, dimension{0, 0, 0, 0, 0, 0, 1}, true},
+	"Hz":  {1, dimension{0, 0, -1}, true},
+	"N":   {1, dimension{1, 1, -2}, true},
+	"Pa":  {1, dimension{-1, 1, -2}, true},
+	"J":   {1, dimension{2, 1, -2}, true},
+	"W":   {1, dimension{2, 1, -3}, true},
+	"C":   {1, dimension{0, 0, 1, 1}, true},
+	"V":   {1, dimension{2, 1, -3, -1}, true},
+	"L":   {1e-3, dimension{3}, true},
+	"min": {60, dimension{0, 0, 1}, false},
+	"h":   {3600, dimension{0, 0, 1}, false},
+	"d":   {86400, dimension{0, 0, 1}, false},
+	"t":   {1000, dimension{0, 1}, false},
+	"in":  {0.0254, dimension{1}, false},
+	"ft":  {0.3048, dimension{1}, false},
+	"yd":  {0.9144, dimension{1}, false},
+	"mi":  {1609.344, dimension{1}, false},
+	"lb":  {0.45359237, dimension{0, 1}, false},
+}
+
+var prefixes = map[string]float64{
+	"T": 1e12, "G": 1e9, "M": 1e6, "k": 1e3, "h": 1e2,
+	"d": 1e-1, "c": 1e-2, "m": 1e-3, "u": 1e-6, "µ": 1e-6, "n": 1e-9, "p": 1e-12,
+}
+
+// lookupUnit finds a unit by name; names that are not units themselves may
+// be SI prefixes followed by a unit, so "min" is a minute but "mm" a
+// millimetre.
+func lookupUnit(name string) (unitDef, bool) {
+	if def, exists := units[name]; exists {
+		return def, true
+	}
+	for prefix, factor := range prefixes {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if def, exists := units[name[len(prefix):]]; exists && def.prefixable {
+			def.factor *= factor
+			return def, true
+		}
+	}
+	return unitDef{}, false
+}
+
+// Unit is the unit of a value: its dimension and factor relative to the
+// SI base units, and the named units it was written with, which it is
+// shown in.
+type Unit struct {
+	dims   dimension
+	factor float64
+	terms  []unitTerm
+}
+
+type unitTerm struct {
+	name     string
+	exponent int
+}
+
+var dimensionless = Unit{factor: 1}
+
+// ParseUnit parses units such as "km", "m/s^2" or "kg*m*s^-2".
+func ParseUnit(text string) (Unit, error) {
+	u := dimensionless
+	sign := 1
+	rest := text
+	for {
+		part := rest
+		end := strings.IndexAny(rest, "*/")
+		if end >= 0 {
+			part = rest[:end]
+		}
+		name, exponentText, hasExponent := strings.Cut(strings.TrimSpace(part), "^")
+		exponent := 1
+		if hasExponent {
+			var err error
+			if exponent, err = strconv.Atoi(exponentText); err != nil {
+				return Unit{}, errors.New("invalid expression: bad unit exponent in " + text)
+			}
+		}
+		def, exists := lookupUnit(name)
+		if !exists {
+			return Unit{}, errors.New("invalid expression: unknown unit " + name)
+		}
+		u = u.mul(Unit{dims: def.dims, factor: def.factor, terms: []unitTerm{{name, 1}}}.pow(sign * exponent))
+
+		if end < 0 {
+			return u, nil
+		}
+		sign = 1
+		if rest[end] == '/' {
+			sign = -1
+		}
+		rest = rest[end+1:]
+	}
+}
+
+func (u Unit) IsDimensionless() bool {
+	return u.dims == dimension{}
+}
+
+func (u Unit) mul(v Unit) Unit {
+	result := Unit{factor: u.factor * v.factor, terms: append([]unitTerm(nil), u.terms...)}
+	for i := range u.dims {
+		result.dims[i] = u.dims[i] + v.dims[i]
+	}
+	for _, t := range v.terms {
+		found := false
+		for i := range result.terms {
+			if result.terms[i].name == t.name {
+				result.terms[i].exponent += t.exponent
+				found = true
+			}
+		}
+		if !found {
+			result.terms = append(result.terms, t)
+		}
+	}
+	kept := result.terms[:0]
+	for _, t := range result.terms {
+		if t.exponent != 0 {
+			kept = append(kept, t)
+		}
+	}
+	result.terms = kept
+	if result.IsDimensionless() {
+		// h/min is the plain number 60
+		return dimensionless
+	}
+	return result
+}
+
+func (u Unit) pow(exponent int) Unit {
+	result := Unit{factor: math.Pow(u.factor, float64(exponent))}
+	for i := range u.dims {
+		result.dims[i] = u.dims[i] * exponent
+	}
+	for _, t := range u.terms {
+		if t.exponent*exponent != 0 {
+			result.terms = append(result.terms, unitTerm{t.name, t.exponent * exponent})
+		}
+	}
+	return result
+}
+
+// root takes the n-th root, e.g. of m^2 for sqrt. Units that cannot be
+// split evenly are shown in SI base units.
+func (u Unit) root(n int) (Unit, bool) {
+	result := Unit{factor: math.Pow(u.factor, 1/float64(n))}
+	for i, d := range u.dims {
+		if d%n != 0 {
+			return Unit{}, false
+		}
+		result.dims[i] = d / n
+	}
+	for _, t := range u.terms {
+		if t.exponent%n != 0 {
+			return result.si(), true
+		}
+		result.terms = append(result.terms, unitTerm{t.name, t.exponent / n})
+	}
+	return result, true
+}
+
+// si is the same dimension expressed in SI base units.
+func (u Unit) si() Unit {
+	result := Unit{dims: u.dims, factor: 1}
+	for i, d := range u.dims {
+		if d != 0 {
+			result.terms = append(result.terms, unitTerm{baseUnits[i], d})
+		}
+	}
+	return result
+}
+
+// String shows the unit as written, e.g. "m/s^2"; dimensionless numbers
+// have no unit.
+func (u Unit) String() string {
+	var numerator, denominator []string
+	for _, t := range u.terms {
+		if t.exponent > 0 {
+			numerator = append(numerator, power(t.name, t.exponent))
+		} else {
+			denominator = append(denominator, power(t.name, -t.exponent))
+		}
+	}
+	if len(numerator) == 0 {
+		// s^-1 rather than 1/s
+		parts := make([]string, len(u.terms))
+		for i, t := range u.terms {
+			parts[i] = power(t.name, t.exponent)
+		}
+		return strings.Join(parts, "*")
+	}
+	text := strings.Join(numerator, "*")
+	for _, d := range denominator {
+		text += "/" + d
+	}
+	return text
+}
+
+func power(name string, exponent int) string {
+	if exponent == 1 {
+		return name
+	}
+	return name + "^" + strconv.Itoa(exponent)
+}
+
+func describe(u Unit) string {
+	if u.IsDimensionless() && len(u.terms) == 0 {
+		return "a plain number"
+	}
+	return u.String()
+}
+
+// unitResolver checks that the units of an expression fit together and
+// rewrites it for planning: numbers with units become plain numbers in SI
+// base units, operations are annotated with the SI unit of their result
+// and conversions only change the unit the result is shown in. Nodes
+// shared by pointer are rewritten once, so they stay shared.
+type unitResolver map[*Node]resolvedUnit
+
+type resolvedUnit struct {
+	node *Node
+	unit Unit
+}
+
+// resolve returns the rewritten tree and the unit its value is shown in.
+func (r unitResolver) resolve(n *Node) (*Node, Unit, error) {
+	if resolved, exists := r[n]; exists {
+		return resolved.node, resolved.unit, nil
+	}
+	node, unit, err := r.resolveNode(n)
+	if err != nil {
+		return nil, Unit{}, err
+	}
+	r[n] = resolvedUnit{node, unit}
+	return node, unit, nil
+}
+
+// showIn converts the value of the rewritten tree from SI base units to
+// the unit.
+func showIn(n *Node, u Unit) *Node {
+	if u.factor == 1 {
+		return n
+	}
+	factor := &Node{Kind: NumberNode, Value: strconv.FormatFloat(u.factor, 'g', -1, 64)}
+	return &Node{Kind: OperationNode, Value: "/", Unit: u.String(), Args: []*Node{n, factor}}
+}
+
+func (r unitResolver) resolveNode(n *Node) (*Node, Unit, error) {
+	switch n.Kind {
+	case NumberNode:
+		if n.Unit == "" {
+			return n, dimensionless, nil
+		}
+		u, err := ParseUnit(n.Unit)
+		if err != nil {
+			return nil, Unit{}, err
+		}
+		if isImaginary(n) {
+			return nil, Unit{}, errors.New("invalid expression: imaginary numbers cannot have units")
+		}
+		v, err := strconv.ParseFloat(n.Value, 64)
+		if err != nil {
+			return nil, Unit{}, errors.New("invalid expression: bad number " + n.Value)
+		}
+		return &Node{Kind: NumberNode, Value: strconv.FormatFloat(v*u.factor, 'g', -1, 64)}, u, nil
+	case VariableNode, CallNode:
+		return n, dimensionless, nil
+	}
+
+	args := make([]*Node, len(n.Args))
+	argUnits := make([]Unit, len(n.Args))
+	operands := n.Args
+	if n.Kind == AggregateNode {
+		operands = flatten(n.Args, nil)
+		args = make([]*Node, len(operands))
+		argUnits = make([]Unit, len(operands))
+	}
+	for i, arg := range operands {
+		var err error
+		if args[i], argUnits[i], err = r.resolve(arg); err != nil {
+			return nil, Unit{}, err
+		}
+	}
+	rewritten := &Node{Kind: n.Kind, Value: n.Value, Args: args}
+
+	var result Unit
+	switch n.Kind {
+	case ConvertNode:
+		target, err := ParseUnit(n.Value)
+		if err != nil {
+			return nil, Unit{}, err
+		}
+		if target.dims != argUnits[0].dims {
+			return nil, Unit{}, errors.New("invalid expression: cannot convert " + describe(argUnits[0]) + " to " + n.Value)
+		}
+		return args[0], target, nil
+	case ListNode:
+		return rewritten, dimensionless, nil
+	case AggregateNode:
+		if err := sameDimension("combine", argUnits); err != nil {
+			return nil, Unit{}, err
+		}
+		if len(argUnits) > 0 {
+			result = argUnits[0]
+		}
+	case ConditionalNode:
+		if err := requireDimensionless(n.Value, argUnits[:1]); err != nil {
+			return nil, Unit{}, err
+		}
+		if err := sameDimension("choose between", argUnits[1:]); err != nil {
+			return nil, Unit{}, err
+		}
+		result = argUnits[1]
+	default:
+		var err error
+		if result, err = operationUnit(n, args, argUnits); err != nil {
+			return nil, Unit{}, err
+		}
+	}
+	if !result.IsDimensionless() {
+		rewritten.Unit = result.si().String()
+	}
+	return rewritten, result, nil
+}
+
+func operationUnit(n *Node, args []*Node, argUnits []Unit) (Unit, error) {
+	switch n.Value {
+	case "+", "-", "min", "max", "abs":
+		verb := map[string]string{"+": "add", "-": "subtract"}[n.Value]
+		if verb == "" {
+			verb = "compare"
+		}
+		return argUnits[0], sameDimension(verb, argUnits)
+	case "<", "<=", ">", ">=", "==", "!=":
+		return dimensionless, sameDimension("compare", argUnits)
+	case "*":
+		return argUnits[0].mul(argUnits[1]), nil
+	case "/":
+		return argUnits[0].mul(argUnits[1].pow(-1)), nil
+	case "^":
+		if err := requireDimensionless("an exponent", argUnits[1:]); err != nil {
+			return Unit{}, err
+		}
+		if argUnits[0].IsDimensionless() {
+			return dimensionless, nil
+		}
+		exponent, err := strconv.Atoi(args[1].Value)
+		if args[1].Kind != NumberNode || err != nil {
+			return Unit{}, errors.New("invalid expression: " + describe(argUnits[0]) + " can only be raised to an integer")
+		}
+		return argUnits[0].pow(exponent), nil
+	case "sqrt":
+		root, ok := argUnits[0].root(2)
+		if !ok {
+			return Unit{}, errors.New("invalid expression: cannot take the square root of " + describe(argUnits[0]))
+		}
+		return root, nil
+	}
+	return dimensionless, requireDimensionless(n.Value, argUnits)
+}
+
+func sameDimension(verb string, argUnits []Unit) error {
+	if len(argUnits) == 0 {
+		return nil
+	}
+	for _, u := range argUnits[1:] {
+		if u.dims != argUnits[0].dims {
+			return errors.New("invalid expression: cannot " + verb + " " + describe(argUnits[0]) + " and " + describe(u))
+		}
+	}
+	return nil
+}
+
+func requireDimensionless(what string, argUnits []Unit) error {
+	for _, u := range argUnits {
+		if !u.IsDimensionless() {
+			return errors.New("invalid expression: " + what + " does not take " + describe(u))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+// Package symbolic transforms expression trees built by pkg/rpn without
+// computing them: differentiation, simplification and canonical printing.
+package symbolic
+
+import (
+	"errors"
+
+	"github.com/katierevinska/calculatorService/pkg/rpn"
+)
+
+// Derive returns the derivative of the expression with respect to the
+// variable. The result is not simplified.
+func Derive(n *rpn.Node, variable string) (*rpn.Node, error) {
+	if !dependsOn(n, variable) {
+		return number(0), nil
+	}
+	switch n.Kind {
+	case rpn.VariableNode:
+		return number(1), nil
+	case rpn.ConditionalNode:
+		then, err := Derive(n.Args[1], variable)
+		if err != nil {
+			return nil, err
+		}
+		otherwise, err := Derive(n.Args[2], variable)
+		if err != nil {
+			return nil, err
+		}
+		return &rpn.Node{Kind: rpn.ConditionalNode, Value: n.Value, Args: []*rpn.Node{n.Args[0], then, otherwise}}, nil
+	case rpn.OperationNode:
+		return deriveOperation(n, variable)
+	}
+	return nil, errors.New("cannot differentiate " + n.String())
+}
+
+func deriveOperation(n *rpn.Node, variable string) (*rpn.Node, error) {
+	derivatives := make([]*rpn.Node, len(n.Args))
+	for i, arg := range n.Args {
+		d, err := Derive(arg, variable)
+		if err != nil {
+			return nil, err
+		}
+		derivatives[i] = d
+	}
+	u, du := n.Args[0], derivatives[0]
+
+	switch n.Value {
+	case "+", "-":
+		return operation(n.Value, du, derivatives[1]), nil
+	case "*":
+		v, dv := n.Args[1], derivatives[1]
+		return operation("+", operation("*", du, v), operation("*", u, dv)), nil
+	case "/":
+		v, dv := n.Args[1], derivatives[1]
+		numerator := operation("-", operation("*", du, v), operation("*", u, dv))
+		return operation("/", numerator, operation("^", v, number(2))), nil
+	case "^":
+		v, dv := n.Args[1], derivatives[1]
+		switch {
+		case !dependsOn(v, variable):
+			return operation("*", operation("*", v, operation("^", u, operation("-", v, number(1)))), du), nil
+		case !dependsOn(u, variable):
+			return operation("*", operation("*", n, operation("ln", u)), dv), nil
+		}
+		// d(u^v) = u^v * (v' * ln(u) + v * u' / u)
+		inner := operation("+", operation("*", dv, operation("ln", u)), operation("/", operation("*", v, du), u))
+		return operation("*", n, inner), nil
+	case "sqrt":
+		return operation("/", du, operation("*", number(2), n)), nil
+	case "abs":
+		return operation("/", operation("*", du, u), n), nil
+	case "ln":
+		return operation("/", du, u), nil
+	}
+	return nil, errors.New("cannot differentiate " + n.Value)
+}
+
+func dependsOn(n *rpn.Node, variable string) bool {
+	if n.Kind == rpn.VariableNode {
+		return n.Value == variable
+	}
+	for _, arg := range n.Args {
+		if dependsOn(arg, variable) {
+			return true
+		}
+	}
+	return false
+}
+
+// Substitute replaces the variables with the given values.
+func Substitute(n *rpn.Node, values map[string]float64) *rpn.Node {
+	if n.Kind == rpn.VariableNode {
+		if v, exists := values[n.Value]; exists {
+			return numberNode(v)
+		}
+		return n
+	}
+	if len(n.Args) == 0 {
+		return n
+	}
+	args := make([]*rpn.Node, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = Substitute(arg, values)
+	}
+	return &rpn.Node{Kind: n.Kind, Value: n.Value, Args: args}
+}
@@ -0,0 +1,105 @@
+package symbolic
+
+import (
+	"strings"
+
+	"github.com/katierevinska/calculatorService/pkg/operations"
+	"github.com/katierevinska/calculatorService/pkg/rpn"
+)
+
+// Binding strength of the printed forms, in the units of the parser:
+// operators bind with ten times their precedence, prefix operators and
+// negative numbers between * and ^.
+const (
+	prefixStrength = 65
+	atomStrength   = 100
+	// "x to unit" binds looser than any operator
+	convertStrength = 0
+	// operators binding looser than * are surrounded by spaces
+	spacedBelow = 60
+)
+
+// Format prints the expression with as few parentheses as the parser needs
+// to read it back, e.g. "3*x^2 + 2".
+func Format(n *rpn.Node) string {
+	switch n.Kind {
+	case rpn.NumberNode, rpn.VariableNode:
+		if n.Unit != "" {
+			return n.Value + " " + n.Unit
+		}
+		return n.Value
+	case rpn.ListNode:
+		return "[" + formatArgs(n.Args) + "]"
+	case rpn.ConvertNode:
+		return formatOperand(n.Args[0], convertStrength) + " to " + n.Value
+	case rpn.OperationNode:
+		op, exists := operations.Default.Lookup(n.Value)
+		if !exists || op.Function {
+			break
+		}
+		if isNegation(n) {
+			return "-" + formatOperand(n.Args[1], spacedBelow)
+		}
+		if op.Prefix {
+			return op.Symbol + formatOperand(n.Args[0], prefixStrength)
+		}
+		return formatBinary(n, op)
+	}
+	return n.Value + "(" + formatArgs(n.Args) + ")"
+}
+
+func formatBinary(n *rpn.Node, op *operations.Operation) string {
+	own := op.Precedence * 10
+	leftMin, rightMin := own, own+1
+	if op.Associativity == operations.RightAssociative {
+		leftMin, rightMin = own+1, own
+	}
+	separator := op.Symbol
+	if own < spacedBelow {
+		separator = " " + op.Symbol + " "
+	}
+	return formatOperand(n.Args[0], leftMin) + separator + formatOperand(n.Args[1], rightMin)
+}
+
+// formatOperand puts the operand in parentheses when it binds looser than
+// min.
+func formatOperand(n *rpn.Node, min int) string {
+	text := Format(n)
+	if strength(n) < min {
+		return "(" + text + ")"
+	}
+	return text
+}
+
+func strength(n *rpn.Node) int {
+	switch n.Kind {
+	case rpn.NumberNode:
+		if strings.HasPrefix(n.Value, "-") {
+			return prefixStrength
+		}
+		if n.Unit != "" {
+			// 2 m^2 must not be read as (2 m)^2
+			return spacedBelow
+		}
+	case rpn.ConvertNode:
+		return convertStrength
+	case rpn.OperationNode:
+		op, exists := operations.Default.Lookup(n.Value)
+		if !exists || op.Function {
+			break
+		}
+		if op.Prefix || isNegation(n) {
+			return prefixStrength
+		}
+		return op.Precedence * 10
+	}
+	return atomStrength
+}
+
+func formatArgs(args []*rpn.Node) string {
+	texts := make([]string, len(args))
+	for i, arg := range args {
+		texts[i] = Format(arg)
+	}
+	return strings.Join(texts, ", ")
+}
@@ -0,0 +1,369 @@
+package symbolic
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/katierevinska/calculatorService/pkg/operations"
+	"github.com/katierevinska/calculatorService/pkg/rpn"
+)
+
+// Simplify rewrites the expression into a canonical form: operations on
+// numbers are folded where the result is exact, like terms of sums and
+// like factors of products are collected, and neutral elements are
+// dropped. Terms and factors keep the order they first appear in.
+func Simplify(n *rpn.Node) *rpn.Node {
+	if len(n.Args) == 0 {
+		return n
+	}
+	args := make([]*rpn.Node, len(n.Args))
+	for i, arg := range n.Args {
+		args[i] = Simplify(arg)
+	}
+	n = &rpn.Node{Kind: n.Kind, Value: n.Value, Unit: n.Unit, Args: args}
+
+	switch n.Kind {
+	case rpn.ConditionalNode:
+		if condition, ok := value(args[0]); ok {
+			if condition != 0 {
+				return args[1]
+			}
+			return args[2]
+		}
+		if equal(args[1], args[2]) {
+			return args[1]
+		}
+		return n
+	case rpn.OperationNode:
+	default:
+		return n
+	}
+
+	if folded, ok := fold(n); ok {
+		return folded
+	}
+	switch n.Value {
+	case "+", "-":
+		return simplifySum(n)
+	case "*":
+		return simplifyProduct(n)
+	case "/":
+		return simplifyQuotient(n)
+	case "^":
+		return simplifyPower(n)
+	}
+	return n
+}
+
+// fold computes operations on numbers unless the result would have to be
+// rounded, so that 1/3 and sqrt(2) stay as they are.
+func fold(n *rpn.Node) (*rpn.Node, bool) {
+	args := make([]string, len(n.Args))
+	for i, arg := range n.Args {
+		if _, ok := value(arg); !ok {
+			return nil, false
+		}
+		args[i] = arg.Value
+	}
+	result, err := operations.Default.Evaluate(n.Value, args)
+	if err != nil || !exact(result) {
+		return nil, false
+	}
+	return numberNode(result), true
+}
+
+func exact(v float64) bool {
+	if math.IsNaN(v) || math.IsInf(v, 0) || math.Abs(v) >= 1e15 {
+		return false
+	}
+	if v == math.Trunc(v) {
+		return true
+	}
+	digits := strings.TrimLeft(strings.NewReplacer("-", "", ".", "").Replace(formatNumber(v)), "0")
+	return len(digits) < 10
+}
+
+type term struct {
+	coefficient float64
+	rest        *rpn.Node // nil for the constant term
+}
+
+func simplifySum(n *rpn.Node) *rpn.Node {
+	var terms []term
+	collectTerms(n, 1, &terms)
+
+	var combined []term
+	var constant float64
+	index := make(map[string]int)
+	for _, t := range terms {
+		if t.rest == nil {
+			constant += t.coefficient
+			continue
+		}
+		key := t.rest.String()
+		if i, exists := index[key]; exists {
+			combined[i].coefficient += t.coefficient
+			continue
+		}
+		index[key] = len(combined)
+		combined = append(combined, t)
+	}
+	combined = append(combined, term{coefficient: constant})
+
+	var result *rpn.Node
+	for _, t := range combined {
+		if t.coefficient == 0 {
+			continue
+		}
+		node := scale(math.Abs(t.coefficient), t.rest)
+		switch {
+		case result == nil && t.coefficient < 0:
+			result = negate(node)
+		case result == nil:
+			result = node
+		case t.coefficient < 0:
+			result = operation("-", result, node)
+		default:
+			result = operation("+", result, node)
+		}
+	}
+	if result == nil {
+		return number(0)
+	}
+	return result
+}
+
+func leadsWithMinus(n *rpn.Node) bool {
+	if n.Kind != rpn.OperationNode || n.Value != "+" && n.Value != "-" {
+		return false
+	}
+	var terms []term
+	collectTerms(n, 1, &terms)
+	for _, t := range terms {
+		if t.coefficient != 0 {
+			return t.coefficient < 0
+		}
+	}
+	return false
+}
+
+func collectTerms(n *rpn.Node, sign float64, terms *[]term) {
+	if n.Kind == rpn.OperationNode && (n.Value == "+" || n.Value == "-") {
+		collectTerms(n.Args[0], sign, terms)
+		if n.Value == "-" {
+			sign = -sign
+		}
+		collectTerms(n.Args[1], sign, terms)
+		return
+	}
+	coefficient, rest := splitCoefficient(n)
+	*terms = append(*terms, term{coefficient: sign * coefficient, rest: rest})
+}
+
+// splitCoefficient splits 3*x*y into 3 and x*y.
+func splitCoefficient(n *rpn.Node) (float64, *rpn.Node) {
+	var factors []*rpn.Node
+	collectFactors(n, &factors)
+	coefficient := 1.0
+	var rest []*rpn.Node
+	for _, factor := range factors {
+		if v, ok := value(factor); ok {
+			coefficient *= v
+		} else {
+			rest = append(rest, factor)
+		}
+	}
+	if len(rest) == 0 {
+		return coefficient, nil
+	}
+	return coefficient, chain("*", rest)
+}
+
+// scale builds coefficient*rest without a redundant factor of 1.
+func scale(coefficient float64, rest *rpn.Node) *rpn.Node {
+	switch {
+	case rest == nil:
+		return numberNode(coefficient)
+	case coefficient == 1:
+		return rest
+	}
+	return chain("*", append([]*rpn.Node{numberNode(coefficient)}, flattenProduct(rest)...))
+}
+
+type power struct {
+	base     *rpn.Node
+	exponent float64
+}
+
+func simplifyProduct(n *rpn.Node) *rpn.Node {
+	var factors []*rpn.Node
+	collectFactors(n, &factors)
+
+	coefficient := 1.0
+	var powers []power
+	index := make(map[string]int)
+	for _, factor := range factors {
+		if v, ok := value(factor); ok {
+			coefficient *= v
+			continue
+		}
+		if isNegation(factor) {
+			coefficient = -coefficient
+			factor = factor.Args[1]
+		} else if leadsWithMinus(factor) {
+			// -(a+b) rather than (-a - b)
+			coefficient = -coefficient
+			factor = simplifySum(operation("-", number(0), factor))
+		}
+		p := power{base: factor, exponent: 1}
+		if factor.Kind == rpn.OperationNode && factor.Value == "^" {
+			if exponent, ok := value(factor.Args[1]); ok {
+				p = power{base: factor.Args[0], exponent: exponent}
+			}
+		}
+		key := p.base.String()
+		if i, exists := index[key]; exists {
+			powers[i].exponent += p.exponent
+			continue
+		}
+		index[key] = len(powers)
+		powers = append(powers, p)
+	}
+	if coefficient == 0 {
+		return number(0)
+	}
+
+	var rest []*rpn.Node
+	for _, p := range powers {
+		switch p.exponent {
+		case 0:
+		case 1:
+			rest = append(rest, p.base)
+		default:
+			rest = append(rest, operation("^", p.base, numberNode(p.exponent)))
+		}
+	}
+	if len(rest) == 0 {
+		return numberNode(coefficient)
+	}
+	if coefficient == -1 {
+		return negate(chain("*", rest))
+	}
+	return scale(coefficient, chain("*", rest))
+}
+
+func simplifyQuotient(n *rpn.Node) *rpn.Node {
+	u, v := n.Args[0], n.Args[1]
+	if divisor, ok := value(v); ok && divisor != 0 {
+		if exact(1 / divisor) {
+			return simplifyProduct(operation("*", numberNode(1/divisor), u))
+		}
+		return n
+	}
+	if dividend, ok := value(u); ok && dividend == 0 {
+		return number(0)
+	}
+	if equal(u, v) {
+		return number(1)
+	}
+	return n
+}
+
+func simplifyPower(n *rpn.Node) *rpn.Node {
+	base, exponent := n.Args[0], n.Args[1]
+	if e, ok := value(exponent); ok {
+		switch e {
+		case 0:
+			return number(1)
+		case 1:
+			return base
+		}
+		if base.Kind == rpn.OperationNode && base.Value == "^" {
+			if inner, ok := value(base.Args[1]); ok {
+				return simplifyPower(operation("^", base.Args[0], numberNode(inner*e)))
+			}
+		}
+	}
+	if b, ok := value(base); ok && b == 1 {
+		return number(1)
+	}
+	return n
+}
+
+func collectFactors(n *rpn.Node, factors *[]*rpn.Node) {
+	if n.Kind == rpn.OperationNode && n.Value == "*" {
+		collectFactors(n.Args[0], factors)
+		collectFactors(n.Args[1], factors)
+		return
+	}
+	*factors = append(*factors, n)
+}
+
+func flattenProduct(n *rpn.Node) []*rpn.Node {
+	var factors []*rpn.Node
+	collectFactors(n, &factors)
+	return factors
+}
+
+// chain joins the nodes left to right: a*b*c is (a*b)*c.
+func chain(symbol string, nodes []*rpn.Node) *rpn.Node {
+	result := nodes[0]
+	for _, n := range nodes[1:] {
+		result = operation(symbol, result, n)
+	}
+	return result
+}
+
+// negate builds -x the way the parser does, as 0 - x, folding the minus
+// into numbers.
+func negate(n *rpn.Node) *rpn.Node {
+	if v, ok := value(n); ok {
+		return numberNode(-v)
+	}
+	return operation("-", number(0), n)
+}
+
+func isNegation(n *rpn.Node) bool {
+	if n.Kind != rpn.OperationNode || n.Value != "-" {
+		return false
+	}
+	v, ok := value(n.Args[0])
+	return ok && v == 0
+}
+
+func equal(a, b *rpn.Node) bool {
+	return a.String() == b.String()
+}
+
+// value returns the number a node stands for; numbers with units are not
+// plain numbers and are kept as they are.
+func value(n *rpn.Node) (float64, bool) {
+	if n.Kind != rpn.NumberNode || n.Unit != "" {
+		return 0, false
+	}
+	v, err := strconv.ParseFloat(n.Value, 64)
+	return v, err == nil
+}
+
+func operation(symbol string, args ...*rpn.Node) *rpn.Node {
+	return &rpn.Node{Kind: rpn.OperationNode, Value: symbol, Args: args}
+}
+
+func number(v int) *rpn.Node {
+	return &rpn.Node{Kind: rpn.NumberNode, Value: strconv.Itoa(v)}
+}
+
+func numberNode(v float64) *rpn.Node {
+	return &rpn.Node{Kind: rpn.NumberNode, Value: formatNumber(v)}
+}
+
+// formatNumber prints the number the way the parser reads it, without an
+// exponent and rounded to 10 significant digits, so 0.1+0.2 is 0.3.
+func formatNumber(v float64) string {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(v, 'g', 10, 64), 64)
+	if rounded == 0 {
+		return "0"
+	}
+	return strconv.FormatFloat(rounded, 'f', -1, 64)
+}
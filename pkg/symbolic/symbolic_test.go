@@ -0,0 +1,98 @@
+package symbolic_test
+
+import (
+	"testing"
+
+	"github.com/katierevinska/calculatorService/pkg/rpn"
+	"github.com/katierevinska/calculatorService/pkg/symbolic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDerive(t *testing.T) {
+	tests := []struct {
+		expression string
+		variable   string
+		expected   string
+	}{
+		{"x^3 + 2*x", "x", "3*x^2 + 2"},
+		{"5", "x", "0"},
+		{"y*x", "x", "y"},
+		{"x*x", "x", "2*x"},
+		{"x/y", "y", "-x/y^2"},
+		{"sqrt(x)", "x", "1/(2*sqrt(x))"},
+		{"2^x", "x", "2^x*ln(2)"},
+		{"ln(x^2+1)", "x", "2*x/(x^2 + 1)"},
+		{"if(y > 0, x^2, -x)", "x", "if(y > 0, 2*x, -1)"},
+		{"(x+1)^2 - 4*(x+1)", "x", "2*(x + 1) - 4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			root, err := rpn.Parse(tt.expression)
+			require.NoError(t, err)
+			derivative, err := symbolic.Derive(root, tt.variable)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, symbolic.Format(symbolic.Simplify(derivative)))
+		})
+	}
+}
+
+func TestDerive_RejectsNonDifferentiableOperations(t *testing.T) {
+	for _, expression := range []string{"x > 1", "min(x, 1)", "sum(x, 2)"} {
+		t.Run(expression, func(t *testing.T) {
+			root, err := rpn.Parse(expression)
+			require.NoError(t, err)
+			_, err = symbolic.Derive(root, "x")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestSimplify(t *testing.T) {
+	tests := []struct {
+		expression string
+		expected   string
+	}{
+		{"x + 0", "x"},
+		{"1*x*1", "x"},
+		{"x*0 + y", "y"},
+		{"x - x", "0"},
+		{"x + x + 2*x", "4*x"},
+		{"x*3*x", "3*x^2"},
+		{"(x^2)^3", "x^6"},
+		{"0.1 + 0.2 + y", "y + 0.3"},
+		{"1/3 + x", "1/3 + x"},
+		{"x/4", "0.25*x"},
+		{"x/x + y^0", "2"},
+		{"-(a+b) * -c", "(a + b)*c"},
+		{"2 - 3*x", "-3*x + 2"},
+		{"(a-b)^2", "(a - b)^2"},
+		{"if(1 > 2, x, y)", "y"},
+		{"x < 2*3 && !y", "x < 6 && !y"},
+		{"2^-x", "2^(-x)"},
+		{"-(a-b)*2", "-2*(a - b)"},
+		{"(1 km + 0) to m", "1 km to m"},
+		{"x * 2 m^2 * 1", "x*(2 m^2)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			root, err := rpn.Parse(tt.expression)
+			require.NoError(t, err)
+			simplified := symbolic.Simplify(root)
+			text := symbolic.Format(simplified)
+			assert.Equal(t, tt.expected, text)
+
+			reparsed, err := rpn.Parse(text)
+			require.NoError(t, err, "Formatted expressions parse back")
+			assert.Equal(t, text, symbolic.Format(symbolic.Simplify(reparsed)), "Simplifying is idempotent")
+		})
+	}
+}
+
+func TestSubstitute(t *testing.T) {
+	root, err := rpn.Parse("3*x^2 + y")
+	require.NoError(t, err)
+	assert.Equal(t, "3*(-2)^2 + y", symbolic.Format(symbolic.Substitute(root, map[string]float64{"x": -2})))
+}